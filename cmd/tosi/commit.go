@@ -0,0 +1,58 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/elotl/tosi/pkg/registries"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/golang/glog"
+)
+
+// stringList is a flag that can be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// commitImage creates the image ref from the changes in the overlayfs mount
+// in mountDest, created via -mount.
+func commitImage(mountDest string, ref *registries.Reference, workdir, overlaydir string, changes *imagestore.ConfigChanges) {
+	mountDest, err := filepath.Abs(mountDest)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	store, err := imagestore.NewStore(workdir, overlaydir, 0, nil)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	dgst, err := store.Commit(mountDest, ref.Repo, changes)
+	if err != nil {
+		fatalf("committing %s as %s: %v", mountDest, ref.Repo, err)
+	}
+	glog.Infof("committed image %s, digest: %s", ref.Repo, dgst)
+	runResult.Target = newImageResult(ref, dgst)
+	printText("%s", pinnedName(ref, dgst))
+}
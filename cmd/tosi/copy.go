@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/source"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// copyImage copies the image from the first of the source locations it can be
+// copied from to dest, without unpacking it. Blobs are streamed between the
+// registries, unless opts.ViaCache is set, in which case they are saved into
+// the cache in workdir first.
+func copyImage(refs []*registries.Reference, dest *registries.Reference, workdir string, parallelism int, opts imagestore.CopyOptions, copts clientOptions) {
+	defer timed("copy", time.Now())
+	client, err := newRegistryClient(dest, copts)
+	if err != nil {
+		failf(argumentCode(err), "%v", err)
+	}
+	for i, ref := range refs {
+		glog.Infof("copying image %q from registry %q to %q in registry %q",
+			ref.Repo, ref.Registry, dest.Repo, dest.Registry)
+		dgst, err := copyFrom(ref, dest, client, workdir, parallelism, opts, copts)
+		if err == nil {
+			glog.Infof("copied image %s, digest: %s", dest.Repo, dgst)
+			runResult.Image = newImageResult(ref, "")
+			runResult.Target = newImageResult(dest, dgst)
+			printText("%s", pinnedName(dest, dgst))
+			return
+		}
+		if i == len(refs)-1 {
+			fatalf("%v", err)
+		}
+		glog.Warningf("%v, trying next registry", err)
+	}
+}
+
+func copyFrom(ref, dest *registries.Reference, client source.Destination, workdir string, parallelism int, opts imagestore.CopyOptions, copts clientOptions) (digest.Digest, error) {
+	src, err := newSource(ref, copts)
+	if err != nil {
+		return "", fmt.Errorf("connecting to registry %s: %w", ref.Registry, err)
+	}
+	store, err := imagestore.NewStore(workdir, "", parallelism, src)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	store = store.WithContext(traceCtx)
+	if copts.allowUnsigned {
+		store.AllowUnsignedSchema1()
+	}
+	if ref.Registry == dest.Registry {
+		opts.MountFrom = stripReference(ref.Repo)
+	}
+	dgst, err := store.Copy(ref.Repo, client, dest.Repo, opts)
+	warnRateLimit(src)
+	if err != nil {
+		return "", fmt.Errorf("copying image %s: %w", ref.Repo, err)
+	}
+	return dgst, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/elotl/tosi/pkg/registries"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/golang/glog"
+)
+
+// diffImages prints the files that differ between the images a and b in the
+// store in workdir, one change per line, or as the changes of the result with
+// -output json.
+func diffImages(a, b []*registries.Reference, workdir string) {
+	store, err := imagestore.NewStore(workdir, "", 0, nil)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	refA := findLocalImage(store, a, workdir)
+	refB := findLocalImage(store, b, workdir)
+	imageA, imageB := refA.Repo, refB.Repo
+	runResult.Image = newImageResult(refA, "")
+	runResult.Target = newImageResult(refB, "")
+	changes, err := store.Diff(imageA, imageB)
+	if err != nil {
+		fatalf("comparing %s and %s: %v", imageA, imageB, err)
+	}
+	glog.Infof("%d files differ between %s and %s",
+		len(changes), imageA, imageB)
+	runResult.Changes = changes
+	if outputFormat == outputJSON {
+		return
+	}
+	for _, change := range changes {
+		switch change.Kind {
+		case imagestore.ChangeAdded:
+			fmt.Printf("A %s\n", change.Path)
+		case imagestore.ChangeRemoved:
+			fmt.Printf("D %s\n", change.Path)
+		case imagestore.ChangeModified:
+			fmt.Printf("M %s: %s\n", change.Path,
+				strings.Join(change.Details(), ", "))
+		}
+	}
+}
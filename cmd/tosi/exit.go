@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+)
+
+// exit exits with code, after printing the result with -output json, writing
+// the metrics and exporting the spans of the run.
+func exit(code int) {
+	finish(nil)
+	os.Exit(code)
+}
+
+// fatalf logs a fatal error, and exits like failf, with the error code for
+// the first error in args, see errorCode.
+func fatalf(format string, args ...interface{}) {
+	code := codeInternal
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			code = errorCode(err)
+			break
+		}
+	}
+	fail(code, fmt.Sprintf(format, args...))
+}
+
+// usagef logs an error about invalid arguments, and exits like failf.
+func usagef(format string, args ...interface{}) {
+	fail(codeInvalidArgument, fmt.Sprintf(format, args...))
+}
+
+// failf logs a fatal error, and exits with the exit code for the error code,
+// after printing the result with -output json, writing the metrics and
+// exporting the spans of the run.
+func failf(code, format string, args ...interface{}) {
+	fail(code, fmt.Sprintf(format, args...))
+}
+
+func fail(code, msg string) {
+	glog.ErrorDepth(2, msg)
+	runResult.Error = &errorResult{
+		Code:     code,
+		Message:  msg,
+		ExitCode: exitCodes[code],
+	}
+	finish(errors.New(msg))
+	os.Exit(exitCodes[code])
+}
+
+// finish prints the result with -output json, writes the metrics and exports
+// the spans of the run, which failed with err if it is not nil.
+func finish(err error) {
+	writeResult()
+	writeMetrics()
+	endTrace(err)
+	glog.Flush()
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/elotl/tosi/pkg/registries"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/golang/glog"
+)
+
+// parseClampTime parses the value of -clamp-mtime, a Unix timestamp.
+func parseClampTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	secs, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q: %v", value, err)
+	}
+	t := time.Unix(secs, 0).UTC()
+	return &t, nil
+}
+
+// flattenImage squashes the image refs in the store in workdir into the
+// tarball dest, or to stdout if dest is "-".
+func flattenImage(refs []*registries.Reference, dest, workdir string, opts imagestore.FlattenOptions) {
+	store, err := imagestore.NewStore(workdir, "", 0, nil)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	local := findLocalImage(store, refs, workdir)
+	runResult.Image = newImageResult(local, "")
+	image := local.Repo
+	if dest == "-" {
+		err = store.Flatten(image, os.Stdout, opts)
+		if err != nil {
+			fatalf("flattening %s: %v", image, err)
+		}
+		return
+	}
+	f, err := os.Create(dest)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	err = store.Flatten(image, f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dest)
+		fatalf("flattening %s into %s: %v", image, dest, err)
+	}
+	glog.Infof("flattened %s into %s", image, dest)
+	setPath(&paths().Tarball, dest)
+}
+
+// flattenToImage squashes the image refs in the store in workdir into the new
+// single-layer image ref.
+func flattenToImage(refs []*registries.Reference, ref *registries.Reference, workdir string, opts imagestore.FlattenOptions) {
+	store, err := imagestore.NewStore(workdir, "", 0, nil)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	local := findLocalImage(store, refs, workdir)
+	runResult.Image = newImageResult(local, "")
+	image := local.Repo
+	dgst, err := store.FlattenImage(image, ref.Repo, opts)
+	if err != nil {
+		fatalf("flattening %s into %s: %v", image, ref.Repo, err)
+	}
+	glog.Infof("created image %s, digest: %s", ref.Repo, dgst)
+	runResult.Target = newImageResult(ref, dgst)
+	printText("%s", pinnedName(ref, dgst))
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/semver"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+)
+
+// newRegistryClient creates a client for the registry of ref. Unlike
+// newSource, it fails for images with a transport prefix.
+func newRegistryClient(ref *registries.Reference, copts clientOptions) (*registryclient.RegistryClient, error) {
+	if transport, _ := util.SplitTransport(ref.Registry); transport != "" {
+		return nil, fmt.Errorf("%s images are not in a registry", transport)
+	}
+	src, err := newSource(ref, copts)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to registry %s: %w", ref.Registry, err)
+	}
+	return src.(*registryclient.RegistryClient), nil
+}
+
+// filterTags returns the tags that are semantic versions matching constraint,
+// which can be empty, sorted by version.
+func filterTags(tags []string, constraint string) ([]string, error) {
+	var c *semver.Constraint
+	if constraint != "" {
+		var err error
+		c, err = semver.ParseConstraint(constraint)
+		if err != nil {
+			return nil, err
+		}
+	}
+	versions := make([]*semver.Version, 0, len(tags))
+	for _, tag := range tags {
+		v, err := semver.Parse(tag)
+		if err != nil {
+			continue
+		}
+		if c != nil && !c.Match(v) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	semver.Sort(versions)
+	filtered := make([]string, 0, len(versions))
+	for _, v := range versions {
+		filtered = append(filtered, v.String())
+	}
+	return filtered, nil
+}
+
+func listTags(refs []*registries.Reference, copts clientOptions, semverOnly bool, constraint string) {
+	defer timed("list", time.Now())
+	var tags []string
+	for i, ref := range refs {
+		repo, _, _, err := util.ParseImageReference(ref.Repo)
+		if err == nil {
+			var client *registryclient.RegistryClient
+			client, err = newRegistryClient(ref, copts)
+			if err == nil {
+				runResult.Image = newImageResult(ref, "")
+				runResult.Image.Reference = ""
+				glog.Infof("listing tags of %q in registry %q", repo, ref.Registry)
+				tags, err = client.Tags(repo)
+				warnRateLimit(client)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if i == len(refs)-1 {
+			fatalf("listing tags of %s: %v", ref.Repo, err)
+		}
+		glog.Warningf("listing tags of %s: %v, trying next registry", ref.Repo, err)
+	}
+	if semverOnly || constraint != "" {
+		var err error
+		tags, err = filterTags(tags, constraint)
+		if err != nil {
+			usagef("filtering tags: %v", err)
+		}
+	}
+	runResult.Tags = tags
+	for _, tag := range tags {
+		printText("%s", tag)
+	}
+}
+
+// listCatalog lists the repositories in the registry, which is either a
+// registry host, e.g. quay.io, or the URL of the registry if regURL is set.
+func listCatalog(regURL, name string, config *registries.Config, copts clientOptions) {
+	defer timed("list", time.Now())
+	var ref *registries.Reference
+	if regURL != "" {
+		ref = &registries.Reference{
+			Registry: regURL,
+		}
+		if u, err := url.Parse(regURL); err == nil {
+			ref.Insecure = config.IsInsecure(u.Host)
+		}
+	} else {
+		var err error
+		ref, err = config.LookupRegistry(name)
+		if err != nil {
+			failf(argumentCode(err), "looking up registry %s: %v", name, err)
+		}
+	}
+	client, err := newRegistryClient(ref, copts)
+	if err != nil {
+		failf(argumentCode(err), "%v", err)
+	}
+	glog.Infof("listing repositories in registry %q", ref.Registry)
+	repos, err := client.Catalog()
+	warnRateLimit(client)
+	if err != nil {
+		fatalf("listing repositories in %s: %v", ref.Registry, err)
+	}
+	runResult.Repositories = repos
+	for _, repo := range repos {
+		printText("%s", repo)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilterTags(t *testing.T) {
+	tags := []string{
+		"latest", "3.12", "3.9", "3.12.1", "v3.13.0-rc1", "3.13.0", "edge",
+		"3.12.1-alpine", "3", "20200626",
+	}
+	testCases := []struct {
+		constraint string
+		expected   []string
+		err        bool
+	}{
+		{
+			constraint: "",
+			expected: []string{
+				"3", "3.9", "3.12", "3.12.1-alpine", "3.12.1", "v3.13.0-rc1",
+				"3.13.0", "20200626",
+			},
+		},
+		{
+			constraint: "~3.12",
+			expected:   []string{"3.12", "3.12.1-alpine", "3.12.1"},
+		},
+		{
+			constraint: ">=3.10, <4",
+			expected:   []string{"3.12", "3.12.1-alpine", "3.12.1", "v3.13.0-rc1", "3.13.0"},
+		},
+		{
+			constraint: "^3",
+			expected: []string{
+				"3", "3.9", "3.12", "3.12.1-alpine", "3.12.1", "v3.13.0-rc1",
+				"3.13.0",
+			},
+		},
+		{
+			constraint: "4",
+			expected:   []string{},
+		},
+		{
+			constraint: ">=latest",
+			err:        true,
+		},
+	}
+	for _, tc := range testCases {
+		filtered, err := filterTags(tags, tc.constraint)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %v", tc.constraint, filtered)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.constraint, err)
+			continue
+		}
+		if !reflect.DeepEqual(filtered, tc.expected) {
+			t.Errorf("%q: expected %v, got %v", tc.constraint, tc.expected, filtered)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/elotl/tosi/pkg/metrics"
+	"github.com/golang/glog"
+)
+
+// metricsTextfile is the file metrics are written to when exiting, set via
+// -metrics-textfile.
+var metricsTextfile string
+
+// writeMetrics writes the metrics to metricsTextfile, if it is set.
+func writeMetrics() {
+	if metricsTextfile == "" {
+		return
+	}
+	if err := metrics.WriteTextfile(metricsTextfile); err != nil {
+		glog.Errorf("writing metrics to %s: %v", metricsTextfile, err)
+	}
+}
+
+// serveMetrics serves the metrics via HTTP on address, in the background.
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	go func() {
+		glog.Infof("serving metrics on %s", address)
+		err := http.ListenAndServe(address, mux)
+		fatalf("serving metrics on %s: %v", address, err)
+	}()
+}
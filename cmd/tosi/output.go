@@ -0,0 +1,266 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/registries"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/ldx/docker-registry-client/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// Output formats, set via -output.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputFormat is the output format of commands, set via -output.
+var outputFormat = outputText
+
+// Error codes of failed runs. They are part of the result printed with
+// -output json, and each has its own exit code.
+const (
+	codeInternal        = "internal"
+	codeInvalidArgument = "invalid_argument"
+	codeNotFound        = "not_found"
+	codeUnauthorized    = "unauthorized"
+	codeRejected        = "rejected"
+	codeUnavailable     = "registry_unavailable"
+	codeRateLimited     = "rate_limited"
+	codeStorage         = "storage"
+)
+
+// exitCodes are the exit codes for the error codes. Invalid arguments exit
+// with 2, like invalid flags.
+var exitCodes = map[string]int{
+	codeInternal:        1,
+	codeInvalidArgument: 2,
+	codeNotFound:        3,
+	codeUnauthorized:    4,
+	codeRejected:        5,
+	codeUnavailable:     6,
+	codeRateLimited:     7,
+	codeStorage:         8,
+}
+
+// result is the result of a run, printed as JSON to stdout with -output
+// json.
+type result struct {
+	Command string `json:"command"`
+	Version string `json:"version"`
+	Success bool   `json:"success"`
+	// Image is the image the command was run for, e.g. the one pulled,
+	// resolved or copied.
+	Image *imageResult `json:"image,omitempty"`
+	// Target is the image created by copy, push, commit and flatten
+	// -as-image, or the image compared with by diff.
+	Target *imageResult `json:"target,omitempty"`
+	// Tags are listed by tags, and Repositories by catalog.
+	Tags         []string `json:"tags,omitempty"`
+	Repositories []string `json:"repositories,omitempty"`
+	// Changes are the files that differ between the images compared by
+	// diff.
+	Changes []imagestore.Change `json:"changes,omitempty"`
+	// Content is the content of the file printed by cat.
+	Content []byte       `json:"content,omitempty"`
+	Paths   *pathsResult `json:"paths,omitempty"`
+	Error   *errorResult `json:"error,omitempty"`
+	// Timings are the durations of the phases of the run in seconds, e.g.
+	// pull and unpack, and of the whole run as total.
+	Timings map[string]float64 `json:"timings"`
+}
+
+type imageResult struct {
+	Registry   string        `json:"registry,omitempty"`
+	Repository string        `json:"repository,omitempty"`
+	Reference  string        `json:"reference,omitempty"`
+	Name       string        `json:"name,omitempty"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+	MediaType  string        `json:"mediaType,omitempty"`
+	ID         string        `json:"id,omitempty"`
+	// Cached is true if the image was already in the cache in workdir.
+	Cached bool          `json:"cached,omitempty"`
+	Layers []layerResult `json:"layers,omitempty"`
+}
+
+type layerResult struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+	Cached bool          `json:"cached"`
+}
+
+// pathsResult are the absolute paths of the files and directories created.
+type pathsResult struct {
+	Extracted string `json:"extracted,omitempty"`
+	Mount     string `json:"mount,omitempty"`
+	DiskImage string `json:"diskImage,omitempty"`
+	Config    string `json:"config,omitempty"`
+	Tarball   string `json:"tarball,omitempty"`
+	Copied    string `json:"copied,omitempty"`
+}
+
+type errorResult struct {
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	ExitCode int    `json:"exitCode"`
+}
+
+var (
+	runResult = result{
+		Timings: make(map[string]float64),
+	}
+	started = time.Now()
+)
+
+// printText prints a line of the text output of commands, which is replaced
+// by the result with -output json.
+func printText(format string, args ...interface{}) {
+	if outputFormat == outputText {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// timed records the duration of phase, which started at start.
+func timed(phase string, start time.Time) {
+	runResult.Timings[phase] = time.Since(start).Seconds()
+}
+
+// newImageResult returns the result for ref, resolved to dgst if it is set.
+func newImageResult(ref *registries.Reference, dgst digest.Digest) *imageResult {
+	img := &imageResult{
+		Registry: ref.Registry,
+		Digest:   dgst,
+	}
+	if repo, reference, err := util.ParseImageSpec(util.SourceName(ref.Repo)); err == nil {
+		img.Repository, img.Reference = repo, reference
+	} else {
+		img.Repository = ref.Repo
+	}
+	if dgst != "" {
+		img.Name = pinnedName(ref, dgst)
+	}
+	return img
+}
+
+// setLayers adds layers to img, marking the ones in cached as found in the
+// cache.
+func (img *imageResult) setLayers(layers []distribution.Descriptor, cached map[digest.Digest]bool) {
+	img.Layers = make([]layerResult, 0, len(layers))
+	for _, layer := range layers {
+		img.Layers = append(img.Layers, layerResult{
+			Digest: layer.Digest,
+			Size:   layer.Size,
+			Cached: img.Cached || cached[layer.Digest],
+		})
+	}
+}
+
+// setPath sets *field to the absolute path of p.
+func setPath(field *string, p string) {
+	if abs, err := filepath.Abs(p); err == nil {
+		p = abs
+	}
+	*field = p
+}
+
+// paths returns the paths of the result, adding them if needed.
+func paths() *pathsResult {
+	if runResult.Paths == nil {
+		runResult.Paths = &pathsResult{}
+	}
+	return runResult.Paths
+}
+
+// errorCode returns the error code for err, based on the errors it wraps.
+func errorCode(err error) string {
+	var statusErr *registry.HttpStatusError
+	if errors.As(err, &statusErr) {
+		switch code := statusErr.Response.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return codeUnauthorized
+		case code == http.StatusNotFound:
+			return codeNotFound
+		case code == http.StatusTooManyRequests:
+			return codeRateLimited
+		case code >= 500:
+			return codeUnavailable
+		}
+		return codeInternal
+	}
+	// Checked after HTTP errors, which are wrapped in url.Error, a net.Error.
+	// Errno is a net.Error too, but it is only one when wrapped in a network
+	// error.
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if _, ok := netErr.(syscall.Errno); !ok {
+			return codeUnavailable
+		}
+	}
+	var verifyErr *imagestore.VerificationError
+	var blockedErr *registries.BlockedError
+	if errors.As(err, &verifyErr) || errors.As(err, &blockedErr) {
+		return codeRejected
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return codeNotFound
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return codeStorage
+	}
+	return codeInternal
+}
+
+// argumentCode returns the error code for err, which is about the command
+// line arguments, e.g. an invalid image name, unless there is a more specific
+// one.
+func argumentCode(err error) string {
+	if code := errorCode(err); code != codeInternal {
+		return code
+	}
+	return codeInvalidArgument
+}
+
+// writeResult prints the result of the run with -output json, which failed
+// with the error of the result, if it is set.
+func writeResult() {
+	if outputFormat != outputJSON {
+		return
+	}
+	runResult.Version = Version
+	runResult.Success = runResult.Error == nil
+	timed("total", started)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(runResult); err != nil {
+		glog.Errorf("writing result: %v", err)
+	}
+}
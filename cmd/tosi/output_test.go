@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/registrytest"
+	imagestore "github.com/elotl/tosi/pkg/store"
+)
+
+// failingRegistry answers pings, and fails all other requests with status.
+func failingRegistry(status int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"errors":[{"code":"%s"}]}`, http.StatusText(status))
+	}))
+}
+
+func TestErrorCodePushFailure(t *testing.T) {
+	reg := registrytest.New()
+	// An empty layer.
+	buf := &bytes.Buffer{}
+	if err := tar.NewWriter(buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer := reg.AddBlob(schema2.MediaTypeLayer, buf.Bytes())
+	config := reg.AddBlob(schema2.MediaTypeImageConfig,
+		[]byte(`{"architecture":"amd64","os":"linux","config":{},"rootfs":{"type":"layers","diff_ids":[]}}`))
+	m := schema2.Manifest{
+		Config: config,
+		Layers: []distribution.Descriptor{layer},
+	}
+	m.SchemaVersion = 2
+	m.MediaType = schema2.MediaTypeManifest
+	payload, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.AddManifest("library/app", "1", schema2.MediaTypeManifest, payload)
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	src, err := registryclient.NewRegistryClientWithOptions(server.URL,
+		registryclient.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "tosi-output-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := imagestore.NewStore(dir, "", 1, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Pull("library/app:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		status   int
+		expected string
+	}{
+		{http.StatusUnauthorized, codeUnauthorized},
+		{http.StatusForbidden, codeUnauthorized},
+		{http.StatusNotFound, codeNotFound},
+		{http.StatusTooManyRequests, codeRateLimited},
+		{http.StatusServiceUnavailable, codeUnavailable},
+	}
+	for _, tc := range testCases {
+		destServer := failingRegistry(tc.status)
+		dest, err := registryclient.NewRegistryClientWithOptions(destServer.URL,
+			registryclient.Options{MaxRetries: -1})
+		if err != nil {
+			destServer.Close()
+			t.Fatal(err)
+		}
+		_, err = store.WithSource(dest).Push("library/app:1", "app:1",
+			imagestore.PushOptions{})
+		if err == nil {
+			t.Errorf("%d: expected push error", tc.status)
+		} else if code := errorCode(err); code != tc.expected {
+			t.Errorf("%d: expected push error code %s, got %s: %v",
+				tc.status, tc.expected, code, err)
+		}
+		_, err = store.Copy("library/app:1", dest, "app:1", imagestore.CopyOptions{})
+		if err == nil {
+			t.Errorf("%d: expected copy error", tc.status)
+		} else if code := errorCode(err); code != tc.expected {
+			t.Errorf("%d: expected copy error code %s, got %s: %v",
+				tc.status, tc.expected, code, err)
+		}
+		destServer.Close()
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/url"
+
+	"github.com/elotl/tosi/pkg/policy"
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/signature"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+)
+
+// verification configures how images are verified before pulling them.
+type verification struct {
+	// keys verifies signatures with the keys given via -verify-key.
+	keys *signature.Verifier
+	// policy is the pull policy loaded via -policy.
+	policy *policy.Policy
+}
+
+// policyName returns the transport and the name of ref used for looking up
+// its scope in the policy.
+func policyName(ref *registries.Reference) (string, string) {
+	if transport, path := util.SplitTransport(ref.Registry); transport != "" {
+		return transport, path + ":" + util.SourceName(ref.Repo)
+	}
+	if ref.Name != "" {
+		return policy.TransportDocker, ref.Name
+	}
+	// Pulled via -url.
+	host := ref.Registry
+	if u, err := url.Parse(ref.Registry); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return policy.TransportDocker, host + "/" + ref.Repo
+}
+
+// verifiers returns the verifiers for pulling ref.
+func (v *verification) verifiers(ref *registries.Reference) []imagestore.Verifier {
+	verifiers := []imagestore.Verifier{}
+	if v.policy != nil {
+		verifiers = append(verifiers, v.policy.ForImage(policyName(ref)))
+	}
+	if v.keys != nil {
+		verifiers = append(verifiers, v.keys)
+	}
+	return verifiers
+}
+
+// checkPolicy checks if the image refs would be allowed to be pulled, without
+// pulling it, and prints its name pinned to the digest of its manifest.
+func checkPolicy(refs []*registries.Reference, copts clientOptions, v *verification) {
+	for i, ref := range refs {
+		desc, err := resolve(ref, copts)
+		if err != nil {
+			if i == len(refs)-1 {
+				fatalf("%v", err)
+			}
+			glog.Warningf("%v, trying next registry", err)
+			continue
+		}
+		src, err := newSource(ref, copts)
+		if err != nil {
+			failf(argumentCode(err), "connecting to registry %s: %v", ref.Registry, err)
+		}
+		repo, reference, err := util.ParseImageSpec(ref.Repo)
+		if err != nil {
+			usagef("%v", err)
+		}
+		runResult.Image = newImageResult(ref, desc.Digest)
+		runResult.Image.MediaType = desc.MediaType
+		for _, verifier := range v.verifiers(ref) {
+			err = verifier.Verify(src, repo, reference, desc.Digest)
+			if err != nil {
+				fatalf("%v", &imagestore.VerificationError{Repo: repo, Err: err})
+			}
+		}
+		glog.Infof("%s is allowed", ref.Repo)
+		printText("%s", pinnedName(ref, desc.Digest))
+		return
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/elotl/tosi/pkg/registries"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+)
+
+// pushImage pushes the first of the local image candidates found in the store
+// in workdir to the registry of remote. If the image was pulled from the same
+// registry, blobs are mounted from its repository instead of uploading them.
+func pushImage(locals []*registries.Reference, remote *registries.Reference, workdir string, parallelism int, chunkSize int64, copts clientOptions) {
+	defer timed("push", time.Now())
+	client, err := newRegistryClient(remote, copts)
+	if err != nil {
+		failf(argumentCode(err), "%v", err)
+	}
+	store, err := imagestore.NewStore(workdir, "", parallelism, client)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	local := findLocalImage(store, locals, workdir)
+	opts := imagestore.PushOptions{
+		ChunkSize: chunkSize,
+	}
+	if local.Registry == remote.Registry {
+		opts.MountFrom = stripReference(local.Repo)
+	}
+	glog.Infof("pushing image %q to %q in registry %q",
+		local.Repo, remote.Repo, remote.Registry)
+	dgst, err := store.Push(local.Repo, remote.Repo, opts)
+	if err != nil {
+		fatalf("pushing image %s: %v", remote.Repo, err)
+	}
+	glog.Infof("pushed image %s, digest: %s", remote.Repo, dgst)
+	runResult.Image = newImageResult(local, "")
+	runResult.Target = newImageResult(remote, dgst)
+	printText("%s", pinnedName(remote, dgst))
+}
+
+// findLocalImage returns the first of the image candidates refs that is in the
+// store in workdir.
+func findLocalImage(store *imagestore.Store, refs []*registries.Reference, workdir string) *registries.Reference {
+	for _, ref := range refs {
+		if store.Has(ref.Repo) {
+			return ref
+		}
+		glog.V(2).Infof("%s from %s not found in %s",
+			ref.Repo, ref.Registry, workdir)
+	}
+	failf(codeNotFound, "image %s not found in %s, pull it first",
+		refs[0].Repo, workdir)
+	return nil
+}
+
+// lookupRemote resolves the name of the image to push to into its registry
+// location.
+func lookupRemote(regURL, image string, config *registries.Config) (*registries.Reference, error) {
+	if transport, _ := util.SplitTransport(image); transport != "" {
+		return nil, fmt.Errorf("pushing to %s is not supported", transport)
+	}
+	refs, err := lookupImage(regURL, image, config)
+	if err != nil {
+		return nil, err
+	}
+	return refs[0], nil
+}
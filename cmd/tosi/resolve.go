@@ -0,0 +1,93 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// stripReference removes the tag and the digest from an image name.
+func stripReference(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// pinnedName returns the name of the image pinned to dgst, e.g.
+// docker.io/library/alpine@sha256:...
+func pinnedName(ref *registries.Reference, dgst digest.Digest) string {
+	name := ref.Name
+	if transport, _ := util.SplitTransport(ref.Registry); transport != "" {
+		name = ref.Registry + ":" + util.SourceName(ref.Repo)
+	} else if name == "" {
+		name = ref.Repo
+	}
+	return stripReference(name) + "@" + dgst.String()
+}
+
+// resolveImage resolves the image to its manifest digest, and prints the
+// image name pinned to the digest.
+func resolveImage(refs []*registries.Reference, copts clientOptions) {
+	defer timed("resolve", time.Now())
+	for i, ref := range refs {
+		glog.Infof("resolving image %q via registry %q", ref.Repo, ref.Registry)
+		desc, err := resolve(ref, copts)
+		if err == nil {
+			glog.Infof("%s: digest %s, media type %q",
+				ref.Repo, desc.Digest, desc.MediaType)
+			runResult.Image = newImageResult(ref, desc.Digest)
+			runResult.Image.MediaType = desc.MediaType
+			printText("%s", pinnedName(ref, desc.Digest))
+			return
+		}
+		if i == len(refs)-1 {
+			fatalf("%v", err)
+		}
+		glog.Warningf("%v, trying next registry", err)
+	}
+}
+
+func resolve(ref *registries.Reference, copts clientOptions) (distribution.Descriptor, error) {
+	src, err := newSource(ref, copts)
+	if err != nil {
+		return distribution.Descriptor{}, fmt.Errorf(
+			"connecting to registry %s: %w", ref.Registry, err)
+	}
+	repo, reference, err := util.ParseImageSpec(ref.Repo)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	desc, err := src.Resolve(repo, reference)
+	warnRateLimit(src)
+	if err != nil {
+		return distribution.Descriptor{}, fmt.Errorf(
+			"resolving image %s: %w", ref.Repo, err)
+	}
+	return desc, nil
+}
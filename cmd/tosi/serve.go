@@ -0,0 +1,170 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/elotl/tosi/pkg/cri"
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/server"
+	"github.com/elotl/tosi/pkg/source"
+	imagestore "github.com/elotl/tosi/pkg/store"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+)
+
+// sourceCache keeps the sources created for pulling images, so registry
+// logins and tokens are reused between pulls.
+type sourceCache struct {
+	mu      sync.Mutex
+	copts   clientOptions
+	sources map[string]source.Source
+}
+
+// get returns the source for pulling ref, logging in with creds if they are
+// set, instead of the ones given on the command line. Sources for creds are
+// not cached, since they are passed with each request, and tokens in them
+// expire or get rotated.
+func (c *sourceCache) get(ref *registries.Reference, creds registryclient.Credentials) (source.Source, error) {
+	copts := c.copts
+	if creds != (registryclient.Credentials{}) {
+		copts.username = ""
+		copts.password = ""
+		copts.credentials = []registryclient.Credentials{creds}
+		return connect(ref, copts)
+	}
+	// Pull secrets might only match some repositories of the registry.
+	key := fmt.Sprintf("%s|%s|%v|%v|%v", ref.Registry, ref.Namespace,
+		ref.Insecure, ref.Mirrors, copts.keyring.Lookup(ref.Registry, ref.Repo))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if src, ok := c.sources[key]; ok {
+		return src, nil
+	}
+	src, err := connect(ref, copts)
+	if err != nil {
+		return nil, err
+	}
+	c.sources[key] = src
+	return src, nil
+}
+
+// connect creates the source for pulling ref with copts.
+func connect(ref *registries.Reference, copts clientOptions) (source.Source, error) {
+	src, err := newSource(ref, copts)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to registry %s: %v", ref.Registry, err)
+	}
+	return src, nil
+}
+
+// listen creates the Unix socket path, replacing the one left behind by a
+// previous run.
+func listen(path string) net.Listener {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fatalf("removing %s: %v", path, err)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		fatalf("listening on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0660); err != nil {
+		fatalf("setting permissions of %s: %v", path, err)
+	}
+	return l
+}
+
+// serve runs the daemon serving the API for the image cache in workdir on
+// socket, and the CRI image service on criSocket if it is set, until it is
+// terminated.
+func serve(socket, criSocket, workdir, overlaydir string, parallelism int, config *registries.Config, copts clientOptions, v *verification) {
+	store, err := imagestore.NewStore(workdir, overlaydir, parallelism, nil)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	if copts.allowUnsigned {
+		store.AllowUnsignedSchema1()
+	}
+	sources := &sourceCache{
+		copts:   copts,
+		sources: make(map[string]source.Source),
+	}
+	resolve := func(image string) ([]server.Location, error) {
+		refs, err := lookupImage("", image, config)
+		if err != nil {
+			return nil, fmt.Errorf("looking up image %s: %v", image, err)
+		}
+		locs := []server.Location{}
+		for _, ref := range refs {
+			ref := ref
+			name := ref.Name
+			if name == "" {
+				name = ref.Registry + "/" + ref.Repo
+			}
+			locs = append(locs, server.Location{
+				Name: name,
+				Repo: ref.Repo,
+				Connect: func(creds registryclient.Credentials) (source.Source, error) {
+					return sources.get(ref, creds)
+				},
+				Verifiers: v.verifiers(ref),
+			})
+		}
+		return locs, nil
+	}
+	srv := server.New(store, resolve)
+	var grpcServer *grpc.Server
+	if criSocket != "" {
+		grpcServer = grpc.NewServer()
+		cri.NewImageService(store, resolve, srv.StoreLock()).Register(grpcServer)
+		l := listen(criSocket)
+		glog.Infof("serving CRI image service on %s", criSocket)
+		go func() {
+			if err := grpcServer.Serve(l); err != nil {
+				fatalf("serving CRI image service on %s: %v", criSocket, err)
+			}
+		}()
+	}
+	l := listen(socket)
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		glog.Infof("received %v, shutting down", sig)
+		close(stopped)
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+		l.Close()
+	}()
+	glog.Infof("serving on %s", socket)
+	err = srv.Serve(l)
+	select {
+	case <-stopped:
+		// The socket is removed when closing the listener.
+	default:
+		fatalf("serving on %s: %v", socket, err)
+	}
+}
@@ -17,20 +17,33 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/docker/docker/api/types/container"
+	"github.com/elotl/tosi/pkg/policy"
+	"github.com/elotl/tosi/pkg/registries"
 	"github.com/elotl/tosi/pkg/registryclient"
-	"github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/signature"
+	"github.com/elotl/tosi/pkg/source"
+	imagestore "github.com/elotl/tosi/pkg/store"
 	"github.com/elotl/tosi/pkg/util"
 	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
 )
 
 const (
 	ROOTFS_BASEDIR = "ROOTFS"
+	// Warn when less than this percentage of the pull quota of a registry is
+	// remaining.
+	rateLimitWarnPercent = 10
 )
 
 var (
@@ -41,21 +54,271 @@ type ImageConfig struct {
 	Config container.Config `json:"config"`
 }
 
+// lookupImage resolves the image name into the list of locations it can be
+// pulled from, in order.
+func lookupImage(regURL, image string, config *registries.Config) ([]*registries.Reference, error) {
+	if regURL != "" {
+		ref := registries.Reference{
+			Registry: regURL,
+			Repo:     image,
+		}
+		if u, err := url.Parse(regURL); err == nil {
+			ref.Insecure = config.IsInsecure(u.Host)
+		}
+		return []*registries.Reference{&ref}, nil
+	}
+	if transport, _ := util.SplitTransport(image); transport != "" {
+		location, img, err := util.ParseFullImage(image)
+		if err != nil {
+			return nil, err
+		}
+		return []*registries.Reference{{Registry: location, Repo: img}}, nil
+	}
+	return config.Lookup(image)
+}
+
+// clientOptions are the command line options for registry clients.
+type clientOptions struct {
+	username   string
+	password   string
+	validate   bool
+	certsDir   string
+	maxRetries int
+	// allowUnsigned allows schema1 manifests without signatures.
+	allowUnsigned bool
+	// credentials are tried before the ones in keyring, e.g. the ones sent
+	// with CRI pulls.
+	credentials []registryclient.Credentials
+	// keyring has the credentials loaded via -pull-secret.
+	keyring *registryclient.Keyring
+	// tokenCache caches registry bearer tokens. If it is nil, they are only
+	// cached in memory.
+	tokenCache *registryclient.TokenCache
+}
+
+// newSource creates the source for pulling ref, which is either in a registry
+// or at a path with a transport prefix.
+func newSource(ref *registries.Reference, copts clientOptions) (source.Source, error) {
+	transport, path := util.SplitTransport(ref.Registry)
+	switch transport {
+	case util.TransportOCI:
+		return source.NewOCILayout(path)
+	case util.TransportDockerArchive:
+		return source.NewDockerArchive(path)
+	}
+	// Copy the shared credentials, so appending never writes into their
+	// backing array, which concurrent pulls of other images use too.
+	creds := append([]registryclient.Credentials{}, copts.credentials...)
+	creds = append(creds, copts.keyring.Lookup(ref.Registry, ref.Repo)...)
+	opts := registryclient.Options{
+		Username:      copts.username,
+		Password:      copts.password,
+		Credentials:   creds,
+		TokenCache:    copts.tokenCache,
+		ValidateCache: copts.validate,
+		Insecure:      ref.Insecure,
+		CertsDir:      copts.certsDir,
+		Namespace:     ref.Namespace,
+		MaxRetries:    copts.maxRetries,
+	}
+	if copts.maxRetries == 0 {
+		// Disabled on the command line.
+		opts.MaxRetries = -1
+	}
+	for _, mirror := range ref.Mirrors {
+		opts.Mirrors = append(opts.Mirrors, registryclient.Mirror{
+			URL:      mirror.Location,
+			Insecure: mirror.Insecure,
+		})
+	}
+	return registryclient.NewRegistryClientWithOptions(ref.Registry, opts)
+}
+
+// warnRateLimit warns if the pull quota of the registry src is nearly
+// exhausted.
+func warnRateLimit(src source.Source) {
+	client, ok := src.(*registryclient.RegistryClient)
+	if !ok {
+		return
+	}
+	rateLimit := client.RateLimit()
+	if rateLimit == nil {
+		return
+	}
+	if rateLimit.Remaining*100 <= rateLimit.Limit*rateLimitWarnPercent {
+		glog.Warningf("registry %s pull quota is nearly exhausted: %v",
+			rateLimit.Registry, rateLimit)
+		return
+	}
+	glog.V(2).Infof("registry %s pull quota: %v",
+		rateLimit.Registry, rateLimit)
+}
+
+// pull pulls ref into the store in workdir, and returns the store and the
+// result for the image pulled.
+func pull(ref *registries.Reference, workdir, overlaydir string, parallelism int, copts clientOptions, v *verification) (*imagestore.Store, *imageResult, error) {
+	src, err := newSource(ref, copts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to registry %s: %w", ref.Registry, err)
+	}
+	store, err := imagestore.NewStore(workdir, overlaydir, parallelism, src)
+	if err != nil {
+		fatalf("creating image store in %s: %v", workdir, err)
+	}
+	store = store.WithContext(traceCtx)
+	if copts.allowUnsigned {
+		store.AllowUnsignedSchema1()
+	}
+	for _, verifier := range v.verifiers(ref) {
+		store.AddVerifier(verifier)
+	}
+	mu := sync.Mutex{}
+	cachedImage := false
+	cachedLayers := make(map[digest.Digest]bool)
+	id, dgst, err := store.PullWithProgress(ref.Repo, func(event imagestore.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Status == imagestore.StatusCached {
+			cachedImage = true
+		} else if event.Cached {
+			cachedLayers[event.Layer] = true
+		}
+	})
+	warnRateLimit(src)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pulling image %s: %w", ref.Repo, err)
+	}
+	glog.Infof("pulled image %s, digest: %s", ref.Repo, dgst)
+	img := newImageResult(ref, dgst)
+	img.ID = id
+	img.Cached = cachedImage
+	layers, err := store.Layers(ref.Repo)
+	if err != nil {
+		glog.Warningf("listing layers of %s: %v", ref.Repo, err)
+	} else {
+		img.setLayers(layers, cachedLayers)
+	}
+	return store, img, nil
+}
+
+// commands are the subcommands; pull is the default.
+var commands = []struct {
+	name        string
+	description string
+}{
+	{"pull", "Pull the image, and optionally unpack or mount it. This is the default."},
+	{"resolve", "Resolve the image reference to its manifest digest, without pulling the image."},
+	{"tags", "List the tags of the image repository."},
+	{"catalog", "List the repositories in the registry, e.g. tosi catalog quay.io."},
+	{"commit", "Create a new image from the changes in an overlayfs mount created via -mount, e.g. tosi commit /tmp/rootfs myapp:1.0."},
+	{"diff", "Show the files that differ between two images in the cache in workdir, e.g. tosi diff library/alpine:3.11 library/alpine:3.12."},
+	{"flatten", "Squash an image in the cache in workdir into a single tarball, e.g. tosi flatten library/alpine:3.6 /tmp/alpine.tar, or with -as-image into a new single-layer image, e.g. tosi flatten -as-image library/alpine:3.6 alpine:flat."},
+	{"policy check", "Check if the pull policy allows the image, without pulling it, e.g. tosi policy check -policy /etc/tosi/policy.json library/alpine:3.6."},
+	{"cat", "Print a file from the image, without unpacking it, e.g. tosi cat library/alpine:3.6 /etc/os-release."},
+	{"cp", "Copy a file or directory from the image, without unpacking it, e.g. tosi cp library/alpine:3.6:/etc/apk /tmp/apk."},
+	{"copy", "Copy an image between registries without unpacking it, e.g. tosi copy library/alpine:3.6 registry.example.com/alpine:3.6."},
+	{"push", "Push an image from the cache in workdir to a registry, e.g. tosi push library/alpine:3.6 registry.example.com/alpine:3.6."},
+	{"serve", "Run a daemon serving an API on a Unix socket for pulling, unpacking, mounting and removing images in the cache in workdir, e.g. tosi serve -socket /run/tosi.sock."},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [command] [options] [image]\n\n", os.Args[0])
+	fmt.Fprintf(out, "Commands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", cmd.name, cmd.description)
+	}
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+}
+
+// parseCommandLine parses the command line, which starts with an optional
+// command, followed by options, and the image, which can also be specified
+// via -image.
+func parseCommandLine() string {
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+		// Subcommands, e.g. policy check.
+		if command == "policy" && len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			command += " " + args[0]
+			args = args[1:]
+		}
+	}
+	flag.Usage = usage
+	flag.CommandLine.Parse(args)
+	if command == "" {
+		return "pull"
+	}
+	for _, cmd := range commands {
+		if cmd.name == command {
+			return command
+		}
+	}
+	fmt.Fprintf(flag.CommandLine.Output(), "Unknown command %q\n", command)
+	flag.Usage()
+	os.Exit(2)
+	return ""
+}
+
 func main() {
 	version := flag.Bool("version", false, "Print current version and exit.")
-	image := flag.String("image", "", "Image repository to pull. Usual conventions can be used; e.g. library/alpine:3.6 to specify the repository library/alpine and the tag 3.6.")
+	image := flag.String("image", "", "Image repository to pull. Usual conventions can be used; e.g. library/alpine:3.6 to specify the repository library/alpine and the tag 3.6. Images can also be pulled from an OCI image layout via oci:<dir>[:<image>], or from a docker-archive tarball via docker-archive:<path>[:<image>].")
 	url := flag.String("url", "", "DEPRECATED. Use -image instead with the registry server as the first part, e.g. quay.io/myuser/myimage.")
 	username := flag.String("username", "", "Username for registry login. Leave it empty if no login is required for pulling the image.")
 	password := flag.String("password", "", "Password for registry login. Leave it empty if no login is required for pulling the image.")
+	pullSecretList := stringList{}
+	flag.Var(&pullSecretList, "pull-secret", "Registry credentials file in the .dockerconfigjson or .dockercfg format, e.g. the payload of a Kubernetes image pull secret. Credentials for the registry are matched like in Kubernetes, and tried in order after -username and -password until the registry accepts them. Can be specified multiple times.")
 	workdir := flag.String("workdir", "/tmp/tosi", "Working directory for downloading layers and other metadata. This directory will be effectively used as a cache of images and layers. Do not modify any file inside it.")
+	message := flag.String("message", "", "Comment for the history entry of the new image. Used by the commit command.")
+	flag.StringVar(&outputFormat, "output", outputText, "Output format: text or json. With json, a result document with the resolved image, its digest, ID and layers, cache hits, the paths created and timings, or the error with its error code is printed to stdout instead of the text output.")
 	overlaydir := flag.String("overlaydir", "", "Working directory for extracting layers. By default, it will be <workdir>/overlays.")
 	extractto := flag.String("extractto", "", "Extract and combine all layers of an image directly into this directory. Mutually exclusive with -mount <dir>.")
+	diskImage := flag.String("diskimage", "", "Create a disk image with the filesystem of the image as this file, e.g. for using it as the root device of a virtual machine. Disk images are cached in workdir.")
+	diskImageFormat := flag.String("diskimage-format", "ext4", "Filesystem of the disk image created via -diskimage: ext4, squashfs or erofs. Creating squashfs and erofs images needs squashfs-tools 4.6 or erofs-utils 1.6 or newer.")
+	includeList := stringList{}
+	flag.Var(&includeList, "include", "Extract only files matching this glob pattern with -extractto, e.g. /etc/*.conf. A pattern matching a directory includes everything in it. Can be specified multiple times.")
+	excludeList := stringList{}
+	flag.Var(&excludeList, "exclude", "Do not extract files matching this glob pattern with -extractto, e.g. /usr/share/doc. A pattern matching a directory excludes everything in it. Can be specified multiple times.")
 	mount := flag.String("mount", "", "Create an overlayfs mount in this directory, which creates a writable mount that is a combined view of all the image layers. Mutually exclusive with -extractto <dir>. The directory will be created if it does not exist.")
 	saveconfig := flag.String("saveconfig", "", "Save config from image to this file as JSON.")
+	policyPath := flag.String("policy", "", "Pull policy file, in the format of policy.json used by containers/image, for allowing or rejecting images per registry, namespace or repository, requiring cosign signatures, or pulling via a digest. By default, all images are allowed.")
 	parallelism := flag.Int("parallel-downloads", 4, "Number of parallel downloads when pulling images.")
+	tokenCache := flag.Bool("token-cache", false, "Save registry bearer tokens and OAuth2 refresh tokens in the tokens directory in workdir, so they are reused by later runs until they expire. By default, tokens are only cached in memory.")
 	validate := flag.Bool("validate-cache", false, "Enable to validate already downloaded layers in cache via verifying their checksum.")
-	flag.Parse()
+	registriesConfig := flag.String("registries-config", "/etc/tosi/registries.json", "Registries configuration file, for configuring mirrors, insecure and blocked registries, and registries to search for image names without a registry host. If it does not exist, the built-in defaults are used.")
+	allowUnsigned := flag.Bool("allow-unsigned-schema1", false, "Allow pulling and copying images with legacy schema1 manifests that have no signatures. Signatures of schema1 manifests are always verified if they are present.")
+	allPlatforms := flag.Bool("all-platforms", false, "Copy all platforms of multi-platform images, and the manifest list or image index. By default, only the image for the current platform is copied. Used by the copy command.")
+	asImage := flag.Bool("as-image", false, "Create a new single-layer image instead of a tarball. Used by the flatten command.")
+	author := flag.String("author", "", "Author of the new image. Used by the commit command.")
+	certsDir := flag.String("certs-dir", registryclient.DefaultCertsDir, "Directory with per-registry TLS certificates: CA certificates as <dir>/<host[:port]>/*.crt, and client certificates and keys as <dir>/<host[:port]>/*.cert and *.key.")
+	insecureRegistries := flag.String("insecure-registries", "", "Comma-separated list of registry hosts, optionally with a port, or CIDR networks that are allowed to use plain HTTP or TLS without certificate verification. Added to the insecure registries in the registries configuration.")
+	maxRetries := flag.Int("max-retries", registryclient.DefaultMaxRetries, "Number of times a registry request failing with a transient error, e.g. a timeout or HTTP 429 and 5xx responses, is retried. Set it to 0 to disable retries.")
+	clampMtime := flag.String("clamp-mtime", "", "Set modification times later than this Unix timestamp to it, e.g. $SOURCE_DATE_EPOCH, for reproducible tarballs. Used by the flatten command.")
+	compress := flag.Bool("compress", false, "Compress the tarball via gzip. Used by the flatten command.")
+	changeList := stringList{}
+	flag.Var(&changeList, "change", "Apply a Dockerfile instruction to the config of the new image, e.g. \"ENV FOO=bar\" or 'CMD [\"/app\"]'. Supported instructions: CMD, ENTRYPOINT, ENV, EXPOSE, LABEL, USER, VOLUME and WORKDIR. Can be specified multiple times. Used by the commit command.")
+	chunkSize := flag.Int64("chunk-size", 0, "Upload blobs in chunks of this many bytes when pushing or copying images. By default, blobs are uploaded in a single request, except when streaming them between registries, which uses 16MiB chunks.")
+	viaCache := flag.Bool("via-cache", false, "Save blobs into the cache in workdir when copying images, instead of streaming them between registries. Used by the copy command.")
+	verifyKeyList := stringList{}
+	flag.Var(&verifyKeyList, "verify-key", "Require images to have a cosign signature created with the private key of this PEM encoded public key, e.g. cosign.pub, before pulling them. Can be specified multiple times, in which case a signature with any of the keys is accepted.")
+	socket := flag.String("socket", "/run/tosi.sock", "Unix socket to serve the API on. Used by the serve command.")
+	criSocket := flag.String("cri-socket", "", "Unix socket to serve the Kubernetes CRI image service on, e.g. /run/tosi-cri.sock, for using tosi as the image service of a container runtime. Disabled by default. Used by the serve command.")
+	flag.StringVar(&metricsTextfile, "metrics-textfile", "", "Write Prometheus metrics of the run, e.g. pulls, layer cache hits, downloaded bytes and failures, to this file when exiting, e.g. for the textfile collector of the node exporter.")
+	metricsAddress := flag.String("metrics-address", "", "Serve Prometheus metrics via HTTP on this address, e.g. :9402, at /metrics. Disabled by default. Used by the serve command.")
+	traceExporter := flag.String("trace", "", "Export OpenTelemetry tracing spans of pulls, manifest fetches, blob downloads, layer unpacks and mounts. Either stdout, which prints spans as JSON to standard error, or otlp, which sends them to an OTLP collector via gRPC. Disabled by default.")
+	traceEndpoint := flag.String("trace-endpoint", "", "Address of the OTLP collector spans are sent to with -trace otlp, without TLS. Defaults to the OTEL_EXPORTER_OTLP_ENDPOINT environment variable, or localhost:4317.")
+	semverOnly := flag.Bool("semver", false, "List only tags that are semantic versions, e.g. 1.2.3 or v1.2, sorted by version. Used by the tags command.")
+	semverRange := flag.String("semver-range", "", "List only tags that are semantic versions matching this range, e.g. \">=1.2, <2\" or \"~1.4\", sorted by version. Used by the tags command.")
+	command := parseCommandLine()
 	flag.Lookup("logtostderr").Value.Set("true")
+	runResult.Command = command
+	if format := outputFormat; format != outputText && format != outputJSON {
+		outputFormat = outputText
+		usagef("Invalid output format %q", format)
+	}
 
 	progname := "tosi"
 	if len(os.Args) > 0 {
@@ -63,71 +326,302 @@ func main() {
 	}
 
 	if *version {
-		fmt.Printf("%s version %s\n", progname, Version)
-		os.Exit(0)
+		printText("%s version %s", progname, Version)
+		exit(0)
 	}
 
 	glog.Infof("%s version: %s", progname, Version)
+	startTracing(*traceExporter, *traceEndpoint, command)
 
-	if *image == "" {
-		glog.Fatalf("Please specify image to pull")
+	args := flag.Args()
+	if *image == "" && len(args) > 0 {
+		*image = args[0]
+		args = args[1:]
+	}
+	if *image == "" && (command != "catalog" || *url == "") && command != "serve" {
+		usagef("Please specify image to pull")
 	}
 
-	registry := *url
-	img := *image
-	if registry == "" {
-		registry, img = util.ParseFullImage(*image)
+	// The path to copy is part of the image argument, e.g. alpine:/etc/apk.
+	srcPath := ""
+	if command == "cp" {
+		i := strings.LastIndex(*image, ":/")
+		if i < 0 {
+			usagef("Please specify the path to copy as <image>:<path>")
+		}
+		*image, srcPath = (*image)[:i], (*image)[i+1:]
+	}
+
+	config, err := registries.Load(*registriesConfig)
+	if err != nil {
+		failf(argumentCode(err), "loading registries config: %v", err)
+	}
+	for _, insecure := range strings.Split(*insecureRegistries, ",") {
+		if insecure = strings.TrimSpace(insecure); insecure != "" {
+			config.InsecureRegistries = append(config.InsecureRegistries, insecure)
+		}
+	}
+
+	copts := clientOptions{
+		username:      *username,
+		password:      *password,
+		validate:      *validate,
+		certsDir:      *certsDir,
+		maxRetries:    *maxRetries,
+		allowUnsigned: *allowUnsigned,
+	}
+	if len(pullSecretList) > 0 {
+		copts.keyring, err = registryclient.LoadKeyring(pullSecretList)
+		if err != nil {
+			failf(argumentCode(err), "loading pull secrets: %v", err)
+		}
+	}
+	if *tokenCache {
+		dir := filepath.Join(*workdir, "tokens")
+		copts.tokenCache, err = registryclient.NewTokenCache(dir)
+		if err != nil {
+			fatalf("creating token cache in %s: %v", dir, err)
+		}
+	}
+
+	v := &verification{}
+	if len(verifyKeyList) > 0 {
+		keys, err := signature.LoadPublicKeys(verifyKeyList)
+		if err != nil {
+			failf(argumentCode(err), "loading public keys: %v", err)
+		}
+		v.keys = signature.NewVerifier(keys)
+	}
+	if *policyPath != "" {
+		v.policy, err = policy.Load(*policyPath)
+		if err != nil {
+			failf(argumentCode(err), "loading policy: %v", err)
+		}
+	}
+
+	if command == "serve" {
+		if *metricsAddress != "" {
+			serveMetrics(*metricsAddress)
+		}
+		serve(*socket, *criSocket, *workdir, *overlaydir, *parallelism, config, copts, v)
+		exit(0)
+	}
+
+	if command == "commit" {
+		if len(args) < 1 {
+			usagef("Please specify the name of the new image")
+		}
+		ref, err := lookupRemote(*url, args[0], config)
+		if err != nil {
+			failf(argumentCode(err), "looking up image %s: %v", args[0], err)
+		}
+		changes := imagestore.ConfigChanges{
+			Author:  *author,
+			Comment: *message,
+		}
+		for _, change := range changeList {
+			if err := changes.ParseChange(change); err != nil {
+				usagef("%v", err)
+			}
+		}
+		commitImage(*image, ref, *workdir, *overlaydir, &changes)
+		exit(0)
+	}
+
+	if command == "catalog" {
+		listCatalog(*url, *image, config, copts)
+		exit(0)
+	}
+
+	refs, err := lookupImage(*url, *image, config)
+	if err != nil {
+		failf(argumentCode(err), "looking up image %s: %v", *image, err)
+	}
+
+	switch command {
+	case "policy check":
+		if v.policy == nil && v.keys == nil {
+			usagef("Please specify the policy to check via -policy")
+		}
+		checkPolicy(refs, copts, v)
+		exit(0)
+	case "diff":
+		if len(args) < 1 {
+			usagef("Please specify the image to compare %s with", *image)
+		}
+		others, err := lookupImage(*url, args[0], config)
+		if err != nil {
+			failf(argumentCode(err), "looking up image %s: %v", args[0], err)
+		}
+		diffImages(refs, others, *workdir)
+		exit(0)
+	case "flatten":
+		if len(args) < 1 {
+			usagef("Please specify the tarball or image to flatten %s into", *image)
+		}
+		clampTime, err := parseClampTime(*clampMtime)
+		if err != nil {
+			usagef("%v", err)
+		}
+		opts := imagestore.FlattenOptions{
+			Compress:  *compress,
+			ClampTime: clampTime,
+		}
+		if !*asImage && args[0] == "-" && outputFormat == outputJSON {
+			usagef("Flattening to stdout does not support -output json")
+		}
+		if *asImage {
+			ref, err := lookupRemote(*url, args[0], config)
+			if err != nil {
+				failf(argumentCode(err), "looking up image %s: %v", args[0], err)
+			}
+			flattenToImage(refs, ref, *workdir, opts)
+		} else {
+			flattenImage(refs, args[0], *workdir, opts)
+		}
+		exit(0)
+	case "copy", "push":
+		if len(args) < 1 {
+			usagef("Please specify the image to %s to", command)
+		}
+		remote, err := lookupRemote(*url, args[0], config)
+		if err != nil {
+			failf(argumentCode(err), "looking up image %s: %v", args[0], err)
+		}
+		if command == "push" {
+			pushImage(refs, remote, *workdir, *parallelism, *chunkSize, copts)
+			exit(0)
+		}
+		opts := imagestore.CopyOptions{
+			PushOptions: imagestore.PushOptions{
+				ChunkSize: *chunkSize,
+			},
+			AllPlatforms: *allPlatforms,
+			ViaCache:     *viaCache,
+		}
+		copyImage(refs, remote, *workdir, *parallelism, opts, copts)
+		exit(0)
+	case "cat":
+		if len(args) < 1 {
+			usagef("Please specify the file to print")
+		}
+		srcPath = args[0]
+	case "cp":
+		if len(args) < 1 {
+			usagef("Please specify the destination to copy %s to", srcPath)
+		}
+	case "resolve":
+		resolveImage(refs, copts)
+		exit(0)
+	case "tags":
+		listTags(refs, copts, *semverOnly, *semverRange)
+		exit(0)
 	}
-	glog.Infof("pulling image %q from registry %q", img, registry)
 
 	rootfs := *extractto
 	if rootfs != "" {
 		if *mount != "" {
-			glog.Fatalf("-extractto and -mount are mutually exclusive")
+			usagef("-extractto and -mount are mutually exclusive")
 		}
 		// If rootfs already exists, it needs to be empty.
 		if util.PathExists(rootfs) && !util.IsEmptyDir(rootfs) {
-			glog.Fatalf("%s is not empty or accessible", rootfs)
+			usagef("%s is not empty or accessible", rootfs)
 		}
 	}
 
-	reg, err := registryclient.NewRegistryClient(
-		registry, *username, *password, *validate)
-	if err != nil {
-		glog.Fatalf("connecting to registry %s: %v", registry, err)
+	var store *imagestore.Store
+	img := ""
+	start := time.Now()
+	for i, ref := range refs {
+		glog.Infof("pulling image %q from registry %q", ref.Repo, ref.Registry)
+		store, runResult.Image, err = pull(ref, *workdir, *overlaydir, *parallelism, copts, v)
+		if err == nil {
+			img = ref.Repo
+			break
+		}
+		if i == len(refs)-1 {
+			fatalf("%v", err)
+		}
+		glog.Warningf("%v, trying next registry", err)
 	}
+	timed("pull", start)
 
-	store, err := store.NewStore(*workdir, *overlaydir, *parallelism, reg)
-	if err != nil {
-		glog.Fatalf("creating image store in %s: %v", *workdir, err)
-	}
-	_, err = store.Pull(img)
-	if err != nil {
-		glog.Fatalf("pulling image %s: %v", img, err)
+	switch command {
+	case "cat":
+		start = time.Now()
+		if outputFormat == outputJSON {
+			buf := bytes.Buffer{}
+			err = store.ReadFile(img, srcPath, &buf)
+			runResult.Content = buf.Bytes()
+		} else {
+			err = store.ReadFile(img, srcPath, os.Stdout)
+		}
+		if err != nil {
+			fatalf("reading %s from %s: %v", srcPath, img, err)
+		}
+		timed("read", start)
+		exit(0)
+	case "cp":
+		start = time.Now()
+		err = store.Extract(img, srcPath, args[0])
+		if err != nil {
+			fatalf("copying %s from %s to %s: %v", srcPath, img, args[0], err)
+		}
+		timed("copy", start)
+		setPath(&paths().Copied, args[0])
+		glog.Infof("Success!")
+		exit(0)
 	}
 
 	if rootfs != "" {
-		err = store.Unpack(img, rootfs)
+		var filter *imagestore.PathFilter
+		if len(includeList) > 0 || len(excludeList) > 0 {
+			filter = &imagestore.PathFilter{
+				Include: includeList,
+				Exclude: excludeList,
+			}
+		}
+		start = time.Now()
+		err = store.UnpackFiltered(img, rootfs, filter)
+		if err != nil {
+			fatalf("unpacking %s into %s: %v", img, rootfs, err)
+		}
+		timed("unpack", start)
+		setPath(&paths().Extracted, rootfs)
+	}
+
+	if *diskImage != "" {
+		format := imagestore.DiskImageFormat(*diskImageFormat)
+		start = time.Now()
+		err = store.BuildDiskImage(img, format, *diskImage)
 		if err != nil {
-			glog.Fatalf("unpacking %s into %s: %v", img, rootfs, err)
+			fatalf("creating disk image %s for %s: %v", *diskImage, img, err)
 		}
+		timed("diskImage", start)
+		setPath(&paths().DiskImage, *diskImage)
 	}
 
 	if *mount != "" {
+		start = time.Now()
 		err = store.Mount(img, *mount)
 		if err != nil {
-			glog.Fatalf("mounting %s into %s: %v", img, *mount, err)
+			fatalf("mounting %s into %s: %v", img, *mount, err)
 		}
+		timed("mount", start)
+		setPath(&paths().Mount, *mount)
 	}
 
 	if *saveconfig != "" {
+		start = time.Now()
 		err = store.SaveConfig(img, *saveconfig)
 		if err != nil {
-			glog.Fatalf("saving config for %s to %s: %v", img, *saveconfig, err)
+			fatalf("saving config for %s to %s: %v", img, *saveconfig, err)
 		}
+		timed("saveConfig", start)
+		setPath(&paths().Config, *saveconfig)
 	}
 
 	// Done!
 	glog.Infof("Success!")
-	os.Exit(0)
+	exit(0)
 }
@@ -0,0 +1,55 @@
+/*
+Copyright 2020 Elotl Inc
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+
+	"github.com/elotl/tosi/pkg/tracing"
+)
+
+// traceCtx has the span of the command, the parent of the spans of the store
+// operations.
+var traceCtx = context.Background()
+
+// endTrace ends the span of the command, and exports the remaining spans.
+var endTrace = func(err error) {}
+
+// startTracing starts the span of command, exporting spans via exporter to
+// endpoint, see tracing.Init.
+func startTracing(exporter, endpoint, command string) {
+	switch exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		usagef("Invalid trace exporter %q", exporter)
+	}
+	shutdown, err := tracing.Init(exporter, endpoint, Version)
+	if err != nil {
+		fatalf("%v", err)
+	}
+	if command == "serve" {
+		// Requests to the daemon have their own spans.
+		endTrace = func(error) { shutdown() }
+		return
+	}
+	ctx, span := tracing.Start(context.Background(), "tosi "+command)
+	traceCtx = ctx
+	endTrace = func(err error) {
+		tracing.End(span, err)
+		shutdown()
+	}
+}
@@ -11,12 +11,21 @@ require (
 	github.com/docker/libtrust v0.0.0-20160708172513-aabc10ec26b7
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/hashicorp/go-multierror v1.1.0
-	github.com/konsorten/go-windows-terminal-sequences v1.0.2
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3
 	github.com/ldx/docker-registry-client v0.0.0-20190716233113-0e4c8bca1281
 	github.com/opencontainers/go-digest v1.0.0-rc1
 	github.com/opencontainers/image-spec v1.0.1
 	github.com/opencontainers/runc v0.1.1 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
-	github.com/sirupsen/logrus v1.4.2
-	golang.org/x/sys v0.0.0-20190712062909-fae7ac547cb7
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sirupsen/logrus v1.6.0
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	go.opentelemetry.io/proto/otlp v0.9.0 // indirect
+	golang.org/x/sys v0.0.0-20210831042530-f4d43177bf5e
+	google.golang.org/grpc v1.40.0
+	k8s.io/cri-api v0.23.1
 )
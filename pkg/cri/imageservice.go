@@ -0,0 +1,394 @@
+package cri
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/server"
+	"github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/tracing"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// ImageService implements the CRI image service on top of a store. Image IDs
+// are the digests of the image configs, like in other container runtimes.
+type ImageService struct {
+	store   *store.Store
+	resolve server.Resolver
+	// lock is the store lock, see server.Server.StoreLock.
+	lock *sync.RWMutex
+}
+
+var _ runtimeapi.ImageServiceServer = &ImageService{}
+
+// NewImageService creates a CRI image service for st, resolving images via
+// resolve. The lock needs to be shared with other users of the store, e.g.
+// server.Server.
+func NewImageService(st *store.Store, resolve server.Resolver, lock *sync.RWMutex) *ImageService {
+	if lock == nil {
+		lock = &sync.RWMutex{}
+	}
+	return &ImageService{
+		store:   st,
+		resolve: resolve,
+		lock:    lock,
+	}
+}
+
+// Register registers the image service with a gRPC server.
+func (s *ImageService) Register(g *grpc.Server) {
+	runtimeapi.RegisterImageServiceServer(g, s)
+}
+
+// credentials returns the registry credentials in auth.
+func credentials(auth *runtimeapi.AuthConfig) (registryclient.Credentials, error) {
+	creds := registryclient.Credentials{}
+	if auth == nil {
+		return creds, nil
+	}
+	creds.Username = auth.Username
+	creds.Password = auth.Password
+	creds.IdentityToken = auth.IdentityToken
+	creds.RegistryToken = auth.RegistryToken
+	if creds.Username == "" && auth.Auth != "" {
+		buf, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return creds, status.Errorf(codes.InvalidArgument,
+				"invalid auth: %v", err)
+		}
+		parts := strings.SplitN(string(buf), ":", 2)
+		if len(parts) != 2 {
+			return creds, status.Errorf(codes.InvalidArgument,
+				"invalid auth: missing password")
+		}
+		creds.Username = parts[0]
+		creds.Password = parts[1]
+	}
+	return creds, nil
+}
+
+// imageID returns the CRI image ID for the ID of an image in the store, which
+// has a prefix for the manifest version, e.g. v2:sha256:<hex>.
+func imageID(id string) string {
+	if strings.HasPrefix(id, "v1:") || strings.HasPrefix(id, "v2:") {
+		return id[3:]
+	}
+	return id
+}
+
+var encodedIDRegexp = regexp.MustCompile("^[a-f0-9]{64}$")
+
+// parseImageID returns the CRI image ID if image is one, either as a digest
+// or as an encoded SHA-256 digest.
+func parseImageID(image string) (string, bool) {
+	if encodedIDRegexp.MatchString(image) {
+		return digest.SHA256.String() + ":" + image, true
+	}
+	if _, err := digest.Parse(image); err == nil {
+		return image, true
+	}
+	return "", false
+}
+
+// qualify returns the fully qualified name of the image name in the store,
+// e.g. docker.io/library/alpine:3.6 for library/alpine:3.6. It is looked up
+// via the resolver, like when pulling the image, so it is the name of the
+// first location name is pulled from. If there is none, name is returned.
+func (s *ImageService) qualify(name string) string {
+	locs, err := s.resolve(name)
+	if err != nil {
+		glog.V(2).Infof("resolving %s: %v", name, err)
+		return name
+	}
+	for _, loc := range locs {
+		if loc.Repo == name && loc.Name != "" {
+			return loc.Name
+		}
+	}
+	return name
+}
+
+// repoTags returns the fully qualified names of image.
+func (s *ImageService) repoTags(image *store.Image) []string {
+	names := []string{}
+	for _, name := range image.Names {
+		names = append(names, s.qualify(name))
+	}
+	return names
+}
+
+// repoDigests returns the fully qualified names of image pinned to its
+// digest.
+func (s *ImageService) repoDigests(image *store.Image) []string {
+	names := []string{}
+	for _, name := range image.Names {
+		repo, _, _, err := util.ParseImageReference(name)
+		if err != nil {
+			continue
+		}
+		names = append(names, s.qualify(repo+"@"+image.Digest.String()))
+	}
+	return names
+}
+
+// toCRI converts an image in the store into a CRI image.
+func (s *ImageService) toCRI(image *store.Image) *runtimeapi.Image {
+	id := imageID(image.ID)
+	img := &runtimeapi.Image{
+		Id:          id,
+		RepoTags:    s.repoTags(image),
+		RepoDigests: s.repoDigests(image),
+		Size_:       uint64(image.Size),
+		Spec: &runtimeapi.ImageSpec{
+			Image: id,
+		},
+	}
+	config, err := s.store.ContainerConfig(image.ID)
+	if err != nil {
+		glog.Warningf("loading config of %s: %v", image.ID, err)
+		return img
+	}
+	// The user is either a UID or a user name, optionally with a group.
+	user := strings.SplitN(config.User, ":", 2)[0]
+	if uid, err := strconv.ParseInt(user, 10, 64); err == nil {
+		img.Uid = &runtimeapi.Int64Value{Value: uid}
+	} else {
+		img.Username = user
+	}
+	return img
+}
+
+// find returns the images in the store matching image, which is either an
+// image ID, or an image name resolved via the resolver.
+func (s *ImageService) find(image string) ([]*store.Image, error) {
+	if id, ok := parseImageID(image); ok {
+		found, err := s.findID(id)
+		if err != nil || len(found) > 0 {
+			return found, err
+		}
+		// Digests can also be names without a repository.
+	}
+	_, img, err := s.findName(image)
+	if err != nil || img == nil {
+		return nil, err
+	}
+	return []*store.Image{img}, nil
+}
+
+// findID returns the images in the store with the CRI image ID id.
+func (s *ImageService) findID(id string) ([]*store.Image, error) {
+	images, err := s.store.List()
+	if err != nil {
+		return nil, err
+	}
+	found := []*store.Image{}
+	for i := range images {
+		if imageID(images[i].ID) == id {
+			found = append(found, &images[i])
+		}
+	}
+	return found, nil
+}
+
+// findName returns the name in the store of the image name resolves to, and
+// the image, or no image if it is not in the store.
+func (s *ImageService) findName(name string) (string, *store.Image, error) {
+	locs, err := s.resolve(name)
+	if err != nil {
+		return "", nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	for _, loc := range locs {
+		if !s.store.Has(loc.Repo) {
+			continue
+		}
+		img, err := s.store.Image(loc.Repo)
+		if err != nil {
+			return "", nil, err
+		}
+		return loc.Repo, img, nil
+	}
+	return "", nil, nil
+}
+
+// PullImage pulls an image, trying the locations it resolves to in order,
+// and returns its ID.
+func (s *ImageService) PullImage(ctx context.Context, req *runtimeapi.PullImageRequest) (*runtimeapi.PullImageResponse, error) {
+	image := req.GetImage().GetImage()
+	if image == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing image")
+	}
+	creds, err := credentials(req.GetAuth())
+	if err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Start(ctx, "PullImage", tracing.Image(image))
+	defer span.End()
+	locs, err := s.resolve(image)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var result error
+	for _, loc := range locs {
+		src, err := loc.Connect(creds)
+		if err != nil {
+			result = multierror.Append(result, err)
+			continue
+		}
+		st := s.store.WithSource(src).WithContext(ctx)
+		for _, verifier := range loc.Verifiers {
+			st.AddVerifier(verifier)
+		}
+		glog.Infof("pulling %s", loc.Repo)
+		id, dgst, err := st.PullWithDigest(loc.Repo)
+		if err != nil {
+			glog.Warningf("pulling %s: %v", loc.Repo, err)
+			result = multierror.Append(result, err)
+			continue
+		}
+		glog.Infof("pulled %s, digest: %s", loc.Repo, dgst)
+		return &runtimeapi.PullImageResponse{
+			ImageRef: imageID(id),
+		}, nil
+	}
+	if result == nil {
+		result = fmt.Errorf("no location found")
+	}
+	return nil, fmt.Errorf("pulling %s: %v", image, result)
+}
+
+// ListImages lists the images in the store, optionally only the ones matching
+// the filter.
+func (s *ImageService) ListImages(ctx context.Context, req *runtimeapi.ListImagesRequest) (*runtimeapi.ListImagesResponse, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var images []*store.Image
+	if filter := req.GetFilter().GetImage().GetImage(); filter != "" {
+		found, err := s.find(filter)
+		if err != nil {
+			return nil, err
+		}
+		images = found
+	} else {
+		all, err := s.store.List()
+		if err != nil {
+			return nil, err
+		}
+		for i := range all {
+			images = append(images, &all[i])
+		}
+	}
+	resp := &runtimeapi.ListImagesResponse{}
+	for _, image := range images {
+		if image.ID == "" {
+			// The manifest could not be loaded.
+			continue
+		}
+		resp.Images = append(resp.Images, s.toCRI(image))
+	}
+	return resp, nil
+}
+
+// ImageStatus returns the status of an image, or no image if it is not in the
+// store.
+func (s *ImageService) ImageStatus(ctx context.Context, req *runtimeapi.ImageStatusRequest) (*runtimeapi.ImageStatusResponse, error) {
+	image := req.GetImage().GetImage()
+	if image == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing image")
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	images, err := s.find(image)
+	if err != nil {
+		return nil, err
+	}
+	resp := &runtimeapi.ImageStatusResponse{}
+	if len(images) == 0 {
+		return resp, nil
+	}
+	resp.Image = s.toCRI(images[0])
+	if req.GetVerbose() {
+		config, err := s.store.ContainerConfig(images[0].ID)
+		if err == nil {
+			buf, err := json.Marshal(config)
+			if err == nil {
+				resp.Info = map[string]string{"config": string(buf)}
+			}
+		}
+	}
+	return resp, nil
+}
+
+// RemoveImage removes an image from the store. Removing an image that is not
+// in the store is not an error. Images removed via their ID or a digest are
+// removed with all of their names; removing a tag only removes that name.
+// Layers are only removed via GC.
+func (s *ImageService) RemoveImage(ctx context.Context, req *runtimeapi.RemoveImageRequest) (*runtimeapi.RemoveImageResponse, error) {
+	image := req.GetImage().GetImage()
+	if image == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing image")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if id, ok := parseImageID(image); ok {
+		images, err := s.findID(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range images {
+			glog.Infof("removing %s, digest: %s", image, img.Digest)
+			if err := s.store.RemoveDigest(img.Digest); err != nil {
+				return nil, err
+			}
+		}
+		if len(images) > 0 {
+			return &runtimeapi.RemoveImageResponse{}, nil
+		}
+	}
+	name, img, err := s.findName(image)
+	if err != nil {
+		return nil, err
+	}
+	if img != nil {
+		glog.Infof("removing %s, digest: %s", name, img.Digest)
+		// Names pinned to a digest remove all names of the image.
+		if err := s.store.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return &runtimeapi.RemoveImageResponse{}, nil
+}
+
+// ImageFsInfo returns the disk usage of the store.
+func (s *ImageService) ImageFsInfo(ctx context.Context, req *runtimeapi.ImageFsInfoRequest) (*runtimeapi.ImageFsInfoResponse, error) {
+	bytes, inodes, err := s.store.DiskUsage()
+	if err != nil {
+		return nil, fmt.Errorf("getting disk usage of %s: %v", s.store.BaseDir, err)
+	}
+	return &runtimeapi.ImageFsInfoResponse{
+		ImageFilesystems: []*runtimeapi.FilesystemUsage{
+			{
+				Timestamp:  time.Now().UnixNano(),
+				FsId:       &runtimeapi.FilesystemIdentifier{Mountpoint: s.store.BaseDir},
+				UsedBytes:  &runtimeapi.UInt64Value{Value: bytes},
+				InodesUsed: &runtimeapi.UInt64Value{Value: inodes},
+			},
+		},
+	}, nil
+}
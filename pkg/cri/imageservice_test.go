@@ -0,0 +1,490 @@
+package cri
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/server"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/store"
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeSource is an in-memory source.Source.
+type fakeSource struct {
+	// manifests are the manifests by image:reference.
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+}
+
+var _ source.Source = &fakeSource{}
+
+func newFakeSource() *fakeSource {
+	return &fakeSource{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+	}
+}
+
+func (f *fakeSource) addBlob(mediaType string, content []byte) distribution.Descriptor {
+	dgst := digest.FromBytes(content)
+	f.blobs[dgst] = content
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    dgst,
+	}
+}
+
+// addImage adds an image with a single layer containing a file, and returns
+// the digest of its manifest.
+func (f *fakeSource) addImage(t *testing.T, repo, tag, user string) digest.Digest {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	content := []byte(repo + ":" + tag)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "etc/image",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := f.addBlob(schema2.MediaTypeLayer, buf.Bytes())
+	config := fmt.Sprintf(`{"architecture":"amd64","os":"linux",`+
+		`"config":{"User":%q},"rootfs":{"type":"layers","diff_ids":[%q]}}`,
+		user, digest.FromBytes(buf.Bytes()))
+	m := schema2.Manifest{
+		Config: f.addBlob(schema2.MediaTypeImageConfig, []byte(config)),
+		Layers: []distribution.Descriptor{layer},
+	}
+	m.SchemaVersion = 2
+	m.MediaType = schema2.MediaTypeManifest
+	payload, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(payload)
+	f.manifests[repo+":"+tag] = payload
+	f.manifests[repo+":"+dgst.String()] = payload
+	return dgst
+}
+
+func (f *fakeSource) Manifest(image, reference string) (string, []byte, error) {
+	payload, ok := f.manifests[image+":"+reference]
+	if !ok {
+		return "", nil, fmt.Errorf("%s:%s not found", image, reference)
+	}
+	return schema2.MediaTypeManifest, payload, nil
+}
+
+func (f *fakeSource) Resolve(image, reference string) (distribution.Descriptor, error) {
+	mediaType, payload, err := f.Manifest(image, reference)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(payload)),
+		Digest:    digest.FromBytes(payload),
+	}, nil
+}
+
+func (f *fakeSource) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	content, ok := f.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", desc.Digest)
+	}
+	return content, nil
+}
+
+func (f *fakeSource) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	content, err := f.GetBlob(image, desc)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, desc.Digest.Encoded())
+	return path, ioutil.WriteFile(path, content, 0644)
+}
+
+// testService is an image service served via an in-memory gRPC connection.
+type testService struct {
+	client runtimeapi.ImageServiceClient
+	src    *fakeSource
+	// creds are the credentials the source was connected with, in order.
+	creds []registryclient.Credentials
+	lock  sync.Mutex
+	// cleanup are the functions run by close, in reverse order.
+	cleanup []func()
+}
+
+// newTestService creates an image service backed by a fake source, resolving
+// images to docker.io, and images without a repository to library/<image>,
+// like Docker Hub. The caller
+// needs to close it.
+func newTestService(t *testing.T) *testService {
+	dir, err := ioutil.TempDir("", "tosi-cri-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testService{src: newFakeSource()}
+	ts.cleanup = append(ts.cleanup, func() { os.RemoveAll(dir) })
+	st, err := store.NewStore(dir, "", 1, nil)
+	if err != nil {
+		ts.close()
+		t.Fatal(err)
+	}
+	resolve := func(image string) ([]server.Location, error) {
+		if strings.Contains(image, " ") {
+			return nil, fmt.Errorf("invalid image %q", image)
+		}
+		image = strings.TrimPrefix(image, "docker.io/")
+		if !strings.Contains(image, "/") {
+			image = "library/" + image
+		}
+		return []server.Location{{
+			Name: "docker.io/" + image,
+			Repo: image,
+			Connect: func(creds registryclient.Credentials) (source.Source, error) {
+				ts.lock.Lock()
+				defer ts.lock.Unlock()
+				ts.creds = append(ts.creds, creds)
+				return ts.src, nil
+			},
+		}}, nil
+	}
+	listener := bufconn.Listen(1024 * 1024)
+	grpcServer := grpc.NewServer()
+	NewImageService(st, resolve, nil).Register(grpcServer)
+	go grpcServer.Serve(listener)
+	ts.cleanup = append(ts.cleanup, grpcServer.Stop)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+			return listener.Dial()
+		}))
+	if err != nil {
+		ts.close()
+		t.Fatal(err)
+	}
+	ts.cleanup = append(ts.cleanup, func() { conn.Close() })
+	ts.client = runtimeapi.NewImageServiceClient(conn)
+	return ts
+}
+
+func (ts *testService) close() {
+	for i := len(ts.cleanup) - 1; i >= 0; i-- {
+		ts.cleanup[i]()
+	}
+}
+
+func (ts *testService) pull(t *testing.T, image string, auth *runtimeapi.AuthConfig) string {
+	resp, err := ts.client.PullImage(context.Background(), &runtimeapi.PullImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+		Auth:  auth,
+	})
+	if err != nil {
+		t.Fatalf("pulling %s: %v", image, err)
+	}
+	return resp.ImageRef
+}
+
+func (ts *testService) status(t *testing.T, image string) *runtimeapi.Image {
+	resp, err := ts.client.ImageStatus(context.Background(), &runtimeapi.ImageStatusRequest{
+		Image: &runtimeapi.ImageSpec{Image: image},
+	})
+	if err != nil {
+		t.Fatalf("getting status of %s: %v", image, err)
+	}
+	return resp.Image
+}
+
+func TestImageService(t *testing.T) {
+	ts := newTestService(t)
+	defer ts.close()
+	dgst := ts.src.addImage(t, "library/alpine", "3.6", "1000")
+	ts.src.addImage(t, "library/busybox", "latest", "nobody")
+	ctx := context.Background()
+
+	id := ts.pull(t, "alpine:3.6", nil)
+	if !strings.HasPrefix(id, "sha256:") {
+		t.Errorf("unexpected image ref %q", id)
+	}
+	ts.pull(t, "busybox", nil)
+
+	img := ts.status(t, "alpine:3.6")
+	if img == nil {
+		t.Fatalf("alpine:3.6 not found")
+	}
+	if img.Id != id {
+		t.Errorf("expected ID %s, got %s", id, img.Id)
+	}
+	tag := "docker.io/library/alpine:3.6"
+	if len(img.RepoTags) != 1 || img.RepoTags[0] != tag {
+		t.Errorf("expected repo tags [%s], got %v", tag, img.RepoTags)
+	}
+	pinned := "docker.io/library/alpine@" + dgst.String()
+	if len(img.RepoDigests) != 1 || img.RepoDigests[0] != pinned {
+		t.Errorf("expected repo digests [%s], got %v", pinned, img.RepoDigests)
+	}
+	if img.Uid.GetValue() != 1000 || img.Username != "" {
+		t.Errorf("expected UID 1000, got %v, user %q", img.Uid, img.Username)
+	}
+	if img.Size_ == 0 {
+		t.Errorf("missing image size")
+	}
+	names := []string{id, strings.TrimPrefix(id, "sha256:"), tag, pinned}
+	for _, name := range names {
+		found := ts.status(t, name)
+		if found == nil || found.Id != id {
+			t.Errorf("image status of %s: expected %s, got %v", name, id, found)
+		}
+	}
+	if user := ts.status(t, "busybox").GetUsername(); user != "nobody" {
+		t.Errorf("expected user nobody, got %q", user)
+	}
+	if found := ts.status(t, "alpine:latest"); found != nil {
+		t.Errorf("expected no image for alpine:latest, got %v", found)
+	}
+
+	list, err := ts.client.ListImages(ctx, &runtimeapi.ListImagesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Images) != 2 {
+		t.Errorf("expected 2 images, got %v", list.Images)
+	}
+	list, err = ts.client.ListImages(ctx, &runtimeapi.ListImagesRequest{
+		Filter: &runtimeapi.ImageFilter{
+			Image: &runtimeapi.ImageSpec{Image: "alpine:3.6"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Images) != 1 || list.Images[0].Id != id {
+		t.Errorf("expected only alpine:3.6, got %v", list.Images)
+	}
+
+	fsInfo, err := ts.client.ImageFsInfo(ctx, &runtimeapi.ImageFsInfoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fsInfo.ImageFilesystems) != 1 ||
+		fsInfo.ImageFilesystems[0].UsedBytes.GetValue() == 0 ||
+		fsInfo.ImageFilesystems[0].InodesUsed.GetValue() == 0 {
+		t.Errorf("unexpected filesystem info %v", fsInfo.ImageFilesystems)
+	}
+
+	_, err = ts.client.RemoveImage(ctx, &runtimeapi.RemoveImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: id},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := ts.status(t, "alpine:3.6"); found != nil {
+		t.Errorf("expected alpine:3.6 to be removed, got %v", found)
+	}
+	// Removing an image that is not in the store is not an error.
+	_, err = ts.client.RemoveImage(ctx, &runtimeapi.RemoveImageRequest{
+		Image: &runtimeapi.ImageSpec{Image: "alpine:3.6"},
+	})
+	if err != nil {
+		t.Errorf("removing missing image: %v", err)
+	}
+	if ts.status(t, "busybox") == nil {
+		t.Errorf("busybox removed along with alpine:3.6")
+	}
+}
+
+func TestPullImageErrors(t *testing.T) {
+	ts := newTestService(t)
+	defer ts.close()
+	testCases := []string{"", "not found", "library/missing:latest"}
+	for _, image := range testCases {
+		_, err := ts.client.PullImage(context.Background(), &runtimeapi.PullImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: image},
+		})
+		if err == nil {
+			t.Errorf("pulling %q: expected error", image)
+		}
+	}
+}
+
+func TestPullImageCredentials(t *testing.T) {
+	testCases := []struct {
+		name     string
+		auth     *runtimeapi.AuthConfig
+		expected registryclient.Credentials
+		invalid  bool
+	}{
+		{
+			name: "no auth",
+		},
+		{
+			name: "username and password",
+			auth: &runtimeapi.AuthConfig{
+				Username: "user",
+				Password: "secret",
+			},
+			expected: registryclient.Credentials{
+				Username: "user",
+				Password: "secret",
+			},
+		},
+		{
+			name: "auth",
+			auth: &runtimeapi.AuthConfig{
+				Auth: base64.StdEncoding.EncodeToString([]byte("user:se:cret")),
+			},
+			expected: registryclient.Credentials{
+				Username: "user",
+				Password: "se:cret",
+			},
+		},
+		{
+			name: "username takes precedence over auth",
+			auth: &runtimeapi.AuthConfig{
+				Username: "user",
+				Password: "secret",
+				Auth:     base64.StdEncoding.EncodeToString([]byte("other:pass")),
+			},
+			expected: registryclient.Credentials{
+				Username: "user",
+				Password: "secret",
+			},
+		},
+		{
+			name: "tokens",
+			auth: &runtimeapi.AuthConfig{
+				IdentityToken: "identity",
+				RegistryToken: "registry",
+			},
+			expected: registryclient.Credentials{
+				IdentityToken: "identity",
+				RegistryToken: "registry",
+			},
+		},
+		{
+			name: "invalid base64",
+			auth: &runtimeapi.AuthConfig{
+				Auth: "not base64!",
+			},
+			invalid: true,
+		},
+		{
+			name: "auth without password",
+			auth: &runtimeapi.AuthConfig{
+				Auth: base64.StdEncoding.EncodeToString([]byte("user")),
+			},
+			invalid: true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTestService(t)
+			defer ts.close()
+			ts.src.addImage(t, "library/alpine", "3.6", "root")
+			_, err := ts.client.PullImage(context.Background(), &runtimeapi.PullImageRequest{
+				Image: &runtimeapi.ImageSpec{Image: "alpine:3.6"},
+				Auth:  tc.auth,
+			})
+			if tc.invalid {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				if len(ts.creds) != 0 {
+					t.Errorf("connected with invalid credentials %v", ts.creds)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ts.creds) != 1 || ts.creds[0] != tc.expected {
+				t.Errorf("expected credentials %+v, got %+v", tc.expected, ts.creds)
+			}
+		})
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	ts := newTestService(t)
+	defer ts.close()
+	dgst := ts.src.addImage(t, "library/alpine", "3.6", "")
+	ts.src.manifests["library/alpine:3"] = ts.src.manifests["library/alpine:3.6"]
+	ctx := context.Background()
+	remove := func(image string) {
+		_, err := ts.client.RemoveImage(ctx, &runtimeapi.RemoveImageRequest{
+			Image: &runtimeapi.ImageSpec{Image: image},
+		})
+		if err != nil {
+			t.Fatalf("removing %s: %v", image, err)
+		}
+	}
+	testCases := []struct {
+		image   string
+		removed []string
+		kept    []string
+	}{
+		{"alpine:3", []string{"alpine:3"}, []string{"alpine:3.6"}},
+		{"docker.io/library/alpine:3.6", []string{"alpine:3.6"}, []string{"alpine:3"}},
+		{"alpine@" + dgst.String(), []string{"alpine:3", "alpine:3.6"}, nil},
+		{"id", []string{"alpine:3", "alpine:3.6"}, nil},
+	}
+	for _, tc := range testCases {
+		id := ts.pull(t, "alpine:3", nil)
+		ts.pull(t, "alpine:3.6", nil)
+		image := tc.image
+		if image == "id" {
+			image = id
+		}
+		remove(image)
+		for _, name := range tc.removed {
+			if found := ts.status(t, name); found != nil {
+				t.Errorf("%s: expected %s to be removed, got %v", tc.image, name, found)
+			}
+		}
+		for _, name := range tc.kept {
+			found := ts.status(t, name)
+			if found == nil {
+				t.Errorf("%s: expected %s to be kept", tc.image, name)
+				continue
+			}
+			tag := "docker.io/library/" + name
+			if len(found.RepoTags) != 1 || found.RepoTags[0] != tag {
+				t.Errorf("%s: expected repo tags [%s], got %v", tc.image, tag,
+					found.RepoTags)
+			}
+		}
+		remove(id)
+	}
+}
@@ -3,78 +3,323 @@ package manifest
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"path/filepath"
-	"strings"
+	"runtime"
 
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/ocischema"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
-	"github.com/elotl/tosi/pkg/registryclient"
-	"github.com/elotl/tosi/pkg/util"
+	"github.com/elotl/tosi/pkg/source"
 	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type Manifest struct {
-	Image      string
-	Tag        string
-	reg        *registryclient.RegistryClient
-	ManifestV1 *schema1.SignedManifest
-	ManifestV2 *schema2.DeserializedManifest
+	Image string
+	// Tag is the reference the manifest was pulled or loaded via, which is
+	// either a tag or a digest.
+	Tag string
+	// Digest is the digest of the manifest image:tag refers to. For
+	// multi-platform images, this is the digest of the manifest list or image
+	// index, not the one of the platform specific manifest.
+	Digest digest.Digest
+	src    source.Source
+	// The raw manifest list or image index for multi-platform images.
+	index []byte
+	// allowUnsigned allows schema1 manifests without signatures.
+	allowUnsigned bool
+	// The raw schema1 manifest, if it is not signed. Signed schema1
+	// manifests keep the raw JWS themselves.
+	unsignedV1 []byte
+	// The OCI image manifest and config a schema1 manifest has been
+	// converted into, see ConvertSchema1.
+	converted   *ocischema.DeserializedManifest
+	config      []byte
+	ManifestV1  *schema1.SignedManifest
+	ManifestV2  *schema2.DeserializedManifest
+	ManifestOCI *ocischema.DeserializedManifest
 }
 
-func Fetch(reg *registryclient.RegistryClient, image, tag string) (*Manifest, error) {
+// detectMediaType guesses the media type of a manifest, when it is not known,
+// e.g. when loading it from disk.
+func detectMediaType(buf []byte) string {
+	versioned := struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+	}{}
+	if err := json.Unmarshal(buf, &versioned); err != nil {
+		return ""
+	}
+	if versioned.SchemaVersion == 1 {
+		return schema1.MediaTypeSignedManifest
+	}
+	if versioned.MediaType != "" {
+		return versioned.MediaType
+	}
+	if versioned.Manifests != nil {
+		return v1.MediaTypeImageIndex
+	}
+	return v1.MediaTypeImageManifest
+}
+
+// selectPlatform returns the manifest for the current OS and architecture from
+// a manifest list or image index.
+func selectPlatform(list *manifestlist.DeserializedManifestList) (*manifestlist.ManifestDescriptor, error) {
+	for i, m := range list.Manifests {
+		if m.Platform.OS != runtime.GOOS ||
+			m.Platform.Architecture != runtime.GOARCH {
+			continue
+		}
+		return &list.Manifests[i], nil
+	}
+	return nil, fmt.Errorf("arch %q OS %q not found in manifest list",
+		runtime.GOARCH, runtime.GOOS)
+}
+
+func (m *Manifest) set(mediaType string, buf []byte) error {
+	if mediaType == "" || mediaType == "application/json" {
+		mediaType = detectMediaType(buf)
+	}
+	if mediaType == schema1.MediaTypeSignedManifest ||
+		mediaType == schema1.MediaTypeManifest {
+		sm, err := parseSchema1(buf, m.allowUnsigned)
+		if err != nil {
+			return err
+		}
+		if !hasSignatures(buf) {
+			m.unsignedV1 = buf
+		}
+		m.ManifestV1 = sm
+		return nil
+	}
+	mfest, _, err := distribution.UnmarshalManifest(mediaType, buf)
+	if err != nil {
+		return err
+	}
+	switch v := mfest.(type) {
+	case *schema2.DeserializedManifest:
+		m.ManifestV2 = v
+	case *ocischema.DeserializedManifest:
+		m.ManifestOCI = v
+	default:
+		return fmt.Errorf("unsupported manifest type %q", mediaType)
+	}
+	return nil
+}
+
+// New creates the manifest for image:tag from a raw platform specific manifest,
+// e.g. one created locally.
+func New(src source.Source, image, tag, mediaType string, payload []byte) (*Manifest, error) {
+	manifest := Manifest{
+		Image:  image,
+		Tag:    tag,
+		Digest: PayloadDigest(payload),
+		src:    src,
+	}
+	err := manifest.set(mediaType, payload)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s:%s manifest: %v", image, tag, err)
+	}
+	return &manifest, nil
+}
+
+// fetchIndex fetches the manifest for image:tag, verifying its digest if tag is
+// a digest. It returns the media type and the raw manifest, and the parsed
+// manifest list if it is a manifest list or an image index.
+func fetchIndex(src source.Source, image, tag string) (string, []byte, *manifestlist.DeserializedManifestList, error) {
+	mediaType, buf, err := src.Manifest(image, tag)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if mediaType == "" {
+		mediaType = detectMediaType(buf)
+	}
+	if dgst, err := digest.Parse(tag); err == nil {
+		// Pulled by digest, verify that we got the right manifest.
+		if err := dgst.Validate(); err != nil {
+			return "", nil, nil, err
+		}
+		if dgst.Algorithm().FromBytes(buf) != dgst && !isSchema1Digest(mediaType, buf, dgst) {
+			return "", nil, nil, fmt.Errorf(
+				"%s@%s: manifest digest mismatch, got %s",
+				image, tag, digest.FromBytes(buf))
+		}
+	}
+	glog.V(5).Infof("%s:%s manifest type %q digest %s",
+		image, tag, mediaType, digest.FromBytes(buf))
+	if mediaType != manifestlist.MediaTypeManifestList &&
+		mediaType != v1.MediaTypeImageIndex {
+		return mediaType, buf, nil, nil
+	}
+	list := manifestlist.DeserializedManifestList{}
+	err = list.UnmarshalJSON(buf)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return mediaType, buf, &list, nil
+}
+
+// fetchPlatform fetches the platform specific manifest desc from a manifest
+// list or image index, verifying its digest.
+func (m *Manifest) fetchPlatform(desc distribution.Descriptor) error {
+	mediaType, buf, err := m.src.Manifest(m.Image, desc.Digest.String())
+	if err != nil {
+		return err
+	}
+	if digest.FromBytes(buf) != desc.Digest {
+		return fmt.Errorf("%s:%s manifest %s: verifier failed",
+			m.Image, m.Tag, desc.Digest)
+	}
+	if mediaType == "" {
+		mediaType = desc.MediaType
+	}
+	return m.set(mediaType, buf)
+}
+
+// Fetch fetches the manifest for image:tag from src. For multi-platform
+// images, the manifest for the current platform is fetched too. The signatures
+// of schema1 manifests are verified, and unsigned schema1 manifests are
+// rejected, unless allowUnsigned is set.
+func Fetch(src source.Source, image, tag string, allowUnsigned bool) (*Manifest, error) {
 	manifest := Manifest{
-		Image: image,
-		Tag:   tag,
-		reg:   reg,
+		Image:         image,
+		Tag:           tag,
+		src:           src,
+		allowUnsigned: allowUnsigned,
 	}
-	manifestv2, err := reg.ManifestV2(image, tag)
+	mediaType, buf, list, err := fetchIndex(src, image, tag)
 	if err != nil {
-		glog.V(2).Infof("error retrieving v2 manifest: %v, trying v1", err)
+		return nil, err
 	}
-	if err != nil || manifestv2.Versioned.SchemaVersion == 1 {
-		// Old, v1 manifest.
-		manifestv1, err := reg.ManifestV1(image, tag)
+	manifest.Digest = PayloadDigest(buf)
+	if list != nil {
+		desc, err := selectPlatform(list)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %v", image, tag, err)
+		}
+		glog.V(2).Infof("%s:%s using manifest %s for %s/%s", image, tag,
+			desc.Digest, desc.Platform.OS, desc.Platform.Architecture)
+		manifest.index = buf
+		err = manifest.fetchPlatform(desc.Descriptor)
 		if err != nil {
 			return nil, err
 		}
-		manifest.ManifestV1 = manifestv1
+		return &manifest, nil
+	}
+	err = manifest.set(mediaType, buf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s:%s manifest: %v", image, tag, err)
 	}
-	manifest.ManifestV2 = manifestv2
 	return &manifest, nil
 }
 
-func Load(reg *registryclient.RegistryClient, dir, image, tag string) (*Manifest, error) {
+// FetchAll fetches the manifests for all platforms of image:tag. If image:tag
+// is not a multi-platform image, only its manifest is returned. Schema1
+// manifests are verified like via Fetch.
+func FetchAll(src source.Source, image, tag string, allowUnsigned bool) ([]*Manifest, error) {
+	mediaType, buf, list, err := fetchIndex(src, image, tag)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		manifest := Manifest{
+			Image:         image,
+			Tag:           tag,
+			Digest:        PayloadDigest(buf),
+			src:           src,
+			allowUnsigned: allowUnsigned,
+		}
+		err = manifest.set(mediaType, buf)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s:%s manifest: %v", image, tag, err)
+		}
+		return []*Manifest{&manifest}, nil
+	}
+	manifests := make([]*Manifest, 0, len(list.Manifests))
+	for _, desc := range list.Manifests {
+		manifest := Manifest{
+			Image:         image,
+			Tag:           tag,
+			Digest:        digest.FromBytes(buf),
+			src:           src,
+			index:         buf,
+			allowUnsigned: allowUnsigned,
+		}
+		glog.V(2).Infof("%s:%s fetching manifest %s for %s/%s", image, tag,
+			desc.Digest, desc.Platform.OS, desc.Platform.Architecture)
+		err = manifest.fetchPlatform(desc.Descriptor)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s manifest %s for %s/%s: %v", image,
+				tag, desc.Digest, desc.Platform.OS, desc.Platform.Architecture,
+				err)
+		}
+		manifests = append(manifests, &manifest)
+	}
+	return manifests, nil
+}
+
+// Load loads the manifest for image:tag from dir, verifying its digest. The
+// tag can also be a digest, in which case the manifest is found via its digest,
+// regardless of the tag or image name it was pulled via. For multi-platform
+// images, the manifest for the current platform is used. The signatures of
+// schema1 manifests are verified, but unsigned ones are accepted, since they
+// were allowed when they were fetched. If a schema1 manifest has been
+// converted, the converted manifest is loaded too.
+func Load(src source.Source, dir, image, tag string) (*Manifest, error) {
 	manifest := Manifest{
-		Image: image,
-		Tag:   tag,
-		reg:   reg,
+		Image:         image,
+		Tag:           tag,
+		src:           src,
+		allowUnsigned: true,
 	}
-	link := filepath.Join(dir, image+":"+tag)
 	glog.V(2).Infof("loading manifest for %s:%s from %s", image, tag, dir)
-	buf, err := ioutil.ReadFile(link)
+	dgst, err := digest.Parse(tag)
+	if err != nil {
+		link := filepath.Join(dir, image+":"+tag)
+		dgst, err = linkDigest(dir, link)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
 	}
-	v1 := schema1.SignedManifest{}
-	err = json.Unmarshal(buf, &v1)
-	if err == nil {
-		glog.V(5).Infof("%s:%s found v1 manifest", image, tag)
-		manifest.ManifestV1 = &v1
-		return &manifest, nil
+	buf, err := readBlob(dir, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
 	}
-	glog.V(5).Infof("%s:%s loading v1 manifest: %v, trying v2", image, tag, err)
-	v2 := schema2.DeserializedManifest{}
-	err = json.Unmarshal(buf, &v2)
-	if err == nil {
-		glog.V(5).Infof("%s:%s found v2 manifest", image, tag)
-		manifest.ManifestV2 = &v2
-		return &manifest, nil
+	manifest.Digest = dgst
+	mediaType := detectMediaType(buf)
+	if mediaType == manifestlist.MediaTypeManifestList ||
+		mediaType == v1.MediaTypeImageIndex {
+		list := manifestlist.DeserializedManifestList{}
+		err = list.UnmarshalJSON(buf)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
+		}
+		desc, err := selectPlatform(&list)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %v", image, tag, err)
+		}
+		manifest.index = buf
+		buf, err = readBlob(dir, desc.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
+		}
+		mediaType = desc.MediaType
+	}
+	err = manifest.set(mediaType, buf)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
+	}
+	if manifest.ManifestV1 != nil {
+		err = manifest.loadConverted(dir, PayloadDigest(buf))
+		if err != nil {
+			return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
+		}
 	}
-	glog.V(5).Infof("%s:%s loading v2 manifest: %v", image, tag, err)
-	return nil, fmt.Errorf("loading %s/%s:%s: %v", dir, image, tag, err)
+	return &manifest, nil
 }
 
 func (m *Manifest) v1Config() ([]byte, error) {
@@ -86,18 +331,40 @@ func (m *Manifest) v1Config() ([]byte, error) {
 }
 
 func (m *Manifest) v2Config() ([]byte, error) {
-	return m.reg.GetBlob(m.Image, m.ManifestV2.Config)
+	return m.src.GetBlob(m.Image, m.ManifestV2.Config)
+}
+
+func (m *Manifest) ociConfig() ([]byte, error) {
+	return m.src.GetBlob(m.Image, m.ManifestOCI.Config)
 }
 
 func (m *Manifest) Config() ([]byte, error) {
-	if m.ManifestV1 != nil {
+	if m.converted != nil {
+		return m.config, nil
+	} else if m.ManifestV1 != nil {
 		return m.v1Config()
 	} else if m.ManifestV2 != nil {
 		return m.v2Config()
+	} else if m.ManifestOCI != nil {
+		return m.ociConfig()
 	}
 	panic("no manifest available")
 }
 
+// ConfigDescriptor returns the descriptor of the config blob. Schema1
+// manifests have no config blob, in which case it returns false, unless they
+// have been converted.
+func (m *Manifest) ConfigDescriptor() (distribution.Descriptor, bool) {
+	if m.converted != nil {
+		return m.converted.Config, true
+	} else if m.ManifestV2 != nil {
+		return m.ManifestV2.Config, true
+	} else if m.ManifestOCI != nil {
+		return m.ManifestOCI.Config, true
+	}
+	return distribution.Descriptor{}, false
+}
+
 func (m *Manifest) v1Layers() []distribution.Descriptor {
 	v1refs := m.ManifestV1.References()
 	refs := make([]distribution.Descriptor, 0, len(v1refs))
@@ -123,76 +390,122 @@ func (m *Manifest) v2Layers() []distribution.Descriptor {
 	return m.ManifestV2.Layers
 }
 
+func (m *Manifest) ociLayers() []distribution.Descriptor {
+	return m.ManifestOCI.Layers
+}
+
 func (m *Manifest) Layers() []distribution.Descriptor {
-	if m.ManifestV1 != nil {
+	if m.converted != nil {
+		return m.converted.Layers
+	} else if m.ManifestV1 != nil {
 		return m.v1Layers()
 	} else if m.ManifestV2 != nil {
 		return m.v2Layers()
+	} else if m.ManifestOCI != nil {
+		return m.ociLayers()
 	}
 	panic("no manifest available")
 }
 
+// Schema1 manifests have no config blob, so their image IDs use the digest of
+// the manifest, until they are converted.
 func (m *Manifest) v1ID() string {
-	name := "v1:" + m.ManifestV1.Name + ":" + m.ManifestV1.Tag
-	return strings.ReplaceAll(name, "/", ":")
+	_, buf, _ := m.Payload()
+	return "v1:" + digest.FromBytes(buf).String()
 }
 
 func (m *Manifest) v2ID() string {
 	return "v2:" + m.ManifestV2.Config.Digest.String()
 }
 
+// Image IDs for OCI manifests use the same "v2:" prefix, since they are also
+// identified by their config digest.
+func (m *Manifest) ociID() string {
+	return "v2:" + m.ManifestOCI.Config.Digest.String()
+}
+
 func (m *Manifest) ID() string {
-	if m.ManifestV1 != nil {
+	if m.converted != nil {
+		return "v2:" + m.converted.Config.Digest.String()
+	} else if m.ManifestV1 != nil {
 		return m.v1ID()
 	} else if m.ManifestV2 != nil {
 		return m.v2ID()
+	} else if m.ManifestOCI != nil {
+		return m.ociID()
 	}
 	panic("no manifest available")
 }
 
-func (m *Manifest) Save(dir string) error {
-	var buf []byte
-	var err error
+// Payload returns the media type and the raw platform specific manifest. For
+// schema1 manifests, this is always the original manifest, even if it has been
+// converted.
+func (m *Manifest) Payload() (string, []byte, error) {
+	if m.unsignedV1 != nil {
+		return schema1.MediaTypeManifest, m.unsignedV1, nil
+	} else if m.ManifestV1 != nil {
+		return m.ManifestV1.Payload()
+	} else if m.ManifestV2 != nil {
+		return m.ManifestV2.Payload()
+	} else if m.ManifestOCI != nil {
+		return m.ManifestOCI.Payload()
+	}
+	panic("no manifest available")
+}
+
+// Index returns the media type and the raw manifest list or image index for
+// multi-platform images. It returns an empty payload for other images.
+func (m *Manifest) Index() (string, []byte) {
+	if m.index == nil {
+		return "", nil
+	}
+	return detectMediaType(m.index), m.index
+}
+
+// References returns the blobs the manifest refers to: the config, if the
+// manifest has one, and the layers.
+func (m *Manifest) References() []distribution.Descriptor {
 	if m.ManifestV1 != nil {
-		_, buf, err = m.ManifestV1.Payload()
-	} else {
-		_, buf, err = m.ManifestV2.Payload()
+		return m.v1Layers()
+	} else if m.ManifestV2 != nil {
+		return m.ManifestV2.References()
+	} else if m.ManifestOCI != nil {
+		return m.ManifestOCI.References()
+	}
+	panic("no manifest available")
+}
+
+// Save stores the manifest in dir, and creates a link with the image name
+// pointing to it, unless the manifest was pulled via a digest. For
+// multi-platform images, the manifest list or image index is saved too, and the
+// link points to it.
+func (m *Manifest) Save(dir string) error {
+	_, buf, err := m.Payload()
+	if err != nil {
+		return err
 	}
+	path, err := writeBlob(dir, buf)
 	if err != nil {
 		return err
 	}
-	// Save manifest if it does not exist.
-	fileName := m.ID()
-	path := filepath.Join(dir, fileName)
-	if _, err = os.Stat(path); err != nil {
-		err = os.MkdirAll(filepath.Dir(path), 0755)
+	if m.converted != nil {
+		err = m.saveConverted(dir, PayloadDigest(buf))
 		if err != nil {
 			return err
 		}
-		err = util.AtomicWriteFile(path, buf, 0644)
+	}
+	if m.index != nil {
+		path, err = writeBlob(dir, m.index)
 		if err != nil {
 			return err
 		}
 	}
+	if _, err := digest.Parse(m.Tag); err == nil {
+		// Manifests are found via their digest, no need for a link.
+		return nil
+	}
 	// Create a link with the image name pointing to the manifest. If the link
 	// already exists, it will be updated.
 	link := filepath.Join(dir, m.Image+":"+m.Tag)
-	linkDir := filepath.Dir(link)
-	err = os.MkdirAll(linkDir, 0755)
-	if err != nil {
-		return err
-	}
-	// Create a relative link, so that it does not depend on absolute paths.
-	// This helps if the cache is moved to new directory.
-	rel, err := filepath.Rel(linkDir, dir)
-	if err != nil {
-		return err
-	}
-	target := filepath.Join(rel, fileName)
-	_ = os.Remove(link)
-	err = os.Symlink(target, link)
-	if err != nil {
-		return err
-	}
-	return nil
+	return createLink(link, path)
 }
@@ -0,0 +1,127 @@
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/libtrust"
+	"github.com/opencontainers/go-digest"
+)
+
+// fakeSource serves manifests by image:reference.
+type fakeSource map[string][]byte
+
+func (f fakeSource) Manifest(image, reference string) (string, []byte, error) {
+	buf, ok := f[image+":"+reference]
+	if !ok {
+		return "", nil, fmt.Errorf("%s:%s not found", image, reference)
+	}
+	return schema1.MediaTypeSignedManifest, buf, nil
+}
+
+func (f fakeSource) Resolve(image, reference string) (distribution.Descriptor, error) {
+	return distribution.Descriptor{}, fmt.Errorf("not implemented")
+}
+
+func (f fakeSource) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (f fakeSource) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	return "", fmt.Errorf("not implemented")
+}
+
+// signedSchema1 returns a signed schema1 manifest for image:tag, and its
+// digest as used by registries.
+func signedSchema1(t *testing.T, image, tag string) ([]byte, digest.Digest) {
+	key, err := libtrust.GenerateECP256PrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := schema1.Manifest{
+		Versioned:    manifest.Versioned{SchemaVersion: 1},
+		Name:         image,
+		Tag:          tag,
+		Architecture: "amd64",
+		FSLayers: []schema1.FSLayer{
+			{BlobSum: digest.FromString("layer")},
+		},
+		History: []schema1.History{
+			{V1Compatibility: `{"id":"e45a5af57b00862e5ef5782a9925979a02ba2b12dff832fd0991335f4a11e5c5","os":"linux","architecture":"amd64"}`},
+		},
+	}
+	sm, err := schema1.Sign(&m, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := sm.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf, digest.FromBytes(sm.Canonical)
+}
+
+func TestSignedSchema1Digest(t *testing.T) {
+	image := "library/old"
+	buf, dgst := signedSchema1(t, image, "1.0")
+	if digest.FromBytes(buf) == dgst {
+		t.Fatalf("signatures not excluded from digest %s", dgst)
+	}
+	src := fakeSource{
+		image + ":1.0":              buf,
+		image + ":" + dgst.String(): buf,
+	}
+
+	mfest, err := Fetch(src, image, "1.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mfest.Digest != dgst {
+		t.Errorf("expected digest %s, got %s", dgst, mfest.Digest)
+	}
+	byDigest, err := Fetch(src, image, dgst.String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byDigest.Digest != dgst {
+		t.Errorf("expected digest %s, got %s", dgst, byDigest.Digest)
+	}
+	all, err := FetchAll(src, image, "1.0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Digest != dgst {
+		t.Errorf("expected one manifest with digest %s, got %v", dgst, all)
+	}
+
+	dir, err := ioutil.TempDir("", "tosi-manifest-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := mfest.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"1.0", dgst.String()} {
+		loaded, err := Load(src, dir, image, ref)
+		if err != nil {
+			t.Fatalf("loading %s:%s: %v", image, ref, err)
+		}
+		if loaded.Digest != dgst {
+			t.Errorf("%s:%s: expected digest %s, got %s", image, ref, dgst,
+				loaded.Digest)
+		}
+	}
+	stored, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].Digest != dgst {
+		t.Errorf("expected one stored manifest with digest %s, got %v", dgst, stored)
+	}
+}
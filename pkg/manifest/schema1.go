@@ -0,0 +1,296 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema1"
+	"github.com/docker/libtrust"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Schema1 manifests have no config blob. Once their layers are available, they
+// are converted into an OCI image manifest, with a config synthesized from
+// the v1Compatibility history of the manifest. The config is stored as a blob,
+// and dir/converted/<algorithm>/<encoded digest> links the schema1 manifest to
+// it.
+const (
+	convertedDir = "converted"
+)
+
+// ErrUnsignedSchema1 is returned for schema1 manifests without signatures,
+// unless they are explicitly allowed.
+var ErrUnsignedSchema1 = errors.New("schema1 manifest is not signed")
+
+// v1Compatibility is the legacy image config stored in the history of schema1
+// manifests, one for each layer.
+type v1Compatibility struct {
+	ID              string          `json:"id"`
+	Parent          string          `json:"parent,omitempty"`
+	Created         time.Time       `json:"created"`
+	Author          string          `json:"author,omitempty"`
+	Comment         string          `json:"comment,omitempty"`
+	Architecture    string          `json:"architecture,omitempty"`
+	OS              string          `json:"os,omitempty"`
+	Config          json.RawMessage `json:"config,omitempty"`
+	ThrowAway       bool            `json:"throwaway,omitempty"`
+	ContainerConfig struct {
+		Cmd []string `json:"Cmd"`
+	} `json:"container_config,omitempty"`
+}
+
+// hasSignatures returns true if the schema1 manifest buf is a JWS with
+// signatures.
+func hasSignatures(buf []byte) bool {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["signatures"]
+	return ok
+}
+
+// parseSchema1 parses the schema1 manifest buf, verifying its signatures.
+// Manifests without signatures are only accepted if allowUnsigned is set.
+func parseSchema1(buf []byte, allowUnsigned bool) (*schema1.SignedManifest, error) {
+	if !hasSignatures(buf) {
+		if !allowUnsigned {
+			return nil, ErrUnsignedSchema1
+		}
+		m := schema1.Manifest{}
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, err
+		}
+		glog.Warningf("using unsigned schema1 manifest %s", digest.FromBytes(buf))
+		return &schema1.SignedManifest{
+			Manifest:  m,
+			Canonical: buf,
+		}, nil
+	}
+	sm := &schema1.SignedManifest{}
+	if err := sm.UnmarshalJSON(buf); err != nil {
+		return nil, err
+	}
+	keys, err := schema1.Verify(sm)
+	if err != nil {
+		return nil, fmt.Errorf("verifying schema1 manifest signature: %v", err)
+	}
+	if len(keys) == 0 {
+		if !allowUnsigned {
+			return nil, ErrUnsignedSchema1
+		}
+		glog.Warningf("using unsigned schema1 manifest %s", digest.FromBytes(buf))
+	}
+	for _, key := range keys {
+		glog.V(2).Infof("schema1 manifest %s signed with key %s",
+			digest.FromBytes(buf), key.KeyID())
+	}
+	return sm, nil
+}
+
+// schema1Digest returns the digest registries use for the signed schema1
+// manifest buf, which is the digest of the manifest without its signatures.
+func schema1Digest(buf []byte) (digest.Digest, error) {
+	jsig, err := libtrust.ParsePrettySignature(buf, "signatures")
+	if err != nil {
+		return "", err
+	}
+	payload, err := jsig.Payload()
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(payload), nil
+}
+
+// PayloadDigest returns the digest registries use for the raw manifest buf,
+// which is also the key it is stored under in the manifest directory. For
+// signed schema1 manifests, it is the digest without the signatures, see
+// schema1Digest.
+func PayloadDigest(buf []byte) digest.Digest {
+	if hasSignatures(buf) && detectMediaType(buf) == schema1.MediaTypeSignedManifest {
+		if dgst, err := schema1Digest(buf); err == nil {
+			return dgst
+		}
+	}
+	return digest.FromBytes(buf)
+}
+
+// v1History returns the history of the schema1 manifest, from the oldest to
+// the newest entry, along with the layer of each entry.
+func (m *Manifest) v1History() ([]v1Compatibility, []distribution.Descriptor, error) {
+	sm := m.ManifestV1
+	if len(sm.History) != len(sm.FSLayers) {
+		return nil, nil, fmt.Errorf("schema1 manifest has %d history entries for %d layers",
+			len(sm.History), len(sm.FSLayers))
+	}
+	if len(sm.History) == 0 {
+		return nil, nil, fmt.Errorf("no config found")
+	}
+	history := make([]v1Compatibility, 0, len(sm.History))
+	layers := make([]distribution.Descriptor, 0, len(sm.FSLayers))
+	for i := len(sm.History) - 1; i >= 0; i-- {
+		h := v1Compatibility{}
+		err := json.Unmarshal([]byte(sm.History[i].V1Compatibility), &h)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing history entry %d: %v", i, err)
+		}
+		history = append(history, h)
+		layers = append(layers, distribution.Descriptor{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Digest:    sm.FSLayers[i].BlobSum,
+		})
+	}
+	return history, layers, nil
+}
+
+// ConvertSchema1 converts a schema1 manifest into an OCI image manifest with
+// the same layers, synthesizing its config from the v1Compatibility history.
+// Empty layers marked as throwaway in the history are dropped. The function
+// diffID returns the diff ID of a layer, so the layers need to be available.
+// Once converted, the config, layers and ID of the manifest are the ones of the
+// OCI image manifest, while Payload still returns the schema1 manifest.
+func (m *Manifest) ConvertSchema1(diffID func(distribution.Descriptor) (digest.Digest, error)) error {
+	if m.ManifestV1 == nil {
+		return fmt.Errorf("%s:%s is not a schema1 image", m.Image, m.Tag)
+	}
+	history, layers, err := m.v1History()
+	if err != nil {
+		return fmt.Errorf("converting %s:%s: %v", m.Image, m.Tag, err)
+	}
+	latest := history[len(history)-1]
+	img := v1.Image{
+		Created:      &latest.Created,
+		Author:       latest.Author,
+		Architecture: latest.Architecture,
+		OS:           latest.OS,
+		RootFS: v1.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{},
+		},
+	}
+	if img.Architecture == "" {
+		img.Architecture = m.ManifestV1.Architecture
+	}
+	if img.OS == "" {
+		img.OS = "linux"
+	}
+	if len(latest.Config) > 0 && string(latest.Config) != "null" {
+		err = json.Unmarshal(latest.Config, &img.Config)
+		if err != nil {
+			return fmt.Errorf("converting %s:%s: parsing config: %v",
+				m.Image, m.Tag, err)
+		}
+	}
+	for i, h := range history {
+		created := h.Created
+		img.History = append(img.History, v1.History{
+			Created:    &created,
+			CreatedBy:  strings.Join(h.ContainerConfig.Cmd, " "),
+			Author:     h.Author,
+			Comment:    h.Comment,
+			EmptyLayer: h.ThrowAway,
+		})
+		if h.ThrowAway {
+			continue
+		}
+		id, err := diffID(layers[i])
+		if err != nil {
+			return fmt.Errorf("converting %s:%s: layer %s: %v",
+				m.Image, m.Tag, layers[i].Digest, err)
+		}
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, id)
+	}
+	config, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	return m.setConverted(config)
+}
+
+// setConverted sets the OCI image manifest the schema1 manifest is converted
+// into, with the synthesized config.
+func (m *Manifest) setConverted(config []byte) error {
+	history, layers, err := m.v1History()
+	if err != nil {
+		return err
+	}
+	img := v1.Image{}
+	if err := json.Unmarshal(config, &img); err != nil {
+		return fmt.Errorf("parsing converted config: %v", err)
+	}
+	converted := ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Size:      int64(len(config)),
+			Digest:    digest.FromBytes(config),
+		},
+	}
+	for i, h := range history {
+		if !h.ThrowAway {
+			converted.Layers = append(converted.Layers, layers[i])
+		}
+	}
+	if len(converted.Layers) != len(img.RootFS.DiffIDs) {
+		return fmt.Errorf("converted config has %d diff IDs for %d layers",
+			len(img.RootFS.DiffIDs), len(converted.Layers))
+	}
+	deserialized, err := ocischema.FromStruct(converted)
+	if err != nil {
+		return err
+	}
+	m.converted = deserialized
+	m.config = config
+	return nil
+}
+
+// convertedLink returns the link to the config of the converted schema1
+// manifest dgst.
+func convertedLink(dir string, dgst digest.Digest) string {
+	return filepath.Join(
+		dir, convertedDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// saveConverted saves the config of the converted schema1 manifest dgst in
+// dir.
+func (m *Manifest) saveConverted(dir string, dgst digest.Digest) error {
+	path, err := writeBlob(dir, m.config)
+	if err != nil {
+		return err
+	}
+	return createLink(convertedLink(dir, dgst), path)
+}
+
+// loadConverted loads the config of the converted schema1 manifest dgst from
+// dir, if it has already been converted.
+func (m *Manifest) loadConverted(dir string, dgst digest.Digest) error {
+	configDigest, err := linkDigest(dir, convertedLink(dir, dgst))
+	if err != nil {
+		glog.V(2).Infof("schema1 manifest %s has not been converted: %v",
+			dgst, err)
+		return nil
+	}
+	config, err := readBlob(dir, configDigest)
+	if err != nil {
+		return err
+	}
+	return m.setConverted(config)
+}
+
+// isSchema1Digest returns true if buf is a signed schema1 manifest, and dgst is
+// its digest as used by registries.
+func isSchema1Digest(mediaType string, buf []byte, dgst digest.Digest) bool {
+	if mediaType != schema1.MediaTypeSignedManifest || dgst.Algorithm() != digest.SHA256 {
+		return false
+	}
+	canonical, err := schema1Digest(buf)
+	return err == nil && canonical == dgst
+}
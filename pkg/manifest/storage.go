@@ -0,0 +1,472 @@
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Manifests are stored in dir/blobs/<algorithm>/<encoded digest>, using the
+// exact payload received from the source, so they can be verified via their
+// digest. Image names, e.g. dir/library/alpine:3.6, are relative symlinks
+// pointing to the manifest blob the tag refers to. For multi-platform images,
+// this is the manifest list or image index, and the platform specific
+// manifest is stored as a blob too.
+const (
+	blobsDir = "blobs"
+	// layoutFile records the version of the layout of dir, so manifests are
+	// only migrated once. Directories without it might have been created by
+	// previous versions.
+	layoutFile    = ".layout"
+	layoutVersion = "1"
+)
+
+func blobPath(dir string, dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(
+		dir, blobsDir, dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+// writeBlob saves the manifest payload buf into dir, and returns the path to
+// the blob file.
+func writeBlob(dir string, buf []byte) (string, error) {
+	dgst := PayloadDigest(buf)
+	path, err := blobPath(dir, dgst)
+	if err != nil {
+		return "", err
+	}
+	if _, err := readBlob(dir, dgst); err == nil {
+		return path, nil
+	} else if util.PathExists(path) {
+		glog.Warningf("replacing invalid manifest %s: %v", path, err)
+		os.Remove(path)
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return "", err
+	}
+	err = util.AtomicWriteFile(path, buf, 0644)
+	if err != nil && !util.PathExists(path) {
+		return "", err
+	}
+	return path, nil
+}
+
+// readBlob reads the manifest with the digest dgst from dir, verifying its
+// content.
+func readBlob(dir string, dgst digest.Digest) ([]byte, error) {
+	path, err := blobPath(dir, dgst)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Signed schema1 manifests might also be stored under the digest of
+	// their full content.
+	if PayloadDigest(buf) != dgst && digest.FromBytes(buf) != dgst {
+		return nil, fmt.Errorf("manifest %s: verifier failed", path)
+	}
+	return buf, nil
+}
+
+// linkDigest returns the digest of the manifest blob the link points to.
+func linkDigest(dir, link string) (digest.Digest, error) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(link), target)
+	}
+	rel, err := filepath.Rel(filepath.Join(dir, blobsDir), target)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 2 {
+		return "", fmt.Errorf("%s does not point to a manifest blob", link)
+	}
+	dgst := digest.NewDigestFromEncoded(digest.Algorithm(parts[0]), parts[1])
+	if err := dgst.Validate(); err != nil {
+		return "", fmt.Errorf("%s: %v", link, err)
+	}
+	return dgst, nil
+}
+
+// createLink creates or updates link, pointing to the manifest blob path.
+func createLink(link, path string) error {
+	linkDir := filepath.Dir(link)
+	err := os.MkdirAll(linkDir, 0755)
+	if err != nil {
+		return err
+	}
+	// Create a relative link, so that it does not depend on absolute paths.
+	// This helps if the cache is moved to new directory.
+	target, err := filepath.Rel(linkDir, path)
+	if err != nil {
+		return err
+	}
+	// Replace the link atomically.
+	tmpLink := filepath.Join(linkDir, "."+filepath.Base(link))
+	_ = os.Remove(tmpLink)
+	err = os.Symlink(target, tmpLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpLink, link)
+	if err != nil {
+		os.Remove(tmpLink)
+		return err
+	}
+	return nil
+}
+
+// isLegacyManifest returns true for manifest files created by previous
+// versions, which were named after the image ID, e.g. v2:sha256:<hex>.
+func isLegacyManifest(name string) bool {
+	return strings.HasPrefix(name, "v1:") || strings.HasPrefix(name, "v2:")
+}
+
+// Migrate converts manifests in dir saved by previous versions, which were
+// stored using the image ID as the file name, into manifest blobs, and updates
+// image links to point to the blobs. Once done, the layout version is saved in
+// dir, and later calls return right away.
+func Migrate(dir string) error {
+	path := filepath.Join(dir, layoutFile)
+	buf, err := ioutil.ReadFile(path)
+	if err == nil {
+		version := strings.TrimSpace(string(buf))
+		if version != layoutVersion {
+			return fmt.Errorf("unsupported manifest layout version %q in %s",
+				version, dir)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	err = migrate(dir)
+	if err != nil {
+		return err
+	}
+	return util.AtomicWriteFile(path, []byte(layoutVersion+"\n"), 0644)
+}
+
+// migrate converts the manifests and image links in dir, see Migrate.
+func migrate(dir string) error {
+	legacy := []string{}
+	links := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(dir, blobsDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if _, err := linkDigest(dir, path); err != nil {
+				links = append(links, path)
+			}
+		} else if filepath.Dir(path) == dir && isLegacyManifest(info.Name()) {
+			legacy = append(legacy, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, link := range links {
+		glog.Infof("migrating manifest %s", link)
+		buf, err := ioutil.ReadFile(link)
+		if err != nil {
+			// Dangling link, nothing to migrate.
+			glog.Warningf("removing invalid manifest link %s: %v", link, err)
+			os.Remove(link)
+			continue
+		}
+		path, err := writeBlob(dir, buf)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %v", link, err)
+		}
+		err = createLink(link, path)
+		if err != nil {
+			return fmt.Errorf("migrating %s: %v", link, err)
+		}
+	}
+	for _, path := range legacy {
+		glog.V(2).Infof("removing legacy manifest %s", path)
+		os.Remove(path)
+	}
+	return nil
+}
+
+// links returns the image links in dir, e.g. library/alpine:3.6, and the
+// digests of the manifest blobs they point to.
+func links(dir string) (map[string]digest.Digest, error) {
+	result := make(map[string]digest.Digest)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == filepath.Join(dir, blobsDir) ||
+				path == filepath.Join(dir, convertedDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		dgst, err := linkDigest(dir, path)
+		if err != nil {
+			glog.Warningf("invalid manifest link %s: %v", path, err)
+			return nil
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		result[filepath.ToSlash(name)] = dgst
+		return nil
+	})
+	return result, err
+}
+
+// blobs returns the digests of the manifest blobs in dir.
+func blobs(dir string) ([]digest.Digest, error) {
+	result := []digest.Digest{}
+	root := filepath.Join(dir, blobsDir)
+	algorithms, err := ioutil.ReadDir(root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, algorithm := range algorithms {
+		files, err := ioutil.ReadDir(filepath.Join(root, algorithm.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			dgst := digest.NewDigestFromEncoded(
+				digest.Algorithm(algorithm.Name()), f.Name())
+			if dgst.Validate() == nil {
+				result = append(result, dgst)
+			}
+		}
+	}
+	return result, nil
+}
+
+// Stored is an image stored in dir: a platform specific manifest, or a manifest
+// list or image index, and the image names linking to it.
+type Stored struct {
+	Digest digest.Digest
+	// Names are the image names, e.g. library/alpine:3.6. Images pulled via
+	// a digest have no names.
+	Names []string
+}
+
+// children returns the blobs in all that are part of other blobs: the platform
+// specific manifests of manifest lists and image indexes, and the configs of
+// converted schema1 manifests.
+func children(dir string, all []digest.Digest) map[digest.Digest]bool {
+	result := make(map[digest.Digest]bool)
+	for _, dgst := range all {
+		if config, err := linkDigest(dir, convertedLink(dir, dgst)); err == nil {
+			result[config] = true
+		}
+		buf, err := readBlob(dir, dgst)
+		if err != nil {
+			glog.Warningf("%v", err)
+			continue
+		}
+		mediaType := detectMediaType(buf)
+		if mediaType != manifestlist.MediaTypeManifestList &&
+			mediaType != v1.MediaTypeImageIndex {
+			continue
+		}
+		list := manifestlist.DeserializedManifestList{}
+		if err := list.UnmarshalJSON(buf); err != nil {
+			glog.Warningf("manifest %s: %v", dgst, err)
+			continue
+		}
+		for _, m := range list.Manifests {
+			result[m.Digest] = true
+		}
+	}
+	return result
+}
+
+// List returns the images stored in dir. The platform specific manifests of
+// multi-platform images and the configs of converted schema1 manifests are
+// not listed separately.
+func List(dir string) ([]Stored, error) {
+	names, err := links(dir)
+	if err != nil {
+		return nil, err
+	}
+	all, err := blobs(dir)
+	if err != nil {
+		return nil, err
+	}
+	children := children(dir, all)
+	images := []Stored{}
+	byDigest := make(map[digest.Digest]int)
+	for _, dgst := range all {
+		if children[dgst] {
+			continue
+		}
+		byDigest[dgst] = len(images)
+		images = append(images, Stored{
+			Digest: dgst,
+			Names:  []string{},
+		})
+	}
+	for name, dgst := range names {
+		i, ok := byDigest[dgst]
+		if !ok {
+			continue
+		}
+		images[i].Names = append(images[i].Names, name)
+	}
+	for i := range images {
+		sort.Strings(images[i].Names)
+	}
+	return images, nil
+}
+
+// removeBlob removes the manifest blob dgst from dir, along with the link to
+// its converted config if it is a converted schema1 manifest.
+func removeBlob(dir string, dgst digest.Digest) error {
+	path, err := blobPath(dir, dgst)
+	if err != nil {
+		return err
+	}
+	glog.V(2).Infof("removing manifest %s", path)
+	os.Remove(convertedLink(dir, dgst))
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// RemoveDigest removes the manifest dgst from dir, along with all links
+// pointing to it, and the blobs that were only part of it, e.g. platform
+// specific manifests.
+func RemoveDigest(dir string, dgst digest.Digest) error {
+	names, err := links(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := readBlob(dir, dgst); err != nil {
+		return fmt.Errorf("%s not found: %v", dgst, err)
+	}
+	for name, target := range names {
+		if target == dgst {
+			glog.V(2).Infof("removing %s", name)
+			os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+			delete(names, name)
+		}
+	}
+	return removeTree(dir, dgst, names)
+}
+
+// Remove removes image:tag from dir. If tag is a digest, all links pointing to
+// the manifest are removed too, see RemoveDigest. Otherwise, the manifest is
+// removed unless other links point to it, along with the blobs that were only
+// part of it.
+func Remove(dir, image, tag string) error {
+	if dgst, err := digest.Parse(tag); err == nil {
+		return RemoveDigest(dir, dgst)
+	}
+	names, err := links(dir)
+	if err != nil {
+		return err
+	}
+	name := image + ":" + tag
+	dgst, ok := names[name]
+	if !ok {
+		return fmt.Errorf("%s not found", name)
+	}
+	err = os.Remove(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	delete(names, name)
+	for _, target := range names {
+		if target == dgst {
+			return nil
+		}
+	}
+	return removeTree(dir, dgst, names)
+}
+
+// removeTree removes the manifest blob dgst from dir, and the blobs that were
+// part of it, unless they are linked via names or part of other blobs.
+func removeTree(dir string, dgst digest.Digest, names map[string]digest.Digest) error {
+	all, err := blobs(dir)
+	if err != nil {
+		return err
+	}
+	before := children(dir, all)
+	if err := removeBlob(dir, dgst); err != nil {
+		return err
+	}
+	all, err = blobs(dir)
+	if err != nil {
+		return err
+	}
+	after := children(dir, all)
+	linked := make(map[digest.Digest]bool)
+	for _, target := range names {
+		linked[target] = true
+	}
+	for child := range before {
+		if after[child] || linked[child] || child == dgst {
+			continue
+		}
+		if err := removeBlob(dir, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Prune removes the manifest blobs in dir not in keep, and returns the number
+// of blobs removed.
+func Prune(dir string, keep map[digest.Digest]bool) (int, error) {
+	all, err := blobs(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, dgst := range all {
+		if keep[dgst] {
+			continue
+		}
+		if err := removeBlob(dir, dgst); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,155 @@
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/ldx/docker-registry-client/registry"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tosi"
+
+// Results of pulls, and of looking up layers in the cache.
+const (
+	ResultPulled = "pulled"
+	ResultCached = "cached"
+	ResultFailed = "failed"
+	ResultHit    = "hit"
+	ResultMiss   = "miss"
+)
+
+// Operations failures are counted for.
+const (
+	OperationPull     = "pull"
+	OperationDownload = "download"
+	OperationUnpack   = "unpack"
+)
+
+var (
+	// Pulls counts image pulls by result: pulled, cached if the image was
+	// pinned to a digest and already in the store, or failed.
+	Pulls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pulls_total",
+		Help:      "Number of image pulls, by result.",
+	}, []string{"result"})
+	// PullDuration is the duration of successful image pulls.
+	PullDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "pull_duration_seconds",
+		Help:      "Duration of successful image pulls.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 14),
+	})
+	// LayerCache counts the layers of pulled images found in the cache
+	// (hit), or downloaded (miss).
+	LayerCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "layer_cache_total",
+		Help:      "Number of layers looked up in the cache when pulling images, by result.",
+	}, []string{"result"})
+	// DownloadedBytes is the size of the blobs downloaded from registries.
+	DownloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "downloaded_bytes_total",
+		Help:      "Number of bytes of blobs downloaded from registries.",
+	})
+	// DownloadDuration is the duration of blob downloads from registries.
+	DownloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "blob_download_duration_seconds",
+		Help:      "Duration of successful blob downloads from registries.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 14),
+	})
+	// UnpackDuration is the duration of unpacking layers.
+	UnpackDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "layer_unpack_duration_seconds",
+		Help:      "Duration of successfully unpacking layers.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	})
+	// Failures counts failed operations, by operation and reason, see
+	// Reason.
+	Failures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "failures_total",
+		Help:      "Number of failed pulls, blob downloads and layer unpacks, by reason.",
+	}, []string{"operation", "reason"})
+	// RegistryResponses counts the HTTP responses of registries and their
+	// token servers, including the ones of retried requests.
+	RegistryResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "registry_responses_total",
+		Help:      "Number of HTTP responses from registries, by host, method and status code.",
+	}, []string{"host", "method", "code"})
+)
+
+// Registry has the tosi metrics, without the ones of the Go runtime and the
+// process, so it can be written to a textfile collector file.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(Pulls, PullDuration, LayerCache, DownloadedBytes,
+		DownloadDuration, UnpackDuration, Failures, RegistryResponses)
+}
+
+// Handler returns the HTTP handler serving the metrics, along with the ones of
+// the Go runtime and the process.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(
+		prometheus.Gatherers{Registry, prometheus.DefaultGatherer},
+		promhttp.HandlerOpts{})
+}
+
+// WriteTextfile writes the metrics to path in the text format, e.g. for the
+// textfile collector of the node exporter. The file is replaced atomically.
+func WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, Registry)
+}
+
+// Reason classifies err for the reason label of Failures, keeping the number
+// of label values small.
+func Reason(err error) string {
+	if merr, ok := err.(*multierror.Error); ok && len(merr.Errors) > 0 {
+		err = merr.Errors[0]
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if statusErr, ok := err.(*registry.HttpStatusError); ok {
+		switch code := statusErr.Response.StatusCode; {
+		case code == http.StatusUnauthorized || code == http.StatusForbidden:
+			return "unauthorized"
+		case code == http.StatusNotFound:
+			return "not_found"
+		case code == http.StatusTooManyRequests:
+			return "rate_limited"
+		case code >= 500:
+			return "server_error"
+		}
+		return "http_error"
+	}
+	if netErr, ok := err.(net.Error); ok {
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		err = pathErr.Err
+	} else if linkErr, ok := err.(*os.LinkError); ok {
+		err = linkErr.Err
+	}
+	switch err {
+	case syscall.ENOSPC:
+		return "no_space"
+	case syscall.EACCES, syscall.EPERM:
+		return "permission"
+	}
+	return "other"
+}
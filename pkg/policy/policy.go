@@ -0,0 +1,311 @@
+package policy
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/elotl/tosi/pkg/signature"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// Requirement types.
+const (
+	// TypeInsecureAcceptAnything accepts any image.
+	TypeInsecureAcceptAnything = "insecureAcceptAnything"
+	// TypeReject rejects all images.
+	TypeReject = "reject"
+	// TypeSignedBy requires a cosign signature created with one of the keys
+	// of the requirement.
+	TypeSignedBy = "signedBy"
+	// TypeSigstoreSigned is the same as TypeSignedBy.
+	TypeSigstoreSigned = "sigstoreSigned"
+	// TypePinnedDigest requires images to be pulled via a digest, and, if
+	// the requirement lists digests, the digest to be one of them.
+	TypePinnedDigest = "pinnedDigest"
+)
+
+// TransportDocker is the transport of images pulled from registries. Scopes
+// for other transports, e.g. oci, are paths.
+const TransportDocker = "docker"
+
+// Requirement is a requirement images need to satisfy.
+type Requirement struct {
+	Type string `json:"type"`
+	// KeyType is the type of the keys for signedBy. Only PEM encoded public
+	// keys, as used by cosign, are supported; GPG keys are not.
+	KeyType string `json:"keyType,omitempty"`
+	// KeyPath, KeyPaths and KeyData are the keys accepted for signatures.
+	// KeyData is the base64 encoded PEM public key.
+	KeyPath  string   `json:"keyPath,omitempty"`
+	KeyPaths []string `json:"keyPaths,omitempty"`
+	KeyData  string   `json:"keyData,omitempty"`
+	// SignedIdentity is not supported, it is only parsed for rejecting
+	// policies relying on it.
+	SignedIdentity json.RawMessage `json:"signedIdentity,omitempty"`
+	// Digests are the digests allowed via pinnedDigest.
+	Digests []digest.Digest `json:"digests,omitempty"`
+
+	verifier *signature.Verifier
+}
+
+// Policy decides which images can be pulled, modeled on policy.json used by
+// containers/image, e.g.:
+//
+//	{
+//	  "default": [{"type": "reject"}],
+//	  "transports": {
+//	    "docker": {
+//	      "docker.io/library": [{"type": "insecureAcceptAnything"}],
+//	      "registry.example.com": [
+//	        {"type": "signedBy", "keyPath": "/etc/tosi/cosign.pub"}
+//	      ],
+//	      "registry.example.com/prod": [
+//	        {"type": "signedBy", "keyPath": "/etc/tosi/cosign.pub"},
+//	        {"type": "pinnedDigest"}
+//	      ]
+//	    }
+//	  }
+//	}
+//
+// Scopes for the docker transport are an image name with a tag or digest, a
+// repository, a namespace, a registry host, or a wildcard like
+// *.example.com. The most specific scope matching the image is used, then the
+// "" scope of the transport, then the default requirements. All requirements
+// of the scope need to be satisfied.
+type Policy struct {
+	Default    []Requirement                       `json:"default"`
+	Transports map[string]map[string][]Requirement `json:"transports"`
+}
+
+// Load reads the policy from path, and loads the keys used by its
+// requirements.
+func Load(path string) (*Policy, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	err = json.Unmarshal(buf, p)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(p.Default) == 0 {
+		return nil, fmt.Errorf("%s: default requirements are missing", path)
+	}
+	if err := validate(p.Default); err != nil {
+		return nil, fmt.Errorf("%s: default: %v", path, err)
+	}
+	for transport, scopes := range p.Transports {
+		for scope, reqs := range scopes {
+			if len(reqs) == 0 {
+				return nil, fmt.Errorf("%s: %s scope %q: no requirements",
+					path, transport, scope)
+			}
+			if err := validate(reqs); err != nil {
+				return nil, fmt.Errorf("%s: %s scope %q: %v",
+					path, transport, scope, err)
+			}
+		}
+	}
+	return p, nil
+}
+
+// loadKeyData parses the base64 encoded PEM public key data.
+func loadKeyData(data string) (crypto.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyData: %v", err)
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("keyData is not a PEM encoded public key")
+	}
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+// validate checks the requirements reqs, and loads their keys.
+func validate(reqs []Requirement) error {
+	for i := range reqs {
+		req := &reqs[i]
+		switch req.Type {
+		case TypeInsecureAcceptAnything, TypeReject, TypePinnedDigest:
+			continue
+		case TypeSignedBy, TypeSigstoreSigned:
+		default:
+			return fmt.Errorf("unknown requirement type %q", req.Type)
+		}
+		if req.KeyType == "GPGKeys" {
+			return fmt.Errorf("%s: GPG keys are not supported, use cosign public keys",
+				req.Type)
+		}
+		if len(req.SignedIdentity) > 0 {
+			return fmt.Errorf("%s: signedIdentity is not supported", req.Type)
+		}
+		paths := req.KeyPaths
+		if req.KeyPath != "" {
+			paths = append([]string{req.KeyPath}, paths...)
+		}
+		keys, err := signature.LoadPublicKeys(paths)
+		if err != nil {
+			return fmt.Errorf("%s: %v", req.Type, err)
+		}
+		if req.KeyData != "" {
+			key, err := loadKeyData(req.KeyData)
+			if err != nil {
+				return fmt.Errorf("%s: %v", req.Type, err)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("%s: no keys", req.Type)
+		}
+		req.verifier = signature.NewVerifier(keys)
+	}
+	return nil
+}
+
+// stripReference removes the tag and the digest from an image name.
+func stripReference(name string) string {
+	if i := strings.Index(name, "@"); i >= 0 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+	return name
+}
+
+// dockerScopes returns the scopes matching the fully qualified image name,
+// e.g. docker.io/library/alpine:3.12, from the most specific to the least
+// specific one.
+func dockerScopes(name string) []string {
+	scopes := []string{name}
+	repo := stripReference(name)
+	if repo != name {
+		scopes = append(scopes, repo)
+	}
+	for i := strings.LastIndex(repo, "/"); i > 0; i = strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+		scopes = append(scopes, repo)
+	}
+	// Wildcards for the registry host, e.g. *.example.com.
+	host := repo
+	for i := strings.Index(host, "."); i >= 0; i = strings.Index(host, ".") {
+		host = host[i+1:]
+		scopes = append(scopes, "*."+host)
+	}
+	return scopes
+}
+
+// pathScopes returns the scopes matching an image at location, e.g. an OCI
+// image layout directory, and the image in it.
+func pathScopes(location, image string) []string {
+	scopes := []string{}
+	if image != "" {
+		scopes = append(scopes, location+":"+image)
+	}
+	for dir := path.Clean(location); ; dir = path.Dir(dir) {
+		scopes = append(scopes, dir)
+		if dir == "/" || dir == "." {
+			break
+		}
+	}
+	return scopes
+}
+
+// Requirements returns the requirements for the image name pulled via
+// transport, and the scope they are configured for. The scope is the name of
+// the transport for its "" scope, and "default" for the default requirements.
+// For the docker transport, name is the fully qualified image name, e.g.
+// docker.io/library/alpine:3.12, otherwise the location with an optional
+// image, e.g. /srv/images:myapp:1.2.
+func (p *Policy) Requirements(transport, name string) ([]Requirement, string) {
+	scopes := p.Transports[transport]
+	var candidates []string
+	if transport == TransportDocker {
+		candidates = dockerScopes(name)
+	} else {
+		location, image := name, ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			location, image = name[:i], name[i+1:]
+		}
+		candidates = pathScopes(location, image)
+	}
+	for _, scope := range candidates {
+		if reqs, ok := scopes[scope]; ok {
+			return reqs, scope
+		}
+	}
+	if reqs, ok := scopes[""]; ok {
+		return reqs, transport
+	}
+	return p.Default, "default"
+}
+
+// Image is the policy for an image, evaluated when pulling it.
+type Image struct {
+	name         string
+	requirements []Requirement
+	scope        string
+}
+
+// ForImage returns the policy for the image name pulled via transport, see
+// Requirements.
+func (p *Policy) ForImage(transport, name string) *Image {
+	reqs, scope := p.Requirements(transport, name)
+	glog.V(2).Infof("policy for %s: scope %q", name, scope)
+	return &Image{
+		name:         name,
+		requirements: reqs,
+		scope:        scope,
+	}
+}
+
+// Verify returns an error if the image is not allowed by the policy. The
+// image is repo in src, pulled via reference, which is a tag or a digest,
+// and has the manifest dgst.
+func (i *Image) Verify(src source.Source, repo, reference string, dgst digest.Digest) error {
+	for _, req := range i.requirements {
+		var err error
+		switch req.Type {
+		case TypeInsecureAcceptAnything:
+		case TypeReject:
+			err = fmt.Errorf("images are rejected")
+		case TypePinnedDigest:
+			err = checkDigest(req.Digests, reference, dgst)
+		case TypeSignedBy, TypeSigstoreSigned:
+			err = req.verifier.Verify(src, repo, reference, dgst)
+		}
+		if err != nil {
+			return fmt.Errorf("%s denied by policy scope %q: %v",
+				i.name, i.scope, err)
+		}
+	}
+	return nil
+}
+
+// checkDigest checks that the image was pulled via a digest, and that it is in
+// digests if there are any.
+func checkDigest(digests []digest.Digest, reference string, dgst digest.Digest) error {
+	if _, err := digest.Parse(reference); err != nil {
+		return fmt.Errorf("images need to be pulled via a digest")
+	}
+	if len(digests) == 0 {
+		return nil
+	}
+	for _, allowed := range digests {
+		if allowed == dgst {
+			return nil
+		}
+	}
+	return fmt.Errorf("digest %s is not allowed", dgst)
+}
@@ -0,0 +1,336 @@
+package policy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/registrytest"
+	"github.com/elotl/tosi/pkg/signaturetest"
+	"github.com/opencontainers/go-digest"
+)
+
+func accept() []Requirement {
+	return []Requirement{{Type: TypeInsecureAcceptAnything}}
+}
+
+func TestRequirements(t *testing.T) {
+	p := &Policy{
+		Default: []Requirement{{Type: TypeReject}},
+		Transports: map[string]map[string][]Requirement{
+			TransportDocker: {
+				"":                                 accept(),
+				"docker.io/library":                accept(),
+				"registry.example.com":             accept(),
+				"registry.example.com/prod":        accept(),
+				"registry.example.com/prod/app":    accept(),
+				"registry.example.com/prod/app:v1": accept(),
+				"*.example.com":                    accept(),
+				"*.internal.example.com":           accept(),
+				"localhost:5000":                   accept(),
+			},
+			"oci": {
+				"/srv/images":             accept(),
+				"/srv/images/app:myapp:1": accept(),
+			},
+			"docker-archive": {
+				"": accept(),
+			},
+		},
+	}
+	testCases := []struct {
+		transport string
+		name      string
+		scope     string
+	}{
+		{TransportDocker, "docker.io/library/alpine:3.12", "docker.io/library"},
+		{TransportDocker, "docker.io/library/alpine@sha256:" + strings.Repeat("a", 64), "docker.io/library"},
+		{TransportDocker, "docker.io/bitnami/redis:6", "docker"},
+		{TransportDocker, "registry.example.com/prod/app:v1", "registry.example.com/prod/app:v1"},
+		{TransportDocker, "registry.example.com/prod/app:v2", "registry.example.com/prod/app"},
+		{TransportDocker, "registry.example.com/prod/app", "registry.example.com/prod/app"},
+		{TransportDocker, "registry.example.com/prod/other:v1", "registry.example.com/prod"},
+		{TransportDocker, "registry.example.com/production/app:v1", "registry.example.com"},
+		{TransportDocker, "registry.example.com/dev/app:v1", "registry.example.com"},
+		{TransportDocker, "mirror.example.com/app:v1", "*.example.com"},
+		{TransportDocker, "a.b.example.com/app:v1", "*.example.com"},
+		{TransportDocker, "registry.internal.example.com/app:v1", "*.internal.example.com"},
+		{TransportDocker, "example.com/app:v1", "docker"},
+		{TransportDocker, "example.com.evil.io/app:v1", "docker"},
+		{TransportDocker, "localhost:5000/app:v1", "localhost:5000"},
+		{TransportDocker, "localhost:5001/app:v1", "docker"},
+		{"oci", "/srv/images/app:myapp:1", "/srv/images/app:myapp:1"},
+		{"oci", "/srv/images/app:myapp:2", "/srv/images"},
+		{"oci", "/srv/images/app", "/srv/images"},
+		{"oci", "/srv/images", "/srv/images"},
+		{"oci", "/srv/images-old/app", "default"},
+		{"oci", "/srv", "default"},
+		{"docker-archive", "/tmp/app.tar:app:1", "docker-archive"},
+		{"dir", "/tmp/app", "default"},
+	}
+	for _, tc := range testCases {
+		_, scope := p.Requirements(tc.transport, tc.name)
+		if scope != tc.scope {
+			t.Errorf("%s %s: expected scope %q, got %q", tc.transport, tc.name,
+				tc.scope, scope)
+		}
+	}
+
+	// Without a "" scope, the default requirements are used.
+	delete(p.Transports[TransportDocker], "")
+	reqs, scope := p.Requirements(TransportDocker, "quay.io/app:v1")
+	if scope != "default" || len(reqs) != 1 || reqs[0].Type != TypeReject {
+		t.Errorf("expected default requirements, got %v for scope %q", reqs, scope)
+	}
+}
+
+// writeFile writes content into the file name in dir, and returns its path.
+func writeFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tosi-policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := writeFile(t, dir, "cosign.pub",
+		signaturetest.PublicKeyPEM(t, signaturetest.NewKey(t)))
+	keyData := base64.StdEncoding.EncodeToString(
+		signaturetest.PublicKeyPEM(t, signaturetest.NewKey(t)))
+	testCases := []struct {
+		name   string
+		policy string
+		err    string
+	}{
+		{
+			name:   "accept",
+			policy: `{"default": [{"type": "insecureAcceptAnything"}]}`,
+		},
+		{
+			name: "keys",
+			policy: fmt.Sprintf(`{"default": [{"type": "reject"}], "transports": {"docker": {
+				"a.example.com": [{"type": "signedBy", "keyPath": %q}],
+				"b.example.com": [{"type": "sigstoreSigned", "keyPaths": [%q], "keyData": %q}]}}}`,
+				keyPath, keyPath, keyData),
+		},
+		{
+			name:   "no default",
+			policy: `{"transports": {"docker": {"": [{"type": "reject"}]}}}`,
+			err:    "default requirements are missing",
+		},
+		{
+			name:   "unknown type",
+			policy: `{"default": [{"type": "signedByAnyone"}]}`,
+			err:    `unknown requirement type "signedByAnyone"`,
+		},
+		{
+			name:   "empty scope",
+			policy: `{"default": [{"type": "reject"}], "transports": {"docker": {"": []}}}`,
+			err:    "no requirements",
+		},
+		{
+			name:   "GPG keys",
+			policy: fmt.Sprintf(`{"default": [{"type": "signedBy", "keyType": "GPGKeys", "keyPath": %q}]}`, keyPath),
+			err:    "GPG keys are not supported",
+		},
+		{
+			name:   "signed identity",
+			policy: fmt.Sprintf(`{"default": [{"type": "signedBy", "keyPath": %q, "signedIdentity": {"type": "matchExact"}}]}`, keyPath),
+			err:    "signedIdentity is not supported",
+		},
+		{
+			name:   "no keys",
+			policy: `{"default": [{"type": "signedBy"}]}`,
+			err:    "no keys",
+		},
+		{
+			name:   "invalid key data",
+			policy: `{"default": [{"type": "signedBy", "keyData": "a2V5"}]}`,
+			err:    "not a PEM encoded public key",
+		},
+		{
+			name:   "missing key",
+			policy: fmt.Sprintf(`{"default": [{"type": "signedBy", "keyPath": %q}]}`, filepath.Join(dir, "missing.pub")),
+			err:    "missing.pub",
+		},
+	}
+	for _, tc := range testCases {
+		path := writeFile(t, dir, "policy.json", []byte(tc.policy))
+		_, err := Load(path)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name,
+				tc.err, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	reg := registrytest.New()
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	client, err := registryclient.NewRegistryClientWithOptions(server.URL,
+		registryclient.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := "test/app"
+	key := signaturetest.NewKey(t)
+	otherKey := signaturetest.NewKey(t)
+	signed := signaturetest.PushImage(t, client, repo, "signed")
+	signaturetest.SignTag(t, client, repo, key, signed, signed)
+	unsigned := signaturetest.PushImage(t, client, repo, "unsigned")
+	wrongKey := signaturetest.PushImage(t, client, repo, "wrong-key")
+	signaturetest.SignReferrer(t, client, repo, otherKey, wrongKey, wrongKey)
+
+	dir, err := ioutil.TempDir("", "tosi-policy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := writeFile(t, dir, "cosign.pub", signaturetest.PublicKeyPEM(t, key))
+	keyData := base64.StdEncoding.EncodeToString(signaturetest.PublicKeyPEM(t, key))
+	signedBy := fmt.Sprintf(`{"type": "signedBy", "keyPath": %q}`, keyPath)
+	other := digest.FromString("other")
+
+	testCases := []struct {
+		name         string
+		requirements string
+		reference    string
+		dgst         digest.Digest
+		err          string
+	}{
+		{
+			name:         "accept",
+			requirements: `{"type": "insecureAcceptAnything"}`,
+			reference:    "unsigned",
+			dgst:         unsigned,
+		},
+		{
+			name:         "reject",
+			requirements: `{"type": "reject"}`,
+			reference:    "signed",
+			dgst:         signed,
+			err:          "images are rejected",
+		},
+		{
+			name:         "accept and reject",
+			requirements: `{"type": "insecureAcceptAnything"}, {"type": "reject"}`,
+			reference:    "signed",
+			dgst:         signed,
+			err:          "images are rejected",
+		},
+		{
+			name:         "signed",
+			requirements: signedBy,
+			reference:    "signed",
+			dgst:         signed,
+		},
+		{
+			name:         "signed via key data",
+			requirements: fmt.Sprintf(`{"type": "sigstoreSigned", "keyData": %q}`, keyData),
+			reference:    signed.String(),
+			dgst:         signed,
+		},
+		{
+			name:         "unsigned",
+			requirements: signedBy,
+			reference:    "unsigned",
+			dgst:         unsigned,
+			err:          "is not signed",
+		},
+		{
+			name:         "signed with another key",
+			requirements: signedBy,
+			reference:    "wrong-key",
+			dgst:         wrongKey,
+			err:          "does not match any of the keys",
+		},
+		{
+			name:         "pinned digest",
+			requirements: `{"type": "pinnedDigest"}`,
+			reference:    unsigned.String(),
+			dgst:         unsigned,
+		},
+		{
+			name:         "pinned digest via tag",
+			requirements: `{"type": "pinnedDigest"}`,
+			reference:    "unsigned",
+			dgst:         unsigned,
+			err:          "images need to be pulled via a digest",
+		},
+		{
+			name:         "allowed digest",
+			requirements: fmt.Sprintf(`{"type": "pinnedDigest", "digests": [%q, %q]}`, other, unsigned),
+			reference:    unsigned.String(),
+			dgst:         unsigned,
+		},
+		{
+			name:         "digest not allowed",
+			requirements: fmt.Sprintf(`{"type": "pinnedDigest", "digests": [%q]}`, other),
+			reference:    unsigned.String(),
+			dgst:         unsigned,
+			err:          "is not allowed",
+		},
+		{
+			name:         "signed and pinned",
+			requirements: signedBy + `, {"type": "pinnedDigest"}`,
+			reference:    signed.String(),
+			dgst:         signed,
+		},
+		{
+			name:         "signed but not pinned",
+			requirements: signedBy + `, {"type": "pinnedDigest"}`,
+			reference:    "signed",
+			dgst:         signed,
+			err:          "images need to be pulled via a digest",
+		},
+	}
+	for _, tc := range testCases {
+		path := writeFile(t, dir, "policy.json", []byte(fmt.Sprintf(
+			`{"default": [{"type": "reject"}], "transports": {"docker": {"registry.example.com/test": [%s]}}}`,
+			tc.requirements)))
+		p, err := Load(path)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		name := "registry.example.com/" + repo + ":" + tc.reference
+		if _, err := digest.Parse(tc.reference); err == nil {
+			name = "registry.example.com/" + repo + "@" + tc.reference
+		}
+		err = p.ForImage(TransportDocker, name).Verify(client, repo,
+			tc.reference, tc.dgst)
+		if tc.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name,
+				tc.err, err)
+			continue
+		}
+		scope := `policy scope "registry.example.com/test"`
+		if !strings.Contains(err.Error(), scope) {
+			t.Errorf("%s: expected %s in error, got %v", tc.name, scope, err)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package registries
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DockerHub is the registry prefix used for image names without a
+	// registry host, e.g. "alpine" or "bitnami/tomcat".
+	DockerHub = "docker.io"
+)
+
+// Endpoint is a registry server location, with an optional namespace, e.g.
+// "gcr.io/google_containers".
+type Endpoint struct {
+	Location string `json:"location"`
+	// Insecure allows plain HTTP and disables TLS certificate verification.
+	Insecure bool `json:"insecure"`
+}
+
+// Registry configures how image names starting with Prefix are pulled. The
+// prefix is replaced with the location of the registry, or with the location
+// of one of the mirrors, which are tried in order before the registry itself.
+type Registry struct {
+	Endpoint
+	Prefix  string     `json:"prefix"`
+	Blocked bool       `json:"blocked"`
+	Mirrors []Endpoint `json:"mirror"`
+}
+
+// BlockedError is returned when looking up an image in a blocked registry.
+type BlockedError struct {
+	Prefix string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("pulling from %s is blocked", e.Prefix)
+}
+
+// Config is the registries configuration, similar in spirit to
+// registries.conf used by containers/image, but in JSON format, e.g.:
+//
+//	{
+//	  "unqualified-search-registries": ["docker.io", "quay.io"],
+//	  "registry": [
+//	    {
+//	      "prefix": "docker.io",
+//	      "location": "registry-1.docker.io",
+//	      "mirror": [{"location": "mirror.example.com:5000/dockerhub"}]
+//	    },
+//	    {"prefix": "registry.example.com", "blocked": true}
+//	  ],
+//	  "insecure-registries": ["lab.example.com:5000", "10.0.0.0/8"]
+//	}
+type Config struct {
+	UnqualifiedSearchRegistries []string   `json:"unqualified-search-registries"`
+	Registries                  []Registry `json:"registry"`
+	// InsecureRegistries are registry hosts, optionally with a port, or
+	// CIDR networks that are allowed to use plain HTTP or TLS without
+	// certificate verification. Loopback addresses are always allowed.
+	InsecureRegistries []string `json:"insecure-registries"`
+}
+
+// Reference is an image name resolved via the registries configuration.
+type Reference struct {
+	// Name is the fully qualified image name, e.g.
+	// docker.io/library/alpine:3.6.
+	Name string
+	// Registry is the URL of the upstream registry server.
+	Registry string
+	// Repo is the repository on the upstream registry, with the tag or
+	// digest, e.g. library/alpine:3.6.
+	Repo string
+	// Namespace is the part of Repo that is replaced with the namespace of
+	// a mirror when pulling from it.
+	Namespace string
+	Insecure  bool
+	Mirrors   []Endpoint
+}
+
+var defaultRegistries = []Registry{
+	{
+		Prefix: DockerHub,
+		Endpoint: Endpoint{
+			Location: "registry-1.docker.io",
+		},
+	},
+	{
+		// k8s.gcr.io is an alias used by GCR.
+		Prefix: "k8s.gcr.io",
+		Endpoint: Endpoint{
+			Location: "gcr.io/google_containers",
+		},
+	},
+}
+
+// DefaultConfig returns the built-in configuration, used when there is no
+// registries configuration file.
+func DefaultConfig() *Config {
+	return &Config{
+		UnqualifiedSearchRegistries: []string{DockerHub},
+		Registries:                  defaultRegistries,
+	}
+}
+
+// Load reads the registries configuration from path. If path does not exist,
+// the default configuration is returned. Built-in registries, e.g. the one for
+// docker.io, are added unless the file configures the same prefix.
+func Load(path string) (*Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		glog.V(2).Infof("%s does not exist, using default config", path)
+		return DefaultConfig(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := Config{}
+	err = json.Unmarshal(buf, &config)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+	if len(config.UnqualifiedSearchRegistries) == 0 {
+		config.UnqualifiedSearchRegistries = []string{DockerHub}
+	}
+	for _, def := range defaultRegistries {
+		if config.find(def.Prefix) == nil {
+			config.Registries = append(config.Registries, def)
+		}
+	}
+	for _, reg := range config.Registries {
+		if reg.Prefix == "" {
+			return nil, fmt.Errorf("%s: registry without prefix", path)
+		}
+	}
+	return &config, nil
+}
+
+func (c *Config) find(prefix string) *Registry {
+	for i := range c.Registries {
+		if c.Registries[i].Prefix == prefix {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
+// match returns the registry with the longest prefix matching name.
+func (c *Config) match(name string) *Registry {
+	var match *Registry
+	for i, reg := range c.Registries {
+		prefix := reg.Prefix
+		if name != prefix &&
+			!strings.HasPrefix(name, prefix+"/") &&
+			!strings.HasPrefix(name, prefix+":") &&
+			!strings.HasPrefix(name, prefix+"@") {
+			continue
+		}
+		if match == nil || len(prefix) > len(match.Prefix) {
+			match = &c.Registries[i]
+		}
+	}
+	return match
+}
+
+// IsInsecure returns true if host, which might also include a port, is in the
+// insecure registries allowlist, or is a loopback address.
+func (c *Config) IsInsecure(host string) bool {
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	ip := net.ParseIP(hostname)
+	if ip != nil && ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range c.InsecureRegistries {
+		if entry == host || entry == hostname {
+			return true
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err == nil && ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) mirrors(reg *Registry) []Endpoint {
+	mirrors := make([]Endpoint, 0, len(reg.Mirrors))
+	for _, mirror := range reg.Mirrors {
+		host, _ := splitLocation(mirror.Location)
+		mirror.Insecure = mirror.Insecure || c.IsInsecure(host)
+		mirrors = append(mirrors, mirror)
+	}
+	return mirrors
+}
+
+// isRegistryHost returns true if the first component of an image name is a
+// registry host, following the conventions used by docker.
+func isRegistryHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// splitLocation splits a location into the host and the namespace.
+func splitLocation(location string) (string, string) {
+	parts := strings.SplitN(location, "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], strings.Trim(parts[1], "/")
+}
+
+func joinRepo(namespace, repo string) string {
+	if namespace == "" {
+		return repo
+	}
+	if strings.HasPrefix(repo, ":") || strings.HasPrefix(repo, "@") {
+		// The prefix matched a full repository name.
+		return namespace + repo
+	}
+	return namespace + "/" + repo
+}
+
+// Lookup resolves an image name into one or more references. Fully qualified
+// names, i.e. those starting with a registry host, resolve to exactly one
+// reference. Other names are tried on each of the unqualified search
+// registries, in order. A scheme, e.g. http://, can be used in front of the
+// registry host.
+func (c *Config) Lookup(image string) ([]*Reference, error) {
+	scheme := "https://"
+	for _, s := range []string{"http://", "https://"} {
+		if strings.HasPrefix(strings.ToLower(image), s) {
+			scheme = s
+			image = image[len(s):]
+		}
+	}
+	names := []string{}
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && isRegistryHost(parts[0]) {
+		names = append(names, strings.ToLower(parts[0])+"/"+parts[1])
+	} else {
+		for _, reg := range c.UnqualifiedSearchRegistries {
+			names = append(names, reg+"/"+image)
+		}
+	}
+	refs := make([]*Reference, 0, len(names))
+	var lastErr error
+	for _, name := range names {
+		ref, err := c.resolve(scheme, name)
+		if err != nil {
+			glog.V(2).Infof("skipping %s: %v", name, err)
+			lastErr = err
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if len(refs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no unqualified search registries for %q", image)
+	}
+	return refs, nil
+}
+
+// LookupRegistry resolves a registry host, optionally with a namespace, e.g.
+// quay.io or k8s.gcr.io. Both the repository and the namespace of the
+// reference returned are set to the namespace on the registry server, e.g.
+// google_containers for k8s.gcr.io.
+func (c *Config) LookupRegistry(name string) (*Reference, error) {
+	scheme := "https://"
+	for _, s := range []string{"http://", "https://"} {
+		if strings.HasPrefix(strings.ToLower(name), s) {
+			scheme = s
+			name = name[len(s):]
+		}
+	}
+	name = strings.TrimSuffix(name, "/")
+	if name == "" {
+		return nil, fmt.Errorf("empty registry name")
+	}
+	host, namespace := splitLocation(name)
+	if !isRegistryHost(host) {
+		return nil, fmt.Errorf("invalid registry host %q", host)
+	}
+	name = strings.ToLower(host)
+	if namespace != "" {
+		name += "/" + namespace
+	}
+	ref, err := c.resolve(scheme, name)
+	if err != nil {
+		return nil, err
+	}
+	ref.Repo = strings.Trim(ref.Repo, "/")
+	ref.Namespace = ref.Repo
+	return ref, nil
+}
+
+func (c *Config) resolve(scheme, name string) (*Reference, error) {
+	host, remainder := splitLocation(name)
+	if host == DockerHub && remainder != "" && !strings.Contains(remainder, "/") {
+		// Official images, e.g. "alpine".
+		remainder = "library/" + remainder
+		name = host + "/" + remainder
+	}
+	ref := Reference{
+		Name: name,
+	}
+	reg := c.match(name)
+	if reg == nil {
+		ref.Registry = scheme + host + "/"
+		ref.Repo = remainder
+		ref.Insecure = c.IsInsecure(host)
+		return &ref, nil
+	}
+	if reg.Blocked {
+		return nil, &BlockedError{Prefix: reg.Prefix}
+	}
+	remainder = strings.TrimLeft(strings.TrimPrefix(name, reg.Prefix), "/")
+	location := reg.Location
+	if location == "" {
+		location = reg.Prefix
+	}
+	host, namespace := splitLocation(location)
+	ref.Registry = scheme + host + "/"
+	ref.Repo = joinRepo(namespace, remainder)
+	ref.Namespace = namespace
+	ref.Insecure = reg.Insecure || c.IsInsecure(host)
+	ref.Mirrors = c.mirrors(reg)
+	return &ref, nil
+}
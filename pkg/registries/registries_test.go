@@ -0,0 +1,408 @@
+package registries
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testConfig() *Config {
+	config := DefaultConfig()
+	config.Registries = append(config.Registries,
+		Registry{
+			Prefix:   "registry.example.com",
+			Endpoint: Endpoint{Location: "r1.example.com"},
+		},
+		Registry{
+			Prefix:   "registry.example.com/team",
+			Endpoint: Endpoint{Location: "r2.example.com/teams/team"},
+		},
+		Registry{
+			Prefix:   "registry.example.com/team/app",
+			Endpoint: Endpoint{Location: "r3.example.com/apps/app"},
+		},
+		Registry{
+			Prefix:  "blocked.example.com",
+			Blocked: true,
+		},
+		Registry{
+			Prefix:  "docker.io/evil",
+			Blocked: true,
+		},
+		Registry{
+			Prefix: "mirrored.example.com",
+			Mirrors: []Endpoint{
+				{Location: "127.0.0.1:5000/mirrored"},
+				{Location: "mirror.example.com"},
+			},
+		},
+	)
+	config.InsecureRegistries = []string{"lab.example.com:5000"}
+	return config
+}
+
+func TestLookup(t *testing.T) {
+	testCases := []struct {
+		image    string
+		expected Reference
+	}{
+		{
+			image: "alpine",
+			expected: Reference{
+				Name:     "docker.io/library/alpine",
+				Registry: "https://registry-1.docker.io/",
+				Repo:     "library/alpine",
+			},
+		},
+		{
+			image: "alpine:3.6",
+			expected: Reference{
+				Name:     "docker.io/library/alpine:3.6",
+				Registry: "https://registry-1.docker.io/",
+				Repo:     "library/alpine:3.6",
+			},
+		},
+		{
+			image: "docker.io/alpine@sha256:abc",
+			expected: Reference{
+				Name:     "docker.io/library/alpine@sha256:abc",
+				Registry: "https://registry-1.docker.io/",
+				Repo:     "library/alpine@sha256:abc",
+			},
+		},
+		{
+			image: "bitnami/redis:6",
+			expected: Reference{
+				Name:     "docker.io/bitnami/redis:6",
+				Registry: "https://registry-1.docker.io/",
+				Repo:     "bitnami/redis:6",
+			},
+		},
+		{
+			image: "docker.io/evilcorp/app",
+			expected: Reference{
+				Name:     "docker.io/evilcorp/app",
+				Registry: "https://registry-1.docker.io/",
+				Repo:     "evilcorp/app",
+			},
+		},
+		{
+			image: "k8s.gcr.io/pause:3.2",
+			expected: Reference{
+				Name:      "k8s.gcr.io/pause:3.2",
+				Registry:  "https://gcr.io/",
+				Repo:      "google_containers/pause:3.2",
+				Namespace: "google_containers",
+			},
+		},
+		{
+			image: "Quay.IO/coreos/etcd:v3",
+			expected: Reference{
+				Name:     "quay.io/coreos/etcd:v3",
+				Registry: "https://quay.io/",
+				Repo:     "coreos/etcd:v3",
+			},
+		},
+		{
+			image: "http://127.0.0.1:5000/app",
+			expected: Reference{
+				Name:     "127.0.0.1:5000/app",
+				Registry: "http://127.0.0.1:5000/",
+				Repo:     "app",
+				Insecure: true,
+			},
+		},
+		{
+			image: "localhost/app",
+			expected: Reference{
+				Name:     "localhost/app",
+				Registry: "https://localhost/",
+				Repo:     "app",
+			},
+		},
+		{
+			image: "lab.example.com:5000/app",
+			expected: Reference{
+				Name:     "lab.example.com:5000/app",
+				Registry: "https://lab.example.com:5000/",
+				Repo:     "app",
+				Insecure: true,
+			},
+		},
+		{
+			image: "registry.example.com/other/app:1",
+			expected: Reference{
+				Name:     "registry.example.com/other/app:1",
+				Registry: "https://r1.example.com/",
+				Repo:     "other/app:1",
+			},
+		},
+		{
+			image: "registry.example.com/team/web:1",
+			expected: Reference{
+				Name:      "registry.example.com/team/web:1",
+				Registry:  "https://r2.example.com/",
+				Repo:      "teams/team/web:1",
+				Namespace: "teams/team",
+			},
+		},
+		{
+			image: "registry.example.com/team/app:1",
+			expected: Reference{
+				Name:      "registry.example.com/team/app:1",
+				Registry:  "https://r3.example.com/",
+				Repo:      "apps/app:1",
+				Namespace: "apps/app",
+			},
+		},
+		{
+			image: "registry.example.com/team/application:1",
+			expected: Reference{
+				Name:      "registry.example.com/team/application:1",
+				Registry:  "https://r2.example.com/",
+				Repo:      "teams/team/application:1",
+				Namespace: "teams/team",
+			},
+		},
+		{
+			image: "mirrored.example.com/app",
+			expected: Reference{
+				Name:     "mirrored.example.com/app",
+				Registry: "https://mirrored.example.com/",
+				Repo:     "app",
+				Mirrors: []Endpoint{
+					{Location: "127.0.0.1:5000/mirrored", Insecure: true},
+					{Location: "mirror.example.com"},
+				},
+			},
+		},
+	}
+	config := testConfig()
+	for _, tc := range testCases {
+		refs, err := config.Lookup(tc.image)
+		if err != nil {
+			t.Errorf("%s: %v", tc.image, err)
+			continue
+		}
+		if len(refs) != 1 {
+			t.Errorf("%s: expected one reference, got %d", tc.image, len(refs))
+			continue
+		}
+		if len(refs[0].Mirrors) == 0 {
+			refs[0].Mirrors = nil
+		}
+		if !reflect.DeepEqual(*refs[0], tc.expected) {
+			t.Errorf("%s: expected %+v, got %+v", tc.image, tc.expected, *refs[0])
+		}
+	}
+}
+
+func TestLookupBlocked(t *testing.T) {
+	testCases := []struct {
+		image  string
+		prefix string
+	}{
+		{"blocked.example.com/app", "blocked.example.com"},
+		{"blocked.example.com:5000/app", "blocked.example.com"},
+		{"docker.io/evil/app", "docker.io/evil"},
+		{"evil/app:1", "docker.io/evil"},
+	}
+	config := testConfig()
+	for _, tc := range testCases {
+		_, err := config.Lookup(tc.image)
+		blocked := &BlockedError{}
+		if !errors.As(err, &blocked) {
+			t.Errorf("%s: expected blocked error, got %v", tc.image, err)
+			continue
+		}
+		if blocked.Prefix != tc.prefix {
+			t.Errorf("%s: expected %s to be blocked, got %s", tc.image,
+				tc.prefix, blocked.Prefix)
+		}
+	}
+	// Only the prefix up to a path component is blocked.
+	for _, image := range []string{"blocked.example.com.evil.io/app", "docker.io/evilcorp/app"} {
+		if _, err := config.Lookup(image); err != nil {
+			t.Errorf("%s: %v", image, err)
+		}
+	}
+}
+
+func TestLookupUnqualified(t *testing.T) {
+	testCases := []struct {
+		search   []string
+		expected []string
+		err      bool
+	}{
+		{
+			search:   []string{"docker.io"},
+			expected: []string{"docker.io/library/app:1"},
+		},
+		{
+			search:   []string{"quay.io", "docker.io", "registry.example.com"},
+			expected: []string{"quay.io/app:1", "docker.io/library/app:1", "registry.example.com/app:1"},
+		},
+		{
+			search:   []string{"blocked.example.com", "quay.io"},
+			expected: []string{"quay.io/app:1"},
+		},
+		{
+			search: []string{"blocked.example.com"},
+			err:    true,
+		},
+		{
+			search: []string{},
+			err:    true,
+		},
+	}
+	for _, tc := range testCases {
+		config := testConfig()
+		config.UnqualifiedSearchRegistries = tc.search
+		refs, err := config.Lookup("app:1")
+		if tc.err {
+			if err == nil {
+				t.Errorf("%v: expected error", tc.search)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tc.search, err)
+			continue
+		}
+		names := []string{}
+		for _, ref := range refs {
+			names = append(names, ref.Name)
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("%v: expected %v, got %v", tc.search, tc.expected, names)
+		}
+	}
+}
+
+func TestLookupRegistry(t *testing.T) {
+	testCases := []struct {
+		name     string
+		registry string
+		repo     string
+		err      bool
+	}{
+		{"quay.io", "https://quay.io/", "", false},
+		{"http://lab.example.com:5000/", "http://lab.example.com:5000/", "", false},
+		{"k8s.gcr.io", "https://gcr.io/", "google_containers", false},
+		{"registry.example.com/team", "https://r2.example.com/", "teams/team", false},
+		{"blocked.example.com", "", "", true},
+		{"library", "", "", true},
+		{"", "", "", true},
+	}
+	config := testConfig()
+	for _, tc := range testCases {
+		ref, err := config.LookupRegistry(tc.name)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.name, err)
+			continue
+		}
+		if ref.Registry != tc.registry || ref.Repo != tc.repo || ref.Namespace != tc.repo {
+			t.Errorf("%q: expected %s %q, got %+v", tc.name, tc.registry,
+				tc.repo, *ref)
+		}
+	}
+}
+
+func TestIsInsecure(t *testing.T) {
+	config := &Config{
+		InsecureRegistries: []string{
+			"lab.example.com",
+			"registry.example.com:5000",
+			"10.0.0.0/8",
+			"fd00::/8",
+		},
+	}
+	testCases := []struct {
+		host     string
+		insecure bool
+	}{
+		{"lab.example.com", true},
+		{"lab.example.com:5000", true},
+		{"registry.example.com:5000", true},
+		{"registry.example.com", false},
+		{"registry.example.com:5001", false},
+		{"10.1.2.3", true},
+		{"10.1.2.3:5000", true},
+		{"11.1.2.3", false},
+		{"[fd00::1]:5000", true},
+		{"[fe80::1]:5000", false},
+		{"127.0.0.1", true},
+		{"127.0.0.2:5000", true},
+		{"[::1]:5000", true},
+		{"localhost", false},
+		{"quay.io", false},
+	}
+	for _, tc := range testCases {
+		if insecure := config.IsInsecure(tc.host); insecure != tc.insecure {
+			t.Errorf("%s: expected insecure %v, got %v", tc.host, tc.insecure,
+				insecure)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tosi-registries-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config, err := Load(filepath.Join(dir, "missing.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, DefaultConfig()) {
+		t.Errorf("expected default config, got %+v", config)
+	}
+
+	path := filepath.Join(dir, "registries.json")
+	err = ioutil.WriteFile(path, []byte(`{"registry": [
+		{"prefix": "docker.io", "location": "hub.example.com"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err = Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config.UnqualifiedSearchRegistries, []string{DockerHub}) {
+		t.Errorf("expected docker.io search registry, got %v",
+			config.UnqualifiedSearchRegistries)
+	}
+	refs, err := config.Lookup("alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs[0].Registry != "https://hub.example.com/" {
+		t.Errorf("expected configured docker.io registry, got %s", refs[0].Registry)
+	}
+	refs, err = config.Lookup("k8s.gcr.io/pause")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs[0].Registry != "https://gcr.io/" {
+		t.Errorf("expected built-in k8s.gcr.io registry, got %s", refs[0].Registry)
+	}
+
+	err = ioutil.WriteFile(path, []byte(`{"registry": [{"location": "hub.example.com"}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("expected error for registry without prefix")
+	}
+}
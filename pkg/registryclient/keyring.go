@@ -0,0 +1,250 @@
+package registryclient
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/elotl/tosi/pkg/registries"
+	"github.com/elotl/tosi/pkg/util"
+)
+
+// Credentials are the credentials for logging in to a registry: a username
+// and password, an OAuth2 identity token, or a bearer token.
+type Credentials struct {
+	Username string
+	Password string
+	// IdentityToken is an OAuth2 refresh token, used for getting bearer
+	// tokens from the token server of the registry.
+	IdentityToken string
+	// RegistryToken is a bearer token sent to the registry as is.
+	RegistryToken string
+}
+
+// describe describes the credentials for logging, without the secrets.
+func (c Credentials) describe() string {
+	switch {
+	case c.Username != "":
+		return c.Username
+	case c.IdentityToken != "":
+		return "identity token"
+	case c.RegistryToken != "":
+		return "registry token"
+	}
+	return "anonymous"
+}
+
+// dockerConfigEntry is an entry in a .dockercfg file or in the auths of a
+// .dockerconfigjson file.
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// Auth is the base64 encoded username and password, separated by a
+	// colon, used if Username is not set.
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// Keyring is a set of registry credentials loaded from .dockerconfigjson or
+// .dockercfg files, e.g. the ones of Kubernetes image pull secrets.
+type Keyring struct {
+	creds map[string][]Credentials
+	// index are the keys of creds, sorted in reverse, so more specific
+	// paths are matched first.
+	index []string
+}
+
+// defaultRegistryHost is the key used by docker for Docker Hub credentials.
+const defaultRegistryHost = "index.docker.io"
+
+// LoadKeyring loads the credentials in the .dockerconfigjson or .dockercfg
+// files at paths. Credentials in files given earlier are tried first.
+func LoadKeyring(paths []string) (*Keyring, error) {
+	k := &Keyring{
+		creds: make(map[string][]Credentials),
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := parseDockerConfig(buf)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+		if err := k.add(entries); err != nil {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(k.index)))
+	return k, nil
+}
+
+// parseDockerConfig parses a .dockerconfigjson file, which has the entries
+// in "auths", or a legacy .dockercfg file, which only has the entries.
+func parseDockerConfig(buf []byte) (map[string]dockerConfigEntry, error) {
+	config := struct {
+		Auths map[string]dockerConfigEntry `json:"auths"`
+	}{}
+	if err := json.Unmarshal(buf, &config); err == nil && config.Auths != nil {
+		return config.Auths, nil
+	}
+	entries := make(map[string]dockerConfigEntry)
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// add adds entries to the keyring, using the same keys as Kubernetes: the
+// registry host, with the path if there is one, e.g. quay.io/myorg.
+func (k *Keyring) add(entries map[string]dockerConfigEntry) error {
+	// Go map iteration order is random, keep the order stable.
+	locations := make([]string, 0, len(entries))
+	for location := range entries {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	for _, location := range locations {
+		entry := entries[location]
+		creds := Credentials{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+			RegistryToken: entry.RegistryToken,
+		}
+		if creds.Username == "" && entry.Auth != "" {
+			buf, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return fmt.Errorf("invalid auth for %s: %v", location, err)
+			}
+			parts := strings.SplitN(string(buf), ":", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("invalid auth for %s: missing password", location)
+			}
+			creds.Username = parts[0]
+			creds.Password = parts[1]
+		}
+		value := location
+		if !strings.HasPrefix(value, "https://") && !strings.HasPrefix(value, "http://") {
+			value = "https://" + value
+		}
+		u, err := url.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid registry %q: %v", location, err)
+		}
+		// Docker treats /v1/ and /v2/ like the registry host.
+		path := u.Path
+		if strings.HasPrefix(path, "/v1/") || strings.HasPrefix(path, "/v2/") {
+			path = path[3:]
+		}
+		key := u.Host
+		if path != "" && path != "/" {
+			key += path
+		}
+		if _, ok := k.creds[key]; !ok {
+			k.index = append(k.index, key)
+		}
+		k.creds[key] = append(k.creds[key], creds)
+	}
+	return nil
+}
+
+// splitHost splits the host of u into its domain name components and port.
+func splitHost(u *url.URL) ([]string, string) {
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	return strings.Split(host, "."), port
+}
+
+// urlsMatch returns true if the schemeless URL target matches glob, which can
+// have wildcards in the components of its domain name, e.g. *.gcr.io. The
+// ports need to be the same, and the path of glob needs to be a prefix of the
+// path of target.
+func urlsMatch(glob, target string) bool {
+	globURL, err := url.Parse("https://" + glob)
+	if err != nil {
+		return false
+	}
+	targetURL, err := url.Parse("https://" + target)
+	if err != nil {
+		return false
+	}
+	globParts, globPort := splitHost(globURL)
+	targetParts, targetPort := splitHost(targetURL)
+	if globPort != targetPort || len(globParts) != len(targetParts) {
+		return false
+	}
+	if !strings.HasPrefix(targetURL.Path, globURL.Path) {
+		return false
+	}
+	for i, globPart := range globParts {
+		matched, err := filepath.Match(globPart, targetParts[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// isDefaultRegistryMatch returns true if image is on Docker Hub.
+func isDefaultRegistryMatch(image string) bool {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts[0]) == 0 {
+		return false
+	}
+	if len(parts) == 1 || parts[0] == registries.DockerHub {
+		return true
+	}
+	return !strings.ContainsAny(parts[0], ".:")
+}
+
+// imageName returns the name of repo on the registry at registryURL, as
+// returned by util.ParseFullImage, without the tag or digest, e.g.
+// quay.io/myorg/myimage. Docker Hub images are named docker.io/<repo>, like
+// in Kubernetes.
+func imageName(registryURL, repo string) string {
+	host := registryURL
+	if u, err := url.Parse(registryURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	switch host {
+	case "registry-1.docker.io", defaultRegistryHost:
+		host = registries.DockerHub
+	}
+	if name, _, _, err := util.ParseImageReference(repo); err == nil {
+		repo = name
+	}
+	return host + "/" + repo
+}
+
+// Lookup returns the credentials for repo on the registry at registryURL, in
+// the order they should be tried. Keys are matched like in Kubernetes: the
+// key needs to match the registry host, with wildcards allowed in its domain
+// name components, and its path needs to be a prefix of the image path. More
+// specific keys are returned first.
+func (k *Keyring) Lookup(registryURL, repo string) []Credentials {
+	if k == nil {
+		return nil
+	}
+	image := imageName(registryURL, repo)
+	result := []Credentials{}
+	for _, key := range k.index {
+		if urlsMatch(key, image) {
+			result = append(result, k.creds[key]...)
+		}
+	}
+	if len(result) == 0 && isDefaultRegistryMatch(image) {
+		result = append(result, k.creds[defaultRegistryHost]...)
+	}
+	return result
+}
@@ -0,0 +1,208 @@
+package registryclient
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestURLsMatch(t *testing.T) {
+	testCases := []struct {
+		glob   string
+		target string
+		match  bool
+	}{
+		{"gcr.io", "gcr.io/project/app", true},
+		{"gcr.io", "us.gcr.io/project/app", false},
+		{"*.gcr.io", "us.gcr.io/project/app", true},
+		{"*.gcr.io", "gcr.io/project/app", false},
+		{"*.gcr.io", "a.b.gcr.io/project/app", false},
+		{"*.*.gcr.io", "a.b.gcr.io/project/app", true},
+		{"*.gcr.io", "us.gcr.io.evil.io/project/app", false},
+		{"registry.example.com:5000", "registry.example.com:5000/app", true},
+		{"registry.example.com:5000", "registry.example.com:5001/app", false},
+		{"registry.example.com:5000", "registry.example.com/app", false},
+		{"registry.example.com", "registry.example.com:5000/app", false},
+		{"*.example.com:5000", "registry.example.com:5000/app", true},
+		{"quay.io/myorg", "quay.io/myorg/app", true},
+		{"quay.io/myorg/app", "quay.io/myorg/app", true},
+		{"quay.io/myorg", "quay.io/otherorg/app", false},
+		{"quay.io/myorg/app", "quay.io/myorg/web", false},
+	}
+	for _, tc := range testCases {
+		if match := urlsMatch(tc.glob, tc.target); match != tc.match {
+			t.Errorf("%s %s: expected match %v, got %v", tc.glob, tc.target,
+				tc.match, match)
+		}
+	}
+}
+
+func TestParseDockerConfig(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		expected map[string]dockerConfigEntry
+		err      bool
+	}{
+		{
+			name:   "dockerconfigjson",
+			config: `{"auths": {"quay.io": {"username": "user", "password": "pass"}}}`,
+			expected: map[string]dockerConfigEntry{
+				"quay.io": {Username: "user", Password: "pass"},
+			},
+		},
+		{
+			name:   "dockercfg",
+			config: `{"quay.io": {"username": "user", "password": "pass"}}`,
+			expected: map[string]dockerConfigEntry{
+				"quay.io": {Username: "user", Password: "pass"},
+			},
+		},
+		{
+			name:     "empty dockerconfigjson",
+			config:   `{"auths": {}}`,
+			expected: map[string]dockerConfigEntry{},
+		},
+		{
+			name:   "tokens",
+			config: `{"auths": {"quay.io": {"identitytoken": "refresh", "registrytoken": "bearer"}}}`,
+			expected: map[string]dockerConfigEntry{
+				"quay.io": {IdentityToken: "refresh", RegistryToken: "bearer"},
+			},
+		},
+		{
+			name:   "invalid",
+			config: `["quay.io"]`,
+			err:    true,
+		},
+	}
+	for _, tc := range testCases {
+		entries, err := parseDockerConfig([]byte(tc.config))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expected, entries)
+		}
+	}
+}
+
+// auth returns the base64 encoded auth of a docker config entry.
+func auth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
+
+// loadKeyring writes configs into files, and loads them into a keyring.
+func loadKeyring(t *testing.T, configs ...string) (*Keyring, error) {
+	dir, err := ioutil.TempDir("", "tosi-keyring-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := []string{}
+	for i, config := range configs {
+		path := filepath.Join(dir, string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return LoadKeyring(paths)
+}
+
+func TestKeyringLookup(t *testing.T) {
+	keyring, err := loadKeyring(t,
+		`{"auths": {
+			"https://index.docker.io/v1/": {"auth": "`+auth("hub", "hubpass")+`"},
+			"*.gcr.io": {"username": "gcr", "password": "gcrpass"},
+			"gcr.io": {"username": "gcr-root", "password": "pass"},
+			"quay.io": {"username": "quay", "password": "pass"},
+			"quay.io/myorg": {"username": "myorg", "password": "pass"},
+			"https://quay.io/v2/myorg/app": {"username": "myorg-app", "password": "pass"},
+			"registry.example.com:5000": {"username": "example", "password": "pass"},
+			"http://insecure.example.com": {"identitytoken": "refresh"}
+		}}`,
+		`{"quay.io": {"username": "quay2", "password": "pass"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		registry  string
+		repo      string
+		usernames []string
+	}{
+		{"https://registry-1.docker.io/", "library/alpine:3.6", []string{"hub"}},
+		{"https://index.docker.io", "bitnami/redis", []string{"hub"}},
+		{"https://gcr.io/", "project/app:1", []string{"gcr-root"}},
+		{"https://us.gcr.io/", "project/app", []string{"gcr"}},
+		{"https://a.b.gcr.io/", "project/app", []string{}},
+		{"https://quay.io/", "otherorg/app", []string{"quay", "quay2"}},
+		{"https://quay.io/", "myorg/web@sha256:" + strings.Repeat("a", 64), []string{"myorg", "quay", "quay2"}},
+		{"https://quay.io/", "myorg/app:1", []string{"myorg-app", "myorg", "quay", "quay2"}},
+		{"https://registry.example.com:5000/", "app", []string{"example"}},
+		{"https://registry.example.com/", "app", []string{}},
+		{"https://registry.example.com:5001/", "app", []string{}},
+		{"http://insecure.example.com/", "app", []string{"identity token"}},
+	}
+	for _, tc := range testCases {
+		usernames := []string{}
+		for _, creds := range keyring.Lookup(tc.registry, tc.repo) {
+			usernames = append(usernames, creds.describe())
+		}
+		if !reflect.DeepEqual(usernames, tc.usernames) {
+			t.Errorf("%s %s: expected %v, got %v", tc.registry, tc.repo,
+				tc.usernames, usernames)
+		}
+	}
+	creds := keyring.Lookup("https://registry-1.docker.io/", "alpine")
+	if len(creds) != 1 || creds[0].Password != "hubpass" {
+		t.Errorf("expected password from auth, got %+v", creds)
+	}
+
+	// Docker Hub credentials can also use the docker.io key.
+	keyring, err = loadKeyring(t, `{"auths": {"docker.io": {"username": "hub", "password": "pass"}}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds := keyring.Lookup("https://registry-1.docker.io/", "library/alpine"); len(creds) != 1 {
+		t.Errorf("expected docker.io credentials, got %+v", creds)
+	}
+
+	// A nil keyring has no credentials.
+	keyring = nil
+	if creds := keyring.Lookup("https://quay.io/", "app"); creds != nil {
+		t.Errorf("expected no credentials, got %+v", creds)
+	}
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{"invalid json", `{`, "parsing"},
+		{"invalid auth", `{"auths": {"quay.io": {"auth": "%%%"}}}`, "invalid auth for quay.io"},
+		{"auth without password", `{"auths": {"quay.io": {"auth": "` +
+			base64.StdEncoding.EncodeToString([]byte("user")) + `"}}}`, "missing password"},
+		{"invalid registry", `{"auths": {"quay.io:port": {"username": "user"}}}`, "invalid registry"},
+	}
+	for _, tc := range testCases {
+		_, err := loadKeyring(t, tc.config)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected error containing %q, got %v", tc.name,
+				tc.err, err)
+		}
+	}
+}
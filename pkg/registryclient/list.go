@@ -0,0 +1,129 @@
+package registryclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/ldx/docker-registry-client/registry"
+)
+
+const (
+	// Number of entries requested per page when listing tags or
+	// repositories. Registries might use a lower limit.
+	pageSize = 100
+)
+
+// Matches the next page in a Link header, e.g.
+// </v2/_catalog?last=foo&n=100>; rel="next". Some registries omit the angle
+// brackets, or the quotes around the relation type.
+var nextLinkRegexp = regexp.MustCompile(`^\s*<?([^;>]+)>?(?:\s*;[^;]*)*;\s*rel="?next"?`)
+
+// nextPage returns the URL of the next page, resolved relative to the URL of
+// the current one, or nil if this is the last page.
+func nextPage(resp *http.Response) (*url.URL, error) {
+	for _, link := range resp.Header["Link"] {
+		m := nextLinkRegexp.FindStringSubmatch(link)
+		if m == nil {
+			continue
+		}
+		next, err := url.Parse(strings.TrimSpace(m[1]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Link header %q: %v", link, err)
+		}
+		return resp.Request.URL.ResolveReference(next), nil
+	}
+	return nil, nil
+}
+
+// getPaginated fetches a paginated list from the registry, starting with
+// path, following Link headers. For each page, fn is called with the
+// response body.
+func getPaginated(reg *registry.Registry, path string, fn func(decoder *json.Decoder) error) error {
+	u, err := url.Parse(fmt.Sprintf("%s%s?n=%d", reg.URL, path, pageSize))
+	if err != nil {
+		return err
+	}
+	for u != nil {
+		glog.V(2).Infof("listing %s", u)
+		resp, err := reg.Client.Get(u.String())
+		if err != nil {
+			return err
+		}
+		err = fn(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("parsing response from %s: %v", u, err)
+		}
+		next, err := nextPage(resp)
+		if err != nil {
+			return err
+		}
+		if next != nil && next.String() == u.String() {
+			return fmt.Errorf("%s: next page links to itself", u)
+		}
+		u = next
+	}
+	return nil
+}
+
+// Tags returns all tags of image in the upstream registry. Mirrors are not
+// used, since they only have the tags that have been pulled through them.
+func (r *RegistryClient) Tags(image string) ([]string, error) {
+	tags := []string{}
+	path := fmt.Sprintf("/v2/%s/tags/list", image)
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		tags = tags[:0]
+		return getPaginated(reg, path, func(decoder *json.Decoder) error {
+			page := struct {
+				Tags []string `json:"tags"`
+			}{}
+			if err := decoder.Decode(&page); err != nil {
+				return err
+			}
+			tags = append(tags, page.Tags...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// Catalog returns all repositories in the upstream registry. If a namespace
+// is set for the client, only repositories in the namespace are returned,
+// without the namespace. Mirrors are not used, since they usually only have a
+// subset of the repositories.
+func (r *RegistryClient) Catalog() ([]string, error) {
+	repos := []string{}
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		repos = repos[:0]
+		return getPaginated(reg, "/v2/_catalog", func(decoder *json.Decoder) error {
+			page := struct {
+				Repositories []string `json:"repositories"`
+			}{}
+			if err := decoder.Decode(&page); err != nil {
+				return err
+			}
+			for _, repo := range page.Repositories {
+				if r.namespace != "" {
+					if !strings.HasPrefix(repo, r.namespace+"/") {
+						continue
+					}
+					repo = strings.TrimPrefix(repo, r.namespace+"/")
+				}
+				repos = append(repos, repo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return repos, nil
+}
@@ -0,0 +1,176 @@
+package registryclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/elotl/tosi/pkg/registrytest"
+)
+
+func TestNextPage(t *testing.T) {
+	testCases := []struct {
+		links    []string
+		expected string
+	}{
+		{nil, ""},
+		{[]string{`</v2/_catalog?last=b&n=2>; rel="next"`}, "https://registry.example.com/v2/_catalog?last=b&n=2"},
+		{[]string{`/v2/_catalog?last=b&n=2; rel=next`}, "https://registry.example.com/v2/_catalog?last=b&n=2"},
+		{[]string{`<https://other.example.com/v2/_catalog?last=b>; type="x"; rel="next"`}, "https://other.example.com/v2/_catalog?last=b"},
+		{[]string{`</v2/_catalog?last=a>; rel="prev"`, `</v2/_catalog?last=c>; rel="next"`}, "https://registry.example.com/v2/_catalog?last=c"},
+		{[]string{`</v2/_catalog?last=a>; rel="prev"`}, ""},
+	}
+	for _, tc := range testCases {
+		req, err := http.NewRequest("GET", "https://registry.example.com/v2/_catalog?n=2", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := &http.Response{
+			Header:  http.Header{"Link": tc.links},
+			Request: req,
+		}
+		next, err := nextPage(resp)
+		if err != nil {
+			t.Errorf("%v: %v", tc.links, err)
+			continue
+		}
+		actual := ""
+		if next != nil {
+			actual = next.String()
+		}
+		if actual != tc.expected {
+			t.Errorf("%v: expected %q, got %q", tc.links, tc.expected, actual)
+		}
+	}
+}
+
+// addTags adds the manifests for the tags of repo to reg.
+func addTags(t *testing.T, reg *registrytest.Registry, repo string, tags []string) {
+	for _, tag := range tags {
+		addImage(t, reg, repo, tag, repo+":"+tag)
+	}
+}
+
+func TestTags(t *testing.T) {
+	upstream := registrytest.New()
+	upstream.PageSize = 2
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+	mirror := registrytest.New()
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+
+	tags := []string{}
+	for i := 0; i < 7; i++ {
+		tags = append(tags, fmt.Sprintf("1.%d", i))
+	}
+	addTags(t, upstream, "library/alpine", tags)
+	// The mirror only has the tags that have been pulled through it.
+	addTags(t, mirror, "library/alpine", tags[:1])
+
+	client, err := NewRegistryClientWithOptions(upstreamServer.URL, Options{
+		Mirrors:    []Mirror{{URL: mirrorServer.URL}},
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err := client.Tags("library/alpine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(actual)
+	if !reflect.DeepEqual(actual, tags) {
+		t.Errorf("expected tags %v, got %v", tags, actual)
+	}
+	pages := 0
+	for _, req := range upstream.Requests() {
+		if strings.HasPrefix(req, "GET /v2/library/alpine/tags/list") {
+			pages++
+		}
+	}
+	if pages != 4 {
+		t.Errorf("expected 4 pages, got %d: %v", pages, upstream.Requests())
+	}
+	for _, req := range mirror.Requests() {
+		if strings.Contains(req, "/tags/list") {
+			t.Errorf("tags listed via mirror: %s", req)
+		}
+	}
+
+	if _, err := client.Tags("library/missing"); err == nil {
+		t.Errorf("expected error listing tags of missing repository")
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	reg := registrytest.New()
+	reg.PageSize = 2
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	repos := []string{
+		"google_containers/etcd",
+		"google_containers/pause",
+		"google_containers/kube-proxy",
+		"library/alpine",
+		"library/busybox",
+	}
+	for _, repo := range repos {
+		addTags(t, reg, repo, []string{"latest"})
+	}
+	testCases := []struct {
+		namespace string
+		expected  []string
+	}{
+		{"", repos},
+		{"google_containers", []string{"etcd", "kube-proxy", "pause"}},
+		{"library", []string{"alpine", "busybox"}},
+		{"other", []string{}},
+	}
+	for _, tc := range testCases {
+		client, err := NewRegistryClientWithOptions(server.URL, Options{
+			Namespace:  tc.namespace,
+			MaxRetries: -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := client.Catalog()
+		if err != nil {
+			t.Fatalf("namespace %q: %v", tc.namespace, err)
+		}
+		expected := append([]string{}, tc.expected...)
+		sort.Strings(expected)
+		sort.Strings(actual)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("namespace %q: expected %v, got %v", tc.namespace,
+				expected, actual)
+		}
+	}
+}
+
+func TestPaginationLoop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/" {
+			return
+		}
+		// Always link to the same page.
+		u := url.URL{Path: r.URL.Path, RawQuery: r.URL.RawQuery}
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next"`, u.String()))
+		fmt.Fprint(w, `{"repositories":["a"]}`)
+	}))
+	defer server.Close()
+	client, err := NewRegistryClientWithOptions(server.URL, Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Catalog()
+	if err == nil || !strings.Contains(err.Error(), "links to itself") {
+		t.Errorf("expected error for page linking to itself, got %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package registryclient
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/docker/distribution"
+	"github.com/golang/glog"
+	"github.com/ldx/docker-registry-client/registry"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultStreamChunkSize is the size of chunks blobs are uploaded in when
+// streaming them, if no chunk size is set.
+const DefaultStreamChunkSize = 16 * 1024 * 1024
+
+// Images are always pushed to the upstream registry, never to mirrors, via
+// withUpstream.
+
+// BlobExists returns true if the blob dgst is present in the repository image
+// in the upstream registry.
+func (r *RegistryClient) BlobExists(image string, dgst digest.Digest) (bool, error) {
+	exists := false
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		var err error
+		exists, err = reg.HasLayer(image, dgst)
+		return err
+	})
+	return exists, err
+}
+
+// MountBlob tries to mount the blob dgst from the repository from into image,
+// via a cross-repository blob mount. Both repositories need to be on the
+// upstream registry. It returns false if the registry did not mount the blob,
+// e.g. because it does not support mounting, or the blob is not accessible in
+// the source repository.
+func (r *RegistryClient) MountBlob(image, from string, dgst digest.Digest) (bool, error) {
+	mounted := false
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		var err error
+		mounted, err = mountBlob(reg, image, from, dgst)
+		return err
+	})
+	return mounted, err
+}
+
+func mountBlob(reg *registry.Registry, image, from string, dgst digest.Digest) (bool, error) {
+	query := url.Values{}
+	query.Set("mount", dgst.String())
+	query.Set("from", from)
+	u := fmt.Sprintf("%s/v2/%s/blobs/uploads/?%s", reg.URL, image, query.Encode())
+	glog.V(2).Infof("mounting blob %s from %s into %s", dgst, from, image)
+	resp, err := reg.Client.Post(u, "application/octet-stream", nil)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		// The registry started a regular upload instead. Abandon it, the
+		// blob will be uploaded via a new session.
+		glog.V(2).Infof("%s: mounting blob %s from %s: got %s",
+			reg.URL, dgst, from, resp.Status)
+		if location, err := uploadLocation(resp); err == nil {
+			cancelUpload(reg, location)
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// startUpload starts a blob upload session in the repository image, and
+// returns its location.
+func startUpload(reg *registry.Registry, image string) (*url.URL, error) {
+	u := fmt.Sprintf("%s/v2/%s/blobs/uploads/", reg.URL, image)
+	resp, err := reg.Client.Post(u, "application/octet-stream", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return uploadLocation(resp)
+}
+
+// startUpload starts a blob upload session in the repository image in the
+// upstream registry. It returns the registry, which the rest of the upload
+// needs to use, and the location of the session.
+func (r *RegistryClient) startUpload(image string) (*registry.Registry, *url.URL, error) {
+	var upstream *registry.Registry
+	var location *url.URL
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		var err error
+		upstream = reg
+		location, err = startUpload(reg, image)
+		return err
+	})
+	return upstream, location, err
+}
+
+// PutBlob uploads the blob described by desc into the repository image. The
+// content is read via content, which needs to have desc.Size bytes. If
+// chunkSize is positive, the blob is uploaded in chunks of at most chunkSize
+// bytes, otherwise in a single request.
+func (r *RegistryClient) PutBlob(image string, desc distribution.Descriptor, content io.ReaderAt, chunkSize int64) error {
+	reg, location, err := r.startUpload(image)
+	if err != nil {
+		return fmt.Errorf("starting upload of %s: %w", desc.Digest, err)
+	}
+	glog.V(2).Infof("uploading image %s blob %s to %s", image, desc.Digest, reg.URL)
+	offset := int64(0)
+	if chunkSize > 0 {
+		for offset < desc.Size {
+			n := chunkSize
+			if offset+n > desc.Size {
+				n = desc.Size - offset
+			}
+			location, err = putChunk(reg, location,
+				io.NewSectionReader(content, offset, n), offset, n)
+			if err != nil {
+				cancelUpload(reg, location)
+				return fmt.Errorf("uploading %s: %w", desc.Digest, err)
+			}
+			offset += n
+		}
+	}
+	err = finishUpload(reg, location, desc.Digest,
+		io.NewSectionReader(content, offset, desc.Size-offset), desc.Size-offset)
+	if err != nil {
+		return fmt.Errorf("uploading %s: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+// PutBlobStream uploads the blob described by desc into the repository image,
+// reading it from content as it is uploaded, e.g. while downloading it from
+// another registry. Blobs larger than chunkSize, or DefaultStreamChunkSize if
+// chunkSize is not positive, are uploaded in chunks, each of which is buffered
+// in memory, so it can be retried.
+func (r *RegistryClient) PutBlobStream(image string, desc distribution.Descriptor, content io.Reader, chunkSize int64) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultStreamChunkSize
+	}
+	reg, location, err := r.startUpload(image)
+	if err != nil {
+		return fmt.Errorf("starting upload of %s: %w", desc.Digest, err)
+	}
+	glog.V(2).Infof("streaming image %s blob %s to %s", image, desc.Digest, reg.URL)
+	buf := make([]byte, chunkSize)
+	offset := int64(0)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			cancelUpload(reg, location)
+			return fmt.Errorf("reading %s: %w", desc.Digest, err)
+		}
+		chunk := bytes.NewReader(buf[:n])
+		if err != nil {
+			// This is the last chunk.
+			err = finishUpload(reg, location, desc.Digest, chunk, int64(n))
+			if err != nil {
+				return fmt.Errorf("uploading %s: %w", desc.Digest, err)
+			}
+			return nil
+		}
+		location, err = putChunk(reg, location, chunk, offset, int64(n))
+		if err != nil {
+			cancelUpload(reg, location)
+			return fmt.Errorf("uploading %s: %w", desc.Digest, err)
+		}
+		offset += int64(n)
+	}
+}
+
+// finishUpload completes the upload session at location, with the last n
+// bytes of the blob dgst read from content.
+func finishUpload(reg *registry.Registry, location *url.URL, dgst digest.Digest, content io.ReaderAt, n int64) error {
+	u := *location
+	query := u.Query()
+	query.Set("digest", dgst.String())
+	u.RawQuery = query.Encode()
+	req, err := newBodyRequest("PUT", u.String(), content, n)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		cancelUpload(reg, location)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// putChunk uploads n bytes read from content as the chunk starting at offset,
+// and returns the location for the next request in the upload session.
+func putChunk(reg *registry.Registry, location *url.URL, content io.ReaderAt, offset, n int64) (*url.URL, error) {
+	glog.V(4).Infof("uploading chunk %d-%d to %s", offset, offset+n-1, location)
+	req, err := newBodyRequest("PATCH", location.String(), content, n)
+	if err != nil {
+		return location, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("%d-%d", offset, offset+n-1))
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		return location, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return location, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return uploadLocation(resp)
+}
+
+// newBodyRequest creates a request with the first n bytes of content as its
+// body. The body can be read again, so the request can be retried, or sent
+// again after authentication.
+func newBodyRequest(method, u string, content io.ReaderAt, n int64) (*http.Request, error) {
+	getBody := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(io.NewSectionReader(content, 0, n)), nil
+	}
+	body, _ := getBody()
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = n
+	req.GetBody = getBody
+	if n == 0 {
+		req.Body = http.NoBody
+		req.GetBody = nil
+	}
+	return req, nil
+}
+
+// uploadLocation returns the URL of the upload session from the Location
+// header, which might be relative to the URL of the request.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("missing upload location in response %s",
+			resp.Status)
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload location %q: %w", location, err)
+	}
+	return resp.Request.URL.ResolveReference(u), nil
+}
+
+// cancelUpload cancels an upload session, so the registry can free up the
+// resources it uses.
+func cancelUpload(reg *registry.Registry, location *url.URL) {
+	req, err := http.NewRequest("DELETE", location.String(), nil)
+	if err != nil {
+		return
+	}
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		glog.V(2).Infof("canceling upload %s: %v", location, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// PutManifest uploads the raw manifest payload as image:reference to the
+// upstream registry, and returns its digest.
+func (r *RegistryClient) PutManifest(image, reference, mediaType string, payload []byte) (digest.Digest, error) {
+	var dgst digest.Digest
+	err := r.withUpstream(func(reg *registry.Registry) error {
+		var err error
+		dgst, err = putManifest(reg, image, reference, mediaType, payload)
+		return err
+	})
+	return dgst, err
+}
+
+func putManifest(reg *registry.Registry, image, reference, mediaType string, payload []byte) (digest.Digest, error) {
+	u := fmt.Sprintf("%s/v2/%s/manifests/%s", reg.URL, image, reference)
+	glog.V(2).Infof("uploading manifest %s", u)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	dgst := digest.FromBytes(payload)
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" {
+		remote, err := digest.Parse(header)
+		if err != nil {
+			return "", fmt.Errorf("invalid digest from %s: %w", u, err)
+		}
+		if remote != dgst {
+			return "", fmt.Errorf("%s: registry reported digest %s, expected %s",
+				u, remote, dgst)
+		}
+	}
+	return dgst, nil
+}
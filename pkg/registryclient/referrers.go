@@ -0,0 +1,102 @@
+package registryclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/golang/glog"
+	"github.com/ldx/docker-registry-client/registry"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// referrersIndex is the image index returned by the OCI referrers API, or
+// stored under the referrers tag by registries not supporting it.
+type referrersIndex struct {
+	Manifests []struct {
+		distribution.Descriptor
+		ArtifactType string `json:"artifactType,omitempty"`
+	} `json:"manifests"`
+}
+
+// ReferrersTag returns the tag used for the list of referrers of the manifest
+// dgst, e.g. sha256-<hex>, in registries not supporting the referrers API.
+func ReferrersTag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1)
+}
+
+// isNotFound returns true if err is an HTTP 404 error.
+func isNotFound(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	statusErr, ok := err.(*registry.HttpStatusError)
+	return ok && statusErr.Response.StatusCode == http.StatusNotFound
+}
+
+// getReferrers fetches the referrers of dgst in image via the referrers API,
+// falling back to the referrers tag.
+func getReferrers(reg *registry.Registry, image string, dgst digest.Digest) (*referrersIndex, error) {
+	u := fmt.Sprintf("%s/v2/%s/referrers/%s", reg.URL, image, dgst)
+	glog.V(2).Infof("getting referrers %s", u)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", v1.MediaTypeImageIndex)
+	var buf []byte
+	resp, err := reg.Client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		buf, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+	} else if isNotFound(err) {
+		glog.V(2).Infof("%s: referrers API not supported, trying tag %s",
+			reg.URL, ReferrersTag(dgst))
+		_, buf, err = getManifest(reg, image, ReferrersTag(dgst))
+		if isNotFound(err) {
+			return &referrersIndex{}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, err
+	}
+	index := &referrersIndex{}
+	if err := json.Unmarshal(buf, index); err != nil {
+		return nil, fmt.Errorf("parsing referrers of %s: %v", dgst, err)
+	}
+	return index, nil
+}
+
+// Referrers returns the descriptors of the manifests referring to the manifest
+// dgst in image, e.g. signatures, via the OCI referrers API. If artifactType
+// is not empty, only referrers of that type are returned.
+func (r *RegistryClient) Referrers(image string, dgst digest.Digest, artifactType string) ([]distribution.Descriptor, error) {
+	descs := []distribution.Descriptor{}
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		index, err := getReferrers(reg, repo, dgst)
+		if err != nil {
+			return err
+		}
+		descs = descs[:0]
+		for _, m := range index.Manifests {
+			if artifactType == "" || m.ArtifactType == artifactType {
+				descs = append(descs, m.Descriptor)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return descs, nil
+}
@@ -2,34 +2,109 @@ package registryclient
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/manifestlist"
 	"github.com/docker/distribution/manifest/schema1"
 	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/metrics"
 	"github.com/elotl/tosi/pkg/util"
 	"github.com/golang/glog"
 	"github.com/ldx/docker-registry-client/registry"
 	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// Mirror is a registry mirror, tried before the upstream registry.
+type Mirror struct {
+	// URL of the mirror. It might have a path, which is used as the
+	// namespace for repositories on the mirror, replacing the upstream
+	// namespace, e.g. https://mirror.example.com/dockerhub.
+	URL string
+	// Insecure allows plain HTTP and disables TLS certificate verification.
+	Insecure bool
+}
+
+// Options configure a RegistryClient.
+type Options struct {
+	// Username and Password are used for logging in to the upstream
+	// registry. Leave them empty if no login is required.
+	Username string
+	Password string
+	// Credentials are tried in order after Username and Password, e.g. the
+	// ones from image pull secrets matching the image, see Keyring. The
+	// first ones the registry accepts are used, and the ones after them are
+	// tried in order if the registry rejects a request, e.g. for a
+	// repository the first ones have no access to.
+	Credentials []Credentials
+	// TokenCache caches the bearer tokens of the registries. If it is nil,
+	// tokens are cached in memory, shared by all clients.
+	TokenCache *TokenCache
+	// ValidateCache enables verifying the checksum of already downloaded
+	// blobs.
+	ValidateCache bool
+	// Insecure allows plain HTTP and disables TLS certificate verification.
+	Insecure bool
+	// CertsDir is the directory with per-registry CA and client
+	// certificates, using the same layout as /etc/docker/certs.d, e.g.
+	// <CertsDir>/registry.example.com:5000/ca.crt. Leave it empty to use
+	// only the system CA certificates.
+	CertsDir string
+	// Namespace is the part of repository names on the upstream registry that
+	// is replaced with the namespace of a mirror, e.g. google_containers for
+	// k8s.gcr.io images, which are served from gcr.io/google_containers.
+	Namespace string
+	// Mirrors are tried in order, before falling back to the upstream
+	// registry.
+	Mirrors []Mirror
+	// MaxRetries is the number of times a request failing with a transient
+	// error is retried. Zero means DefaultMaxRetries, and a negative value
+	// disables retries.
+	MaxRetries int
+}
+
+type endpoint struct {
+	reg   *registry.Registry
+	retry *retryTransport
+	// Only set for mirrors.
+	mirror    bool
+	namespace string
+	// pingErr is the error pinging the registry when creating the endpoint,
+	// e.g. if it rejected the credentials.
+	pingErr error
+}
+
 type RegistryClient struct {
-	reg                  *registry.Registry
+	// Mirrors first, the upstream registry last.
+	endpoints            []*endpoint
+	namespace            string
 	validateCachedLayers bool
+	// logins are the endpoints for the upstream registry using the
+	// credentials after the ones it accepted when pinging it, in order. They
+	// are created from remaining via connect when the registry rejects a
+	// request, e.g. because the credentials are only valid for some
+	// repositories.
+	lock      sync.Mutex
+	logins    []*endpoint
+	remaining []Credentials
+	connect   func(creds Credentials) (*endpoint, error)
 }
 
-func NewRegistryClient(registryURL, username, password string, validate bool) (*RegistryClient, error) {
-	regURL := strings.TrimSuffix(registryURL, "/")
+func newTransport(tlsConfig *tls.Config) *http.Transport {
 	// Creates a client with a shorter connection timeout, useful inside AWS.
-	timeoutTransport := &http.Transport{
+	transport := &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
 			Timeout:   10 * time.Second,
@@ -40,41 +115,414 @@ func NewRegistryClient(registryURL, username, password string, validate bool) (*
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
 	}
-	u, _ := url.Parse(regURL)
-	if u.Scheme == "" {
-		regURL = "https://" + regURL
+	return transport
+}
+
+func newRegistry(regURL string, creds Credentials, cache *TokenCache, tlsConfig *tls.Config, maxRetries int) (*registry.Registry, *retryTransport, error) {
+	// Retries happen below authentication, so requests for tokens are
+	// retried too.
+	retry := newRetryTransport(newTransport(tlsConfig), regURL, maxRetries)
+	tokens, err := newTokenTransport(retry, regURL, creds, cache)
+	if err != nil {
+		return nil, nil, err
+	}
+	transport := &registry.ErrorTransport{
+		Transport: &registry.BasicTransport{
+			Transport: tokens,
+			URL:       regURL,
+			Username:  creds.Username,
+			Password:  creds.Password,
+		},
 	}
-	transport := registry.WrapTransport(
-		timeoutTransport, regURL, username, password)
-	reg := &registry.Registry{
+	return &registry.Registry{
 		URL: regURL,
 		Client: &http.Client{
 			Transport: transport,
 		},
 		Logf: registry.Log,
+	}, retry, nil
+}
+
+// isConnectionError returns true if err is not an HTTP status error, e.g. the
+// connection was refused or the TLS handshake failed.
+func isConnectionError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	_, ok := err.(*registry.HttpStatusError)
+	return !ok
+}
+
+// isAuthError returns true if err is an HTTP 401 or 403 error, e.g. if the
+// registry rejected the credentials.
+func isAuthError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	statusErr, ok := err.(*registry.HttpStatusError)
+	if !ok {
+		return false
+	}
+	code := statusErr.Response.StatusCode
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+// newEndpoint creates an endpoint for the registry at regURL, and pings it. If
+// insecure is set, plain HTTP is used if HTTPS does not work. TLS certificates
+// for the registry are loaded from certsDir. Bearer tokens are cached in
+// cache.
+func newEndpoint(regURL string, creds Credentials, cache *TokenCache, insecure bool, certsDir string, maxRetries int) (*endpoint, error) {
+	regURL = strings.TrimSuffix(regURL, "/")
+	if !strings.Contains(regURL, "://") {
+		regURL = "https://" + regURL
+	}
+	u, err := url.Parse(regURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry URL %q: %v", regURL, err)
+	}
+	tlsConfig, err := newTLSConfig(certsDir, u.Host, insecure)
+	if err != nil {
+		return nil, fmt.Errorf("TLS configuration for %s: %v", u.Host, err)
+	}
+	reg, retry, err := newRegistry(regURL, creds, cache, tlsConfig, maxRetries)
+	if err != nil {
+		return nil, err
+	}
+	err = reg.Ping()
+	if err != nil && insecure && u.Scheme == "https" && isConnectionError(err) {
+		httpURL := "http://" + strings.TrimPrefix(regURL, "https://")
+		glog.Warningf("pinging %s failed: %v, trying %s", regURL, err, httpURL)
+		reg, retry, err = newRegistry(httpURL, creds, cache, tlsConfig, maxRetries)
+		if err != nil {
+			return nil, err
+		}
+		err = reg.Ping()
+	}
+	if err != nil {
+		glog.Warningf("pinging %s failed: %v", reg.URL, err)
+	}
+	return &endpoint{
+		reg:     reg,
+		retry:   retry,
+		pingErr: err,
+	}, nil
+}
+
+// loginEndpoint creates the endpoint for the upstream registry via connect,
+// trying creds in order until the registry accepts one of them. Without
+// credentials, no login is used. If the registry rejects all of them, the
+// first ones are used, so pulls fail with the same error as before. It also
+// returns the credentials after the accepted ones, which are tried when the
+// registry rejects a request later.
+func loginEndpoint(regURL string, creds []Credentials, connect func(creds Credentials) (*endpoint, error)) (*endpoint, []Credentials, error) {
+	if len(creds) == 0 {
+		creds = []Credentials{{}}
+	}
+	var first *endpoint
+	for i, c := range creds {
+		e, err := connect(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		if first == nil {
+			first = e
+		}
+		if e.pingErr == nil || !isAuthError(e.pingErr) {
+			if i > 0 {
+				glog.Infof("logged in to %s as %s", regURL, c.describe())
+			}
+			return e, creds[i+1:], nil
+		}
+		if i < len(creds)-1 {
+			glog.Warningf("%s rejected the credentials of %s, trying the next ones",
+				regURL, c.describe())
+		}
+	}
+	return first, nil, nil
+}
+
+// login returns the upstream endpoint using the credentials with index i in
+// the remaining ones, connecting to the registry if needed, or nil if there
+// are no more credentials.
+func (r *RegistryClient) login(i int) (*endpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for len(r.logins) <= i && len(r.remaining) > 0 {
+		creds := r.remaining[0]
+		e, err := r.connect(creds)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("trying the credentials of %s for %s",
+			creds.describe(), e.reg.URL)
+		r.remaining = r.remaining[1:]
+		r.logins = append(r.logins, e)
+	}
+	if i >= len(r.logins) {
+		return nil, nil
+	}
+	return r.logins[i], nil
+}
+
+// withUpstream calls fn with the upstream registry. If the registry rejects
+// the credentials, fn is called again with the other credentials in order,
+// until it succeeds. If all of them are rejected, the first error is
+// returned.
+func (r *RegistryClient) withUpstream(fn func(reg *registry.Registry) error) error {
+	e := r.endpoints[len(r.endpoints)-1]
+	err := fn(e.reg)
+	for i := 0; err != nil && isAuthError(err); i++ {
+		next, loginErr := r.login(i)
+		if loginErr != nil {
+			glog.Warningf("connecting to %s: %v", e.reg.URL, loginErr)
+			return err
+		}
+		if next == nil {
+			return err
+		}
+		glog.Warningf("%s: %v, retrying with the next credentials",
+			e.reg.URL, err)
+		if nextErr := fn(next.reg); nextErr == nil || !isAuthError(nextErr) {
+			return nextErr
+		}
+	}
+	return err
+}
+
+// NewRegistryClient creates a client for the registry at registryURL, logging
+// in with username and password if they are set. If validate is set, the
+// checksums of already downloaded blobs are verified.
+func NewRegistryClient(registryURL, username, password string, validate bool) (*RegistryClient, error) {
+	return NewRegistryClientWithOptions(registryURL, Options{
+		Username:      username,
+		Password:      password,
+		ValidateCache: validate,
+	})
+}
+
+// NewRegistryClientWithOptions creates a client for the registry at
+// registryURL, configured via opts.
+func NewRegistryClientWithOptions(registryURL string, opts Options) (*RegistryClient, error) {
+	maxRetries := opts.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	} else if maxRetries < 0 {
+		maxRetries = 0
+	}
+	endpoints := make([]*endpoint, 0, len(opts.Mirrors)+1)
+	for _, mirror := range opts.Mirrors {
+		mirrorURL := mirror.URL
+		if !strings.Contains(mirrorURL, "://") {
+			mirrorURL = "https://" + mirrorURL
+		}
+		u, err := url.Parse(mirrorURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror URL %q: %v", mirror.URL, err)
+		}
+		namespace := strings.Trim(u.Path, "/")
+		u.Path = ""
+		e, err := newEndpoint(u.String(), Credentials{}, opts.TokenCache,
+			mirror.Insecure, opts.CertsDir, maxRetries)
+		if err != nil {
+			return nil, err
+		}
+		e.mirror = true
+		e.namespace = namespace
+		endpoints = append(endpoints, e)
 	}
-	if err := reg.Ping(); err != nil {
-		glog.Warningf("pinging %s failed: %v", registryURL, err)
+	creds := []Credentials{}
+	if opts.Username != "" || opts.Password != "" {
+		creds = append(creds, Credentials{
+			Username: opts.Username,
+			Password: opts.Password,
+		})
 	}
+	creds = append(creds, opts.Credentials...)
+	connect := func(c Credentials) (*endpoint, error) {
+		return newEndpoint(registryURL, c, opts.TokenCache, opts.Insecure,
+			opts.CertsDir, maxRetries)
+	}
+	e, remaining, err := loginEndpoint(registryURL, creds, connect)
+	if err != nil {
+		return nil, err
+	}
+	endpoints = append(endpoints, e)
 	return &RegistryClient{
-		reg:                  reg,
-		validateCachedLayers: validate,
+		endpoints:            endpoints,
+		namespace:            opts.Namespace,
+		validateCachedLayers: opts.ValidateCache,
+		remaining:            remaining,
+		connect:              connect,
 	}, nil
 }
 
-func (r *RegistryClient) ManifestV1(image, tag string) (*schema1.SignedManifest, error) {
-	return r.reg.Manifest(image, tag)
+// RateLimit returns the lowest pull quota reported by the registry or its
+// mirrors, relative to their limits, or nil if none of them reported one.
+func (r *RegistryClient) RateLimit() *RateLimit {
+	var lowest *RateLimit
+	for _, e := range r.endpoints {
+		rateLimit := e.retry.RateLimit()
+		if rateLimit == nil || rateLimit.Limit <= 0 {
+			continue
+		}
+		if lowest == nil ||
+			rateLimit.Remaining*lowest.Limit < lowest.Remaining*rateLimit.Limit {
+			lowest = rateLimit
+		}
+	}
+	return lowest
+}
+
+// repo returns the name of the upstream repository image on endpoint e.
+func (r *RegistryClient) repo(e *endpoint, image string) string {
+	if !e.mirror {
+		return image
+	}
+	if r.namespace != "" {
+		image = strings.TrimPrefix(image, r.namespace+"/")
+	}
+	if e.namespace == "" {
+		return image
+	}
+	return e.namespace + "/" + image
+}
+
+// try calls fn for each endpoint, mirrors first, until it succeeds. The
+// upstream registry is called via withUpstream.
+func (r *RegistryClient) try(image string, fn func(reg *registry.Registry, repo string) error) error {
+	for _, e := range r.endpoints[:len(r.endpoints)-1] {
+		err := fn(e.reg, r.repo(e, image))
+		if err == nil {
+			return nil
+		}
+		glog.Warningf("mirror %s failed for %s: %v, trying next endpoint",
+			e.reg.URL, image, err)
+	}
+	return r.withUpstream(func(reg *registry.Registry) error {
+		return fn(reg, image)
+	})
+}
+
+// ManifestMediaTypes are the manifest media types sent in the Accept header
+// when fetching manifests, in order of preference.
+var ManifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	manifestlist.MediaTypeManifestList,
+	v1.MediaTypeImageManifest,
+	v1.MediaTypeImageIndex,
+	schema1.MediaTypeSignedManifest,
+	schema1.MediaTypeManifest,
+}
+
+// Manifest fetches the manifest of image:reference from the registry. It
+// returns the media type reported by the registry and the raw manifest, which
+// might be a manifest list or an image index.
+func (r *RegistryClient) Manifest(image, reference string) (string, []byte, error) {
+	mediaType := ""
+	var buf []byte
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		var err error
+		mediaType, buf, err = getManifest(reg, repo, reference)
+		return err
+	})
+	return mediaType, buf, err
+}
+
+func getManifest(reg *registry.Registry, image, reference string) (string, []byte, error) {
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", reg.URL, image, reference)
+	glog.V(2).Infof("getting manifest %s", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, mediaType := range ManifestMediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, err
+	}
+	return resp.Header.Get("Content-Type"), buf, nil
+}
+
+// Resolve returns the descriptor of the manifest for image:reference, via a
+// HEAD request. If the registry does not send the Docker-Content-Digest
+// header, the manifest is fetched for calculating its digest.
+func (r *RegistryClient) Resolve(image, reference string) (distribution.Descriptor, error) {
+	desc := distribution.Descriptor{}
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		var err error
+		desc, err = headManifest(reg, repo, reference)
+		if err != nil {
+			return err
+		}
+		if desc.Digest != "" {
+			return nil
+		}
+		glog.V(2).Infof("%s: no digest for %s:%s, fetching manifest",
+			reg.URL, repo, reference)
+		mediaType, buf, err := getManifest(reg, repo, reference)
+		if err != nil {
+			return err
+		}
+		desc = distribution.Descriptor{
+			MediaType: mediaType,
+			Size:      int64(len(buf)),
+			Digest:    digest.FromBytes(buf),
+		}
+		return nil
+	})
+	return desc, err
 }
 
-func (r *RegistryClient) ManifestV2(image, tag string) (*schema2.DeserializedManifest, error) {
-	return r.reg.ManifestV2(image, tag)
+func headManifest(reg *registry.Registry, image, reference string) (distribution.Descriptor, error) {
+	desc := distribution.Descriptor{}
+	url := fmt.Sprintf("%s/v2/%s/manifests/%s", reg.URL, image, reference)
+	glog.V(2).Infof("resolving manifest %s", url)
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return desc, err
+	}
+	for _, mediaType := range ManifestMediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		return desc, err
+	}
+	resp.Body.Close()
+	desc.MediaType = resp.Header.Get("Content-Type")
+	desc.Size = resp.ContentLength
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" {
+		desc.Digest, err = digest.Parse(header)
+		if err != nil {
+			return desc, fmt.Errorf("invalid digest from %s: %v", url, err)
+		}
+	}
+	return desc, nil
 }
 
 func (r *RegistryClient) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	var buf []byte
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		var err error
+		buf, err = getBlob(reg, repo, desc)
+		return err
+	})
+	return buf, err
+}
+
+func getBlob(reg *registry.Registry, image string, desc distribution.Descriptor) ([]byte, error) {
 	name := desc.Digest.String()
 	glog.V(2).Infof("getting image %s blob %s", image, name)
-	reader, err := r.reg.DownloadLayer(image, desc.Digest)
+	reader, err := reg.DownloadLayer(image, desc.Digest)
 	if err != nil {
 		return nil, err
 	}
@@ -96,6 +544,19 @@ func (r *RegistryClient) GetBlob(image string, desc distribution.Descriptor) ([]
 	return buf.Bytes(), nil
 }
 
+// OpenBlob returns a reader for streaming the content of a blob from the
+// registry, without verifying it.
+func (r *RegistryClient) OpenBlob(image string, desc distribution.Descriptor) (io.ReadCloser, error) {
+	var reader io.ReadCloser
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		var err error
+		glog.V(2).Infof("opening image %s blob %s from %s", repo, desc.Digest, reg.URL)
+		reader, err = reg.DownloadLayer(repo, desc.Digest)
+		return err
+	})
+	return reader, err
+}
+
 func (r *RegistryClient) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
 	name := filepath.Join(dir, desc.Digest.Encoded())
 	// Check if we already have the blob downloaded.
@@ -105,38 +566,26 @@ func (r *RegistryClient) SaveBlob(image, dir string, desc distribution.Descripto
 			glog.V(2).Infof("image %s blob %s already exists", image, name)
 			return name, nil
 		}
+		glog.Warningf("image %s blob %s is corrupted, removing", image, name)
+		os.Remove(name)
 	}
-	glog.V(2).Infof("saving image %s blob %s", image, name)
-	tmpname := filepath.Join(dir, "."+desc.Digest.Encoded())
-	reader, err := r.reg.DownloadLayer(image, desc.Digest)
-	if err != nil {
-		return "", err
-	}
-	defer reader.Close()
-	f, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
-	verifier := desc.Digest.Verifier()
-	writer := io.MultiWriter(f, verifier)
-	n, err := io.Copy(writer, reader)
-	if err != nil {
-		return "", err
-	}
-	f.Close()
-	if n < desc.Size {
-		return "", fmt.Errorf(
-			"saving %s: wrote only %d/%d bytes", name, n, desc.Size)
-	}
-	glog.V(5).Infof("%s size: %d bytes", name, n)
-	if !verifier.Verified() {
-		return "", fmt.Errorf("%s: verifier failed", name)
-	}
-	err = util.RenameFile(tmpname, name)
+	start := time.Now()
+	err := r.try(image, func(reg *registry.Registry, repo string) error {
+		glog.V(2).Infof("saving image %s blob %s from %s", repo, name, reg.URL)
+		reader, err := reg.DownloadLayer(repo, desc.Digest)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		return util.WriteBlob(name, desc, reader)
+	})
 	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.OperationDownload,
+			metrics.Reason(err)).Inc()
 		return "", err
 	}
+	metrics.DownloadedBytes.Add(float64(desc.Size))
+	metrics.DownloadDuration.Observe(time.Since(start).Seconds())
 	glog.V(2).Infof("%s saved blob", name)
 	return name, nil
 }
@@ -0,0 +1,248 @@
+package registryclient
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/registrytest"
+)
+
+// addImage adds a manifest for repo:tag to reg, with content identifying it,
+// and returns the payload.
+func addImage(t *testing.T, reg *registrytest.Registry, repo, tag, content string) []byte {
+	m := schema2.Manifest{
+		Config: reg.AddBlob(schema2.MediaTypeImageConfig, []byte(content)),
+		Layers: []distribution.Descriptor{},
+	}
+	m.SchemaVersion = 2
+	m.MediaType = schema2.MediaTypeManifest
+	payload, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.AddManifest(repo, tag, schema2.MediaTypeManifest, payload)
+	return payload
+}
+
+// manifestRequests returns the manifest requests served by reg.
+func manifestRequests(reg *registrytest.Registry) []string {
+	requests := []string{}
+	for _, req := range reg.Requests() {
+		if strings.Contains(req, "/manifests/") {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func TestTLSCertsDir(t *testing.T) {
+	server := httptest.NewTLSServer(registrytest.New())
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certsDir, err := ioutil.TempDir("", "tosi-certs-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(certsDir)
+
+	// The certificate of the test server is not trusted without certs.d.
+	client, err := NewRegistryClientWithOptions(server.URL, Options{
+		CertsDir:   certsDir,
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.endpoints[0].pingErr; err == nil {
+		t.Fatalf("expected certificate error without CA")
+	}
+
+	dir := filepath.Join(certsDir, u.Host)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ca := pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	})
+	err = ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = NewRegistryClientWithOptions(server.URL, Options{
+		CertsDir:   certsDir,
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.endpoints[0].pingErr; err != nil {
+		t.Fatalf("pinging with CA from %s: %v", dir, err)
+	}
+
+	// Client certificates need both the certificate and the key.
+	err = ioutil.WriteFile(filepath.Join(dir, "client.key"), []byte("key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewRegistryClientWithOptions(server.URL, Options{
+		CertsDir:   certsDir,
+		MaxRetries: -1,
+	})
+	if err == nil || !strings.Contains(err.Error(), "missing client certificate") {
+		t.Fatalf("expected missing client certificate error, got %v", err)
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	upstream := registrytest.New()
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+	mirror := registrytest.New()
+	mirrorServer := httptest.NewServer(mirror)
+	defer mirrorServer.Close()
+	// A mirror that is down.
+	downServer := httptest.NewServer(registrytest.New())
+	downURL := downServer.URL
+	downServer.Close()
+
+	upstreamAlpine := addImage(t, upstream, "google_containers/alpine", "3.6", "upstream")
+	mirrorAlpine := addImage(t, mirror, "dockerhub/alpine", "3.6", "mirror")
+	upstreamBusybox := addImage(t, upstream, "google_containers/busybox", "latest", "upstream")
+
+	client, err := NewRegistryClientWithOptions(upstreamServer.URL, Options{
+		Namespace: "google_containers",
+		Mirrors: []Mirror{
+			{URL: downURL},
+			{URL: mirrorServer.URL + "/dockerhub/"},
+		},
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		image    string
+		expected []byte
+		upstream bool
+	}{
+		{"google_containers/alpine", mirrorAlpine, false},
+		{"google_containers/busybox", upstreamBusybox, true},
+	}
+	for _, tc := range testCases {
+		before := len(manifestRequests(upstream))
+		ref := "3.6"
+		if tc.upstream {
+			ref = "latest"
+		}
+		_, buf, err := client.Manifest(tc.image, ref)
+		if err != nil {
+			t.Fatalf("getting %s: %v", tc.image, err)
+		}
+		if string(buf) != string(tc.expected) {
+			t.Errorf("%s: expected manifest %s, got %s", tc.image, tc.expected, buf)
+		}
+		fromUpstream := len(manifestRequests(upstream)) > before
+		if fromUpstream != tc.upstream {
+			t.Errorf("%s: expected upstream %v, got %v", tc.image, tc.upstream,
+				fromUpstream)
+		}
+	}
+	found := false
+	for _, req := range manifestRequests(mirror) {
+		if req == "GET /v2/dockerhub/busybox/manifests/latest" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("mirror not tried for busybox: %v", mirror.Requests())
+	}
+
+	// Without mirrors, the upstream manifest is returned.
+	client, err = NewRegistryClientWithOptions(upstreamServer.URL, Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, buf, err := client.Manifest("google_containers/alpine", "3.6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(upstreamAlpine) {
+		t.Errorf("expected upstream manifest %s, got %s", upstreamAlpine, buf)
+	}
+}
+
+func TestCredentialsFallback(t *testing.T) {
+	reg := registrytest.New()
+	// Each user can only access the repositories in their namespace.
+	reg.Authorize = func(r *http.Request, repo string) bool {
+		if repo == "" {
+			return true
+		}
+		user, _, ok := r.BasicAuth()
+		return ok && strings.HasPrefix(repo, user+"/")
+	}
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	alice := addImage(t, reg, "alice/app", "1", "alice")
+	bob := addImage(t, reg, "bob/app", "1", "bob")
+
+	client, err := NewRegistryClientWithOptions(server.URL, Options{
+		Credentials: []Credentials{
+			{Username: "alice", Password: "secret"},
+			{Username: "bob", Password: "secret"},
+		},
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		for repo, expected := range map[string][]byte{"alice/app": alice, "bob/app": bob} {
+			_, buf, err := client.Manifest(repo, "1")
+			if err != nil {
+				t.Fatalf("getting %s: %v", repo, err)
+			}
+			if string(buf) != string(expected) {
+				t.Errorf("%s: expected %s, got %s", repo, expected, buf)
+			}
+		}
+	}
+	if _, err := client.PutManifest("bob/app", "2", schema2.MediaTypeManifest, bob); err != nil {
+		t.Errorf("pushing to bob/app: %v", err)
+	}
+	tags, err := client.Tags("bob/app")
+	if err != nil || len(tags) != 2 {
+		t.Errorf("expected 2 tags for bob/app, got %v, %v", tags, err)
+	}
+	_, _, err = client.Manifest("carol/app", "1")
+	if err == nil || !isAuthError(err) {
+		t.Errorf("expected authentication error for carol/app, got %v", err)
+	}
+
+	// Without bob, the registry rejects requests for bob/app.
+	client, err = NewRegistryClientWithOptions(server.URL, Options{
+		Username:   "alice",
+		Password:   "secret",
+		MaxRetries: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := client.Manifest("bob/app", "1"); err == nil || !isAuthError(err) {
+		t.Errorf("expected authentication error for bob/app, got %v", err)
+	}
+}
@@ -0,0 +1,297 @@
+package registryclient
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/elotl/tosi/pkg/metrics"
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultMaxRetries is the number of times a failed request is retried
+	// if Options.MaxRetries is not set.
+	DefaultMaxRetries = 5
+	// Backoff before the first retry, doubled after each attempt.
+	initialBackoff = 500 * time.Millisecond
+	maxBackoff     = 30 * time.Second
+	// Requests are not retried if the registry asks to wait longer than
+	// this, e.g. when the Docker Hub pull quota is exhausted.
+	maxRetryAfter = 2 * time.Minute
+)
+
+var (
+	jitterLock sync.Mutex
+	jitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// RateLimit is the pull quota reported by a registry via the RateLimit-Limit
+// and RateLimit-Remaining headers, e.g. "100;w=21600".
+type RateLimit struct {
+	// Registry is the URL of the registry that reported the limit.
+	Registry  string
+	Limit     int
+	Remaining int
+	// Window is the period the limit applies to, if reported.
+	Window time.Duration
+}
+
+func (l RateLimit) String() string {
+	s := fmt.Sprintf("%d/%d pulls remaining", l.Remaining, l.Limit)
+	if l.Window > 0 {
+		s += fmt.Sprintf(" per %v", l.Window)
+	}
+	return s
+}
+
+// parseRateLimit parses a rate limit header value, e.g. "100;w=21600". It
+// returns the quota and the window, which is zero if not present.
+func parseRateLimit(value string) (int, time.Duration, error) {
+	parts := strings.Split(value, ";")
+	quota, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid rate limit %q", value)
+	}
+	window := time.Duration(0)
+	for _, param := range parts[1:] {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "w=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(param, "w="))
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid rate limit window %q", value)
+		}
+		window = time.Duration(seconds) * time.Second
+	}
+	return quota, window, nil
+}
+
+// parseRetryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date. It returns zero if the header is missing or
+// invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// isRetryableStatus returns true for status codes that indicate a transient
+// failure. Others, e.g. 401 or 404, are returned to the caller right away.
+func isRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// isRetryableError returns true if err is a transient network error, e.g. a
+// timeout or a connection reset by the registry. Errors like connection
+// refused or TLS certificate errors are not retried.
+func isRetryableError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	switch e := err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError,
+		x509.CertificateInvalidError:
+		return false
+	case *net.OpError:
+		if e.Timeout() {
+			return true
+		}
+		return isRetryableError(e.Err)
+	case *net.DNSError:
+		return e.Timeout() || e.Temporary()
+	case syscall.Errno:
+		return e == syscall.ECONNRESET || e == syscall.ECONNABORTED ||
+			e == syscall.EPIPE
+	case interface{ Unwrap() error }:
+		if inner := e.Unwrap(); inner != nil {
+			return isRetryableError(inner)
+		}
+	}
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return true
+	}
+	return false
+}
+
+// retryTransport retries requests that failed with a transient error, using
+// exponential backoff with jitter, or the delay requested by the registry via
+// Retry-After. It also keeps track of the rate limit reported by the
+// registry.
+type retryTransport struct {
+	Transport  http.RoundTripper
+	MaxRetries int
+	registry   string
+	lock       sync.Mutex
+	rateLimit  *RateLimit
+}
+
+func newRetryTransport(transport http.RoundTripper, registry string, maxRetries int) *retryTransport {
+	return &retryTransport{
+		Transport:  transport,
+		MaxRetries: maxRetries,
+		registry:   registry,
+	}
+}
+
+// backoff returns the delay before retry number attempt, starting from zero.
+func backoff(attempt int) time.Duration {
+	delay := maxBackoff
+	if attempt < 16 {
+		delay = initialBackoff << uint(attempt)
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	// Use a random delay between delay/2 and delay.
+	half := int64(delay / 2)
+	jitterLock.Lock()
+	defer jitterLock.Unlock()
+	return time.Duration(half + jitter.Int63n(half+1))
+}
+
+// RateLimit returns the most recent rate limit reported by the registry, or
+// nil if it has not reported any.
+func (t *retryTransport) RateLimit() *RateLimit {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.rateLimit == nil {
+		return nil
+	}
+	rateLimit := *t.rateLimit
+	return &rateLimit
+}
+
+func (t *retryTransport) updateRateLimit(resp *http.Response) {
+	limitHeader := resp.Header.Get("RateLimit-Limit")
+	remainingHeader := resp.Header.Get("RateLimit-Remaining")
+	if limitHeader == "" || remainingHeader == "" {
+		return
+	}
+	limit, window, err := parseRateLimit(limitHeader)
+	if err != nil {
+		glog.V(2).Infof("%s: %v", t.registry, err)
+		return
+	}
+	remaining, _, err := parseRateLimit(remainingHeader)
+	if err != nil {
+		glog.V(2).Infof("%s: %v", t.registry, err)
+		return
+	}
+	rateLimit := &RateLimit{
+		Registry:  t.registry,
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+	}
+	glog.V(4).Infof("%s: rate limit %v", t.registry, rateLimit)
+	t.lock.Lock()
+	t.rateLimit = rateLimit
+	t.lock.Unlock()
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptReq, err := withFreshBody(req)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.Transport.RoundTrip(attemptReq)
+		if resp != nil {
+			t.updateRateLimit(resp)
+			metrics.RegistryResponses.WithLabelValues(req.URL.Host,
+				req.Method, strconv.Itoa(resp.StatusCode)).Inc()
+		}
+		delay := backoff(attempt)
+		if err == nil {
+			if !isRetryableStatus(resp.StatusCode) {
+				return resp, nil
+			}
+			retryAfter := parseRetryAfter(
+				resp.Header.Get("Retry-After"), time.Now())
+			if retryAfter > maxRetryAfter {
+				glog.Warningf("%s %s: %s, registry asked to retry after %v, giving up",
+					req.Method, req.URL, resp.Status, retryAfter)
+				return resp, nil
+			}
+			if retryAfter > delay {
+				delay = retryAfter
+			}
+		} else if !isRetryableError(err) {
+			return nil, err
+		}
+		if attempt >= t.MaxRetries || !canResend(req) {
+			return resp, err
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			// Drain the body, so the connection can be reused.
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		glog.Warningf("%s %s: %s, retrying in %v (%d/%d)",
+			req.Method, req.URL, reason, delay, attempt+1, t.MaxRetries)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// withFreshBody returns a copy of req with a new body, so that the request can
+// be sent again, e.g. when retrying it, or after getting a token when the
+// registry requires authentication. Requests without GetBody are returned as
+// is.
+func withFreshBody(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	fresh := new(http.Request)
+	*fresh = *req
+	fresh.Body = body
+	return fresh, nil
+}
+
+// canResend returns true if req can be sent again.
+func canResend(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,183 @@
+package registryclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"5", 5 * time.Second},
+		{" 120 ", 2 * time.Minute},
+		{"-1", 0},
+		{"soon", 0},
+		{"1.5", 0},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{now.Add(-30 * time.Second).Format(http.TimeFormat), 0},
+		{"Tue, 01 Jun 2021 12:01:00 GMT", time.Minute},
+	}
+	for _, tc := range testCases {
+		actual := parseRetryAfter(tc.value, now)
+		if actual != tc.expected {
+			t.Errorf("parseRetryAfter(%q): expected %v, got %v",
+				tc.value, tc.expected, actual)
+		}
+	}
+}
+
+func TestParseRateLimit(t *testing.T) {
+	testCases := []struct {
+		value  string
+		quota  int
+		window time.Duration
+		err    bool
+	}{
+		{value: "100", quota: 100},
+		{value: "100;w=21600", quota: 100, window: 6 * time.Hour},
+		{value: " 76 ; w=21600", quota: 76, window: 6 * time.Hour},
+		{value: "100;comment=x", quota: 100},
+		{value: "", err: true},
+		{value: "many", err: true},
+		{value: "100;w=long", err: true},
+	}
+	for _, tc := range testCases {
+		quota, window, err := parseRateLimit(tc.value)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parseRateLimit(%q): expected error", tc.value)
+			}
+			continue
+		}
+		if err != nil || quota != tc.quota || window != tc.window {
+			t.Errorf("parseRateLimit(%q): expected %d, %v, got %d, %v, %v",
+				tc.value, tc.quota, tc.window, quota, window, err)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, initialBackoff},
+		{1, 2 * initialBackoff},
+		{2, 4 * initialBackoff},
+		{5, 16 * time.Second},
+		{6, maxBackoff},
+		{15, maxBackoff},
+		{16, maxBackoff},
+		{100, maxBackoff},
+	}
+	for _, tc := range testCases {
+		for i := 0; i < 100; i++ {
+			delay := backoff(tc.attempt)
+			if delay < tc.max/2 || delay > tc.max {
+				t.Fatalf("backoff(%d): %v not between %v and %v",
+					tc.attempt, delay, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+func TestRetryTransport(t *testing.T) {
+	testCases := []struct {
+		name string
+		// statuses are the status codes sent by the server, in order. The
+		// last one is repeated. All responses have the Retry-After header
+		// retryAfter, if set.
+		statuses   []int
+		retryAfter string
+		maxRetries int
+		expected   int
+		requests   int
+	}{
+		{
+			name:       "success",
+			statuses:   []int{http.StatusOK},
+			maxRetries: 3,
+			expected:   http.StatusOK,
+			requests:   1,
+		},
+		{
+			name:       "transient failure",
+			statuses:   []int{http.StatusServiceUnavailable, http.StatusOK},
+			retryAfter: "0",
+			maxRetries: 3,
+			expected:   http.StatusOK,
+			requests:   2,
+		},
+		{
+			name:       "not retryable",
+			statuses:   []int{http.StatusNotFound},
+			maxRetries: 3,
+			expected:   http.StatusNotFound,
+			requests:   1,
+		},
+		{
+			name:       "out of retries",
+			statuses:   []int{http.StatusBadGateway},
+			maxRetries: 1,
+			expected:   http.StatusBadGateway,
+			requests:   2,
+		},
+		{
+			name:       "retry after too long",
+			statuses:   []int{http.StatusTooManyRequests},
+			retryAfter: "3600",
+			maxRetries: 3,
+			expected:   http.StatusTooManyRequests,
+			requests:   1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			lock := sync.Mutex{}
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				lock.Lock()
+				status := tc.statuses[len(tc.statuses)-1]
+				if requests < len(tc.statuses) {
+					status = tc.statuses[requests]
+				}
+				requests++
+				lock.Unlock()
+				w.Header().Set("RateLimit-Limit", "100;w=21600")
+				w.Header().Set("RateLimit-Remaining", "99;w=21600")
+				if tc.retryAfter != "" {
+					w.Header().Set("Retry-After", tc.retryAfter)
+				}
+				w.WriteHeader(status)
+			}))
+			defer server.Close()
+			transport := newRetryTransport(http.DefaultTransport, server.URL,
+				tc.maxRetries)
+			client := &http.Client{Transport: transport}
+			resp, err := client.Get(server.URL + "/v2/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tc.expected {
+				t.Errorf("expected status %d, got %d", tc.expected, resp.StatusCode)
+			}
+			if requests != tc.requests {
+				t.Errorf("expected %d requests, got %d", tc.requests, requests)
+			}
+			rateLimit := transport.RateLimit()
+			if rateLimit == nil || rateLimit.Limit != 100 ||
+				rateLimit.Remaining != 99 || rateLimit.Window != 6*time.Hour {
+				t.Errorf("unexpected rate limit %v", rateLimit)
+			}
+		})
+	}
+}
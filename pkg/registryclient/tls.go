@@ -0,0 +1,78 @@
+package registryclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultCertsDir is where docker looks for per-registry certificates.
+	DefaultCertsDir = "/etc/docker/certs.d"
+)
+
+// newTLSConfig creates the TLS configuration for the registry at host, which
+// might also include a port. Certificates are loaded from certsDir/<host>,
+// using the same layout as docker: *.crt files are CA certificates, which are
+// added to the system pool, and *.cert and *.key files are client certificate
+// and key pairs, e.g. client.cert and client.key.
+func newTLSConfig(certsDir, host string, insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if certsDir == "" || host == "" {
+		return config, nil
+	}
+	dir := filepath.Join(certsDir, host)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		switch filepath.Ext(f.Name()) {
+		case ".crt":
+			if config.RootCAs == nil {
+				pool, err := x509.SystemCertPool()
+				if err != nil {
+					glog.Warningf("loading system certificates: %v", err)
+					pool = x509.NewCertPool()
+				}
+				config.RootCAs = pool
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !config.RootCAs.AppendCertsFromPEM(buf) {
+				return nil, fmt.Errorf("no certificates found in %s", path)
+			}
+			glog.V(2).Infof("%s: added CA certificate %s", host, path)
+		case ".cert":
+			keyPath := strings.TrimSuffix(path, ".cert") + ".key"
+			cert, err := tls.LoadX509KeyPair(path, keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("loading client certificate %s: %v",
+					path, err)
+			}
+			config.Certificates = append(config.Certificates, cert)
+			glog.V(2).Infof("%s: added client certificate %s", host, path)
+		case ".key":
+			certPath := strings.TrimSuffix(path, ".key") + ".cert"
+			if _, err := os.Stat(certPath); err != nil {
+				return nil, fmt.Errorf("missing client certificate %s for %s",
+					certPath, path)
+			}
+		}
+	}
+	return config, nil
+}
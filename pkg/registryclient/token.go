@@ -0,0 +1,477 @@
+package registryclient
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/registry/client/auth/challenge"
+	"github.com/golang/glog"
+)
+
+const (
+	// clientID identifies tosi to OAuth2 token servers.
+	clientID = "tosi"
+	// defaultTokenExpiry is the lifetime of tokens without expires_in, as
+	// specified by the token authentication specification.
+	defaultTokenExpiry = 60 * time.Second
+	// tokenExpiryMargin is how long before expiring tokens are renewed, so
+	// they do not expire while requests using them are in flight.
+	tokenExpiryMargin = 10 * time.Second
+)
+
+// cachedToken is a bearer token, or an OAuth2 refresh token.
+type cachedToken struct {
+	Token string `json:"token,omitempty"`
+	// Expires is zero for refresh tokens, which do not expire.
+	Expires      time.Time `json:"expires,omitempty"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+}
+
+func (t *cachedToken) valid() bool {
+	return t.Expires.IsZero() || time.Now().Add(tokenExpiryMargin).Before(t.Expires)
+}
+
+// TokenCache caches the bearer tokens of registries, keyed by the realm and
+// service of the token server, the scopes of the token and the credentials
+// used for getting it, until they expire. OAuth2 refresh tokens are cached
+// too, so no password is needed for getting tokens for other scopes.
+type TokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+	// dir is where tokens are saved, if set, so they can be used by other
+	// processes too.
+	dir string
+}
+
+// defaultTokenCache is used by clients created without a token cache, so
+// clients in the same process share their tokens.
+var defaultTokenCache, _ = NewTokenCache("")
+
+// NewTokenCache creates a token cache. If dir is not empty, tokens are saved
+// in it, and loaded from it if they are not in memory.
+func NewTokenCache(dir string) (*TokenCache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &TokenCache{
+		tokens: make(map[string]*cachedToken),
+		dir:    dir,
+	}, nil
+}
+
+// path returns the file the token with key is saved in. Keys contain
+// credentials, so only their hash is used.
+func (c *TokenCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *TokenCache) get(key string) *cachedToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	token, ok := c.tokens[key]
+	if !ok && c.dir != "" {
+		buf, err := ioutil.ReadFile(c.path(key))
+		if err == nil {
+			token = &cachedToken{}
+			if err := json.Unmarshal(buf, token); err != nil {
+				glog.Warningf("invalid cached token %s: %v", c.path(key), err)
+				token = nil
+			}
+		}
+	}
+	if token == nil || !token.valid() {
+		return nil
+	}
+	c.tokens[key] = token
+	return token
+}
+
+func (c *TokenCache) put(key string, token *cachedToken) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[key] = token
+	if c.dir == "" {
+		return
+	}
+	buf, err := json.Marshal(token)
+	if err != nil {
+		return
+	}
+	// Write to a unique temporary file, other processes might save the
+	// same token at the same time.
+	f, err := ioutil.TempFile(c.dir, ".token")
+	if err != nil {
+		glog.Warningf("saving token: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), c.path(key))
+	}
+	if err != nil {
+		glog.Warningf("saving token: %v", err)
+	}
+}
+
+func (c *TokenCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.tokens, key)
+	if c.dir != "" {
+		os.Remove(c.path(key))
+	}
+}
+
+// Scopes are the access a token grants, e.g. repository:library/alpine:pull,
+// mapped to the actions, e.g. pull and push.
+type scopes map[string]map[string]bool
+
+// add adds the space separated scopes in s.
+func (s scopes) add(str string) {
+	for _, scope := range strings.Fields(str) {
+		i := strings.LastIndex(scope, ":")
+		if i < 0 {
+			continue
+		}
+		resource := scope[:i]
+		if s[resource] == nil {
+			s[resource] = make(map[string]bool)
+		}
+		for _, action := range strings.Split(scope[i+1:], ",") {
+			s[resource][action] = true
+		}
+	}
+}
+
+// list returns the scopes in a canonical form, sorted.
+func (s scopes) list() []string {
+	result := make([]string, 0, len(s))
+	for resource, actions := range s {
+		list := make([]string, 0, len(actions))
+		for action := range actions {
+			list = append(list, action)
+		}
+		sort.Strings(list)
+		result = append(result, resource+":"+strings.Join(list, ","))
+	}
+	sort.Strings(result)
+	return result
+}
+
+var repoPathRegexp = regexp.MustCompile(`/v2/(.+?)/(manifests|blobs|tags|referrers)/`)
+
+// requestScopes returns the scopes req needs. Requests modifying the
+// repository need push access, and cross-repository blob mounts need pull
+// access to the source repository too.
+func requestScopes(req *http.Request) scopes {
+	s := make(scopes)
+	if strings.HasSuffix(req.URL.Path, "/v2/_catalog") {
+		s.add("registry:catalog:*")
+		return s
+	}
+	m := repoPathRegexp.FindStringSubmatch(req.URL.Path)
+	if m == nil {
+		return s
+	}
+	actions := "pull"
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		actions = "pull,push"
+	}
+	s.add("repository:" + m[1] + ":" + actions)
+	if from := req.URL.Query().Get("from"); from != "" {
+		s.add("repository:" + from + ":pull")
+	}
+	return s
+}
+
+// tokenTransport authenticates requests to the registry at url via bearer
+// tokens, getting them from the token server of the registry, or from the
+// token cache. Other requests, e.g. blob downloads redirected to a CDN, are
+// sent as they are.
+type tokenTransport struct {
+	transport http.RoundTripper
+	url       *url.URL
+	creds     Credentials
+	cache     *TokenCache
+	mu        sync.Mutex
+	// realm and service identify the token server, once the registry sent
+	// a challenge.
+	realm   string
+	service string
+}
+
+func newTokenTransport(transport http.RoundTripper, regURL string, creds Credentials, cache *TokenCache) (*tokenTransport, error) {
+	u, err := url.Parse(regURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid registry URL %q: %v", regURL, err)
+	}
+	if cache == nil {
+		cache = defaultTokenCache
+	}
+	return &tokenTransport{
+		transport: transport,
+		url:       u,
+		creds:     creds,
+		cache:     cache,
+	}, nil
+}
+
+// isRegistry returns true if req is a request to the registry.
+func (t *tokenTransport) isRegistry(req *http.Request) bool {
+	return strings.EqualFold(req.URL.Scheme, t.url.Scheme) &&
+		strings.EqualFold(req.URL.Host, t.url.Host)
+}
+
+// tokenKey returns the cache key of the token for the scopes s.
+func (t *tokenTransport) tokenKey(realm, service string, s []string) string {
+	return strings.Join([]string{realm, service, strings.Join(s, " "),
+		t.creds.Username, t.creds.Password, t.creds.IdentityToken}, "|")
+}
+
+// refreshKey returns the cache key of the refresh token for the credentials.
+func (t *tokenTransport) refreshKey(realm, service string) string {
+	return strings.Join([]string{"refresh", realm, service,
+		t.creds.Username, t.creds.Password}, "|")
+}
+
+// withBearer returns a copy of req with token as its bearer token.
+func withBearer(req *http.Request, token string) *http.Request {
+	clone := req.Clone(req.Context())
+	clone.Header.Set("Authorization", "Bearer "+token)
+	return clone
+}
+
+// rewind returns a copy of req for sending it again, or nil if its body cannot
+// be sent again.
+func rewind(req *http.Request) *http.Request {
+	clone := req.Clone(req.Context())
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return nil
+		}
+		clone.Body = body
+	}
+	return clone
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.isRegistry(req) {
+		return t.transport.RoundTrip(req)
+	}
+	if t.creds.RegistryToken != "" {
+		return t.transport.RoundTrip(withBearer(req, t.creds.RegistryToken))
+	}
+	needed := requestScopes(req)
+	t.mu.Lock()
+	realm, service := t.realm, t.service
+	t.mu.Unlock()
+	sentKey := ""
+	orig := req
+	if realm != "" && len(needed) > 0 {
+		// Get a token before sending the request, the registry will
+		// require one anyway.
+		s := needed.list()
+		token, authResp, err := t.getToken(realm, service, s)
+		if authResp != nil {
+			// The token server rejected the credentials.
+			return authResp, nil
+		}
+		if err == nil {
+			req = withBearer(orig, token)
+			sentKey = t.tokenKey(realm, service, s)
+		}
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	var bearer *challenge.Challenge
+	for _, c := range challenge.ResponseChallenges(resp) {
+		if c.Scheme == "bearer" {
+			c := c
+			bearer = &c
+			break
+		}
+	}
+	if bearer == nil {
+		return resp, nil
+	}
+	if sentKey != "" {
+		// Revoked, or the scopes of the token are not sufficient, e.g. the
+		// registry requires more scopes than the ones of the request.
+		glog.V(2).Infof("%s rejected cached token: %v", req.URL.Host,
+			bearer.Parameters["error"])
+		t.cache.remove(sentKey)
+	}
+	realm = bearer.Parameters["realm"]
+	service = bearer.Parameters["service"]
+	t.mu.Lock()
+	t.realm, t.service = realm, service
+	t.mu.Unlock()
+	// Upgrade the scopes of the token to the ones in the challenge.
+	needed.add(bearer.Parameters["scope"])
+	s := needed.list()
+	token, authResp, err := t.getToken(realm, service, s)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	if authResp != nil {
+		// The token server rejected the credentials.
+		resp.Body.Close()
+		return authResp, nil
+	}
+	retry := rewind(orig)
+	if retry == nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.transport.RoundTrip(withBearer(retry, token))
+}
+
+// tokenResponse is the response of a token server, either via the docker
+// token protocol, or via OAuth2.
+type tokenResponse struct {
+	Token        string    `json:"token"`
+	AccessToken  string    `json:"access_token"`
+	RefreshToken string    `json:"refresh_token"`
+	ExpiresIn    int       `json:"expires_in"`
+	IssuedAt     time.Time `json:"issued_at"`
+}
+
+// getToken returns a token for the scopes s from the cache, or from the token
+// server at realm. If the token server rejects the request, its response is
+// returned.
+func (t *tokenTransport) getToken(realm, service string, s []string) (string, *http.Response, error) {
+	key := t.tokenKey(realm, service, s)
+	if token := t.cache.get(key); token != nil {
+		return token.Token, nil, nil
+	}
+	refresh := t.creds.IdentityToken
+	refreshKey := t.refreshKey(realm, service)
+	if refresh == "" {
+		if cached := t.cache.get(refreshKey); cached != nil {
+			refresh = cached.RefreshToken
+		}
+	}
+	var resp *http.Response
+	var err error
+	if refresh != "" {
+		resp, err = t.refreshToken(realm, service, refresh, s)
+		if err == nil && resp.StatusCode != http.StatusOK &&
+			t.creds.IdentityToken == "" && t.creds.Username != "" {
+			// The cached refresh token is not valid anymore, log in
+			// again.
+			glog.V(2).Infof("%s rejected refresh token: %s", realm, resp.Status)
+			resp.Body.Close()
+			t.cache.remove(refreshKey)
+			resp, err = t.fetchToken(realm, service, s)
+		}
+	} else {
+		resp, err = t.fetchToken(realm, service, s)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp, nil
+	}
+	defer resp.Body.Close()
+	tr := tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return "", nil, fmt.Errorf("parsing token from %s: %v", realm, err)
+	}
+	token := tr.Token
+	if token == "" {
+		token = tr.AccessToken
+	}
+	if token == "" {
+		return "", nil, fmt.Errorf("no token received from %s", realm)
+	}
+	issued := tr.IssuedAt
+	if issued.IsZero() || issued.After(time.Now()) {
+		issued = time.Now()
+	}
+	expiry := time.Duration(tr.ExpiresIn) * time.Second
+	if expiry < defaultTokenExpiry {
+		expiry = defaultTokenExpiry
+	}
+	glog.V(2).Infof("got token from %s for %v, expires in %v", realm, s, expiry)
+	t.cache.put(key, &cachedToken{
+		Token:   token,
+		Expires: issued.Add(expiry),
+	})
+	if tr.RefreshToken != "" && t.creds.IdentityToken == "" {
+		t.cache.put(refreshKey, &cachedToken{RefreshToken: tr.RefreshToken})
+	}
+	return token, nil, nil
+}
+
+// fetchToken gets a token via the docker token protocol, logging in with the
+// username and password, if set. An OAuth2 refresh token is requested too,
+// for getting tokens for other scopes later.
+func (t *tokenTransport) fetchToken(realm, service string, s []string) (*http.Response, error) {
+	u, err := url.Parse(realm)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+	q := u.Query()
+	if service != "" {
+		q.Set("service", service)
+	}
+	for _, scope := range s {
+		q.Add("scope", scope)
+	}
+	if t.creds.Username != "" || t.creds.Password != "" {
+		q.Set("offline_token", "true")
+		q.Set("client_id", clientID)
+	}
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if t.creds.Username != "" || t.creds.Password != "" {
+		req.SetBasicAuth(t.creds.Username, t.creds.Password)
+	}
+	return t.transport.RoundTrip(req)
+}
+
+// refreshToken gets a token via the OAuth2 refresh token grant.
+func (t *tokenTransport) refreshToken(realm, service, refresh string, s []string) (*http.Response, error) {
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refresh)
+	form.Set("service", service)
+	form.Set("client_id", clientID)
+	if len(s) > 0 {
+		form.Set("scope", strings.Join(s, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, realm, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("invalid token realm %q: %v", realm, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return t.transport.RoundTrip(req)
+}
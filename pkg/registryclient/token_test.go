@@ -0,0 +1,522 @@
+package registryclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tokenServer is a registry requiring bearer tokens, and its token server.
+// The token server accepts the user alice with the password secret, and
+// anonymous requests.
+type tokenServer struct {
+	registry *httptest.Server
+	auth     *httptest.Server
+	lock     sync.Mutex
+	// expiresIn and issuedAt are sent with new tokens, if set.
+	expiresIn int
+	issuedAt  time.Time
+	// tokens are the valid tokens, mapped to the scopes they grant.
+	tokens map[string]scopes
+	// refreshTokens are the valid OAuth2 refresh tokens.
+	refreshTokens map[string]bool
+	// requests are the requests served by the token server, e.g.
+	// "GET alice repository:library/alpine:pull" or
+	// "POST refresh-1 repository:library/alpine:pull".
+	requests []string
+	// redirect is where blob downloads are redirected to, if set.
+	redirect string
+	// extraScope is required by the registry in addition to the scopes of
+	// requests, if set.
+	extraScope string
+	issued     int
+}
+
+func newTokenServer() *tokenServer {
+	ts := &tokenServer{
+		tokens:        make(map[string]scopes),
+		refreshTokens: make(map[string]bool),
+	}
+	ts.auth = httptest.NewServer(http.HandlerFunc(ts.serveToken))
+	ts.registry = httptest.NewServer(http.HandlerFunc(ts.serveRegistry))
+	return ts
+}
+
+func (ts *tokenServer) close() {
+	ts.registry.Close()
+	ts.auth.Close()
+}
+
+// tokenRequests returns the requests served by the token server, and resets
+// them.
+func (ts *tokenServer) tokenRequests() []string {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	requests := ts.requests
+	ts.requests = nil
+	return requests
+}
+
+// revoke revokes all tokens.
+func (ts *tokenServer) revoke() {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.tokens = make(map[string]scopes)
+}
+
+func (ts *tokenServer) serveToken(w http.ResponseWriter, r *http.Request) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	requested := []string{}
+	offline := false
+	request := []string{r.Method}
+	switch r.Method {
+	case http.MethodGet:
+		user, password, ok := r.BasicAuth()
+		if ok && (user != "alice" || password != "secret") {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		requested = r.URL.Query()["scope"]
+		offline = ok && r.URL.Query().Get("offline_token") == "true"
+		if ok {
+			request = append(request, user)
+		}
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		refresh := r.PostForm.Get("refresh_token")
+		if r.PostForm.Get("grant_type") != "refresh_token" || !ts.refreshTokens[refresh] {
+			http.Error(w, "invalid grant", http.StatusUnauthorized)
+			return
+		}
+		requested = strings.Fields(r.PostForm.Get("scope"))
+		request = append(request, refresh)
+	default:
+		http.Error(w, "invalid method", http.StatusMethodNotAllowed)
+		return
+	}
+	request = append(request, requested...)
+	ts.requests = append(ts.requests, strings.Join(request, " "))
+	ts.issued++
+	resp := tokenResponse{
+		Token:     fmt.Sprintf("token-%d", ts.issued),
+		ExpiresIn: ts.expiresIn,
+		IssuedAt:  ts.issuedAt,
+	}
+	granted := make(scopes)
+	granted.add(strings.Join(requested, " "))
+	ts.tokens[resp.Token] = granted
+	if offline {
+		resp.RefreshToken = fmt.Sprintf("refresh-%d", ts.issued)
+		ts.refreshTokens[resp.RefreshToken] = true
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+var testRepoPathRegexp = regexp.MustCompile(`^/v2/(.+?)/(manifests|blobs)/`)
+
+// authorized returns true if the bearer token of r grants the scopes s.
+func (ts *tokenServer) authorized(r *http.Request, s scopes) bool {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	granted, ok := ts.tokens[strings.TrimPrefix(auth, "Bearer ")]
+	if !ok {
+		return false
+	}
+	for resource, actions := range s {
+		for action := range actions {
+			if !granted[resource][action] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (ts *tokenServer) serveRegistry(w http.ResponseWriter, r *http.Request) {
+	needed := make(scopes)
+	m := testRepoPathRegexp.FindStringSubmatch(r.URL.Path)
+	if m != nil {
+		actions := "pull"
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			actions = "pull,push"
+		}
+		needed.add("repository:" + m[1] + ":" + actions)
+		if from := r.URL.Query().Get("from"); from != "" {
+			needed.add("repository:" + from + ":pull")
+		}
+	} else if r.URL.Path != "/v2/" {
+		http.NotFound(w, r)
+		return
+	}
+	needed.add(ts.extraScope)
+	if !ts.authorized(r, needed) {
+		challenge := fmt.Sprintf(`Bearer realm="%s/token",service="test"`,
+			ts.auth.URL)
+		if len(needed) > 0 {
+			challenge += fmt.Sprintf(`,scope="%s"`,
+				strings.Join(needed.list(), " "))
+		}
+		w.Header().Set("WWW-Authenticate", challenge)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if m != nil && m[2] == "blobs" && r.Method == http.MethodGet && ts.redirect != "" {
+		http.Redirect(w, r, ts.redirect+r.URL.Path, http.StatusTemporaryRedirect)
+		return
+	}
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// do sends a request to path on the registry via client, and returns the
+// body of the response, or an error if it is not successful.
+func (ts *tokenServer) do(client *http.Client, method, path string) (string, error) {
+	req, err := http.NewRequest(method, ts.registry.URL+path, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return string(buf), nil
+}
+
+// client returns a client for the registry of ts, with the same transports
+// as the ones of registry clients.
+func (ts *tokenServer) client(t *testing.T, creds Credentials, cache *TokenCache) *http.Client {
+	if cache == nil {
+		var err error
+		cache, err = NewTokenCache("")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reg, _, err := newRegistry(ts.registry.URL, creds, cache, nil, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg.Client
+}
+
+func TestTokenRedirect(t *testing.T) {
+	ts := newTokenServer()
+	defer ts.close()
+	lock := sync.Mutex{}
+	cdnAuth := []string{}
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		cdnAuth = append(cdnAuth, r.Header.Get("Authorization"))
+		fmt.Fprint(w, "blob")
+	}))
+	defer cdn.Close()
+	ts.redirect = cdn.URL
+
+	testCases := []struct {
+		name  string
+		creds Credentials
+		// tokenRequests are the expected requests to the token server.
+		tokenRequests []string
+	}{
+		{
+			name:  "password",
+			creds: Credentials{Username: "alice", Password: "secret"},
+			tokenRequests: []string{
+				"GET alice repository:library/alpine:pull",
+			},
+		},
+		{
+			name:          "anonymous",
+			tokenRequests: []string{"GET repository:library/alpine:pull"},
+		},
+		{
+			name:  "registry token",
+			creds: Credentials{RegistryToken: "token-0"},
+		},
+	}
+	ts.tokens["token-0"] = scopes{"repository:library/alpine": {"pull": true}}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			client := ts.client(t, tc.creds, nil)
+			cdnAuth = nil
+			ts.tokenRequests()
+			// The second download uses the cached token.
+			for i := 0; i < 2; i++ {
+				body, err := ts.do(client, http.MethodGet,
+					"/v2/library/alpine/blobs/sha256:1234")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body != "blob" {
+					t.Errorf("expected blob from CDN, got %q", body)
+				}
+			}
+			for _, auth := range cdnAuth {
+				if auth != "" {
+					t.Errorf("credentials sent to CDN: %q", auth)
+				}
+			}
+			if len(cdnAuth) != 2 {
+				t.Errorf("expected 2 CDN requests, got %d", len(cdnAuth))
+			}
+			requests := ts.tokenRequests()
+			if strings.Join(requests, "\n") != strings.Join(tc.tokenRequests, "\n") {
+				t.Errorf("expected token requests %q, got %q",
+					tc.tokenRequests, requests)
+			}
+		})
+	}
+}
+
+// expectTokenRequests checks that the token server of ts served the requests
+// in expected since the last check.
+func expectTokenRequests(t *testing.T, ts *tokenServer, expected ...string) {
+	t.Helper()
+	actual := ts.tokenRequests()
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected token requests %q, got %q", expected, actual)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	now := time.Now()
+	testCases := []struct {
+		name      string
+		expiresIn int
+		issuedAt  time.Time
+		// cached is true if the token is expected to be used for the second
+		// request.
+		cached bool
+	}{
+		{name: "default expiry", cached: true},
+		{name: "expires in", expiresIn: 3600, cached: true},
+		{name: "too short expiry", expiresIn: 1, cached: true},
+		{name: "issued an hour ago", expiresIn: 3600, issuedAt: now.Add(-time.Hour)},
+		{name: "issued in the future", expiresIn: 3600, issuedAt: now.Add(time.Hour), cached: true},
+		{name: "issued a minute ago", issuedAt: now.Add(-time.Minute)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := newTokenServer()
+			defer ts.close()
+			ts.expiresIn = tc.expiresIn
+			ts.issuedAt = tc.issuedAt
+			client := ts.client(t, Credentials{}, nil)
+			for i := 0; i < 2; i++ {
+				_, err := ts.do(client, http.MethodGet, "/v2/library/alpine/manifests/3.6")
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected := 2
+			if tc.cached {
+				expected = 1
+			}
+			if requests := ts.tokenRequests(); len(requests) != expected {
+				t.Errorf("expected %d token requests, got %q", expected, requests)
+			}
+		})
+	}
+}
+
+func TestTokenCacheDir(t *testing.T) {
+	ts := newTokenServer()
+	defer ts.close()
+	dir, err := ioutil.TempDir("", "tosi-token-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	alice := Credentials{Username: "alice", Password: "secret"}
+	path := "/v2/library/alpine/manifests/3.6"
+
+	cache, err := NewTokenCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.do(ts.client(t, alice, cache), http.MethodGet, path); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "GET alice repository:library/alpine:pull")
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The token and the refresh token.
+	if len(files) != 2 {
+		t.Errorf("expected 2 cached tokens, got %d", len(files))
+	}
+	for _, f := range files {
+		if f.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected mode 0600, got %v", f.Name(), f.Mode())
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(f.Name()+string(buf), "secret") {
+			t.Errorf("%s: password saved with token", f.Name())
+		}
+	}
+
+	// Another process uses the saved token, but only with the same
+	// credentials.
+	cache, err = NewTokenCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.do(ts.client(t, alice, cache), http.MethodGet, path); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts)
+	if _, err := ts.do(ts.client(t, Credentials{}, cache), http.MethodGet, path); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "GET repository:library/alpine:pull")
+
+	// Invalid tokens are ignored.
+	for _, f := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, f.Name()), []byte("{"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cache, err = NewTokenCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.do(ts.client(t, alice, cache), http.MethodGet, path); err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "GET alice repository:library/alpine:pull")
+}
+
+func TestTokenRefresh(t *testing.T) {
+	ts := newTokenServer()
+	defer ts.close()
+	client := ts.client(t, Credentials{Username: "alice", Password: "secret"}, nil)
+	get := func(repo string) {
+		t.Helper()
+		_, err := ts.do(client, http.MethodGet, "/v2/"+repo+"/manifests/latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get("library/alpine")
+	expectTokenRequests(t, ts, "GET alice repository:library/alpine:pull")
+	// Tokens for other scopes are requested via the refresh token.
+	get("library/busybox")
+	expectTokenRequests(t, ts, "POST refresh-1 repository:library/busybox:pull")
+
+	// Without a valid refresh token, the client logs in again.
+	ts.lock.Lock()
+	ts.refreshTokens = make(map[string]bool)
+	ts.lock.Unlock()
+	get("library/debian")
+	expectTokenRequests(t, ts, "GET alice repository:library/debian:pull")
+	get("library/ubuntu")
+	expectTokenRequests(t, ts, "POST refresh-3 repository:library/ubuntu:pull")
+
+	// Identity tokens are refresh tokens, and there is no password for
+	// logging in again.
+	ts.lock.Lock()
+	ts.refreshTokens["identity"] = true
+	ts.lock.Unlock()
+	client = ts.client(t, Credentials{IdentityToken: "identity"}, nil)
+	get("library/alpine")
+	expectTokenRequests(t, ts, "POST identity repository:library/alpine:pull")
+	ts.lock.Lock()
+	ts.refreshTokens = make(map[string]bool)
+	ts.lock.Unlock()
+	_, err := ts.do(client, http.MethodGet, "/v2/library/busybox/manifests/latest")
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expected 401 with revoked identity token, got %v", err)
+	}
+	expectTokenRequests(t, ts)
+}
+
+func TestTokenRejected(t *testing.T) {
+	ts := newTokenServer()
+	defer ts.close()
+	client := ts.client(t, Credentials{}, nil)
+	path := "/v2/library/alpine/manifests/3.6"
+	for i := 0; i < 2; i++ {
+		if _, err := ts.do(client, http.MethodGet, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTokenRequests(t, ts, "GET repository:library/alpine:pull")
+	// A revoked token is dropped from the cache, and a new one is used for
+	// the request and the next ones.
+	ts.revoke()
+	for i := 0; i < 2; i++ {
+		if _, err := ts.do(client, http.MethodGet, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectTokenRequests(t, ts, "GET repository:library/alpine:pull")
+}
+
+func TestTokenScopes(t *testing.T) {
+	ts := newTokenServer()
+	defer ts.close()
+	client := ts.client(t, Credentials{Username: "alice", Password: "secret"}, nil)
+	_, err := ts.do(client, http.MethodGet, "/v2/library/app/manifests/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "GET alice repository:library/app:pull")
+	// Pushing needs a token for pushing.
+	_, err = ts.do(client, http.MethodPut, "/v2/library/app/manifests/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "POST refresh-1 repository:library/app:pull,push")
+	// Mounting a blob needs pull access to the repository it is mounted
+	// from.
+	_, err = ts.do(client, http.MethodPost,
+		"/v2/library/app/blobs/uploads/?mount=sha256:1234&from=library/base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "POST refresh-1 repository:library/app:pull,push repository:library/base:pull")
+
+	// The scopes of tokens are upgraded to the ones the registry asks for.
+	ts = newTokenServer()
+	defer ts.close()
+	ts.extraScope = "registry:catalog:*"
+	client = ts.client(t, Credentials{}, nil)
+	_, err = ts.do(client, http.MethodGet, "/v2/library/app/manifests/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectTokenRequests(t, ts, "GET registry:catalog:* repository:library/app:pull")
+}
@@ -0,0 +1,360 @@
+// Package registrytest provides an in-memory registry implementing the parts
+// of the distribution API used by tosi, for testing against an in-process
+// registry, e.g. via httptest.NewServer.
+package registrytest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var (
+	manifestPath  = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	uploadPath    = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([^/]*)$`)
+	blobPath      = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	tagsPath      = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+	referrersPath = regexp.MustCompile(`^/v2/(.+)/referrers/([^/]+)$`)
+)
+
+// referrer is a descriptor in the image index returned by the referrers API.
+type referrer struct {
+	v1.Descriptor
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+type storedManifest struct {
+	mediaType string
+	payload   []byte
+}
+
+// Registry is an in-memory registry. Blobs are shared by all repositories.
+type Registry struct {
+	// Authorize, if set, is called for each request, with the repository it
+	// is for, which is empty for /v2/ and the catalog. If it returns false,
+	// the request is rejected with 401.
+	Authorize func(r *http.Request, repo string) bool
+	// PageSize is the maximum number of tags or repositories returned per
+	// page, if positive, even if clients ask for more.
+	PageSize int
+	// NoReferrers disables the OCI referrers API, like in registries not
+	// supporting it.
+	NoReferrers bool
+
+	mu sync.Mutex
+	// manifests are the manifests per repository, by tag and by digest.
+	manifests map[string]map[string]storedManifest
+	blobs     map[digest.Digest][]byte
+	uploads   map[string][]byte
+	nextID    int
+	requests  []string
+}
+
+// New creates an empty registry.
+func New() *Registry {
+	return &Registry{
+		manifests: make(map[string]map[string]storedManifest),
+		blobs:     make(map[digest.Digest][]byte),
+		uploads:   make(map[string][]byte),
+	}
+}
+
+// AddBlob adds content as a blob, and returns its descriptor.
+func (reg *Registry) AddBlob(mediaType string, content []byte) distribution.Descriptor {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	dgst := digest.FromBytes(content)
+	reg.blobs[dgst] = content
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    dgst,
+	}
+}
+
+// AddManifest adds the manifest payload to repo under its digest, and under
+// tag if it is not empty, and returns its descriptor.
+func (reg *Registry) AddManifest(repo, tag, mediaType string, payload []byte) distribution.Descriptor {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.addManifest(repo, tag, mediaType, payload)
+}
+
+func (reg *Registry) addManifest(repo, tag, mediaType string, payload []byte) distribution.Descriptor {
+	if reg.manifests[repo] == nil {
+		reg.manifests[repo] = make(map[string]storedManifest)
+	}
+	m := storedManifest{
+		mediaType: mediaType,
+		payload:   payload,
+	}
+	dgst := digest.FromBytes(payload)
+	reg.manifests[repo][dgst.String()] = m
+	if tag != "" {
+		reg.manifests[repo][tag] = m
+	}
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(payload)),
+		Digest:    dgst,
+	}
+}
+
+// Requests returns the requests served so far, as "METHOD path".
+func (reg *Registry) Requests() []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return append([]string{}, reg.requests...)
+}
+
+// ServeHTTP serves the distribution API.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.requests = append(reg.requests, r.Method+" "+r.URL.Path)
+	repo := ""
+	for _, re := range []*regexp.Regexp{manifestPath, uploadPath, blobPath, tagsPath, referrersPath} {
+		if m := re.FindStringSubmatch(r.URL.Path); m != nil {
+			repo = m[1]
+			break
+		}
+	}
+	if reg.Authorize != nil && !reg.Authorize(r, repo) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED")
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.URL.Path == "/v2/" {
+		return
+	}
+	if r.URL.Path == "/v2/_catalog" {
+		repos := []string{}
+		for repo := range reg.manifests {
+			repos = append(repos, repo)
+		}
+		reg.servePage(w, r, "repositories", repos)
+		return
+	}
+	if m := manifestPath.FindStringSubmatch(r.URL.Path); m != nil {
+		reg.serveManifest(w, r, m[1], m[2])
+		return
+	}
+	if m := uploadPath.FindStringSubmatch(r.URL.Path); m != nil {
+		reg.serveUpload(w, r, m[1], m[2])
+		return
+	}
+	if m := blobPath.FindStringSubmatch(r.URL.Path); m != nil {
+		reg.serveBlob(w, r, m[2])
+		return
+	}
+	if m := tagsPath.FindStringSubmatch(r.URL.Path); m != nil {
+		manifests, ok := reg.manifests[m[1]]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN")
+			return
+		}
+		tags := []string{}
+		for ref := range manifests {
+			if _, err := digest.Parse(ref); err != nil {
+				tags = append(tags, ref)
+			}
+		}
+		reg.servePage(w, r, "tags", tags)
+		return
+	}
+	if m := referrersPath.FindStringSubmatch(r.URL.Path); m != nil && !reg.NoReferrers {
+		reg.serveReferrers(w, r, m[1], digest.Digest(m[2]))
+		return
+	}
+	writeError(w, http.StatusNotFound, "NOT_FOUND")
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"errors":[{"code":%q}]}`, code)
+}
+
+func (reg *Registry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := reg.manifests[repo][ref]
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.payload)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.payload).String())
+		if r.Method == http.MethodGet {
+			w.Write(m.payload)
+		}
+	case http.MethodPut:
+		payload, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID")
+			return
+		}
+		tag := ref
+		if _, err := digest.Parse(ref); err == nil {
+			tag = ""
+		}
+		desc := reg.addManifest(repo, tag, r.Header.Get("Content-Type"), payload)
+		w.Header().Set("Docker-Content-Digest", desc.Digest.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED")
+	}
+}
+
+func (reg *Registry) serveBlob(w http.ResponseWriter, r *http.Request, ref string) {
+	content, ok := reg.blobs[digest.Digest(ref)]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.Header().Set("Docker-Content-Digest", ref)
+	if r.Method == http.MethodGet {
+		w.Write(content)
+	}
+}
+
+func (reg *Registry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "BLOB_UPLOAD_INVALID")
+		return
+	}
+	if r.Method == http.MethodPost {
+		if mount := digest.Digest(r.URL.Query().Get("mount")); mount != "" {
+			if _, ok := reg.blobs[mount]; ok {
+				w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, mount))
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+		}
+		reg.nextID++
+		id = strconv.Itoa(reg.nextID)
+		reg.uploads[id] = nil
+	}
+	data, ok := reg.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN")
+		return
+	}
+	data = append(data, body...)
+	reg.uploads[id] = data
+	location := fmt.Sprintf("/v2/%s/blobs/uploads/%s", repo, id)
+	switch r.Method {
+	case http.MethodDelete:
+		delete(reg.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPut:
+	default:
+		w.Header().Set("Location", location)
+		w.Header().Set("Range", fmt.Sprintf("0-%d", len(data)-1))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	dgst, err := digest.Parse(r.URL.Query().Get("digest"))
+	if err != nil || dgst.Algorithm().FromBytes(data) != dgst {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID")
+		return
+	}
+	delete(reg.uploads, id)
+	reg.blobs[dgst] = data
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, dgst))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// servePage serves a page of the sorted list items, as the field key of the
+// response, starting after the last query parameter.
+func (reg *Registry) servePage(w http.ResponseWriter, r *http.Request, key string, items []string) {
+	sort.Strings(items)
+	query := r.URL.Query()
+	n := len(items)
+	if limit, err := strconv.Atoi(query.Get("n")); err == nil && limit > 0 && limit < n {
+		n = limit
+	}
+	if reg.PageSize > 0 && reg.PageSize < n {
+		n = reg.PageSize
+	}
+	if last := query.Get("last"); last != "" {
+		items = items[sort.SearchStrings(items, last):]
+		if len(items) > 0 && items[0] == last {
+			items = items[1:]
+		}
+	}
+	if len(items) > n {
+		items = items[:n]
+		next := url.Values{}
+		next.Set("n", strconv.Itoa(n))
+		next.Set("last", items[n-1])
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`,
+			r.URL.Path, next.Encode()))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{key: items})
+}
+
+// serveReferrers serves the image index of the manifests in repo with dgst as
+// their subject.
+func (reg *Registry) serveReferrers(w http.ResponseWriter, r *http.Request, repo string, dgst digest.Digest) {
+	artifactType := r.URL.Query().Get("artifactType")
+	index := struct {
+		SchemaVersion int        `json:"schemaVersion"`
+		MediaType     string     `json:"mediaType"`
+		Manifests     []referrer `json:"manifests"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     v1.MediaTypeImageIndex,
+		Manifests:     []referrer{},
+	}
+	seen := map[digest.Digest]bool{}
+	for _, m := range reg.manifests[repo] {
+		manifest := struct {
+			ArtifactType string         `json:"artifactType"`
+			Config       v1.Descriptor  `json:"config"`
+			Subject      *v1.Descriptor `json:"subject"`
+		}{}
+		if err := json.Unmarshal(m.payload, &manifest); err != nil {
+			continue
+		}
+		if manifest.Subject == nil || manifest.Subject.Digest != dgst {
+			continue
+		}
+		desc := referrer{
+			Descriptor: v1.Descriptor{
+				MediaType: m.mediaType,
+				Size:      int64(len(m.payload)),
+				Digest:    digest.FromBytes(m.payload),
+			},
+			ArtifactType: manifest.ArtifactType,
+		}
+		if desc.ArtifactType == "" {
+			desc.ArtifactType = manifest.Config.MediaType
+		}
+		if seen[desc.Digest] || (artifactType != "" && desc.ArtifactType != artifactType) {
+			continue
+		}
+		seen[desc.Digest] = true
+		index.Manifests = append(index.Manifests, desc)
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageIndex)
+	json.NewEncoder(w).Encode(index)
+}
@@ -0,0 +1,207 @@
+package semver
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Image tags often only have a major and a minor version, e.g. "3.12", or a
+// "v" prefix, so the parser is more lenient than https://semver.org.
+var versionRegexp = regexp.MustCompile(
+	`^v?(\d+)(?:\.(\d+))?(?:\.(\d+))?(?:-([0-9A-Za-z.-]+))?(?:\+([0-9A-Za-z.-]+))?$`)
+
+// Version is a semantic version parsed from an image tag.
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+	Build      string
+	// Original is the tag the version was parsed from.
+	Original string
+}
+
+// Parse parses a version, e.g. "1.2.3", "v1.2" or "1.2.3-rc.1".
+func Parse(s string) (*Version, error) {
+	m := versionRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	v := Version{
+		Prerelease: m[4],
+		Build:      m[5],
+		Original:   s,
+	}
+	for i, p := range []*int{&v.Major, &v.Minor, &v.Patch} {
+		if m[i+1] == "" {
+			continue
+		}
+		n, err := strconv.Atoi(m[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q: %v", s, err)
+		}
+		*p = n
+	}
+	return &v, nil
+}
+
+func (v *Version) String() string {
+	return v.Original
+}
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// comparePrerelease compares prerelease versions. A version without a
+// prerelease has higher precedence than one with a prerelease.
+func comparePrerelease(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if c := compareInt(an, bn); c != 0 {
+				return c
+			}
+		case aerr == nil:
+			// Numeric identifiers have lower precedence.
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(as), len(bs))
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal to or higher than o. Build
+// metadata is ignored.
+func (v *Version) Compare(o *Version) int {
+	if c := compareInt(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+// Sort sorts versions in ascending order. Versions with the same precedence,
+// e.g. "1.2" and "1.2.0", are sorted by their original string.
+func Sort(versions []*Version) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		c := versions[i].Compare(versions[j])
+		if c == 0 {
+			return versions[i].Original < versions[j].Original
+		}
+		return c < 0
+	})
+}
+
+type condition struct {
+	op      string
+	version *Version
+}
+
+func (c condition) match(v *Version) bool {
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case "=", "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "~":
+		// Same major and minor version.
+		return cmp >= 0 && v.Major == c.version.Major &&
+			v.Minor == c.version.Minor
+	case "^":
+		// Same major version.
+		return cmp >= 0 && v.Major == c.version.Major
+	}
+	return false
+}
+
+// Constraint is a version range, e.g. ">=1.2, <2" or "~1.4".
+type Constraint struct {
+	conditions []condition
+}
+
+var (
+	conditionRegexp = regexp.MustCompile(`^(==|=|!=|>=|<=|>|<|~|\^)?(\S+)$`)
+	// Spaces between operators and versions, e.g. ">= 1.2".
+	operatorSpaceRegexp = regexp.MustCompile(`(==|=|!=|>=|<=|>|<|~|\^)\s+`)
+)
+
+// ParseConstraint parses a comma or space separated list of conditions, all of
+// which need to match. Conditions are a version with an optional operator:
+// =, !=, >, >=, <, <=, ~ (same minor version) or ^ (same major version). The
+// default operator is =.
+func ParseConstraint(s string) (*Constraint, error) {
+	c := Constraint{}
+	s = operatorSpaceRegexp.ReplaceAllString(s, "$1")
+	for _, field := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' '
+	}) {
+		m := conditionRegexp.FindStringSubmatch(field)
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition %q in %q", field, s)
+		}
+		v, err := Parse(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid condition %q: %v", field, err)
+		}
+		op := m[1]
+		if op == "" {
+			op = "="
+		}
+		c.conditions = append(c.conditions, condition{op: op, version: v})
+	}
+	if len(c.conditions) == 0 {
+		return nil, fmt.Errorf("empty version constraint")
+	}
+	return &c, nil
+}
+
+// Match returns true if v matches all conditions of the constraint.
+func (c *Constraint) Match(v *Version) bool {
+	for _, cond := range c.conditions {
+		if !cond.match(v) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,209 @@
+package semver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		s        string
+		expected Version
+		err      bool
+	}{
+		{s: "1.2.3", expected: Version{Major: 1, Minor: 2, Patch: 3}},
+		{s: "v1.2.3", expected: Version{Major: 1, Minor: 2, Patch: 3}},
+		{s: "1.2", expected: Version{Major: 1, Minor: 2}},
+		{s: "v1.2", expected: Version{Major: 1, Minor: 2}},
+		{s: "3", expected: Version{Major: 3}},
+		{s: "1.2.3-rc1", expected: Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc1"}},
+		{s: "1.2-rc.1", expected: Version{Major: 1, Minor: 2, Prerelease: "rc.1"}},
+		{s: "1.2.3-alpine3.12", expected: Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "alpine3.12"}},
+		{s: "1.2.3+build.5", expected: Version{Major: 1, Minor: 2, Patch: 3, Build: "build.5"}},
+		{s: "1.2.3-rc.1+build", expected: Version{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc.1", Build: "build"}},
+		{s: "010.2.3", expected: Version{Major: 10, Minor: 2, Patch: 3}},
+		{s: "latest", err: true},
+		{s: "", err: true},
+		{s: "v", err: true},
+		{s: "1.2.3.4", err: true},
+		{s: "V1.2", err: true},
+		{s: "1.2.", err: true},
+		{s: "1.2.3-", err: true},
+		{s: "1.2.3-rc_1", err: true},
+		{s: "99999999999999999999", err: true},
+	}
+	for _, tc := range testCases {
+		v, err := Parse(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: expected error, got %+v", tc.s, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.s, err)
+			continue
+		}
+		tc.expected.Original = tc.s
+		if !reflect.DeepEqual(*v, tc.expected) {
+			t.Errorf("%q: expected %+v, got %+v", tc.s, tc.expected, *v)
+		}
+	}
+}
+
+func mustParse(t *testing.T, s string) *Version {
+	v, err := Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestCompare(t *testing.T) {
+	testCases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2", "1.2.0", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"1.2.3+a", "1.2.3+b", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.3", "1.2.9", 1},
+		{"2", "1.99.99", 1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.2.3-rc1", "1.2.3", -1},
+		{"1.2.3-rc1", "1.2.2", 1},
+		// The precedence of prereleases from https://semver.org.
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-alpha.beta", "1.0.0-beta", -1},
+		{"1.0.0-beta", "1.0.0-beta.2", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-beta.11", "1.0.0-rc.1", -1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.1", "1.0.0-rc.1", 0},
+	}
+	for _, tc := range testCases {
+		a, b := mustParse(t, tc.a), mustParse(t, tc.b)
+		if c := a.Compare(b); c != tc.expected {
+			t.Errorf("%s %s: expected %d, got %d", tc.a, tc.b, tc.expected, c)
+		}
+		if c := b.Compare(a); c != -tc.expected {
+			t.Errorf("%s %s: expected %d, got %d", tc.b, tc.a, -tc.expected, c)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	tags := []string{
+		"1.0.0", "1.0.0-rc.1", "v1.2", "0.9", "1.0.0-beta.11", "1.2.0",
+		"1.0.0-beta.2", "1.10", "1.0.0-alpha", "1.2.0+build",
+	}
+	versions := []*Version{}
+	for _, tag := range tags {
+		versions = append(versions, mustParse(t, tag))
+	}
+	Sort(versions)
+	sorted := []string{}
+	for _, v := range versions {
+		sorted = append(sorted, v.String())
+	}
+	expected := []string{
+		"0.9", "1.0.0-alpha", "1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1",
+		"1.0.0", "1.2.0", "1.2.0+build", "v1.2", "1.10",
+	}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Errorf("expected %v, got %v", expected, sorted)
+	}
+}
+
+func TestConstraint(t *testing.T) {
+	testCases := []struct {
+		constraint string
+		matching   []string
+		other      []string
+	}{
+		{
+			constraint: "1.2",
+			matching:   []string{"1.2", "1.2.0", "v1.2.0+build"},
+			other:      []string{"1.2.1", "1.2.0-rc1"},
+		},
+		{
+			constraint: "!=1.2",
+			matching:   []string{"1.2.1", "1.1"},
+			other:      []string{"1.2.0"},
+		},
+		{
+			constraint: ">=1.2",
+			matching:   []string{"1.2", "1.2.1", "2"},
+			other:      []string{"1.1.9", "1.2.0-rc1"},
+		},
+		{
+			constraint: "<2",
+			matching:   []string{"1.99", "2.0.0-rc1"},
+			other:      []string{"2", "2.0.1"},
+		},
+		{
+			constraint: "~1.4",
+			matching:   []string{"1.4", "1.4.0", "1.4.9"},
+			other:      []string{"1.3.9", "1.5.0", "1.4.0-rc1", "2.4.0"},
+		},
+		{
+			constraint: "~1.4.2",
+			matching:   []string{"1.4.2", "1.4.10"},
+			other:      []string{"1.4.1", "1.5.0"},
+		},
+		{
+			constraint: "^1.2",
+			matching:   []string{"1.2", "1.2.5", "1.9", "v1.10.1"},
+			other:      []string{"1.1.9", "2.0.0", "0.2.0"},
+		},
+		{
+			constraint: ">=1.2, <2",
+			matching:   []string{"1.2", "1.9.9"},
+			other:      []string{"1.1", "2", "2.1"},
+		},
+		{
+			constraint: ">=1.2,<2,!=1.5.0",
+			matching:   []string{"1.4", "1.5.1"},
+			other:      []string{"1.5", "2"},
+		},
+		{
+			constraint: ">= 1.2 < 2",
+			matching:   []string{"1.2", "1.9.9"},
+			other:      []string{"1.1", "2"},
+		},
+		{
+			constraint: "> v1.2.3-rc.1 <= 1.2.3",
+			matching:   []string{"1.2.3-rc.2", "1.2.3"},
+			other:      []string{"1.2.3-rc.1", "1.2.4"},
+		},
+	}
+	for _, tc := range testCases {
+		c, err := ParseConstraint(tc.constraint)
+		if err != nil {
+			t.Errorf("%q: %v", tc.constraint, err)
+			continue
+		}
+		for _, s := range tc.matching {
+			if !c.Match(mustParse(t, s)) {
+				t.Errorf("%q: expected %s to match", tc.constraint, s)
+			}
+		}
+		for _, s := range tc.other {
+			if c.Match(mustParse(t, s)) {
+				t.Errorf("%q: expected %s not to match", tc.constraint, s)
+			}
+		}
+	}
+}
+
+func TestParseConstraintErrors(t *testing.T) {
+	for _, s := range []string{"", " , ", ">=", "=>1.2", "~latest", ">=1.2, <two", "1.2.3.4"} {
+		if c, err := ParseConstraint(s); err == nil {
+			t.Errorf("%q: expected error, got %+v", s, c)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"github.com/elotl/tosi/pkg/store"
+)
+
+// The API is served via HTTP over a Unix socket. Requests and responses are
+// JSON objects; errors are returned as an Error with a 4xx or 5xx status code.
+//
+//	POST /v1/pull      PullRequest, streams Events as newline delimited JSON
+//	POST /v1/unpack    UnpackRequest
+//	POST /v1/mount     MountRequest
+//	POST /v1/umount    UmountRequest
+//	GET  /v1/images    returns a list of store.Image
+//	POST /v1/remove    RemoveRequest
+//	POST /v1/gc        returns store.GCStats
+const (
+	pathPull   = "/v1/pull"
+	pathUnpack = "/v1/unpack"
+	pathMount  = "/v1/mount"
+	pathUmount = "/v1/umount"
+	pathImages = "/v1/images"
+	pathRemove = "/v1/remove"
+	pathGC     = "/v1/gc"
+)
+
+// Statuses of the last event of a pull, besides the ones of
+// store.ProgressEvent.
+const (
+	// StatusDone is sent once the image is in the store, with its ID and
+	// digest.
+	StatusDone = "done"
+	// StatusFailed is sent if the image could not be pulled.
+	StatusFailed = "failed"
+)
+
+// PullRequest pulls an image into the store. The image is resolved like on
+// the command line, e.g. library/alpine:3.6 or quay.io/myuser/myimage:1.0.
+type PullRequest struct {
+	Image string `json:"image"`
+}
+
+// Event is the progress of a pull. Clients pulling the same image at the
+// same time get the same events, including the ones sent before they
+// started waiting for the pull.
+type Event struct {
+	store.ProgressEvent
+	// Error is set for failed pulls.
+	Error string `json:"error,omitempty"`
+}
+
+// UnpackRequest pulls an image, and extracts it into Dest. If Include or
+// Exclude is set, only the files matching them are extracted, see
+// store.PathFilter.
+type UnpackRequest struct {
+	Image   string   `json:"image"`
+	Dest    string   `json:"dest"`
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// MountRequest pulls an image, and creates an overlayfs mount of it in Dest.
+type MountRequest struct {
+	Image string `json:"image"`
+	Dest  string `json:"dest"`
+}
+
+// UmountRequest unmounts a mount created via MountRequest. The changes made
+// in the mount are kept for committing them, unless RemoveChanges is set.
+type UmountRequest struct {
+	Dest          string `json:"dest"`
+	RemoveChanges bool   `json:"removeChanges,omitempty"`
+}
+
+// RemoveRequest removes an image from the store. The image is the name in the
+// store, as listed via /v1/images, or the name with a digest.
+type RemoveRequest struct {
+	Image string `json:"image"`
+}
+
+// Error is the response of failed requests.
+type Error struct {
+	Error string `json:"error"`
+}
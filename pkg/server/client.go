@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/elotl/tosi/pkg/store"
+)
+
+// Client is a client for the API of a server listening on a Unix socket.
+type Client struct {
+	client *http.Client
+}
+
+// NewClient creates a client for the server listening on socket.
+func NewClient(socket string) *Client {
+	return &Client{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request with req as its JSON body, and returns the response if
+// it succeeded.
+func (c *Client) do(method, path string, req interface{}) (*http.Response, error) {
+	var body io.Reader
+	if req != nil {
+		buf, err := json.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(buf)
+	}
+	r, err := http.NewRequest(method, "http://tosi"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		e := Error{}
+		if err := json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return nil, fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return nil, fmt.Errorf("%s", e.Error)
+	}
+	return resp, nil
+}
+
+// call sends a request, and decodes the JSON response into resp, if it is not
+// nil.
+func (c *Client) call(method, path string, req, resp interface{}) error {
+	r, err := c.do(method, path, req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// Pull pulls image, calling progress, if it is not nil, with the events of
+// the pull. It returns the last event, which has the ID and the digest of the
+// image.
+func (c *Client) Pull(image string, progress func(Event)) (Event, error) {
+	resp, err := c.do(http.MethodPost, pathPull, PullRequest{Image: image})
+	if err != nil {
+		return Event{}, err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		event := Event{}
+		err := dec.Decode(&event)
+		if err == io.EOF {
+			return Event{}, fmt.Errorf("pulling %s: connection closed", image)
+		}
+		if err != nil {
+			return Event{}, err
+		}
+		if progress != nil {
+			progress(event)
+		}
+		switch event.Status {
+		case StatusDone:
+			return event, nil
+		case StatusFailed:
+			return event, fmt.Errorf("%s", event.Error)
+		}
+	}
+}
+
+// Unpack pulls and extracts an image.
+func (c *Client) Unpack(req UnpackRequest) error {
+	return c.call(http.MethodPost, pathUnpack, req, nil)
+}
+
+// Mount pulls an image, and creates an overlayfs mount of it in dest.
+func (c *Client) Mount(image, dest string) error {
+	return c.call(http.MethodPost, pathMount, MountRequest{
+		Image: image,
+		Dest:  dest,
+	}, nil)
+}
+
+// Umount unmounts the overlayfs mount in dest.
+func (c *Client) Umount(dest string, removeChanges bool) error {
+	return c.call(http.MethodPost, pathUmount, UmountRequest{
+		Dest:          dest,
+		RemoveChanges: removeChanges,
+	}, nil)
+}
+
+// Images lists the images in the store.
+func (c *Client) Images() ([]store.Image, error) {
+	images := []store.Image{}
+	err := c.call(http.MethodGet, pathImages, nil, &images)
+	return images, err
+}
+
+// Remove removes an image from the store.
+func (c *Client) Remove(image string) error {
+	return c.call(http.MethodPost, pathRemove, RemoveRequest{Image: image}, nil)
+}
+
+// GC removes the files in the store not used by any image.
+func (c *Client) GC() (store.GCStats, error) {
+	stats := store.GCStats{}
+	err := c.call(http.MethodPost, pathGC, struct{}{}, &stats)
+	return stats, err
+}
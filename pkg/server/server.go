@@ -0,0 +1,422 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/store"
+	"github.com/elotl/tosi/pkg/tracing"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Location is a location an image can be pulled from.
+type Location struct {
+	// Name is the fully qualified image name, e.g.
+	// docker.io/library/alpine:3.6, which is also reported to the kubelet
+	// via CRI. Concurrent pulls with the same name are deduplicated.
+	Name string
+	// Repo is the image in the source, e.g. library/alpine:3.6, which is also
+	// the name of the image in the store.
+	Repo string
+	// Connect returns the source for pulling the image with creds, e.g. the
+	// ones sent by the kubelet from the image pull secrets of a pod. Without
+	// credentials, the default ones of the source are used.
+	Connect func(creds registryclient.Credentials) (source.Source, error)
+	// Verifiers are the verifiers the image needs to pass when pulling it.
+	Verifiers []store.Verifier
+}
+
+// Resolver returns the locations image can be pulled from, in order. It is
+// also used for finding images in the store, so it should not contact the
+// registry; sources are created via Location.Connect when pulling.
+type Resolver func(image string) ([]Location, error)
+
+// Server serves the API for pulling, unpacking and mounting images in a store.
+type Server struct {
+	store   *store.Store
+	resolve Resolver
+	// ctx is the parent of pulls, which are shared by the requests for the
+	// same image, so they can't be canceled with the one that started them.
+	ctx context.Context
+	// lock is held for reading while pulling and using images, and for
+	// writing while removing them.
+	lock  sync.RWMutex
+	mu    sync.Mutex
+	pulls map[string]*pull
+}
+
+// New creates a server for st, resolving images to pull via resolve.
+func New(st *store.Store, resolve Resolver) *Server {
+	return &Server{
+		store:   st,
+		resolve: resolve,
+		ctx:     context.Background(),
+		pulls:   make(map[string]*pull),
+	}
+}
+
+// StoreLock returns the lock held for reading while the store is used, and for
+// writing while removing images. Other services using the same store need to
+// hold it too.
+func (s *Server) StoreLock() *sync.RWMutex {
+	return &s.lock
+}
+
+// pull is a pull in progress, with the events sent so far.
+type pull struct {
+	mu      sync.Mutex
+	events  []Event
+	done    bool
+	updated chan struct{}
+	// repo is the name of the image in the store, once pulled.
+	repo string
+}
+
+func newPull() *pull {
+	return &pull{
+		updated: make(chan struct{}),
+	}
+}
+
+func (p *pull) send(event Event, done bool, repo string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, event)
+	p.done = done
+	p.repo = repo
+	close(p.updated)
+	p.updated = make(chan struct{})
+}
+
+// watch calls fn with the events of the pull, starting with the ones already
+// sent, until the pull is done or fn returns an error. It returns the last
+// event.
+func (p *pull) watch(fn func(Event) error) (Event, string, error) {
+	i := 0
+	for {
+		p.mu.Lock()
+		events := p.events[i:]
+		done := p.done
+		repo := p.repo
+		updated := p.updated
+		p.mu.Unlock()
+		for _, event := range events {
+			if err := fn(event); err != nil {
+				return event, "", err
+			}
+		}
+		i += len(events)
+		if done {
+			return events[len(events)-1], repo, nil
+		}
+		<-updated
+	}
+}
+
+// run pulls image from locs, trying them in order. The span of the pull is
+// linked to the span of the request that started it.
+func (s *Server) run(link trace.Link, p *pull, image string, locs []Location) {
+	ctx, span := tracing.StartLinked(s.ctx, "pull", []trace.Link{link},
+		tracing.Image(image))
+	defer span.End()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var result error
+	for _, loc := range locs {
+		src, err := loc.Connect(registryclient.Credentials{})
+		if err != nil {
+			glog.Warningf("connecting to %s: %v", loc.Name, err)
+			result = multierror.Append(result, err)
+			continue
+		}
+		st := s.store.WithSource(src).WithContext(ctx)
+		for _, verifier := range loc.Verifiers {
+			st.AddVerifier(verifier)
+		}
+		glog.Infof("pulling %s", loc.Name)
+		id, dgst, err := st.PullWithProgress(loc.Repo, func(event store.ProgressEvent) {
+			event.Image = image
+			p.send(Event{ProgressEvent: event}, false, "")
+		})
+		if err == nil {
+			glog.Infof("pulled %s, digest: %s", loc.Name, dgst)
+			s.finish(p, loc.Name, Event{
+				ProgressEvent: store.ProgressEvent{
+					Image:  image,
+					Status: StatusDone,
+					Digest: dgst,
+					ID:     id,
+				},
+			}, loc.Repo)
+			return
+		}
+		glog.Warningf("pulling %s: %v", loc.Name, err)
+		result = multierror.Append(result, err)
+	}
+	s.finish(p, locs[0].Name, Event{
+		ProgressEvent: store.ProgressEvent{
+			Image:  image,
+			Status: StatusFailed,
+		},
+		Error: fmt.Sprintf("pulling %s: %v", image, result),
+	}, "")
+}
+
+// finish sends the last event of the pull of name. Pulls started afterwards
+// will pull the image again.
+func (s *Server) finish(p *pull, name string, event Event, repo string) {
+	s.mu.Lock()
+	delete(s.pulls, name)
+	s.mu.Unlock()
+	p.send(event, true, repo)
+}
+
+// startPull starts pulling image, unless it is already being pulled, in which
+// case it returns the pull in progress. The pull keeps running if the request
+// in ctx is canceled, as other requests might be waiting for it too.
+func (s *Server) startPull(ctx context.Context, image string) (*pull, error) {
+	locs, err := s.resolve(image)
+	if err != nil {
+		return nil, err
+	}
+	if len(locs) == 0 {
+		return nil, fmt.Errorf("no location found for %s", image)
+	}
+	name := locs[0].Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.pulls[name]; ok {
+		glog.V(2).Infof("%s is already being pulled", name)
+		return p, nil
+	}
+	p := newPull()
+	s.pulls[name] = p
+	go s.run(trace.LinkFromContext(ctx), p, image, locs)
+	return p, nil
+}
+
+// ensure pulls image, and returns its name in the store.
+func (s *Server) ensure(ctx context.Context, image string) (string, error) {
+	p, err := s.startPull(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	last, repo, _ := p.watch(func(Event) error { return nil })
+	if last.Status != StatusDone {
+		return "", fmt.Errorf("%s", last.Error)
+	}
+	name, _, _, err := util.ParseImageReference(repo)
+	if err != nil {
+		return "", err
+	}
+	return name + "@" + last.Digest.String(), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		glog.Warningf("writing response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+// decode decodes the JSON request body of a POST request into v.
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s %s is not supported", r.Method, r.URL.Path))
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %v", err))
+		return false
+	}
+	return true
+}
+
+func (s *Server) handlePull(w http.ResponseWriter, r *http.Request) {
+	req := PullRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+	p, err := s.startPull(r.Context(), req.Image)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	_, _, err = p.watch(func(event Event) error {
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		glog.V(2).Infof("client stopped watching pull of %s: %v", req.Image, err)
+	}
+}
+
+func (s *Server) handleUnpack(w http.ResponseWriter, r *http.Request) {
+	req := UnpackRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Dest == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing destination"))
+		return
+	}
+	image, err := s.ensure(r.Context(), req.Image)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	var filter *store.PathFilter
+	if len(req.Include) > 0 || len(req.Exclude) > 0 {
+		filter = &store.PathFilter{
+			Include: req.Include,
+			Exclude: req.Exclude,
+		}
+	}
+	s.lock.RLock()
+	err = s.store.WithContext(r.Context()).UnpackFiltered(image, req.Dest, filter)
+	s.lock.RUnlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError,
+			fmt.Errorf("unpacking %s: %v", req.Image, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleMount(w http.ResponseWriter, r *http.Request) {
+	req := MountRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+	if req.Dest == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("missing destination"))
+		return
+	}
+	image, err := s.ensure(r.Context(), req.Image)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	s.lock.RLock()
+	err = s.store.WithContext(r.Context()).Mount(image, req.Dest)
+	s.lock.RUnlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError,
+			fmt.Errorf("mounting %s: %v", req.Image, err))
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleUmount(w http.ResponseWriter, r *http.Request) {
+	req := UmountRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+	s.lock.RLock()
+	err := s.store.Unmount(req.Dest, req.RemoveChanges)
+	s.lock.RUnlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleImages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("%s %s is not supported", r.Method, r.URL.Path))
+		return
+	}
+	s.lock.RLock()
+	images, err := s.store.List()
+	s.lock.RUnlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, images)
+}
+
+func (s *Server) handleRemove(w http.ResponseWriter, r *http.Request) {
+	req := RemoveRequest{}
+	if !decode(w, r, &req) {
+		return
+	}
+	s.lock.Lock()
+	err := s.store.Remove(req.Image)
+	s.lock.Unlock()
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+func (s *Server) handleGC(w http.ResponseWriter, r *http.Request) {
+	if !decode(w, r, &struct{}{}) {
+		return
+	}
+	s.lock.Lock()
+	stats, err := s.store.GC()
+	s.lock.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	glog.Infof("garbage collection removed %+v", stats)
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// traced returns a handler creating a span for each request handled by h,
+// which is the parent of the spans of the store operations.
+func traced(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.Start(r.Context(), r.Method+" "+r.URL.Path)
+		defer span.End()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// Handler returns the HTTP handler serving the API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pathPull, traced(s.handlePull))
+	mux.HandleFunc(pathUnpack, traced(s.handleUnpack))
+	mux.HandleFunc(pathMount, traced(s.handleMount))
+	mux.HandleFunc(pathUmount, s.handleUmount)
+	mux.HandleFunc(pathImages, s.handleImages)
+	mux.HandleFunc(pathRemove, s.handleRemove)
+	mux.HandleFunc(pathGC, s.handleGC)
+	return mux
+}
+
+// Serve serves the API on l, e.g. a Unix socket listener.
+func (s *Server) Serve(l net.Listener) error {
+	return http.Serve(l, s.Handler())
+}
@@ -0,0 +1,463 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/store"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// blockingSource is an in-memory source.Source. Blob requests wait until
+// release is closed.
+type blockingSource struct {
+	manifests map[string][]byte
+	blobs     map[digest.Digest][]byte
+	release   chan struct{}
+	lock      sync.Mutex
+	// fetches is the number of requests for each blob.
+	fetches map[digest.Digest]int
+}
+
+var _ source.Source = &blockingSource{}
+
+func newBlockingSource() *blockingSource {
+	release := make(chan struct{})
+	close(release)
+	return &blockingSource{
+		manifests: make(map[string][]byte),
+		blobs:     make(map[digest.Digest][]byte),
+		release:   release,
+		fetches:   make(map[digest.Digest]int),
+	}
+}
+
+func (b *blockingSource) addBlob(mediaType string, content []byte) distribution.Descriptor {
+	dgst := digest.FromBytes(content)
+	b.blobs[dgst] = content
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    dgst,
+	}
+}
+
+// addImage adds an image with a layer containing etc/image, which has the
+// name of the image, and returns the digest of its manifest.
+func (b *blockingSource) addImage(t *testing.T, repo, tag string) digest.Digest {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	content := []byte(repo + ":" + tag)
+	err := tw.WriteHeader(&tar.Header{
+		Name:     "etc/image",
+		Mode:     0644,
+		Size:     int64(len(content)),
+		Typeflag: tar.TypeReg,
+	})
+	if err == nil {
+		_, err = tw.Write(content)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := b.addBlob(schema2.MediaTypeLayer, buf.Bytes())
+	config := fmt.Sprintf(`{"architecture":"amd64","os":"linux","config":{},`+
+		`"rootfs":{"type":"layers","diff_ids":[%q]}}`, layer.Digest)
+	m := schema2.Manifest{
+		Config: b.addBlob(schema2.MediaTypeImageConfig, []byte(config)),
+		Layers: []distribution.Descriptor{layer},
+	}
+	m.SchemaVersion = 2
+	m.MediaType = schema2.MediaTypeManifest
+	payload, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(payload)
+	b.manifests[repo+":"+tag] = payload
+	b.manifests[repo+":"+dgst.String()] = payload
+	return dgst
+}
+
+func (b *blockingSource) Manifest(image, reference string) (string, []byte, error) {
+	payload, ok := b.manifests[image+":"+reference]
+	if !ok {
+		return "", nil, fmt.Errorf("%s:%s not found", image, reference)
+	}
+	return schema2.MediaTypeManifest, payload, nil
+}
+
+func (b *blockingSource) Resolve(image, reference string) (distribution.Descriptor, error) {
+	mediaType, payload, err := b.Manifest(image, reference)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(payload)),
+		Digest:    digest.FromBytes(payload),
+	}, nil
+}
+
+func (b *blockingSource) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	b.lock.Lock()
+	b.fetches[desc.Digest]++
+	release := b.release
+	b.lock.Unlock()
+	<-release
+	content, ok := b.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", desc.Digest)
+	}
+	return content, nil
+}
+
+func (b *blockingSource) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	content, err := b.GetBlob(image, desc)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, desc.Digest.Encoded())
+	return path, ioutil.WriteFile(path, content, 0644)
+}
+
+// block makes blob requests wait until the function returned is called.
+func (b *blockingSource) block() func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.release = make(chan struct{})
+	return func() { close(b.release) }
+}
+
+// testServer is a server listening on a Unix socket, resolving images to
+// docker.io/library/<image>, pulled from a blocking source.
+type testServer struct {
+	*Server
+	client *Client
+	src    *blockingSource
+	dir    string
+	// resolved is sent the images resolved for pulls.
+	resolved chan string
+	listener net.Listener
+}
+
+func newTestServer(t *testing.T) *testServer {
+	dir, err := ioutil.TempDir("", "tosi-server-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{
+		src:      newBlockingSource(),
+		dir:      dir,
+		resolved: make(chan string, 100),
+	}
+	st, err := store.NewStore(filepath.Join(dir, "store"), "", 1, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	ts.Server = New(st, func(image string) ([]Location, error) {
+		if strings.Contains(image, " ") {
+			return nil, fmt.Errorf("invalid image %q", image)
+		}
+		ts.resolved <- image
+		return []Location{{
+			Name: "docker.io/library/" + image,
+			Repo: "library/" + image,
+			Connect: func(registryclient.Credentials) (source.Source, error) {
+				return ts.src, nil
+			},
+		}}, nil
+	})
+	socket := filepath.Join(dir, "tosi.sock")
+	ts.listener, err = net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	go ts.Serve(ts.listener)
+	ts.client = NewClient(socket)
+	return ts
+}
+
+func (ts *testServer) close() {
+	ts.listener.Close()
+	os.RemoveAll(ts.dir)
+}
+
+// pullResult is the result of a pull via the client.
+type pullResult struct {
+	events []Event
+	last   Event
+	err    error
+}
+
+func TestPullDedup(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	dgst := ts.src.addImage(t, "library/app", "1")
+	release := ts.src.block()
+
+	// The pulls wait for the layer, after resolving the manifest, so the
+	// ones started later join the first one.
+	clients := 3
+	joined := make(chan struct{}, clients)
+	results := make(chan pullResult, clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			result := pullResult{}
+			first := true
+			result.last, result.err = ts.client.Pull("app:1", func(event Event) {
+				result.events = append(result.events, event)
+				if first {
+					first = false
+					joined <- struct{}{}
+				}
+			})
+			results <- result
+		}()
+	}
+	for i := 0; i < clients; i++ {
+		select {
+		case <-joined:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out waiting for pulls to start")
+		}
+	}
+	release()
+
+	var expected []Event
+	for i := 0; i < clients; i++ {
+		result := <-results
+		if result.err != nil {
+			t.Fatalf("pulling app:1: %v", result.err)
+		}
+		if result.last.Status != StatusDone || result.last.Digest != dgst ||
+			result.last.ID == "" {
+			t.Errorf("unexpected last event %+v", result.last)
+		}
+		statuses := []string{}
+		for _, event := range result.events {
+			if event.Image != "app:1" {
+				t.Errorf("unexpected image in event %+v", event)
+			}
+			statuses = append(statuses, event.Status)
+		}
+		expectedStatuses := []string{
+			store.StatusResolved,
+			store.StatusDownloading,
+			store.StatusDownloaded,
+			store.StatusPulled,
+			StatusDone,
+		}
+		if !reflect.DeepEqual(statuses, expectedStatuses) {
+			t.Errorf("expected events %v, got %v", expectedStatuses, statuses)
+		}
+		// All clients get the same events, including the ones sent before
+		// they joined.
+		if expected == nil {
+			expected = result.events
+		} else if !reflect.DeepEqual(result.events, expected) {
+			t.Errorf("expected events %+v, got %+v", expected, result.events)
+		}
+	}
+
+	// Once done, the image is pulled again. The blobs are fetched as often
+	// as for the pull shared by all clients.
+	fetches := ts.src.fetches
+	ts.src.fetches = make(map[digest.Digest]int)
+	if err := ts.client.Remove("library/app:1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.client.GC(); err != nil {
+		t.Fatal(err)
+	}
+	last, err := ts.client.Pull("app:1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Digest != dgst || last.ID != expected[len(expected)-1].ID {
+		t.Errorf("expected the same image, got %+v", last)
+	}
+	if !reflect.DeepEqual(fetches, ts.src.fetches) {
+		t.Errorf("expected blob fetches %v, got %v", ts.src.fetches, fetches)
+	}
+	if n := len(ts.resolved); n != clients+1 {
+		t.Errorf("expected %d pulls, got %d", clients+1, n)
+	}
+}
+
+func TestPullFailure(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+
+	_, err := ts.client.Pull("invalid image", nil)
+	if err == nil || !strings.Contains(err.Error(), `invalid image "invalid image"`) {
+		t.Errorf("expected resolve error, got %v", err)
+	}
+
+	events := []Event{}
+	last, err := ts.client.Pull("missing:1", func(event Event) {
+		events = append(events, event)
+	})
+	if err == nil || !strings.Contains(err.Error(), "library/missing:1 not found") {
+		t.Errorf("expected missing image error, got %v", err)
+	}
+	if last.Status != StatusFailed || len(events) != 1 {
+		t.Errorf("expected one failed event, got %+v", events)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	ts := newTestServer(t)
+	defer ts.close()
+	dgst := ts.src.addImage(t, "library/app", "1")
+
+	dest := filepath.Join(ts.dir, "rootfs")
+	err := ts.client.Unpack(UnpackRequest{Image: "app:1", Dest: dest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dest, "etc/image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "library/app:1" {
+		t.Errorf("unexpected content %q", content)
+	}
+	err = ts.client.Unpack(UnpackRequest{Image: "app:1"})
+	if err == nil || !strings.Contains(err.Error(), "missing destination") {
+		t.Errorf("expected missing destination error, got %v", err)
+	}
+
+	images, err := ts.client.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Digest != dgst ||
+		!reflect.DeepEqual(images[0].Names, []string{"library/app:1"}) {
+		t.Errorf("unexpected images %+v", images)
+	}
+
+	// Only POST is allowed for requests with a body.
+	resp, err := ts.client.client.Get("http://tosi" + pathPull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected %d for GET %s, got %s", http.StatusMethodNotAllowed,
+			pathPull, resp.Status)
+	}
+	resp, err = ts.client.client.Post("http://tosi"+pathPull,
+		"application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d for invalid JSON, got %s", http.StatusBadRequest,
+			resp.Status)
+	}
+
+	if err := ts.client.Remove("library/app:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.client.Remove("library/app:1"); err == nil {
+		t.Errorf("expected error removing app:1 again")
+	}
+	images, err = ts.client.Images()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 0 {
+		t.Errorf("expected no images, got %+v", images)
+	}
+	stats, err := ts.client.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Blobs != 2 || stats.Configs != 1 {
+		t.Errorf("expected the layer and config to be removed, got %+v", stats)
+	}
+}
+
+func TestPullSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(prev)
+	ts := newTestServer(t)
+	defer ts.close()
+	ts.src.addImage(t, "library/app", "1")
+
+	// The pull outlives the request that started it.
+	release := ts.src.block()
+	ctx, cancel := context.WithCancel(context.Background())
+	p, err := ts.startPull(ctx, "app:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	release()
+	last, _, _ := p.watch(func(Event) error { return nil })
+	if last.Status != StatusDone {
+		t.Fatalf("pull failed: %+v", last)
+	}
+
+	if _, err := ts.client.Pull("app:1", nil); err != nil {
+		t.Fatal(err)
+	}
+	spans := map[string][]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	requests := spans["POST "+pathPull]
+	pulls := spans["pull"]
+	if len(requests) != 1 || len(pulls) != 2 || len(spans["Pull"]) != 2 {
+		t.Fatalf("unexpected spans %v", spans)
+	}
+	for _, pull := range pulls {
+		if pull.Parent().IsValid() {
+			t.Errorf("expected pull to be a root span, got parent %v", pull.Parent())
+		}
+	}
+	// The first pull was started without a span.
+	if links := pulls[0].Links(); len(links) != 0 {
+		t.Errorf("expected no links, got %v", links)
+	}
+	links := pulls[1].Links()
+	if len(links) != 1 || !links[0].SpanContext.Equal(requests[0].SpanContext()) {
+		t.Errorf("expected link to %v, got %v", requests[0].SpanContext(), links)
+	}
+	for i, span := range spans["Pull"] {
+		if !span.Parent().Equal(pulls[i].SpanContext()) {
+			t.Errorf("expected parent %v, got %v", pulls[i].SpanContext(),
+				span.Parent())
+		}
+	}
+}
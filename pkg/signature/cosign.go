@@ -0,0 +1,182 @@
+package signature
+
+import (
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// SimpleSigningMediaType is the media type of the layers of cosign
+	// signature manifests, which contain the signed payload.
+	SimpleSigningMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+	// SignatureAnnotation is the layer annotation with the base64 encoded
+	// signature of the payload.
+	SignatureAnnotation = "dev.cosignproject.cosign/signature"
+	// ArtifactType is the artifact type of cosign signatures attached to
+	// images via the OCI referrers API.
+	ArtifactType = "application/vnd.dev.cosign.artifact.sig.v1+json"
+	// signatureType is the type of cosign image signature payloads.
+	signatureType = "cosign container image signature"
+)
+
+// Payload is the simple signing payload signed by cosign.
+type Payload struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest digest.Digest `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional,omitempty"`
+}
+
+// SignatureTag returns the tag cosign stores the signatures of the manifest
+// dgst under, e.g. sha256-<hex>.sig.
+func SignatureTag(dgst digest.Digest) string {
+	return strings.Replace(dgst.String(), ":", "-", 1) + ".sig"
+}
+
+// Verifier verifies cosign signatures of images with a set of public keys.
+type Verifier struct {
+	keys []crypto.PublicKey
+}
+
+// NewVerifier creates a verifier accepting signatures created with the
+// private key of any of keys.
+func NewVerifier(keys []crypto.PublicKey) *Verifier {
+	return &Verifier{
+		keys: keys,
+	}
+}
+
+// signatureManifests returns the raw signature manifests of the manifest dgst
+// in repo, stored under the signature tag, or attached via the OCI referrers
+// API if src supports it.
+func signatureManifests(src source.Source, repo string, dgst digest.Digest) [][]byte {
+	manifests := [][]byte{}
+	_, buf, err := src.Manifest(repo, SignatureTag(dgst))
+	if err == nil {
+		manifests = append(manifests, buf)
+	} else {
+		glog.V(2).Infof("%s: no signatures via tag %s: %v",
+			repo, SignatureTag(dgst), err)
+	}
+	lister, ok := src.(source.ReferrersLister)
+	if !ok {
+		return manifests
+	}
+	descs, err := lister.Referrers(repo, dgst, ArtifactType)
+	if err != nil {
+		glog.Warningf("%s: listing referrers of %s: %v", repo, dgst, err)
+		return manifests
+	}
+	for _, desc := range descs {
+		_, buf, err := src.Manifest(repo, desc.Digest.String())
+		if err != nil {
+			glog.Warningf("%s: fetching signature %s: %v", repo, desc.Digest, err)
+			continue
+		}
+		if desc.Digest.Algorithm().FromBytes(buf) != desc.Digest {
+			glog.Warningf("%s: signature manifest %s: verifier failed",
+				repo, desc.Digest)
+			continue
+		}
+		manifests = append(manifests, buf)
+	}
+	return manifests
+}
+
+// verifyLayer verifies the signature in the annotations of the signature
+// manifest layer against the payload in the layer blob, and checks that the
+// payload is for the manifest dgst.
+func (v *Verifier) verifyLayer(src source.Source, repo string, dgst digest.Digest, layer v1.Descriptor) error {
+	encoded := layer.Annotations[SignatureAnnotation]
+	if encoded == "" {
+		return errors.New("missing signature annotation")
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid signature annotation: %v", err)
+	}
+	payload, err := src.GetBlob(repo, distribution.Descriptor{
+		MediaType: layer.MediaType,
+		Size:      layer.Size,
+		Digest:    layer.Digest,
+	})
+	if err != nil {
+		return fmt.Errorf("fetching payload: %v", err)
+	}
+	verified := false
+	for _, key := range v.keys {
+		if err := verifySignature(key, payload, sig); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return errors.New("signature does not match any of the keys")
+	}
+	p := Payload{}
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("parsing payload: %v", err)
+	}
+	if p.Critical.Type != signatureType {
+		return fmt.Errorf("unexpected payload type %q", p.Critical.Type)
+	}
+	if p.Critical.Image.DockerManifestDigest != dgst {
+		return fmt.Errorf("signature is for %s",
+			p.Critical.Image.DockerManifestDigest)
+	}
+	glog.V(2).Infof("%s@%s: signature for %s", repo, dgst,
+		p.Critical.Identity.DockerReference)
+	return nil
+}
+
+// Verify returns nil if the manifest dgst in repo has a cosign signature
+// created with one of the keys of the verifier. Signatures are looked up via
+// the sha256-<hex>.sig tag, and via the OCI referrers API.
+func (v *Verifier) Verify(src source.Source, repo, reference string, dgst digest.Digest) error {
+	name := repo + ":" + reference
+	if _, err := digest.Parse(reference); err == nil {
+		name = repo + "@" + reference
+	}
+	problems := []string{}
+	for _, buf := range signatureManifests(src, repo, dgst) {
+		m := v1.Manifest{}
+		if err := json.Unmarshal(buf, &m); err != nil {
+			problems = append(problems, fmt.Sprintf("parsing manifest: %v", err))
+			continue
+		}
+		for _, layer := range m.Layers {
+			if layer.MediaType != SimpleSigningMediaType {
+				continue
+			}
+			err := v.verifyLayer(src, repo, dgst, layer)
+			if err == nil {
+				glog.Infof("verified signature %s of %s@%s",
+					layer.Digest, repo, dgst)
+				return nil
+			}
+			problems = append(problems,
+				fmt.Sprintf("signature %s: %v", layer.Digest, err))
+		}
+	}
+	if len(problems) == 0 {
+		return fmt.Errorf("%s (%s) is not signed", name, dgst)
+	}
+	return fmt.Errorf("no valid signature found for %s (%s): %s",
+		name, dgst, strings.Join(problems, "; "))
+}
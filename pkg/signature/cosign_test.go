@@ -0,0 +1,119 @@
+package signature_test
+
+import (
+	"crypto"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/registrytest"
+	"github.com/elotl/tosi/pkg/signature"
+	"github.com/elotl/tosi/pkg/signaturetest"
+	"github.com/opencontainers/go-digest"
+)
+
+const testRepo = "test/app"
+
+func TestVerify(t *testing.T) {
+	key := signaturetest.NewKey(t)
+	otherKey := signaturetest.NewKey(t)
+	testCases := []struct {
+		name string
+		// attach signs the image dgst, with other being the digest of
+		// another image.
+		attach func(client *registryclient.RegistryClient, dgst, other digest.Digest)
+		keys   []crypto.PublicKey
+		err    string
+	}{
+		{
+			name: "signature tag",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {
+				signaturetest.SignTag(t, client, testRepo, key, dgst, dgst)
+			},
+			keys: []crypto.PublicKey{&key.PublicKey},
+		},
+		{
+			name: "referrer",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {
+				signaturetest.SignReferrer(t, client, testRepo, key, dgst, dgst)
+			},
+			keys: []crypto.PublicKey{&key.PublicKey},
+		},
+		{
+			name: "any of the keys",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {
+				signaturetest.SignTag(t, client, testRepo, key, dgst, dgst)
+			},
+			keys: []crypto.PublicKey{&otherKey.PublicKey, &key.PublicKey},
+		},
+		{
+			name: "wrong key",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {
+				signaturetest.SignTag(t, client, testRepo, otherKey, dgst, dgst)
+				signaturetest.SignReferrer(t, client, testRepo, otherKey, dgst, dgst)
+			},
+			keys: []crypto.PublicKey{&key.PublicKey},
+			err:  "signature does not match any of the keys",
+		},
+		{
+			name: "payload for another image",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {
+				signaturetest.SignTag(t, client, testRepo, key, dgst, other)
+			},
+			keys: []crypto.PublicKey{&key.PublicKey},
+			err:  "signature is for %OTHER%",
+		},
+		{
+			name:   "unsigned",
+			attach: func(client *registryclient.RegistryClient, dgst, other digest.Digest) {},
+			keys:   []crypto.PublicKey{&key.PublicKey},
+			err:    "is not signed",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reg := registrytest.New()
+			server := httptest.NewServer(reg)
+			defer server.Close()
+			client, err := registryclient.NewRegistryClientWithOptions(server.URL,
+				registryclient.Options{MaxRetries: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			dgst := signaturetest.PushImage(t, client, testRepo, "v1")
+			other := signaturetest.PushImage(t, client, testRepo, "v2")
+			tc.attach(client, dgst, other)
+			err = signature.NewVerifier(tc.keys).Verify(client, testRepo, "v1", dgst)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			expected := strings.Replace(tc.err, "%OTHER%", other.String(), 1)
+			if err == nil || !strings.Contains(err.Error(), expected) {
+				t.Fatalf("expected error containing %q, got %v", expected, err)
+			}
+		})
+	}
+}
+
+func TestVerifyWithoutReferrersAPI(t *testing.T) {
+	key := signaturetest.NewKey(t)
+	reg := registrytest.New()
+	reg.NoReferrers = true
+	server := httptest.NewServer(reg)
+	defer server.Close()
+	client, err := registryclient.NewRegistryClientWithOptions(server.URL,
+		registryclient.Options{MaxRetries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := signaturetest.PushImage(t, client, testRepo, "v1")
+	signaturetest.SignTag(t, client, testRepo, key, dgst, dgst)
+	err = signature.NewVerifier([]crypto.PublicKey{&key.PublicKey}).Verify(client, testRepo, dgst.String(), dgst)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
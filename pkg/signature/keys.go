@@ -0,0 +1,86 @@
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// LoadPublicKey loads a PEM encoded public key from path, e.g. a cosign.pub
+// file created via cosign generate-key-pair. ECDSA, RSA and Ed25519 keys are
+// supported.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", path, block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported public key type %T", path, key)
+}
+
+// LoadPublicKeys loads the PEM encoded public keys in paths.
+func LoadPublicKeys(paths []string) ([]crypto.PublicKey, error) {
+	keys := make([]crypto.PublicKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadPublicKey(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// ecdsaSignature is an ASN.1 encoded ECDSA signature.
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// verifySignature verifies sig, created by signing the SHA-256 hash of
+// payload with the private key of key, or payload itself for Ed25519 keys.
+func verifySignature(key crypto.PublicKey, payload, sig []byte) error {
+	hash := sha256.Sum256(payload)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		esig := ecdsaSignature{}
+		rest, err := asn1.Unmarshal(sig, &esig)
+		if err != nil || len(rest) > 0 {
+			return errors.New("invalid ECDSA signature")
+		}
+		if !ecdsa.Verify(key, hash[:], esig.R, esig.S) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, payload, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
@@ -0,0 +1,166 @@
+// Package signaturetest pushes images and cosign signatures for them to a
+// registry, for testing signature verification, e.g. against a registry from
+// registrytest.
+package signaturetest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/signature"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewKey generates an ECDSA P-256 key, like the ones of cosign.
+func NewKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// PublicKeyPEM returns the PEM encoded public key of key, like cosign.pub.
+func PublicKeyPEM(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// PushImage pushes a minimal image to repo:tag in the registry of client, and
+// returns the digest of its manifest. Images with different tags have
+// different digests.
+func PushImage(t *testing.T, client *registryclient.RegistryClient, repo, tag string) digest.Digest {
+	config := []byte(`{"architecture":"amd64","os":"linux","config":{"Labels":{"tag":"` +
+		tag + `"}},"rootfs":{"type":"layers","diff_ids":[]}}`)
+	desc := pushBlob(t, client, repo, schema2.MediaTypeImageConfig, config)
+	m := v1.Manifest{
+		Config: v1.Descriptor{
+			MediaType: desc.MediaType,
+			Size:      desc.Size,
+			Digest:    desc.Digest,
+		},
+		Layers: []v1.Descriptor{},
+	}
+	m.SchemaVersion = 2
+	return pushManifest(t, client, repo, tag, v1.MediaTypeImageManifest, m)
+}
+
+func pushBlob(t *testing.T, client *registryclient.RegistryClient, repo, mediaType string, content []byte) distribution.Descriptor {
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    digest.FromBytes(content),
+	}
+	err := client.PutBlob(repo, desc, bytes.NewReader(content), 0)
+	if err != nil {
+		t.Fatalf("pushing blob: %v", err)
+	}
+	return desc
+}
+
+func pushManifest(t *testing.T, client *registryclient.RegistryClient, repo, reference, mediaType string, m interface{}) digest.Digest {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := client.PutManifest(repo, reference, mediaType, buf)
+	if err != nil {
+		t.Fatalf("pushing manifest: %v", err)
+	}
+	return dgst
+}
+
+// sign signs payload like cosign, via an ASN.1 encoded ECDSA signature of its
+// SHA-256 hash.
+func sign(t *testing.T, key *ecdsa.PrivateKey, payload []byte) string {
+	hash := sha256.Sum256(payload)
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// signatureManifest pushes the simple signing payload for the image signed
+// with key, and returns the signature manifest for it.
+func signatureManifest(t *testing.T, client *registryclient.RegistryClient, repo string, key *ecdsa.PrivateKey, signed digest.Digest) v1.Manifest {
+	p := signature.Payload{}
+	p.Critical.Type = "cosign container image signature"
+	p.Critical.Identity.DockerReference = "registry.example.com/" + repo
+	p.Critical.Image.DockerManifestDigest = signed
+	payload, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := pushBlob(t, client, repo, signature.SimpleSigningMediaType, payload)
+	config := pushBlob(t, client, repo, signature.ArtifactType, []byte("{}"))
+	m := v1.Manifest{
+		Config: v1.Descriptor{
+			MediaType: config.MediaType,
+			Size:      config.Size,
+			Digest:    config.Digest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+			Digest:    layer.Digest,
+			Annotations: map[string]string{
+				signature.SignatureAnnotation: sign(t, key, payload),
+			},
+		}},
+	}
+	m.SchemaVersion = 2
+	return m
+}
+
+// SignTag attaches a signature of signed, created with key, to the image
+// dgst in repo via the signature tag.
+func SignTag(t *testing.T, client *registryclient.RegistryClient, repo string, key *ecdsa.PrivateKey, dgst, signed digest.Digest) {
+	m := signatureManifest(t, client, repo, key, signed)
+	pushManifest(t, client, repo, signature.SignatureTag(dgst),
+		v1.MediaTypeImageManifest, m)
+}
+
+// SignReferrer attaches a signature of signed, created with key, to the image
+// dgst in repo via the referrers API.
+func SignReferrer(t *testing.T, client *registryclient.RegistryClient, repo string, key *ecdsa.PrivateKey, dgst, signed digest.Digest) {
+	m := struct {
+		v1.Manifest
+		ArtifactType string         `json:"artifactType"`
+		Subject      *v1.Descriptor `json:"subject"`
+	}{
+		Manifest:     signatureManifest(t, client, repo, key, signed),
+		ArtifactType: signature.ArtifactType,
+		Subject: &v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    dgst,
+		},
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pushManifest(t, client, repo, digest.FromBytes(buf).String(),
+		v1.MediaTypeImageManifest, m)
+}
@@ -0,0 +1,30 @@
+package source
+
+import (
+	"io"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+// Destination is a location images can be pushed to, e.g. an image registry.
+type Destination interface {
+	// BlobExists returns true if the blob dgst is already present in the
+	// repository image.
+	BlobExists(image string, dgst digest.Digest) (bool, error)
+	// MountBlob tries to mount the blob dgst from the repository from into
+	// image, without uploading it. It returns false if the blob could not be
+	// mounted, in which case it needs to be uploaded.
+	MountBlob(image, from string, dgst digest.Digest) (bool, error)
+	// PutBlob uploads the blob described by desc into the repository image.
+	// If chunkSize is positive, the blob is uploaded in chunks of this size,
+	// otherwise in a single request.
+	PutBlob(image string, desc distribution.Descriptor, content io.ReaderAt, chunkSize int64) error
+	// PutBlobStream uploads the blob described by desc into the repository
+	// image, reading it from content while uploading it. Blobs larger than
+	// chunkSize are uploaded in chunks.
+	PutBlobStream(image string, desc distribution.Descriptor, content io.Reader, chunkSize int64) error
+	// PutManifest uploads the raw manifest payload as image:reference, and
+	// returns its digest.
+	PutManifest(image, reference, mediaType string, payload []byte) (digest.Digest, error)
+}
@@ -0,0 +1,285 @@
+package source
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// archiveImage is an entry in manifest.json of a docker-archive tarball.
+type archiveImage struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// DockerArchive is a tarball created via "docker save". Since the tarball
+// does not contain registry manifests, a schema2 manifest is synthesized for
+// each image in it.
+type DockerArchive struct {
+	path   string
+	once   sync.Once
+	err    error
+	images []archiveImage
+	// Blob descriptors by file name in the tarball.
+	descs map[string]distribution.Descriptor
+	// File names in the tarball by blob digest.
+	blobs map[digest.Digest]string
+}
+
+// NewDockerArchive returns a Source for the docker-archive tarball at path.
+func NewDockerArchive(path string) (*DockerArchive, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	return &DockerArchive{
+		path:  path,
+		descs: make(map[string]distribution.Descriptor),
+		blobs: make(map[digest.Digest]string),
+	}, nil
+}
+
+// walk calls fn for each file in the tarball, until fn returns true.
+func (d *DockerArchive) walk(fn func(name string, r io.Reader) (bool, error)) error {
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading %s: %v", d.path, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		done, err := fn(path.Clean(hdr.Name), tr)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+func (d *DockerArchive) readFile(name string) ([]byte, error) {
+	var buf []byte
+	err := d.walk(func(n string, r io.Reader) (bool, error) {
+		if n != name {
+			return false, nil
+		}
+		var err error
+		buf, err = ioutil.ReadAll(r)
+		return true, err
+	})
+	if err == nil && buf == nil {
+		err = fmt.Errorf("%s not found in %s", name, d.path)
+	}
+	return buf, err
+}
+
+// scan reads manifest.json from the tarball, and calculates the digests of all
+// configs and layers referenced from it.
+func (d *DockerArchive) scan() error {
+	buf, err := d.readFile("manifest.json")
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(buf, &d.images)
+	if err != nil {
+		return fmt.Errorf("parsing manifest.json in %s: %v", d.path, err)
+	}
+	configs := make(map[string]bool)
+	layers := make(map[string]bool)
+	for _, image := range d.images {
+		configs[path.Clean(image.Config)] = true
+		for _, layer := range image.Layers {
+			layers[path.Clean(layer)] = true
+		}
+	}
+	glog.V(2).Infof("%s: calculating digests for %d configs and %d layers",
+		d.path, len(configs), len(layers))
+	return d.walk(func(name string, r io.Reader) (bool, error) {
+		mediaType := ""
+		br := bufio.NewReader(r)
+		if configs[name] {
+			mediaType = schema2.MediaTypeImageConfig
+		} else if layers[name] {
+			mediaType = schema2.MediaTypeUncompressedLayer
+			magic, _ := br.Peek(2)
+			if bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+				mediaType = schema2.MediaTypeLayer
+			}
+		} else {
+			return false, nil
+		}
+		digester := digest.Canonical.Digester()
+		n, err := io.Copy(digester.Hash(), br)
+		if err != nil {
+			return true, err
+		}
+		desc := distribution.Descriptor{
+			MediaType: mediaType,
+			Size:      n,
+			Digest:    digester.Digest(),
+		}
+		d.descs[name] = desc
+		d.blobs[desc.Digest] = name
+		return false, nil
+	})
+}
+
+func (d *DockerArchive) load() error {
+	d.once.Do(func() {
+		d.err = d.scan()
+	})
+	return d.err
+}
+
+func familiarName(name string) string {
+	name = strings.TrimPrefix(name, "docker.io/")
+	return strings.TrimPrefix(name, "library/")
+}
+
+func (d *DockerArchive) manifest(image archiveImage) ([]byte, error) {
+	config, ok := d.descs[path.Clean(image.Config)]
+	if !ok {
+		return nil, fmt.Errorf("config %s not found in %s", image.Config, d.path)
+	}
+	m := schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    config,
+	}
+	for _, layer := range image.Layers {
+		desc, ok := d.descs[path.Clean(layer)]
+		if !ok {
+			return nil, fmt.Errorf("layer %s not found in %s", layer, d.path)
+		}
+		m.Layers = append(m.Layers, desc)
+	}
+	deserialized, err := schema2.FromStruct(m)
+	if err != nil {
+		return nil, err
+	}
+	_, buf, err := deserialized.Payload()
+	return buf, err
+}
+
+// Images in the tarball are matched via their repo tags. If the tarball has
+// only one image, it is used for the default "latest" tag.
+func (d *DockerArchive) Manifest(image, reference string) (string, []byte, error) {
+	err := d.load()
+	if err != nil {
+		return "", nil, err
+	}
+	dgst, err := digest.Parse(reference)
+	if err == nil {
+		for _, img := range d.images {
+			buf, err := d.manifest(img)
+			if err != nil {
+				return "", nil, err
+			}
+			if digest.FromBytes(buf) == dgst {
+				return schema2.MediaTypeManifest, buf, nil
+			}
+		}
+		return "", nil, fmt.Errorf("%s@%s not found in %s",
+			image, reference, d.path)
+	}
+	name := familiarName(util.SourceName(image) + ":" + reference)
+	for _, img := range d.images {
+		for _, tag := range img.RepoTags {
+			if familiarName(tag) == name {
+				buf, err := d.manifest(img)
+				return schema2.MediaTypeManifest, buf, err
+			}
+		}
+	}
+	if reference == "latest" && len(d.images) == 1 {
+		buf, err := d.manifest(d.images[0])
+		return schema2.MediaTypeManifest, buf, err
+	}
+	return "", nil, fmt.Errorf("%s:%s not found in %s", image, reference, d.path)
+}
+
+func (d *DockerArchive) Resolve(image, reference string) (distribution.Descriptor, error) {
+	mediaType, buf, err := d.Manifest(image, reference)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(buf)),
+		Digest:    digest.FromBytes(buf),
+	}, nil
+}
+
+func (d *DockerArchive) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	err := d.load()
+	if err != nil {
+		return nil, err
+	}
+	name, ok := d.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found in %s", desc.Digest, d.path)
+	}
+	glog.V(2).Infof("getting image %s blob %s from %s", image, name, d.path)
+	buf, err := d.readFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(buf) != desc.Digest {
+		return nil, fmt.Errorf("reading %s: verifier failed", name)
+	}
+	return buf, nil
+}
+
+func (d *DockerArchive) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	name := filepath.Join(dir, desc.Digest.Encoded())
+	if _, err := os.Stat(name); err == nil {
+		glog.V(2).Infof("image %s blob %s already exists", image, name)
+		return name, nil
+	}
+	err := d.load()
+	if err != nil {
+		return "", err
+	}
+	entry, ok := d.blobs[desc.Digest]
+	if !ok {
+		return "", fmt.Errorf("blob %s not found in %s", desc.Digest, d.path)
+	}
+	glog.V(2).Infof("saving image %s blob %s from %s", image, name, entry)
+	found := false
+	err = d.walk(func(n string, r io.Reader) (bool, error) {
+		if n != entry {
+			return false, nil
+		}
+		found = true
+		return true, util.WriteBlob(name, desc, r)
+	})
+	if err == nil && !found {
+		err = fmt.Errorf("%s not found in %s", entry, d.path)
+	}
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,302 @@
+package source
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+// writeArchive writes a docker-archive tarball with files, and manifest.json
+// with images, into dir.
+func writeArchive(t *testing.T, dir string, images []archiveImage, files map[string][]byte) string {
+	buf, err := json.Marshal(images)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "app.tar")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	write := func(name string, content []byte) {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		write(name, content)
+	}
+	write("manifest.json", buf)
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func gzipped(t *testing.T, content []byte) []byte {
+	buf := bytes.Buffer{}
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// parseManifest parses a schema2 manifest from a docker-archive source.
+func parseManifest(t *testing.T, buf []byte) schema2.Manifest {
+	m := schema2.Manifest{}
+	if err := json.Unmarshal(buf, &m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestDockerArchiveManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"myapp.json":       []byte(`{"architecture": "amd64", "os": "linux", "config": {}}`),
+		"other.json":       []byte(`{"architecture": "arm64", "os": "linux", "config": {}}`),
+		"base/layer.tar":   []byte("base layer"),
+		"myapp/layer.tar":  gzipped(t, []byte("myapp layer")),
+		"unused/layer.tar": []byte("unused layer"),
+	}
+	path := writeArchive(t, dir, []archiveImage{
+		{
+			Config:   "myapp.json",
+			RepoTags: []string{"myapp:1.2", "registry.example.com/team/myapp:1.2"},
+			Layers:   []string{"base/layer.tar", "./myapp/layer.tar"},
+		},
+		{
+			Config:   "other.json",
+			RepoTags: []string{"docker.io/library/other:1.2"},
+			Layers:   []string{"base/layer.tar"},
+		},
+	}, files)
+	src, err := NewDockerArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, buf, err := src.Manifest("myapp", "1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	myapp := parseManifest(t, buf)
+	if myapp.Config.Digest != digest.FromBytes(files["myapp.json"]) ||
+		myapp.Config.MediaType != schema2.MediaTypeImageConfig {
+		t.Errorf("unexpected config %+v", myapp.Config)
+	}
+	expected := []distribution.Descriptor{
+		{
+			MediaType: schema2.MediaTypeUncompressedLayer,
+			Size:      int64(len(files["base/layer.tar"])),
+			Digest:    digest.FromBytes(files["base/layer.tar"]),
+		},
+		{
+			MediaType: schema2.MediaTypeLayer,
+			Size:      int64(len(files["myapp/layer.tar"])),
+			Digest:    digest.FromBytes(files["myapp/layer.tar"]),
+		},
+	}
+	if len(myapp.Layers) != len(expected) {
+		t.Fatalf("expected %d layers, got %+v", len(expected), myapp.Layers)
+	}
+	for i, layer := range myapp.Layers {
+		if layer.MediaType != expected[i].MediaType ||
+			layer.Size != expected[i].Size || layer.Digest != expected[i].Digest {
+			t.Errorf("layer %d: expected %+v, got %+v", i, expected[i], layer)
+		}
+	}
+	myappDigest := digest.FromBytes(buf)
+	_, buf, err = src.Manifest("other", "1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherDigest := digest.FromBytes(buf)
+
+	testCases := []struct {
+		image     string
+		reference string
+		expected  digest.Digest
+		err       bool
+	}{
+		{image: "myapp", reference: "1.2", expected: myappDigest},
+		{image: "library/myapp", reference: "1.2", expected: myappDigest},
+		{image: "_docker-archive/myapp", reference: "1.2", expected: myappDigest},
+		{image: "registry.example.com/team/myapp", reference: "1.2", expected: myappDigest},
+		{image: "other", reference: "1.2", expected: otherDigest},
+		{image: "_docker-archive/library/other", reference: "1.2", expected: otherDigest},
+		{image: "myapp", reference: otherDigest.String(), expected: otherDigest},
+		{image: "_docker-archive/myapp", reference: myappDigest.String(), expected: myappDigest},
+		{image: "myapp", reference: "1.3", err: true},
+		{image: "team/myapp", reference: "1.2", err: true},
+		// With more than one image, "latest" needs to be a repo tag.
+		{image: "myapp", reference: "latest", err: true},
+		{image: "myapp", reference: digest.FromString("missing").String(), err: true},
+	}
+	for _, tc := range testCases {
+		mediaType, buf, err := src.Manifest(tc.image, tc.reference)
+		desc, rerr := src.Resolve(tc.image, tc.reference)
+		if tc.err {
+			if err == nil || rerr == nil {
+				t.Errorf("%s:%s: expected error, got %v, %v", tc.image,
+					tc.reference, err, rerr)
+			}
+			continue
+		}
+		if err != nil || rerr != nil {
+			t.Errorf("%s:%s: %v, %v", tc.image, tc.reference, err, rerr)
+			continue
+		}
+		if digest.FromBytes(buf) != tc.expected || desc.Digest != tc.expected {
+			t.Errorf("%s:%s: expected %s, got %s and %s", tc.image,
+				tc.reference, tc.expected, digest.FromBytes(buf), desc.Digest)
+		}
+		if mediaType != schema2.MediaTypeManifest ||
+			desc.MediaType != mediaType || desc.Size != int64(len(buf)) {
+			t.Errorf("%s:%s: unexpected media type %q and descriptor %+v",
+				tc.image, tc.reference, mediaType, desc)
+		}
+	}
+}
+
+func TestDockerArchiveSingleImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := writeArchive(t, dir, []archiveImage{{
+		Config: "config.json",
+		Layers: []string{"layer.tar"},
+	}}, map[string][]byte{
+		"config.json": []byte(`{"architecture": "amd64", "os": "linux", "config": {}}`),
+		"layer.tar":   []byte("layer"),
+	})
+	src, err := NewDockerArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name defaults to the base name of the tarball without extension.
+	if _, err := src.Resolve("_docker-archive/app", "latest"); err != nil {
+		t.Error(err)
+	}
+	if _, err := src.Resolve("_docker-archive/app", "1.0"); err == nil {
+		t.Errorf("expected error for _docker-archive/app:1.0")
+	}
+}
+
+func TestDockerArchiveErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := NewDockerArchive(filepath.Join(dir, "missing.tar")); err == nil {
+		t.Errorf("expected error for missing tarball")
+	}
+	path := writeArchive(t, dir, []archiveImage{{
+		Config:   "config.json",
+		RepoTags: []string{"myapp:1.2"},
+		Layers:   []string{"missing/layer.tar"},
+	}}, map[string][]byte{
+		"config.json": []byte(`{"architecture": "amd64", "os": "linux", "config": {}}`),
+	})
+	src, err := NewDockerArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := src.Manifest("myapp", "1.2"); err == nil {
+		t.Errorf("expected error for missing layer")
+	}
+
+	path = filepath.Join(dir, "invalid.tar")
+	if err := ioutil.WriteFile(path, []byte("not a tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	src, err = NewDockerArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := src.Manifest("myapp", "1.2"); err == nil {
+		t.Errorf("expected error for invalid tarball")
+	}
+}
+
+func TestDockerArchiveBlobs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{
+		"config.json": []byte(`{"architecture": "amd64", "os": "linux", "config": {}}`),
+		"layer.tar":   []byte("layer"),
+		"extra.tar":   []byte("extra"),
+	}
+	path := writeArchive(t, dir, []archiveImage{{
+		Config:   "config.json",
+		RepoTags: []string{"myapp:1.2"},
+		Layers:   []string{"layer.tar"},
+	}}, files)
+	src, err := NewDockerArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layer := distribution.Descriptor{
+		MediaType: schema2.MediaTypeUncompressedLayer,
+		Size:      int64(len(files["layer.tar"])),
+		Digest:    digest.FromBytes(files["layer.tar"]),
+	}
+	buf, err := src.GetBlob("_docker-archive/myapp", layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "layer" {
+		t.Errorf("expected blob content %q, got %q", "layer", buf)
+	}
+	// Only blobs referenced from manifest.json are available.
+	extra := distribution.Descriptor{
+		MediaType: schema2.MediaTypeUncompressedLayer,
+		Size:      int64(len(files["extra.tar"])),
+		Digest:    digest.FromBytes(files["extra.tar"]),
+	}
+	if _, err := src.GetBlob("_docker-archive/myapp", extra); err == nil {
+		t.Errorf("expected error getting unreferenced blob")
+	}
+
+	saveDir := tempDir(t)
+	defer os.RemoveAll(saveDir)
+	name, err := src.SaveBlob("_docker-archive/myapp", saveDir, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != filepath.Join(saveDir, layer.Digest.Encoded()) {
+		t.Errorf("unexpected blob path %s", name)
+	}
+	buf, err = ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "layer" {
+		t.Errorf("expected saved blob content %q, got %q", "layer", buf)
+	}
+	if _, err := src.SaveBlob("_docker-archive/myapp", saveDir, extra); err == nil {
+		t.Errorf("expected error saving unreferenced blob")
+	}
+}
@@ -0,0 +1,174 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OCILayout is an OCI image layout directory, as described in
+// https://github.com/opencontainers/image-spec/blob/master/image-layout.md.
+type OCILayout struct {
+	dir string
+}
+
+// NewOCILayout returns a Source for the OCI image layout in dir.
+func NewOCILayout(dir string) (*OCILayout, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, v1.ImageLayoutFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %v", dir, err)
+	}
+	layout := v1.ImageLayout{}
+	err = json.Unmarshal(buf, &layout)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s in %s: %v", v1.ImageLayoutFile, dir, err)
+	}
+	if layout.Version != v1.ImageLayoutVersion {
+		return nil, fmt.Errorf("unsupported OCI image layout version %q in %s",
+			layout.Version, dir)
+	}
+	return &OCILayout{
+		dir: dir,
+	}, nil
+}
+
+func (o *OCILayout) blobPath(dgst digest.Digest) (string, error) {
+	if err := dgst.Validate(); err != nil {
+		return "", err
+	}
+	return filepath.Join(
+		o.dir, "blobs", dgst.Algorithm().String(), dgst.Encoded()), nil
+}
+
+func (o *OCILayout) index() (*v1.Index, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(o.dir, "index.json"))
+	if err != nil {
+		return nil, err
+	}
+	index := v1.Index{}
+	err = json.Unmarshal(buf, &index)
+	if err != nil {
+		return nil, fmt.Errorf("parsing index.json in %s: %v", o.dir, err)
+	}
+	return &index, nil
+}
+
+// Manifests in the index are matched via their ref.name annotation, which can
+// either be a full image name with a tag, or only a tag. If the index has only
+// one manifest, it is used for the default "latest" tag.
+func (o *OCILayout) lookup(image, reference string) (*v1.Descriptor, error) {
+	image = util.SourceName(image)
+	index, err := o.index()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{image + ":" + reference, reference} {
+		for i, m := range index.Manifests {
+			if m.Annotations[v1.AnnotationRefName] == name {
+				return &index.Manifests[i], nil
+			}
+		}
+	}
+	if reference == "latest" && len(index.Manifests) == 1 {
+		return &index.Manifests[0], nil
+	}
+	return nil, fmt.Errorf("%s:%s not found in OCI layout %s",
+		image, reference, o.dir)
+}
+
+func (o *OCILayout) Manifest(image, reference string) (string, []byte, error) {
+	mediaType := ""
+	dgst, err := digest.Parse(reference)
+	if err != nil {
+		desc, err := o.lookup(image, reference)
+		if err != nil {
+			return "", nil, err
+		}
+		dgst = desc.Digest
+		mediaType = desc.MediaType
+	}
+	glog.V(2).Infof("getting %s:%s manifest %s from %s",
+		image, reference, dgst, o.dir)
+	path, err := o.blobPath(dgst)
+	if err != nil {
+		return "", nil, err
+	}
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if digest.FromBytes(buf) != dgst {
+		return "", nil, fmt.Errorf("manifest %s: verifier failed", dgst)
+	}
+	return mediaType, buf, nil
+}
+
+func (o *OCILayout) Resolve(image, reference string) (distribution.Descriptor, error) {
+	if _, err := digest.Parse(reference); err == nil {
+		mediaType, buf, err := o.Manifest(image, reference)
+		if err != nil {
+			return distribution.Descriptor{}, err
+		}
+		return distribution.Descriptor{
+			MediaType: mediaType,
+			Size:      int64(len(buf)),
+			Digest:    digest.FromBytes(buf),
+		}, nil
+	}
+	desc, err := o.lookup(image, reference)
+	if err != nil {
+		return distribution.Descriptor{}, err
+	}
+	return distribution.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	}, nil
+}
+
+func (o *OCILayout) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	path, err := o.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(2).Infof("getting image %s blob %s", image, path)
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(buf) != desc.Digest {
+		return nil, fmt.Errorf("reading %s: verifier failed", path)
+	}
+	return buf, nil
+}
+
+func (o *OCILayout) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	name := filepath.Join(dir, desc.Digest.Encoded())
+	if _, err := os.Stat(name); err == nil {
+		glog.V(2).Infof("image %s blob %s already exists", image, name)
+		return name, nil
+	}
+	path, err := o.blobPath(desc.Digest)
+	if err != nil {
+		return "", err
+	}
+	glog.V(2).Infof("saving image %s blob %s from %s", image, name, path)
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = util.WriteBlob(name, desc, f)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,272 @@
+package source
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// tempDir creates a temporary directory; the caller needs to remove it.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "tosi-source-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// ociLayout is an OCI image layout directory created for tests.
+type ociLayout struct {
+	t     *testing.T
+	dir   string
+	index v1.Index
+}
+
+func newOCILayout(t *testing.T, dir string) *ociLayout {
+	layout := &ociLayout{
+		t:   t,
+		dir: dir,
+		index: v1.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+		},
+	}
+	layout.writeJSON(filepath.Join(dir, v1.ImageLayoutFile),
+		v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	layout.writeJSON(filepath.Join(dir, "index.json"), layout.index)
+	return layout
+}
+
+func (o *ociLayout) writeJSON(path string, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		o.t.Fatal(err)
+	}
+}
+
+func (o *ociLayout) addBlob(mediaType string, content []byte) distribution.Descriptor {
+	dgst := digest.FromBytes(content)
+	dir := filepath.Join(o.dir, "blobs", dgst.Algorithm().String())
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		o.t.Fatal(err)
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, dgst.Encoded()), content, 0644)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	return distribution.Descriptor{
+		MediaType: mediaType,
+		Size:      int64(len(content)),
+		Digest:    dgst,
+	}
+}
+
+// addImage adds an image with one layer, and an index entry for it with
+// the ref.name annotation refName, if it's not empty.
+func (o *ociLayout) addImage(refName, content string) distribution.Descriptor {
+	config := o.addBlob(v1.MediaTypeImageConfig, []byte(`{"architecture": "amd64", "os": "linux"}`))
+	layer := o.addBlob(v1.MediaTypeImageLayer, []byte(content))
+	m := v1.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: v1.Descriptor{
+			MediaType: config.MediaType,
+			Size:      config.Size,
+			Digest:    config.Digest,
+		},
+		Layers: []v1.Descriptor{{
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+			Digest:    layer.Digest,
+		}},
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		o.t.Fatal(err)
+	}
+	desc := o.addBlob(v1.MediaTypeImageManifest, buf)
+	entry := v1.Descriptor{
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Digest:    desc.Digest,
+	}
+	if refName != "" {
+		entry.Annotations = map[string]string{v1.AnnotationRefName: refName}
+	}
+	o.index.Manifests = append(o.index.Manifests, entry)
+	o.writeJSON(filepath.Join(o.dir, "index.json"), o.index)
+	return desc
+}
+
+func TestNewOCILayout(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	if _, err := NewOCILayout(dir); err == nil ||
+		!strings.Contains(err.Error(), "is not an OCI image layout") {
+		t.Errorf("expected error for missing %s, got %v", v1.ImageLayoutFile, err)
+	}
+	layout := newOCILayout(t, dir)
+	if _, err := NewOCILayout(dir); err != nil {
+		t.Fatal(err)
+	}
+	layout.writeJSON(filepath.Join(dir, v1.ImageLayoutFile),
+		v1.ImageLayout{Version: "2.0.0"})
+	if _, err := NewOCILayout(dir); err == nil ||
+		!strings.Contains(err.Error(), "unsupported OCI image layout version") {
+		t.Errorf("expected error for layout version 2.0.0, got %v", err)
+	}
+}
+
+func TestOCILayoutManifest(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	layout := newOCILayout(t, dir)
+	myapp := layout.addImage("myapp:1.2", "myapp")
+	other := layout.addImage("other:1.2", "other")
+	tagged := layout.addImage("2.0", "tagged")
+	unnamed := layout.addImage("", "unnamed")
+	src, err := NewOCILayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		image     string
+		reference string
+		expected  distribution.Descriptor
+		err       bool
+	}{
+		{image: "myapp", reference: "1.2", expected: myapp},
+		{image: "other", reference: "1.2", expected: other},
+		{image: "_oci/myapp", reference: "1.2", expected: myapp},
+		{image: "_oci/other", reference: "1.2", expected: other},
+		{image: "anything", reference: "2.0", expected: tagged},
+		{image: "myapp", reference: unnamed.Digest.String(), expected: unnamed},
+		{image: "_oci/myapp", reference: other.Digest.String(), expected: other},
+		{image: "myapp", reference: "1.3", err: true},
+		{image: "library/myapp", reference: "1.2", err: true},
+		// With more than one image, "latest" needs to be in the index.
+		{image: "myapp", reference: "latest", err: true},
+		{image: "myapp", reference: digest.FromString("missing").String(), err: true},
+	}
+	for _, tc := range testCases {
+		mediaType, buf, err := src.Manifest(tc.image, tc.reference)
+		desc, rerr := src.Resolve(tc.image, tc.reference)
+		if tc.err {
+			if err == nil || rerr == nil {
+				t.Errorf("%s:%s: expected error, got %v, %v", tc.image,
+					tc.reference, err, rerr)
+			}
+			continue
+		}
+		if err != nil || rerr != nil {
+			t.Errorf("%s:%s: %v, %v", tc.image, tc.reference, err, rerr)
+			continue
+		}
+		if digest.FromBytes(buf) != tc.expected.Digest {
+			t.Errorf("%s:%s: expected manifest %s, got %s", tc.image,
+				tc.reference, tc.expected.Digest, digest.FromBytes(buf))
+		}
+		if desc.Digest != tc.expected.Digest || desc.Size != tc.expected.Size {
+			t.Errorf("%s:%s: expected %+v, got %+v", tc.image, tc.reference,
+				tc.expected, desc)
+		}
+		if !strings.HasPrefix(tc.reference, "sha256:") &&
+			(mediaType != v1.MediaTypeImageManifest || desc.MediaType != mediaType) {
+			t.Errorf("%s:%s: unexpected media types %q and %q", tc.image,
+				tc.reference, mediaType, desc.MediaType)
+		}
+	}
+}
+
+func TestOCILayoutSingleImage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	layout := newOCILayout(t, dir)
+	desc := layout.addImage("", "single")
+	src, err := NewOCILayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The name defaults to the base name of the layout directory.
+	image := "_oci/" + filepath.Base(dir)
+	resolved, err := src.Resolve(image, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Digest != desc.Digest {
+		t.Errorf("expected %s, got %s", desc.Digest, resolved.Digest)
+	}
+	if _, err := src.Resolve(image, "1.0"); err == nil {
+		t.Errorf("expected error for %s:1.0", image)
+	}
+}
+
+func TestOCILayoutBlobs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	layout := newOCILayout(t, dir)
+	layer := layout.addBlob(v1.MediaTypeImageLayer, []byte("layer"))
+	corrupt := layout.addBlob(v1.MediaTypeImageLayer, []byte("corrupt"))
+	path := filepath.Join(dir, "blobs", "sha256", corrupt.Digest.Encoded())
+	if err := ioutil.WriteFile(path, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := distribution.Descriptor{
+		MediaType: v1.MediaTypeImageLayer,
+		Size:      7,
+		Digest:    digest.FromString("missing"),
+	}
+	src, err := NewOCILayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := src.GetBlob("_oci/myapp", layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "layer" {
+		t.Errorf("expected blob content %q, got %q", "layer", buf)
+	}
+	for _, desc := range []distribution.Descriptor{corrupt, missing} {
+		if _, err := src.GetBlob("_oci/myapp", desc); err == nil {
+			t.Errorf("expected error getting blob %s", desc.Digest)
+		}
+	}
+	if _, err := src.GetBlob("_oci/myapp", distribution.Descriptor{Digest: "sha256:../../oci-layout"}); err == nil {
+		t.Errorf("expected error for invalid digest")
+	}
+
+	saveDir := tempDir(t)
+	defer os.RemoveAll(saveDir)
+	name, err := src.SaveBlob("_oci/myapp", saveDir, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != filepath.Join(saveDir, layer.Digest.Encoded()) {
+		t.Errorf("unexpected blob path %s", name)
+	}
+	buf, err = ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "layer" {
+		t.Errorf("expected saved blob content %q, got %q", "layer", buf)
+	}
+	for _, desc := range []distribution.Descriptor{corrupt, missing} {
+		if _, err := src.SaveBlob("_oci/myapp", saveDir, desc); err == nil {
+			t.Errorf("expected error saving blob %s", desc.Digest)
+		}
+		if _, err := os.Stat(filepath.Join(saveDir, desc.Digest.Encoded())); err == nil {
+			t.Errorf("blob %s saved", desc.Digest)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package source
+
+import (
+	"io"
+
+	"github.com/docker/distribution"
+	"github.com/opencontainers/go-digest"
+)
+
+// Source is a location images can be pulled from: an image registry, an OCI
+// image layout directory or a docker-archive tarball.
+type Source interface {
+	// Manifest returns the media type and the raw manifest for
+	// image:reference. The reference is either a tag or a digest. The
+	// manifest might be a manifest list or an image index.
+	Manifest(image, reference string) (string, []byte, error)
+	// Resolve returns the descriptor of the manifest for image:reference,
+	// with its media type and canonical digest, without fetching blobs.
+	Resolve(image, reference string) (distribution.Descriptor, error)
+	// GetBlob returns the content of a blob, verifying its digest.
+	GetBlob(image string, desc distribution.Descriptor) ([]byte, error)
+	// SaveBlob saves a blob into dir, using the encoded digest as the file
+	// name, and returns the path to the blob file.
+	SaveBlob(image, dir string, desc distribution.Descriptor) (string, error)
+}
+
+// BlobOpener is implemented by sources that can stream blobs, without saving
+// them first.
+type BlobOpener interface {
+	// OpenBlob returns a reader for the content of a blob. The caller needs
+	// to close it, and verify the content if needed.
+	OpenBlob(image string, desc distribution.Descriptor) (io.ReadCloser, error)
+}
+
+// ReferrersLister is implemented by sources that can list the manifests
+// referring to an image manifest, e.g. its signatures.
+type ReferrersLister interface {
+	// Referrers returns the descriptors of the manifests referring to the
+	// manifest dgst in image. If artifactType is not empty, only referrers
+	// of that type are returned.
+	Referrers(image string, dgst digest.Digest, artifactType string) ([]distribution.Descriptor, error)
+}
@@ -0,0 +1,474 @@
+package store
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ConfigChanges are changes to the config of an image created via Commit.
+type ConfigChanges struct {
+	// Env variables, as KEY=value, replacing variables with the same name.
+	Env []string
+	// Entrypoint and Cmd replace the ones of the base image if set.
+	Entrypoint []string
+	Cmd        []string
+	WorkingDir string
+	User       string
+	// ExposedPorts, e.g. 8080/tcp, and Volumes are added to the ones of the
+	// base image.
+	ExposedPorts []string
+	Volumes      []string
+	// Labels are added to the ones of the base image.
+	Labels map[string]string
+	// Author of the image, and Comment for its history entry.
+	Author  string
+	Comment string
+}
+
+// parseCommand parses the argument of a CMD or ENTRYPOINT instruction, either
+// a JSON array or a command run via /bin/sh -c.
+func parseCommand(arg string) []string {
+	cmd := []string{}
+	if err := json.Unmarshal([]byte(arg), &cmd); err == nil {
+		return cmd
+	}
+	return []string{"/bin/sh", "-c", arg}
+}
+
+// shellWords splits s into words like a shell, removing the quotes. Single
+// quotes keep their content as is. Outside of quotes, a backslash escapes the
+// next character; in double quotes, only \, ", $ and `. If split is false,
+// whitespace does not separate words, and s is returned as a single word.
+func shellWords(s string, split bool) ([]string, error) {
+	words := []string{}
+	word := strings.Builder{}
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			if quote == '"' && !strings.ContainsRune("\\\"$`", c) {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+			inWord = true
+		case split && unicode.IsSpace(c):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// ParseChange parses a Dockerfile style instruction, e.g. "ENV FOO=bar" or
+// `CMD ["/bin/sh"]`, and adds it to c. Supported instructions are CMD,
+// ENTRYPOINT, ENV, EXPOSE, LABEL, USER, VOLUME and WORKDIR.
+func (c *ConfigChanges) ParseChange(change string) error {
+	fields := strings.SplitN(strings.TrimSpace(change), " ", 2)
+	if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+		return fmt.Errorf("invalid change %q", change)
+	}
+	arg := strings.TrimSpace(fields[1])
+	switch strings.ToUpper(fields[0]) {
+	case "CMD":
+		c.Cmd = parseCommand(arg)
+	case "ENTRYPOINT":
+		c.Entrypoint = parseCommand(arg)
+	case "ENV", "LABEL":
+		pairs := []string{}
+		if strings.Contains(strings.Fields(arg)[0], "=") {
+			words, err := shellWords(arg, true)
+			if err != nil {
+				return fmt.Errorf("invalid change %q: %v", change, err)
+			}
+			pairs = words
+		} else {
+			// Legacy form: ENV KEY value, where the value is the rest of the
+			// line.
+			kv := strings.SplitN(arg, " ", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("invalid change %q", change)
+			}
+			words, err := shellWords(kv[0]+"="+strings.TrimSpace(kv[1]), false)
+			if err != nil {
+				return fmt.Errorf("invalid change %q: %v", change, err)
+			}
+			pairs = words
+		}
+		for _, pair := range pairs {
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("invalid change %q", change)
+			}
+			value := kv[1]
+			if strings.ToUpper(fields[0]) == "ENV" {
+				c.Env = append(c.Env, kv[0]+"="+value)
+				continue
+			}
+			if c.Labels == nil {
+				c.Labels = make(map[string]string)
+			}
+			c.Labels[kv[0]] = value
+		}
+	case "EXPOSE":
+		for _, port := range strings.Fields(arg) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			c.ExposedPorts = append(c.ExposedPorts, port)
+		}
+	case "USER":
+		c.User = arg
+	case "VOLUME":
+		volumes := []string{}
+		if err := json.Unmarshal([]byte(arg), &volumes); err != nil {
+			volumes = strings.Fields(arg)
+		}
+		c.Volumes = append(c.Volumes, volumes...)
+	case "WORKDIR":
+		c.WorkingDir = arg
+	default:
+		return fmt.Errorf("unsupported instruction in change %q", change)
+	}
+	return nil
+}
+
+// setEnv sets the variable in env, which is KEY=value, replacing the existing
+// value.
+func setEnv(env []string, variable string) []string {
+	name := strings.SplitN(variable, "=", 2)[0]
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == name {
+			env[i] = variable
+			return env
+		}
+	}
+	return append(env, variable)
+}
+
+func (c *ConfigChanges) apply(img *v1.Image) {
+	cfg := &img.Config
+	for _, e := range c.Env {
+		cfg.Env = setEnv(cfg.Env, e)
+	}
+	if c.Entrypoint != nil {
+		cfg.Entrypoint = c.Entrypoint
+		if c.Cmd == nil {
+			// Like in Dockerfiles, a new entrypoint resets the command.
+			cfg.Cmd = nil
+		}
+	}
+	if c.Cmd != nil {
+		cfg.Cmd = c.Cmd
+	}
+	if c.WorkingDir != "" {
+		cfg.WorkingDir = c.WorkingDir
+	}
+	if c.User != "" {
+		cfg.User = c.User
+	}
+	for _, port := range c.ExposedPorts {
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		cfg.ExposedPorts[port] = struct{}{}
+	}
+	for _, volume := range c.Volumes {
+		if cfg.Volumes == nil {
+			cfg.Volumes = make(map[string]struct{})
+		}
+		cfg.Volumes[volume] = struct{}{}
+	}
+	for k, v := range c.Labels {
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		cfg.Labels[k] = v
+	}
+	if c.Author != "" {
+		img.Author = c.Author
+	}
+}
+
+// createLayer creates a gzipped layer tarball in the layer cache from the
+// overlayfs upper directory dir, converting overlayfs whiteouts and opaque
+// directories into .wh. files. It returns the descriptor of the layer, and
+// the digest of the uncompressed tarball, which is its diff ID.
+func (s *Store) createLayer(dir, mediaType string) (distribution.Descriptor, digest.Digest, error) {
+	tarball, err := archive.TarWithOptions(dir, &archive.TarOptions{
+		Compression:    archive.Uncompressed,
+		WhiteoutFormat: archive.OverlayWhiteoutFormat,
+	})
+	if err != nil {
+		return distribution.Descriptor{}, "", err
+	}
+	defer tarball.Close()
+	desc, diffID, err := s.saveLayer(tarball, mediaType)
+	if err != nil {
+		return desc, "", fmt.Errorf("creating layer from %s: %v", dir, err)
+	}
+	return desc, diffID, nil
+}
+
+// saveLayer compresses the uncompressed layer tarball via gzip, and saves it
+// in the layer cache. It returns the descriptor of the layer, and its diff ID.
+func (s *Store) saveLayer(tarball io.Reader, mediaType string) (distribution.Descriptor, digest.Digest, error) {
+	desc := distribution.Descriptor{
+		MediaType: mediaType,
+	}
+	tmp, err := ioutil.TempFile(s.layerDir, ".layer-")
+	if err != nil {
+		return desc, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	diffID := digest.Canonical.Digester()
+	compressed := digest.Canonical.Digester()
+	gz := gzip.NewWriter(io.MultiWriter(tmp, compressed.Hash()))
+	_, err = io.Copy(io.MultiWriter(gz, diffID.Hash()), tarball)
+	if err != nil {
+		return desc, "", err
+	}
+	if err := gz.Close(); err != nil {
+		return desc, "", err
+	}
+	info, err := tmp.Stat()
+	if err != nil {
+		return desc, "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return desc, "", err
+	}
+	desc.Digest = compressed.Digest()
+	desc.Size = info.Size()
+	path := filepath.Join(s.layerDir, desc.Digest.Encoded())
+	if !util.PathExists(path) {
+		err = util.RenameFile(tmp.Name(), path)
+		if err != nil {
+			return desc, "", err
+		}
+	}
+	return desc, diffID.Digest(), nil
+}
+
+// readConfigBlob reads the config blob desc from the layer cache.
+func (s *Store) readConfigBlob(desc distribution.Descriptor) ([]byte, error) {
+	path := filepath.Join(s.layerDir, desc.Digest.Encoded())
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if desc.Digest.Algorithm().FromBytes(buf) != desc.Digest {
+		return nil, fmt.Errorf("config blob %s: verifier failed", path)
+	}
+	return buf, nil
+}
+
+// imageConfig reads the config of the image mfest, named name, from the layer
+// cache.
+func (s *Store) imageConfig(mfest *manifest.Manifest, name string) (distribution.Descriptor, *v1.Image, error) {
+	desc, ok := mfest.ConfigDescriptor()
+	if !ok {
+		return desc, nil, fmt.Errorf("schema1 image %s has not been converted, pull the image again", name)
+	}
+	buf, err := s.readConfigBlob(desc)
+	if err != nil {
+		return desc, nil, fmt.Errorf("reading config of %s, pull the image again: %v",
+			name, err)
+	}
+	img := &v1.Image{}
+	err = json.Unmarshal(buf, img)
+	if err != nil {
+		return desc, nil, fmt.Errorf("parsing config of %s: %v", name, err)
+	}
+	return desc, img, nil
+}
+
+// mountedImage returns the image mounted via Mount into dest.
+func mountedImage(dest string) (string, digest.Digest, error) {
+	buf, err := ioutil.ReadFile(dest + ".image")
+	if err != nil {
+		return "", "", fmt.Errorf("%s is not an image mount: %v", dest, err)
+	}
+	repo, _, dgst, err := util.ParseImageReference(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return "", "", fmt.Errorf("%s: invalid image %q: %v", dest, buf, err)
+	}
+	if dgst == "" {
+		return "", "", fmt.Errorf("%s: invalid image %q", dest, buf)
+	}
+	return repo, dgst, nil
+}
+
+// Commit creates a new image newRef, e.g. myapp:1.0, from the changes made in
+// the overlayfs mount created via Mount in mountDest, on top of the image
+// mounted. The changes are added as a new layer, and changes are applied to
+// the image config. The new image is saved into the store, and it can be
+// pushed or mounted like pulled images. It returns the digest of the new
+// manifest.
+func (s *Store) Commit(mountDest, newRef string, changes *ConfigChanges) (digest.Digest, error) {
+	repo, tag, dgst, err := util.ParseImageReference(newRef)
+	if err != nil {
+		return "", err
+	}
+	if dgst != "" {
+		return "", fmt.Errorf("%s: images can only be committed via a tag", newRef)
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	baseRepo, baseDigest, err := mountedImage(mountDest)
+	if err != nil {
+		return "", err
+	}
+	base, err := manifest.Load(s.src, s.manifestDir, baseRepo, baseDigest.String())
+	if err != nil {
+		return "", err
+	}
+	baseConfig, img, err := s.imageConfig(base, baseRepo)
+	if err != nil {
+		return "", err
+	}
+	layerType := v1.MediaTypeImageLayerGzip
+	if base.ManifestV2 != nil {
+		layerType = schema2.MediaTypeLayer
+	}
+	glog.Infof("creating layer from %s", mountDest+".upper")
+	layer, diffID, err := s.createLayer(mountDest+".upper", layerType)
+	if err != nil {
+		return "", err
+	}
+	glog.V(2).Infof("created layer %s, diff ID %s", layer.Digest, diffID)
+	now := time.Now().UTC()
+	img.Created = &now
+	img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, diffID)
+	history := v1.History{
+		Created:   &now,
+		CreatedBy: "tosi commit",
+	}
+	if changes != nil {
+		changes.apply(img)
+		history.Author = changes.Author
+		history.Comment = changes.Comment
+	}
+	img.History = append(img.History, history)
+	layers := append(append([]distribution.Descriptor{}, base.Layers()...), layer)
+	return s.saveImage(repo, tag, img, baseConfig.MediaType, layers,
+		base.ManifestV2 != nil)
+}
+
+// saveImage saves a new image repo:tag with the config img and layers, which
+// need to be in the layer cache, into the store, and returns the digest of its
+// manifest. The manifest is a Docker schema2 manifest if dockerV2 is set,
+// otherwise an OCI image manifest.
+func (s *Store) saveImage(repo, tag string, img *v1.Image, configType string, layers []distribution.Descriptor, dockerV2 bool) (digest.Digest, error) {
+	config, err := json.Marshal(img)
+	if err != nil {
+		return "", err
+	}
+	configDesc := distribution.Descriptor{
+		MediaType: configType,
+		Size:      int64(len(config)),
+		Digest:    digest.FromBytes(config),
+	}
+	err = util.AtomicWriteFile(
+		filepath.Join(s.layerDir, configDesc.Digest.Encoded()), config, 0644)
+	if err != nil {
+		return "", err
+	}
+	var mediaType string
+	var payload []byte
+	if dockerV2 {
+		m, err := schema2.FromStruct(schema2.Manifest{
+			Versioned: schema2.SchemaVersion,
+			Config:    configDesc,
+			Layers:    layers,
+		})
+		if err != nil {
+			return "", err
+		}
+		mediaType, payload, err = m.Payload()
+		if err != nil {
+			return "", err
+		}
+	} else {
+		m, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config:    configDesc,
+			Layers:    layers,
+		})
+		if err != nil {
+			return "", err
+		}
+		mediaType, payload, err = m.Payload()
+		if err != nil {
+			return "", err
+		}
+	}
+	mfest, err := manifest.New(s.src, repo, tag, mediaType, payload)
+	if err != nil {
+		return "", err
+	}
+	err = mfest.Save(s.manifestDir)
+	if err != nil {
+		return "", fmt.Errorf("saving manifest for %s: %v", repo+":"+tag, err)
+	}
+	err = saveContainerConfig(
+		mfest.ID(), config, filepath.Join(s.configDir, mfest.ID()))
+	if err != nil {
+		return "", fmt.Errorf("saving config for %s: %v", repo+":"+tag, err)
+	}
+	return mfest.Digest, nil
+}
@@ -0,0 +1,244 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestParseChangeEnvLabel(t *testing.T) {
+	testCases := []struct {
+		change string
+		env    []string
+		labels map[string]string
+		err    bool
+	}{
+		{
+			change: "ENV FOO=bar",
+			env:    []string{"FOO=bar"},
+		},
+		{
+			change: `ENV FOO="hello world" BAR=baz`,
+			env:    []string{"FOO=hello world", "BAR=baz"},
+		},
+		{
+			change: `ENV FOO='single "quoted"' BAR=a\ b`,
+			env:    []string{`FOO=single "quoted"`, "BAR=a b"},
+		},
+		{
+			change: `ENV FOO="say \"hi\"" BAR="C:\path" BAZ=\$HOME`,
+			env:    []string{`FOO=say "hi"`, `BAR=C:\path`, "BAZ=$HOME"},
+		},
+		{
+			change: "ENV EMPTY= FOO=bar",
+			env:    []string{"EMPTY=", "FOO=bar"},
+		},
+		{
+			change: `ENV FOO "hello world"`,
+			env:    []string{"FOO=hello world"},
+		},
+		{
+			change: "ENV FOO hello  world",
+			env:    []string{"FOO=hello  world"},
+		},
+		{
+			change: `LABEL "com.example.vendor"="ACME Inc" version=1.0`,
+			labels: map[string]string{
+				"com.example.vendor": "ACME Inc",
+				"version":            "1.0",
+			},
+		},
+		{
+			change: `LABEL description="multi word\tvalue" other='a\b'`,
+			labels: map[string]string{
+				"description": `multi word\tvalue`,
+				"other":       `a\b`,
+			},
+		},
+		{
+			change: `ENV FOO="unterminated`,
+			err:    true,
+		},
+		{
+			change: `ENV FOO=bar\`,
+			err:    true,
+		},
+		{
+			change: "ENV =bar",
+			err:    true,
+		},
+	}
+	for _, tc := range testCases {
+		c := &ConfigChanges{}
+		err := c.ParseChange(tc.change)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.change)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.change, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.Env, tc.env) {
+			t.Errorf("%s: expected env %q, got %q", tc.change, tc.env, c.Env)
+		}
+		if !reflect.DeepEqual(c.Labels, tc.labels) {
+			t.Errorf("%s: expected labels %q, got %q", tc.change, tc.labels,
+				c.Labels)
+		}
+	}
+}
+
+// layerEntries returns the names of the entries in the gzipped layer desc.
+func layerEntries(t *testing.T, st *Store, desc distribution.Descriptor) []string {
+	f, err := os.Open(filepath.Join(st.layerDir, desc.Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCommitWhiteouts(t *testing.T) {
+	st, dir := testStore(t, testLayer(t,
+		testDir("bin/"),
+		testFile("bin/git", "git"),
+		testFile("bin/ls", "ls"),
+		testDir("opt/"),
+		testFile("opt/old", "old")))
+	defer os.RemoveAll(dir)
+	base := digest.FromBytes(st.src.(*memorySource).manifest)
+
+	// The changes made in a mount, like overlayfs records them in the upper
+	// directory: a whiteout device for removed files, and an opaque
+	// directory for a replaced one.
+	dest := filepath.Join(dir, "mnt")
+	upper := dest + ".upper"
+	for _, d := range []string{"bin", "etc", "opt"} {
+		if err := os.MkdirAll(filepath.Join(upper, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(upper, "etc/new"), []byte("new"), 0644)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(upper, "opt/app"), []byte("app"), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(dest+".image", []byte("test/image@"+base.String()), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mknod(filepath.Join(upper, "bin/git"), syscall.S_IFCHR, 0); err != nil {
+		t.Skipf("creating whiteout device: %v", err)
+	}
+	err = syscall.Setxattr(filepath.Join(upper, "opt"), "trusted.overlay.opaque", []byte("y"), 0)
+	if err != nil {
+		t.Skipf("creating opaque directory: %v", err)
+	}
+
+	changes := &ConfigChanges{Author: "tester", Comment: "add app"}
+	if err := changes.ParseChange("ENV APP=/opt/app"); err != nil {
+		t.Fatal(err)
+	}
+	dgst, err := st.Commit(dest, "test/app:1", changes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mfest, err := manifest.Load(st.src, st.manifestDir, "test/app", dgst.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers := mfest.Layers()
+	if len(layers) != 2 {
+		t.Fatalf("expected 2 layers, got %v", layers)
+	}
+	entries := layerEntries(t, st, layers[1])
+	expected := []string{
+		"bin/", "bin/.wh.git", "etc/", "etc/new", "opt/", "opt/.wh..wh..opq", "opt/app",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected layer entries %v, got %v", expected, entries)
+	}
+
+	_, img, err := st.imageConfig(mfest, "test/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The layer of the base image is not compressed, so its diff ID is its
+	// digest.
+	if len(img.RootFS.DiffIDs) != 2 || img.RootFS.DiffIDs[0] != layers[0].Digest {
+		t.Fatalf("expected the diff ID of the new layer to be added, got %v",
+			img.RootFS.DiffIDs)
+	}
+	if len(img.History) != 1 || img.History[0].CreatedBy != "tosi commit" ||
+		img.History[0].Author != "tester" || img.History[0].Comment != "add app" {
+		t.Errorf("unexpected history %+v", img.History)
+	}
+	if !reflect.DeepEqual(img.Config.Env, []string{"APP=/opt/app"}) {
+		t.Errorf("unexpected env %v", img.Config.Env)
+	}
+
+	// The diff ID is the digest of the uncompressed layer.
+	f, err := os.Open(filepath.Join(st.layerDir, layers[1].Digest.Encoded()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffID, err := digest.Canonical.FromReader(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diffID != img.RootFS.DiffIDs[1] {
+		t.Errorf("expected diff ID %s, got %s", diffID, img.RootFS.DiffIDs[1])
+	}
+
+	// The whiteouts are applied on top of the base image.
+	actual := flattened(t, st, "test/app:1")
+	expectedFiles := map[string]string{
+		"bin/":    "dir",
+		"bin/ls":  "ls",
+		"etc/":    "dir",
+		"etc/new": "new",
+		"opt/":    "dir",
+		"opt/app": "app",
+	}
+	if !reflect.DeepEqual(actual, expectedFiles) {
+		t.Errorf("expected %v, got %v", expectedFiles, actual)
+	}
+}
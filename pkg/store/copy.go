@@ -0,0 +1,141 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// CopyOptions configure copying images.
+type CopyOptions struct {
+	PushOptions
+	// AllPlatforms copies all platforms of multi-platform images, along with
+	// the manifest list or image index. Otherwise only the image for the
+	// current platform is copied.
+	AllPlatforms bool
+	// ViaCache saves blobs into the layer cache of the store, and uploads
+	// them from there, instead of streaming them. It is also used if the
+	// source does not support streaming blobs.
+	ViaCache bool
+}
+
+// copyBlob copies the blob desc from the source of the store into repo in
+// dest, unless it is already there.
+func (s *Store) copyBlob(srcRepo string, dest source.Destination, repo string, desc distribution.Descriptor, opts CopyOptions) error {
+	missing, err := needsUpload(dest, repo, desc, opts.MountFrom)
+	if err != nil || !missing {
+		return err
+	}
+	opener, ok := s.src.(source.BlobOpener)
+	if opts.ViaCache || !ok {
+		_, err := s.src.SaveBlob(srcRepo, s.layerDir, desc)
+		if err != nil {
+			return fmt.Errorf("downloading: %w", err)
+		}
+		return s.uploadBlob(dest, repo, desc, opts.ChunkSize)
+	}
+	reader, err := opener.OpenBlob(srcRepo, desc)
+	if err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	defer reader.Close()
+	glog.Infof("%s: copying blob %s (%d bytes)", repo, desc.Digest, desc.Size)
+	return dest.PutBlobStream(repo, desc, reader, opts.ChunkSize)
+}
+
+// copyManifest copies the blobs of mfest, then uploads the manifest as
+// repo:reference.
+func (s *Store) copyManifest(mfest *manifest.Manifest, dest source.Destination, repo, reference string, opts CopyOptions) (digest.Digest, error) {
+	err := s.forEachBlob(mfest.References(), func(desc distribution.Descriptor) error {
+		return s.copyBlob(mfest.Image, dest, repo, desc, opts)
+	})
+	if err != nil {
+		return "", fmt.Errorf("copying blobs: %w", err)
+	}
+	mediaType, payload, err := mfest.Payload()
+	if err != nil {
+		return "", err
+	}
+	glog.V(2).Infof("uploading manifest for %s:%s", repo, reference)
+	return dest.PutManifest(repo, reference, mediaType, payload)
+}
+
+// Copy copies image from the source of the store to destRef in dest, e.g.
+// from Docker Hub to a private registry, without unpacking layers. Blobs are
+// streamed from the source to the destination, unless opts.ViaCache is set.
+// Manifests are copied as is, so their digests do not change. If destRef has
+// no tag, the tag of image is used. It returns the digest of the copied
+// manifest, which is the manifest list or image index when copying all
+// platforms.
+func (s *Store) Copy(image string, dest source.Destination, destRef string, opts CopyOptions) (digest.Digest, error) {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return "", err
+	}
+	if !opts.AllPlatforms {
+		mfest, err := manifest.Fetch(s.src, repo, ref, s.allowUnsigned)
+		if err != nil {
+			return "", fmt.Errorf("retrieving manifest for %s: %w", image, err)
+		}
+		_, payload, err := mfest.Payload()
+		if err != nil {
+			return "", err
+		}
+		if manifest.PayloadDigest(payload) != mfest.Digest {
+			glog.Warningf("%s is a multi-platform image, copying only the manifest %s for the current platform",
+				image, manifest.PayloadDigest(payload))
+		}
+		destRepo, reference, err := destReference(
+			destRef, ref, manifest.PayloadDigest(payload))
+		if err != nil {
+			return "", err
+		}
+		dgst, err := s.copyManifest(mfest, dest, destRepo, reference, opts)
+		if err != nil {
+			return "", fmt.Errorf("copying %s to %s: %w", image, destRef, err)
+		}
+		return dgst, nil
+	}
+	manifests, err := manifest.FetchAll(s.src, repo, ref, s.allowUnsigned)
+	if err != nil {
+		return "", fmt.Errorf("retrieving manifests for %s: %w", image, err)
+	}
+	destRepo, reference, err := destReference(destRef, ref, manifests[0].Digest)
+	if err != nil {
+		return "", err
+	}
+	mediaType, index := manifests[0].Index()
+	if index == nil {
+		dgst, err := s.copyManifest(manifests[0], dest, destRepo, reference, opts)
+		if err != nil {
+			return "", fmt.Errorf("copying %s to %s: %w", image, destRef, err)
+		}
+		return dgst, nil
+	}
+	// Platform specific manifests need to be in the repository before the
+	// manifest list or image index referring to them.
+	for _, mfest := range manifests {
+		_, payload, err := mfest.Payload()
+		if err != nil {
+			return "", err
+		}
+		dgst := manifest.PayloadDigest(payload)
+		glog.Infof("copying %s manifest %s", image, dgst)
+		_, err = s.copyManifest(mfest, dest, destRepo, dgst.String(), opts)
+		if err != nil {
+			return "", fmt.Errorf("copying %s manifest %s to %s: %w",
+				image, dgst, destRef, err)
+		}
+	}
+	glog.V(2).Infof("uploading manifest list for %s:%s", destRepo, reference)
+	dgst, err := dest.PutManifest(destRepo, reference, mediaType, index)
+	if err != nil {
+		return "", fmt.Errorf("copying %s to %s: %w", image, destRef, err)
+	}
+	return dgst, nil
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"archive/tar"
+	"fmt"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// ChangeKind is the kind of a change to a file between two images.
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+)
+
+// FileInfo describes a file in an image.
+type FileInfo struct {
+	// Mode is the file mode, e.g. -rw-r--r--.
+	Mode string `json:"mode"`
+	Size int64  `json:"size"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	// Digest is the digest of the content of regular files.
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Linkname is the target of symbolic links.
+	Linkname string `json:"linkname,omitempty"`
+}
+
+func newFileInfo(e *fsEntry) *FileInfo {
+	// Hard links are compared via the content of their target.
+	info := &FileInfo{
+		Mode:   e.hdr.FileInfo().Mode().String(),
+		Size:   e.size,
+		UID:    e.hdr.Uid,
+		GID:    e.hdr.Gid,
+		Digest: e.digest,
+	}
+	if e.hdr.Typeflag == tar.TypeSymlink {
+		info.Linkname = e.hdr.Linkname
+	}
+	return info
+}
+
+// Change is a file that differs between two images.
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+	// Before is the file in the first image, After is the one in the second.
+	Before *FileInfo `json:"before,omitempty"`
+	After  *FileInfo `json:"after,omitempty"`
+}
+
+// Details returns the attributes of the file that changed, e.g. "mode" or
+// "content".
+func (c *Change) Details() []string {
+	if c.Kind != ChangeModified {
+		return nil
+	}
+	details := []string{}
+	a, b := c.Before, c.After
+	if a.Mode != b.Mode {
+		details = append(details, fmt.Sprintf("mode %s -> %s", a.Mode, b.Mode))
+	}
+	if a.UID != b.UID || a.GID != b.GID {
+		details = append(details, fmt.Sprintf("owner %d:%d -> %d:%d",
+			a.UID, a.GID, b.UID, b.GID))
+	}
+	if a.Size != b.Size {
+		details = append(details, fmt.Sprintf("size %d -> %d", a.Size, b.Size))
+	}
+	if a.Digest != b.Digest {
+		details = append(details, "content")
+	}
+	if a.Linkname != b.Linkname {
+		details = append(details, fmt.Sprintf("link %s -> %s",
+			a.Linkname, b.Linkname))
+	}
+	return details
+}
+
+// Diff compares the filesystems of imageA and imageB, which need to be in the
+// store, by reading their layers, and returns the files added, removed or
+// modified in imageB, sorted by path. Files are compared via their mode, size,
+// ownership, content digest and link target; modification times are ignored.
+func (s *Store) Diff(imageA, imageB string) ([]Change, error) {
+	a, _, err := s.loadTree(imageA, true)
+	if err != nil {
+		return nil, err
+	}
+	b, _, err := s.loadTree(imageB, true)
+	if err != nil {
+		return nil, err
+	}
+	changes := []Change{}
+	for _, p := range a.paths() {
+		ea := a.entries[p]
+		eb, ok := b.entries[p]
+		if !ok {
+			changes = append(changes, Change{
+				Path:   absPath(p),
+				Kind:   ChangeRemoved,
+				Before: newFileInfo(ea),
+			})
+			continue
+		}
+		before, after := newFileInfo(ea), newFileInfo(eb)
+		if *before != *after {
+			changes = append(changes, Change{
+				Path:   absPath(p),
+				Kind:   ChangeModified,
+				Before: before,
+				After:  after,
+			})
+		}
+	}
+	for _, p := range b.paths() {
+		if _, ok := a.entries[p]; ok {
+			continue
+		}
+		changes = append(changes, Change{
+			Path:  absPath(p),
+			Kind:  ChangeAdded,
+			After: newFileInfo(b.entries[p]),
+		})
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
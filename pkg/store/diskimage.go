@@ -0,0 +1,207 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+)
+
+// DiskImageFormat is the filesystem format of disk images.
+type DiskImageFormat string
+
+const (
+	// DiskImageSquashfs images are created via mksquashfs, squashfs-tools 4.6
+	// or newer is needed for reading tarballs.
+	DiskImageSquashfs DiskImageFormat = "squashfs"
+	// DiskImageErofs images are created via mkfs.erofs, erofs-utils 1.6 or
+	// newer is needed for reading tarballs.
+	DiskImageErofs DiskImageFormat = "erofs"
+	// DiskImageExt4 images are created via mkfs.ext4 from a directory the
+	// image is unpacked into.
+	DiskImageExt4 DiskImageFormat = "ext4"
+)
+
+const (
+	// ext4Slack is the free space left in ext4 images, besides the space
+	// needed for the files in the image.
+	ext4Slack = 64 * 1024 * 1024
+	// ext4BlockSize is the block size of ext4 images.
+	ext4BlockSize = 4096
+)
+
+// runTool runs a tool for creating disk images, with stdin as its input.
+func runTool(stdin io.Reader, name string, args ...string) error {
+	glog.V(2).Infof("running %s %v", name, args)
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = stdin
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("running %s: %v; output: %s", name, err, output)
+	}
+	return nil
+}
+
+// buildFromTarball creates the disk image dest via a tool reading the
+// flattened image from stdin.
+func (s *Store) buildFromTarball(image, dest string, format DiskImageFormat) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.Flatten(image, pw, FlattenOptions{}))
+	}()
+	defer pr.Close()
+	if format == DiskImageSquashfs {
+		return runTool(pr, "mksquashfs", "-", dest, "-tar", "-noappend", "-no-progress")
+	}
+	return runTool(pr, "mkfs.erofs", "--quiet", "--tar=f", dest, "/dev/stdin")
+}
+
+// buildExt4 unpacks image into a temporary directory, and creates the ext4
+// disk image dest with its content. The size of the image is calculated from
+// the files in the image.
+func (s *Store) buildExt4(image, dest string) error {
+	dir, err := ioutil.TempDir(s.diskImageDir, ".rootfs-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	// An empty filter extracts the merged tree, so files removed by upper
+	// layers, and their whiteouts, do not end up in the disk image.
+	err = s.UnpackFiltered(image, dir, &PathFilter{})
+	if err != nil {
+		return err
+	}
+	size := int64(ext4Slack)
+	inodes := 1024
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		inodes++
+		size += (info.Size() + ext4BlockSize - 1) / ext4BlockSize * ext4BlockSize
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Leave room for directories, extent trees and the inode tables.
+	size += size / 10
+	size = (size + ext4BlockSize - 1) / ext4BlockSize * ext4BlockSize
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return runTool(nil, "mkfs.ext4", "-q", "-F", "-m", "0",
+		"-b", strconv.Itoa(ext4BlockSize), "-N", strconv.Itoa(inodes),
+		"-d", dir, dest)
+}
+
+// diskImage returns the disk image in format for image from the cache in the
+// store, creating it if needed.
+func (s *Store) diskImage(image string, format DiskImageFormat) (string, error) {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return "", err
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.diskImageDir, mfest.ID()+"."+string(format))
+	if util.PathExists(path) {
+		glog.Infof("using cached %s image %s for %s", format, path, image)
+		return path, nil
+	}
+	tmp := filepath.Join(s.diskImageDir, "."+filepath.Base(path)+"-"+randomString())
+	defer os.Remove(tmp)
+	glog.Infof("creating %s image for %s", format, image)
+	switch format {
+	case DiskImageSquashfs, DiskImageErofs:
+		err = s.buildFromTarball(image, tmp, format)
+	case DiskImageExt4:
+		err = s.buildExt4(image, tmp)
+	default:
+		return "", fmt.Errorf("unsupported disk image format %q", format)
+	}
+	if err != nil {
+		return "", err
+	}
+	err = util.RenameFile(tmp, path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// BuildDiskImage creates a disk image with the filesystem of image, which
+// needs to be in the store, in format as dest, e.g. for using it as the root
+// block device of a virtual machine. Disk images are cached in the store by
+// image ID, so they are only created once for each image and format.
+func (s *Store) BuildDiskImage(image string, format DiskImageFormat, dest string) error {
+	path, err := s.diskImage(image, format)
+	if err != nil {
+		return fmt.Errorf("creating %s image for %s: %v", format, image, err)
+	}
+	// Images are copied, since dest might be modified if it is mounted
+	// read-write.
+	err = copySparse(path, dest)
+	if err != nil {
+		os.Remove(dest)
+		return err
+	}
+	return nil
+}
+
+// copySparse copies the file src to dest, skipping blocks of zeroes, so dest
+// is sparse, like the disk images created.
+func copySparse(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	buf := make([]byte, 64*1024)
+	size := int64(0)
+	for {
+		n, err := io.ReadFull(in, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if bytes.Count(buf[:n], []byte{0}) == n {
+			_, err = out.Seek(int64(n), io.SeekCurrent)
+		} else {
+			_, err = out.Write(buf[:n])
+		}
+		if err != nil {
+			return err
+		}
+		size += int64(n)
+	}
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+	return out.Close()
+}
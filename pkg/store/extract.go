@@ -0,0 +1,466 @@
+package store
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/docker/distribution"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+)
+
+// maxSymlinks is the maximum number of symbolic links followed when resolving
+// a path in an image.
+const maxSymlinks = 255
+
+// errEntryFound stops walking a layer once the entry needed has been read.
+var errEntryFound = errors.New("entry found")
+
+// PathFilter selects files in an image via glob patterns, e.g. "/etc/*.conf"
+// or "/usr/share/doc". A pattern matching a directory matches everything
+// under it too. A file is selected if it matches any of the include patterns,
+// or there are none, and it does not match any of the exclude patterns.
+type PathFilter struct {
+	Include []string
+	Exclude []string
+}
+
+// matchAny returns true if p, or any of its parent directories, matches one
+// of patterns.
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		pattern = cleanPath(pattern)
+		for q := p; ; q = cleanPath(path.Dir(q)) {
+			if ok, _ := path.Match(pattern, q); ok {
+				return true
+			}
+			if q == "." {
+				break
+			}
+		}
+	}
+	return false
+}
+
+// Match returns true if the file p in an image is selected by the filter.
+func (f *PathFilter) Match(p string) bool {
+	p = cleanPath(p)
+	if len(f.Include) > 0 && !matchAny(f.Include, p) {
+		return false
+	}
+	return !matchAny(f.Exclude, p)
+}
+
+// hasChildren returns true if there are entries under the directory dir.
+// Directories might not have an entry of their own in layer tarballs.
+func (t *fsTree) hasChildren(dir string) bool {
+	for name := range t.entries {
+		if name != dir && isUnder(name, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve resolves p in the tree, following symbolic links in the image, and
+// returns the resolved path. Absolute link targets are relative to the root of
+// the image, and ".." never goes above the root.
+func (t *fsTree) resolve(p string) (string, error) {
+	p = cleanPath(p)
+	components := strings.Split(p, "/")
+	resolved := "."
+	links := 0
+	for len(components) > 0 {
+		c := components[0]
+		components = components[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = cleanPath(path.Dir(resolved))
+			continue
+		}
+		next := cleanPath(path.Join(resolved, c))
+		e, ok := t.entries[next]
+		if !ok {
+			if !t.hasChildren(next) {
+				return "", fmt.Errorf("%s: %w", absPath(p), syscall.ENOENT)
+			}
+			resolved = next
+			continue
+		}
+		if e.hdr.Typeflag != tar.TypeSymlink {
+			if len(components) > 0 && e.hdr.Typeflag != tar.TypeDir {
+				return "", fmt.Errorf("%s: %s is not a directory",
+					absPath(p), absPath(next))
+			}
+			resolved = next
+			continue
+		}
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links",
+				absPath(p))
+		}
+		if path.IsAbs(e.hdr.Linkname) {
+			resolved = "."
+		}
+		components = append(strings.Split(e.hdr.Linkname, "/"), components...)
+	}
+	return resolved, nil
+}
+
+// loadTree loads the manifest of image from the store, and builds the tree of
+// its filesystem. If hashContent is set, the digest of regular files is
+// calculated.
+func (s *Store) loadTree(image string, hashContent bool) (*fsTree, []distribution.Descriptor, error) {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return nil, nil, err
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers := mfest.Layers()
+	t, err := s.buildTree(layers, hashContent)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading layers of %s: %v", image, err)
+	}
+	return t, layers, nil
+}
+
+// readEntry copies the content of the regular file e from its layer to w.
+func (s *Store) readEntry(layers []distribution.Descriptor, e *fsEntry, w io.Writer) error {
+	index := 0
+	err := s.walkLayer(layers[e.layer], func(hdr *tar.Header, r io.Reader) error {
+		index++
+		if index-1 != e.index {
+			return nil
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+		return errEntryFound
+	})
+	if err == errEntryFound {
+		return nil
+	}
+	if err == nil {
+		err = fmt.Errorf("%s not found in layer %s",
+			absPath(cleanPath(e.hdr.Name)), layers[e.layer].Digest)
+	}
+	return err
+}
+
+// writeEntries writes the entries at the positions in wanted in the tarball of
+// layer as a new tarball to w, renamed to the names in wanted. Hard links are
+// renamed via names, which maps the paths of all entries written to their new
+// names. Hard links to the files in orphans, which are not written from this
+// layer, are written as regular files with the content of their target.
+func (s *Store) writeEntries(layer distribution.Descriptor, wanted map[int]string, names map[string]string, orphans map[string]bool, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	// The content of the targets in orphans, saved into temporary files as
+	// they are read, since hard links come after their targets.
+	targets := make(map[string]*spooledFile)
+	defer func() {
+		for _, f := range targets {
+			f.remove()
+		}
+	}()
+	index := 0
+	err := s.walkLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+		name, ok := wanted[index]
+		index++
+		if !ok {
+			p := cleanPath(hdr.Name)
+			if orphans[p] && isRegular(hdr) {
+				if f := targets[p]; f != nil {
+					f.remove()
+				}
+				f, err := spool(hdr, r)
+				if err != nil {
+					return err
+				}
+				targets[p] = f
+			}
+			return nil
+		}
+		h := *hdr
+		h.Name = name
+		if h.Typeflag == tar.TypeLink {
+			p := cleanPath(hdr.Linkname)
+			target, ok := names[p]
+			if !ok || orphans[p] {
+				return writeOrphan(tw, &h, targets[p])
+			}
+			h.Linkname = target
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			return err
+		}
+		if isRegular(hdr) {
+			if _, err := io.Copy(tw, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// spooledFile is the content of a regular file in a layer, saved into a
+// temporary file.
+type spooledFile struct {
+	hdr  *tar.Header
+	path string
+}
+
+// spool saves the content of the regular file hdr, read via r, into a
+// temporary file.
+func spool(hdr *tar.Header, r io.Reader) (*spooledFile, error) {
+	f, err := ioutil.TempFile("", "tosi-link-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooledFile{hdr: hdr, path: f.Name()}, nil
+}
+
+func (f *spooledFile) remove() {
+	os.Remove(f.path)
+}
+
+// writeOrphan writes the hard link h, whose target is not extracted, as a
+// regular file with the content of the target.
+func writeOrphan(tw *tar.Writer, h *tar.Header, target *spooledFile) error {
+	if target == nil {
+		glog.Warningf("skipping hard link %s: target %s not found",
+			absPath(cleanPath(h.Name)), absPath(cleanPath(h.Linkname)))
+		return nil
+	}
+	glog.V(2).Infof("extracting hard link %s as a copy of %s",
+		absPath(cleanPath(h.Name)), absPath(cleanPath(h.Linkname)))
+	h.Typeflag = tar.TypeReg
+	h.Linkname = ""
+	h.Size = target.hdr.Size
+	f, err := os.Open(target.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(h); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// unpackEntries extracts the entries of the tree with a path in names into
+// dest, each renamed to the name it maps to. Only the final version of each
+// file is extracted, read from the layer it comes from, so files removed or
+// replaced by later layers are never written.
+func (s *Store) unpackEntries(layers []distribution.Descriptor, t *fsTree, names map[string]string, dest string) error {
+	wanted := make([]map[int]string, len(layers))
+	// The targets of hard links that are not extracted from the same layer,
+	// since they are excluded, or replaced by a later layer.
+	orphans := make([]map[string]bool, len(layers))
+	for p, name := range names {
+		e := t.entries[p]
+		if wanted[e.layer] == nil {
+			wanted[e.layer] = make(map[int]string)
+		}
+		wanted[e.layer][e.index] = name
+		if e.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		target := cleanPath(e.hdr.Linkname)
+		if _, ok := names[target]; ok && t.entries[target].layer == e.layer {
+			continue
+		}
+		if orphans[e.layer] == nil {
+			orphans[e.layer] = make(map[string]bool)
+		}
+		orphans[e.layer][target] = true
+	}
+	for i, layer := range layers {
+		if len(wanted[i]) == 0 {
+			continue
+		}
+		glog.V(1).Infof("unpacking %d files from layer %s into %s",
+			len(wanted[i]), layer.Digest, dest)
+		pr, pw := io.Pipe()
+		errc := make(chan error, 1)
+		go func(layer distribution.Descriptor, wanted map[int]string, orphans map[string]bool) {
+			err := s.writeEntries(layer, wanted, names, orphans, pw)
+			pw.CloseWithError(err)
+			errc <- err
+		}(layer, wanted[i], orphans[i])
+		err := archive.Untar(pr, dest, &archive.TarOptions{
+			NoLchown: false,
+			InUserNS: true,
+		})
+		// Unblock the writer if Untar stopped reading early.
+		pr.Close()
+		werr := <-errc
+		if err != nil {
+			return err
+		}
+		if werr != nil && werr != io.ErrClosedPipe {
+			return werr
+		}
+	}
+	return nil
+}
+
+// unpackFiltered extracts the files in the image selected by filter into dest,
+// along with their parent directories.
+func (s *Store) unpackFiltered(image, dest string, filter *PathFilter) error {
+	t, layers, err := s.loadTree(image, false)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for p := range t.entries {
+		if p == "." || !filter.Match(p) {
+			continue
+		}
+		names[p] = p
+		for dir := cleanPath(path.Dir(p)); dir != "."; dir = cleanPath(path.Dir(dir)) {
+			if _, ok := t.entries[dir]; ok {
+				names[dir] = dir
+			}
+		}
+	}
+	glog.Infof("unpacking %d of %d files of %s into %s",
+		len(names), len(t.entries), image, dest)
+	return s.unpackEntries(layers, t, names, dest)
+}
+
+// ReadFile writes the content of the file p in image, which needs to be in the
+// store, to w. Symbolic links are followed within the image. Only the layer
+// with the file is read, the image is not extracted.
+func (s *Store) ReadFile(image, p string, w io.Writer) error {
+	t, layers, err := s.loadTree(image, false)
+	if err != nil {
+		return err
+	}
+	resolved, err := t.resolve(p)
+	if err != nil {
+		return err
+	}
+	e, err := t.regularFile(resolved)
+	if err != nil {
+		return err
+	}
+	return s.readEntry(layers, e, w)
+}
+
+// regularFile returns the entry with the content of the regular file p, which
+// is the target entry for hard links.
+func (t *fsTree) regularFile(p string) (*fsEntry, error) {
+	e, ok := t.entries[p]
+	if !ok && !t.hasChildren(p) {
+		return nil, fmt.Errorf("%s: %w", absPath(p), syscall.ENOENT)
+	}
+	if !ok || e.hdr.Typeflag == tar.TypeDir {
+		return nil, fmt.Errorf("%s is a directory", absPath(p))
+	}
+	if e.hdr.Typeflag == tar.TypeLink {
+		target, ok := t.entries[cleanPath(e.hdr.Linkname)]
+		if !ok {
+			return nil, fmt.Errorf("%s: hard link target %s: %w",
+				absPath(p), absPath(cleanPath(e.hdr.Linkname)), syscall.ENOENT)
+		}
+		e = target
+	}
+	if !isRegular(e.hdr) {
+		return nil, fmt.Errorf("%s is not a regular file", absPath(p))
+	}
+	return e, nil
+}
+
+// Extract copies the file or directory p in image, which needs to be in the
+// store, to dest, without extracting the rest of the image. Symbolic links
+// in p are followed within the image. Like cp, if dest is an existing
+// directory, p is copied into it. Directories are copied recursively.
+func (s *Store) Extract(image, p, dest string) error {
+	t, layers, err := s.loadTree(image, false)
+	if err != nil {
+		return err
+	}
+	resolved, err := t.resolve(p)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dest); err == nil && info.IsDir() && resolved != "." {
+		dest = filepath.Join(dest, path.Base(resolved))
+	}
+	e, ok := t.entries[resolved]
+	if ok && e.hdr.Typeflag != tar.TypeDir {
+		return s.extractFile(layers, t, resolved, dest)
+	}
+	mode := os.FileMode(0755)
+	if ok {
+		mode = e.hdr.FileInfo().Mode().Perm()
+	}
+	if err := os.MkdirAll(dest, mode); err != nil {
+		return err
+	}
+	names := make(map[string]string)
+	for name := range t.entries {
+		if name == resolved || !isUnder(name, resolved) {
+			continue
+		}
+		if resolved == "." {
+			names[name] = name
+		} else {
+			names[name] = name[len(resolved)+1:]
+		}
+	}
+	glog.Infof("extracting %d files from %s:%s into %s",
+		len(names), image, absPath(resolved), dest)
+	return s.unpackEntries(layers, t, names, dest)
+}
+
+// extractFile copies the regular file p in the tree to the file dest.
+func (s *Store) extractFile(layers []distribution.Descriptor, t *fsTree, p, dest string) error {
+	e, err := t.regularFile(p)
+	if err != nil {
+		return err
+	}
+	glog.Infof("extracting %s into %s", absPath(p), dest)
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		e.hdr.FileInfo().Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = s.readEntry(layers, e, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(dest, e.hdr.ModTime, e.hdr.ModTime)
+}
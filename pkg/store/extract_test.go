@@ -0,0 +1,303 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+// memorySource is an in-memory source with a single image.
+type memorySource struct {
+	manifest []byte
+	blobs    map[digest.Digest][]byte
+}
+
+func (m *memorySource) Manifest(image, reference string) (string, []byte, error) {
+	return schema2.MediaTypeManifest, m.manifest, nil
+}
+
+func (m *memorySource) Resolve(image, reference string) (distribution.Descriptor, error) {
+	return distribution.Descriptor{
+		MediaType: schema2.MediaTypeManifest,
+		Size:      int64(len(m.manifest)),
+		Digest:    digest.FromBytes(m.manifest),
+	}, nil
+}
+
+func (m *memorySource) GetBlob(image string, desc distribution.Descriptor) ([]byte, error) {
+	buf, ok := m.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %s not found", desc.Digest)
+	}
+	return buf, nil
+}
+
+func (m *memorySource) SaveBlob(image, dir string, desc distribution.Descriptor) (string, error) {
+	buf, err := m.GetBlob(image, desc)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, desc.Digest.Encoded())
+	return path, ioutil.WriteFile(path, buf, 0644)
+}
+
+// testEntry is an entry of a test layer, with the content of regular files.
+type testEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func testFile(name, content string) testEntry {
+	return testEntry{
+		hdr:     tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644},
+		content: content,
+	}
+}
+
+func testDir(name string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}}
+}
+
+func testLink(name, target string) testEntry {
+	return testEntry{hdr: tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target}}
+}
+
+// testLayer returns an uncompressed layer tarball with entries.
+func testLayer(t *testing.T, entries ...testEntry) []byte {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testStore creates a store in a temporary directory, and pulls an image
+// with layers into it as test/image:latest. The caller needs to remove the
+// directory.
+func testStore(t *testing.T, layers ...[]byte) (*Store, string) {
+	src := &memorySource{blobs: make(map[digest.Digest][]byte)}
+	m := schema2.Manifest{}
+	m.SchemaVersion = 2
+	m.MediaType = schema2.MediaTypeManifest
+	diffIDs := []digest.Digest{}
+	for _, layer := range layers {
+		dgst := digest.FromBytes(layer)
+		src.blobs[dgst] = layer
+		diffIDs = append(diffIDs, dgst)
+		m.Layers = append(m.Layers, distribution.Descriptor{
+			MediaType: schema2.MediaTypeLayer,
+			Size:      int64(len(layer)),
+			Digest:    dgst,
+		})
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": diffIDs,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Config = distribution.Descriptor{
+		MediaType: schema2.MediaTypeImageConfig,
+		Size:      int64(len(config)),
+		Digest:    digest.FromBytes(config),
+	}
+	src.blobs[m.Config.Digest] = config
+	src.manifest, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "tosi-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := NewStore(dir, "", 1, src)
+	if err == nil {
+		_, err = st.Pull("test/image:latest")
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return st, dir
+}
+
+func TestUnpackFilteredHardLinks(t *testing.T) {
+	base := testLayer(t,
+		testDir("bin/"),
+		testFile("bin/git", "v1"),
+		testLink("bin/git-add", "bin/git"),
+		testLink("bin/git-commit", "bin/git"))
+	testCases := []struct {
+		name   string
+		layers [][]byte
+		filter *PathFilter
+		// files are the expected files, mapped to their content.
+		files map[string]string
+		// linked is true if the extracted files are expected to be hard links
+		// to the same file.
+		linked bool
+	}{
+		{
+			name:   "everything",
+			layers: [][]byte{base},
+			filter: &PathFilter{},
+			files: map[string]string{
+				"bin/git":        "v1",
+				"bin/git-add":    "v1",
+				"bin/git-commit": "v1",
+			},
+			linked: true,
+		},
+		{
+			name:   "target excluded",
+			layers: [][]byte{base},
+			filter: &PathFilter{Exclude: []string{"/bin/git"}},
+			files: map[string]string{
+				"bin/git-add":    "v1",
+				"bin/git-commit": "v1",
+			},
+		},
+		{
+			name:   "target not included",
+			layers: [][]byte{base},
+			filter: &PathFilter{Include: []string{"/bin/git-add"}},
+			files: map[string]string{
+				"bin/git-add": "v1",
+			},
+		},
+		{
+			name:   "target replaced",
+			layers: [][]byte{base, testLayer(t, testFile("bin/git", "v2"))},
+			filter: &PathFilter{},
+			files: map[string]string{
+				"bin/git":        "v2",
+				"bin/git-add":    "v1",
+				"bin/git-commit": "v1",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, dir := testStore(t, tc.layers...)
+			defer os.RemoveAll(dir)
+			dest := filepath.Join(dir, "rootfs")
+			err := st.UnpackFiltered("test/image:latest", dest, tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inodes := make(map[uint64]bool)
+			for _, name := range []string{"bin/git", "bin/git-add", "bin/git-commit"} {
+				path := filepath.Join(dest, name)
+				expected, ok := tc.files[name]
+				buf, err := ioutil.ReadFile(path)
+				if !ok {
+					if !os.IsNotExist(err) {
+						t.Errorf("%s: expected not to be extracted, got %v", name, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("%s: %v", name, err)
+				}
+				if string(buf) != expected {
+					t.Errorf("%s: expected %q, got %q", name, expected, buf)
+				}
+				info, err := os.Stat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				inodes[info.Sys().(*syscall.Stat_t).Ino] = true
+			}
+			if tc.linked && len(inodes) != 1 {
+				t.Errorf("expected hard links to one file, got %d files", len(inodes))
+			}
+			if !tc.linked && len(inodes) != len(tc.files) {
+				t.Errorf("expected %d separate files, got %d", len(tc.files), len(inodes))
+			}
+		})
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	st, dir := testStore(t, testLayer(t,
+		testDir("etc/"),
+		testFile("etc/hostname", "alpine"),
+		testFile("usr/bin/env", "env")))
+	defer os.RemoveAll(dir)
+	testCases := []struct {
+		path     string
+		expected string
+		enoent   bool
+	}{
+		{path: "/etc/hostname", expected: "alpine"},
+		{path: "/usr/bin/env", expected: "env"},
+		{path: "/etc/missing", enoent: true},
+		{path: "/missing/file", enoent: true},
+		{path: "/etc"},
+		{path: "/usr/bin"},
+	}
+	for _, tc := range testCases {
+		buf := &bytes.Buffer{}
+		err := st.ReadFile("test/image:latest", tc.path, buf)
+		if tc.expected != "" {
+			if err != nil || buf.String() != tc.expected {
+				t.Errorf("%s: expected %q, got %q, %v", tc.path, tc.expected,
+					buf.String(), err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", tc.path)
+			continue
+		}
+		if errors.Is(err, syscall.ENOENT) != tc.enoent {
+			t.Errorf("%s: expected ENOENT %v, got %v", tc.path, tc.enoent, err)
+		}
+		if tc.enoent && !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s: expected not exist error, got %v", tc.path, err)
+		}
+	}
+
+	// Paths are resolved before looking up the file, so check missing files
+	// in the tree too.
+	tree := &fsTree{entries: map[string]*fsEntry{
+		"bin/sh": {hdr: &tar.Header{
+			Name:     "bin/sh",
+			Typeflag: tar.TypeLink,
+			Linkname: "bin/busybox",
+		}},
+	}}
+	for _, p := range []string{"bin/missing", "bin/sh"} {
+		if _, err := tree.regularFile(p); !errors.Is(err, syscall.ENOENT) {
+			t.Errorf("%s: expected ENOENT, got %v", p, err)
+		}
+	}
+}
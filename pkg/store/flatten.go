@@ -0,0 +1,278 @@
+package store
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FlattenOptions configure flattening images.
+type FlattenOptions struct {
+	// Compress compresses the tarball via gzip.
+	Compress bool
+	// ClampTime, if set, replaces modification times later than it, e.g. for
+	// reproducible tarballs via SOURCE_DATE_EPOCH.
+	ClampTime *time.Time
+}
+
+// spoolFile is the content of a regular file copied from a layer into the
+// spool file, at offset.
+type spoolFile struct {
+	offset int64
+	size   int64
+}
+
+// orphanKey identifies the regular file path in the layer with the index
+// layer, which is not in the tree, but is the target of a hard link in it.
+type orphanKey struct {
+	layer int
+	path  string
+}
+
+// orphans returns the targets of the hard links in the tree which are not in
+// the tree, or not from the layer of the link, since a later layer removed or
+// replaced them, for each layer.
+func (t *fsTree) orphans(layers int) []map[string]bool {
+	orphans := make([]map[string]bool, layers)
+	for _, e := range t.entries {
+		if e.hdr.Typeflag != tar.TypeLink {
+			continue
+		}
+		target := cleanPath(e.hdr.Linkname)
+		if te, ok := t.entries[target]; ok && te.layer == e.layer {
+			continue
+		}
+		if orphans[e.layer] == nil {
+			orphans[e.layer] = make(map[string]bool)
+		}
+		orphans[e.layer][target] = true
+	}
+	return orphans
+}
+
+// spoolContent copies the content of the regular files in the tree, and of
+// the targets in orphans, from the layers into the file spool, so they can be
+// read in any order.
+func (s *Store) spoolContent(layers []distribution.Descriptor, t *fsTree, orphans []map[string]bool, spool *os.File) (map[*fsEntry]spoolFile, map[orphanKey]spoolFile, error) {
+	wanted := make([]map[int]*fsEntry, len(layers))
+	for _, e := range t.entries {
+		if !isRegular(e.hdr) {
+			continue
+		}
+		if wanted[e.layer] == nil {
+			wanted[e.layer] = make(map[int]*fsEntry)
+		}
+		wanted[e.layer][e.index] = e
+	}
+	files := make(map[*fsEntry]spoolFile)
+	targets := make(map[orphanKey]spoolFile)
+	offset := int64(0)
+	for i, layer := range layers {
+		if len(wanted[i]) == 0 && len(orphans[i]) == 0 {
+			continue
+		}
+		index := 0
+		err := s.walkLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+			e, ok := wanted[i][index]
+			index++
+			key := orphanKey{layer: i, path: cleanPath(hdr.Name)}
+			if !ok && !(orphans[i][key.path] && isRegular(hdr)) {
+				return nil
+			}
+			n, err := io.Copy(spool, r)
+			if err != nil {
+				return err
+			}
+			if ok {
+				files[e] = spoolFile{offset: offset, size: n}
+			} else {
+				targets[key] = spoolFile{offset: offset, size: n}
+			}
+			offset += n
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return files, targets, nil
+}
+
+// flattenHeader returns the header for the entry p in the flattened tarball.
+func flattenHeader(p string, e *fsEntry, opts FlattenOptions) *tar.Header {
+	hdr := *e.hdr
+	hdr.Name = p
+	if hdr.Typeflag == tar.TypeDir {
+		hdr.Name += "/"
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = cleanPath(hdr.Linkname)
+	}
+	// Access and change times would make the tarball differ between
+	// extractions of the same image.
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if opts.ClampTime != nil && hdr.ModTime.After(*opts.ClampTime) {
+		hdr.ModTime = *opts.ClampTime
+	}
+	return &hdr
+}
+
+// Flatten writes the final filesystem of image, which needs to be in the
+// store, to w as a single tarball, with whiteouts applied. Entries are sorted
+// by path, with hard links after all other entries, so the same image always
+// results in the same tarball. Hard links to files removed or replaced by a
+// later layer are written as regular files with the content of their target.
+// The content of files is copied into a temporary file in the layer cache
+// first, since it is read in a different order than it is stored in the
+// layers.
+func (s *Store) Flatten(image string, w io.Writer, opts FlattenOptions) error {
+	t, layers, err := s.loadTree(image, false)
+	if err != nil {
+		return err
+	}
+	spool, err := ioutil.TempFile(s.layerDir, ".flatten-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	orphans := t.orphans(len(layers))
+	files, targets, err := s.spoolContent(layers, t, orphans, spool)
+	if err != nil {
+		return fmt.Errorf("reading layers of %s: %v", image, err)
+	}
+	var gz *gzip.Writer
+	if opts.Compress {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	links := []string{}
+	for _, p := range t.paths() {
+		e := t.entries[p]
+		if p == "." {
+			continue
+		}
+		if e.hdr.Typeflag == tar.TypeLink {
+			links = append(links, p)
+			continue
+		}
+		hdr := flattenHeader(p, e, opts)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if f, ok := files[e]; ok {
+			_, err := io.Copy(tw, io.NewSectionReader(spool, f.offset, f.size))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, p := range links {
+		e := t.entries[p]
+		hdr := flattenHeader(p, e, opts)
+		if !orphans[e.layer][hdr.Linkname] {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		f, ok := targets[orphanKey{layer: e.layer, path: hdr.Linkname}]
+		if !ok {
+			glog.Warningf("skipping hard link %s: target %s not found",
+				absPath(p), absPath(hdr.Linkname))
+			continue
+		}
+		glog.V(2).Infof("writing hard link %s as a copy of %s", absPath(p),
+			absPath(hdr.Linkname))
+		hdr.Typeflag = tar.TypeReg
+		hdr.Linkname = ""
+		hdr.Size = f.size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := io.Copy(tw, io.NewSectionReader(spool, f.offset, f.size))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		return gz.Close()
+	}
+	return nil
+}
+
+// FlattenImage creates a new image newRef, e.g. myapp:flat, with the final
+// filesystem of image, which needs to be in the store, as its only layer. The
+// config of image is kept, with the history of the squashed layers marked as
+// empty. It returns the digest of the new manifest.
+func (s *Store) FlattenImage(image, newRef string, opts FlattenOptions) (digest.Digest, error) {
+	repo, tag, dgst, err := util.ParseImageReference(newRef)
+	if err != nil {
+		return "", err
+	}
+	if dgst != "" {
+		return "", fmt.Errorf("%s: images can only be created via a tag", newRef)
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	baseRepo, baseRef, err := util.ParseImageSpec(image)
+	if err != nil {
+		return "", err
+	}
+	base, err := manifest.Load(s.src, s.manifestDir, baseRepo, baseRef)
+	if err != nil {
+		return "", err
+	}
+	configDesc, img, err := s.imageConfig(base, image)
+	if err != nil {
+		return "", err
+	}
+	layerType := v1.MediaTypeImageLayerGzip
+	if base.ManifestV2 != nil {
+		layerType = schema2.MediaTypeLayer
+	}
+	opts.Compress = false
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.Flatten(image, pw, opts))
+	}()
+	layer, diffID, err := s.saveLayer(pr, layerType)
+	pr.Close()
+	if err != nil {
+		return "", fmt.Errorf("flattening %s: %v", image, err)
+	}
+	glog.V(2).Infof("created layer %s, diff ID %s", layer.Digest, diffID)
+	now := time.Now().UTC()
+	if opts.ClampTime != nil && now.After(*opts.ClampTime) {
+		now = *opts.ClampTime
+	}
+	img.Created = &now
+	img.RootFS.DiffIDs = []digest.Digest{diffID}
+	for i := range img.History {
+		img.History[i].EmptyLayer = true
+	}
+	img.History = append(img.History, v1.History{
+		Created:   &now,
+		CreatedBy: "tosi flatten " + image,
+	})
+	return s.saveImage(repo, tag, img, configDesc.MediaType,
+		[]distribution.Descriptor{layer}, base.ManifestV2 != nil)
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// flattened returns the entries of the flattened tarball of image in st,
+// mapped to their content, or the target for hard links, e.g. "link:bin/git".
+func flattened(t *testing.T, st *Store, image string) map[string]string {
+	buf := &bytes.Buffer{}
+	if err := st.Flatten(image, buf, FlattenOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeLink:
+			entries[hdr.Name] = "link:" + hdr.Linkname
+		case tar.TypeDir:
+			entries[hdr.Name] = "dir"
+		default:
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[hdr.Name] = string(content)
+		}
+	}
+	return entries
+}
+
+func TestFlattenHardLinks(t *testing.T) {
+	base := testLayer(t,
+		testDir("bin/"),
+		testFile("bin/git", "v1"),
+		testLink("bin/git-add", "bin/git"))
+	testCases := []struct {
+		name     string
+		layers   [][]byte
+		expected map[string]string
+	}{
+		{
+			name:   "single layer",
+			layers: [][]byte{base},
+			expected: map[string]string{
+				"bin/":        "dir",
+				"bin/git":     "v1",
+				"bin/git-add": "link:bin/git",
+			},
+		},
+		{
+			name:   "target removed",
+			layers: [][]byte{base, testLayer(t, testFile("bin/.wh.git", ""))},
+			expected: map[string]string{
+				"bin/":        "dir",
+				"bin/git-add": "v1",
+			},
+		},
+		{
+			name:   "target replaced",
+			layers: [][]byte{base, testLayer(t, testFile("bin/git", "v2"))},
+			expected: map[string]string{
+				"bin/":        "dir",
+				"bin/git":     "v2",
+				"bin/git-add": "v1",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			st, dir := testStore(t, tc.layers...)
+			defer os.RemoveAll(dir)
+			actual := flattened(t, st, "test/image:latest")
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,361 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// Image is an image in the store.
+type Image struct {
+	// Names are the names the image was pulled or created via, e.g.
+	// library/alpine:3.6. Images pulled via a digest have no names.
+	Names []string `json:"names"`
+	// Digest is the digest of the manifest, or the manifest list or image
+	// index for multi-platform images.
+	Digest digest.Digest `json:"digest"`
+	ID     string        `json:"id"`
+	// Size is the size of the layers and the config of the image.
+	Size int64 `json:"size"`
+}
+
+// GCStats are the number of files removed from the store by GC.
+type GCStats struct {
+	Manifests      int `json:"manifests"`
+	Blobs          int `json:"blobs"`
+	UnpackedLayers int `json:"unpackedLayers"`
+	Configs        int `json:"configs"`
+	DiskImages     int `json:"diskImages"`
+}
+
+// List returns the images in the store.
+func (s *Store) List() ([]Image, error) {
+	stored, err := manifest.List(s.manifestDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %v", err)
+	}
+	images := make([]Image, 0, len(stored))
+	for _, st := range stored {
+		image := Image{
+			Names:  st.Names,
+			Digest: st.Digest,
+		}
+		mfest, err := manifest.Load(s.src, s.manifestDir, "", st.Digest.String())
+		if err != nil {
+			glog.Warningf("loading manifest %s: %v", st.Digest, err)
+		} else {
+			image.ID = mfest.ID()
+			image.Size = imageSize(mfest)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// imageSize returns the size of the layers and the config of mfest.
+func imageSize(mfest *manifest.Manifest) int64 {
+	size := int64(0)
+	for _, layer := range mfest.Layers() {
+		size += layer.Size
+	}
+	if config, ok := mfest.ConfigDescriptor(); ok {
+		size += config.Size
+	}
+	return size
+}
+
+// Image returns image from the store, without pulling it. The image can be
+// pinned to a digest, in which case it is found regardless of the name it
+// was pulled via.
+func (s *Store) Image(image string) (*Image, error) {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return nil, err
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	images, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, img := range images {
+		if img.Digest == mfest.Digest {
+			return &img, nil
+		}
+	}
+	return &Image{
+		Names:  []string{},
+		Digest: mfest.Digest,
+		ID:     mfest.ID(),
+		Size:   imageSize(mfest),
+	}, nil
+}
+
+// ContainerConfig returns the container config of the image with the ID id,
+// e.g. its user and entrypoint.
+func (s *Store) ContainerConfig(id string) (*container.Config, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.configDir, id))
+	if err != nil {
+		return nil, err
+	}
+	config := container.Config{}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("parsing config of %s: %v", id, err)
+	}
+	return &config, nil
+}
+
+// DiskUsage returns the number of bytes and inodes used by the store.
+func (s *Store) DiskUsage() (uint64, uint64, error) {
+	bytes := uint64(0)
+	inodes := uint64(0)
+	dirs := []string{s.BaseDir}
+	if rel, err := filepath.Rel(s.BaseDir, s.overlayDir); err != nil ||
+		strings.HasPrefix(rel, "..") {
+		dirs = append(dirs, s.overlayDir)
+	}
+	for _, dir := range dirs {
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					// Removed while walking the directory.
+					return nil
+				}
+				return err
+			}
+			inodes++
+			bytes += uint64(info.Size())
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return bytes, inodes, nil
+}
+
+// Remove removes image from the store. If image is pinned to a digest, all
+// names pointing to the same manifest are removed. Layers are only removed
+// via GC.
+func (s *Store) Remove(image string) error {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return err
+	}
+	err = manifest.Remove(s.manifestDir, repo, ref)
+	if err != nil {
+		return fmt.Errorf("removing %s: %v", image, err)
+	}
+	return nil
+}
+
+// RemoveDigest removes the image with the manifest dgst from the store, along
+// with all of its names. Layers are only removed via GC.
+func (s *Store) RemoveDigest(dgst digest.Digest) error {
+	err := manifest.RemoveDigest(s.manifestDir, dgst)
+	if err != nil {
+		return fmt.Errorf("removing %s: %v", dgst, err)
+	}
+	return nil
+}
+
+// isEncodedDigest returns true if name is an encoded SHA-256 digest, which
+// layers and unpacked layers are named after.
+func isEncodedDigest(name string) bool {
+	return digest.NewDigestFromEncoded(digest.SHA256, name).Validate() == nil
+}
+
+// mountedLayers returns the unpacked layers used by overlayfs mounts, as the
+// paths of the layer directories.
+func (s *Store) mountedLayers() (map[string]bool, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	layers := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), " - ")
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "overlay ") {
+			continue
+		}
+		for _, opt := range strings.Split(fields[1], ",") {
+			if i := strings.Index(opt, "lowerdir="); i >= 0 {
+				opt = opt[i+len("lowerdir="):]
+			} else {
+				continue
+			}
+			for _, lower := range strings.Split(opt, ":") {
+				if !filepath.IsAbs(lower) {
+					// Short links are relative to the overlay directory.
+					lower = filepath.Join(s.overlayDir, lower)
+				}
+				if path, err := filepath.EvalSymlinks(lower); err == nil {
+					lower = path
+				}
+				layers[lower] = true
+			}
+		}
+	}
+	return layers, scanner.Err()
+}
+
+// removeUnpackedLayer removes the layer unpacked into the overlay directory
+// dir, along with its short link.
+func (s *Store) removeUnpackedLayer(dir string) error {
+	if link, err := ioutil.ReadFile(dir + ".link"); err == nil {
+		os.Remove(filepath.Join(s.overlayDir, string(link)))
+	}
+	os.Remove(dir + ".link")
+	return os.RemoveAll(dir)
+}
+
+// GC removes manifests, blobs, unpacked layers, configs and disk images not
+// used by any of the images in the store. Unpacked layers used by overlayfs
+// mounts are kept. It must not run concurrently with pulling or creating
+// images.
+func (s *Store) GC() (GCStats, error) {
+	stats := GCStats{}
+	stored, err := manifest.List(s.manifestDir)
+	if err != nil {
+		return stats, err
+	}
+	manifests := make(map[digest.Digest]bool)
+	blobs := make(map[string]bool)
+	ids := make(map[string]bool)
+	for _, st := range stored {
+		mfest, err := manifest.Load(s.src, s.manifestDir, "", st.Digest.String())
+		if err != nil {
+			return stats, fmt.Errorf("loading manifest %s, remove the image: %v",
+				st.Digest, err)
+		}
+		_, payload, err := mfest.Payload()
+		if err != nil {
+			return stats, err
+		}
+		manifests[st.Digest] = true
+		manifests[manifest.PayloadDigest(payload)] = true
+		for _, desc := range append(mfest.References(), mfest.Layers()...) {
+			blobs[desc.Digest.Encoded()] = true
+		}
+		if config, ok := mfest.ConfigDescriptor(); ok {
+			blobs[config.Digest.Encoded()] = true
+			if mfest.ManifestV1 != nil {
+				// The config of a converted schema1 manifest.
+				manifests[config.Digest] = true
+			}
+		}
+		ids[mfest.ID()] = true
+	}
+	stats.Manifests, err = manifest.Prune(s.manifestDir, manifests)
+	if err != nil {
+		return stats, err
+	}
+	files, err := ioutil.ReadDir(s.layerDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		if !isEncodedDigest(f.Name()) || blobs[f.Name()] {
+			continue
+		}
+		glog.V(2).Infof("removing blob %s", f.Name())
+		if err := os.Remove(filepath.Join(s.layerDir, f.Name())); err != nil {
+			return stats, err
+		}
+		stats.Blobs++
+	}
+	mounted, err := s.mountedLayers()
+	if err != nil {
+		return stats, fmt.Errorf("listing mounts: %v", err)
+	}
+	files, err = ioutil.ReadDir(s.overlayDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		dir := filepath.Join(s.overlayDir, f.Name())
+		if !f.IsDir() || !isEncodedDigest(f.Name()) || blobs[f.Name()] {
+			continue
+		}
+		if mounted[dir] {
+			glog.Infof("keeping unpacked layer %s, it is mounted", dir)
+			continue
+		}
+		glog.V(2).Infof("removing unpacked layer %s", dir)
+		if err := s.removeUnpackedLayer(dir); err != nil {
+			return stats, err
+		}
+		stats.UnpackedLayers++
+	}
+	files, err = ioutil.ReadDir(s.configDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") || ids[f.Name()] {
+			continue
+		}
+		glog.V(2).Infof("removing config %s", f.Name())
+		if err := os.Remove(filepath.Join(s.configDir, f.Name())); err != nil {
+			return stats, err
+		}
+		stats.Configs++
+	}
+	files, err = ioutil.ReadDir(s.diskImageDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, f := range files {
+		name := f.Name()
+		id := strings.TrimSuffix(name, filepath.Ext(name))
+		if strings.HasPrefix(name, ".") || ids[id] {
+			continue
+		}
+		glog.V(2).Infof("removing disk image %s", name)
+		if err := os.Remove(filepath.Join(s.diskImageDir, name)); err != nil {
+			return stats, err
+		}
+		stats.DiskImages++
+	}
+	return stats, nil
+}
+
+// Unmount unmounts the overlayfs mount created via Mount in dest. The changes
+// made in the mount are kept, so they can still be committed, unless
+// removeChanges is set.
+func (s *Store) Unmount(dest string, removeChanges bool) error {
+	if !util.PathExists(dest + ".image") {
+		return fmt.Errorf("%s is not an image mount", dest)
+	}
+	output, err := exec.Command("umount", dest).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("unmounting %s: %v; output: %s", dest, err, output)
+	}
+	err = os.RemoveAll(dest + ".work")
+	if err != nil {
+		return err
+	}
+	if !removeChanges {
+		return nil
+	}
+	err = os.RemoveAll(dest + ".upper")
+	if err != nil {
+		return err
+	}
+	return os.Remove(dest + ".image")
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Statuses of progress events sent while pulling images.
+const (
+	// StatusResolved is sent once the manifest of the image is fetched.
+	StatusResolved = "resolved"
+	// StatusCached is sent if the image is already in the store.
+	StatusCached = "cached"
+	// StatusDownloading is sent when a layer starts downloading.
+	StatusDownloading = "downloading"
+	// StatusWaiting is sent when a layer is being pulled by another pull,
+	// which the pull waits for.
+	StatusWaiting = "waiting"
+	// StatusDownloaded is sent once a layer is downloaded and unpacked.
+	StatusDownloaded = "downloaded"
+	// StatusPulled is sent once the image is in the store.
+	StatusPulled = "pulled"
+)
+
+// ProgressEvent is the progress of pulling an image.
+type ProgressEvent struct {
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	// Layer is the layer the event is for, if any.
+	Layer digest.Digest `json:"layer,omitempty"`
+	// Cached is true if the layer was already in the store, and did not need
+	// to be downloaded.
+	Cached bool `json:"cached,omitempty"`
+	// Digest is the digest of the manifest of the image, once resolved.
+	Digest digest.Digest `json:"digest,omitempty"`
+	// ID is the image ID, once pulled.
+	ID string `json:"id,omitempty"`
+}
+
+// ProgressFunc is called with the progress events of a pull. It might be
+// called from several goroutines concurrently.
+type ProgressFunc func(event ProgressEvent)
+
+// inflight deduplicates concurrent operations with the same key, e.g. pulling
+// a layer shared by several images pulled at the same time.
+type inflight struct {
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+type inflightCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		calls: make(map[string]*inflightCall),
+	}
+}
+
+// do runs fn, unless an operation with key is already running, in which case
+// it waits for that one to finish, and returns its result. The function
+// waiting, if not nil, is called before waiting.
+func (f *inflight) do(key string, waiting func(), fn func() error) error {
+	f.mu.Lock()
+	if call, ok := f.calls[key]; ok {
+		f.mu.Unlock()
+		if waiting != nil {
+			waiting()
+		}
+		<-call.done
+		return call.err
+	}
+	call := &inflightCall{
+		done: make(chan struct{}),
+	}
+	f.calls[key] = call
+	f.mu.Unlock()
+	call.err = fn()
+	f.mu.Lock()
+	delete(f.calls, key)
+	f.mu.Unlock()
+	close(call.done)
+	return call.err
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/golang/glog"
+	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+)
+
+// PushOptions configure pushing images.
+type PushOptions struct {
+	// MountFrom is a repository on the destination registry that has the
+	// blobs of the image, e.g. the one it was pulled from. If set, blobs
+	// missing from the destination repository are mounted from it if
+	// possible, instead of uploading them.
+	MountFrom string
+	// ChunkSize is the size of chunks blobs are uploaded in. Zero means
+	// blobs are uploaded in a single request.
+	ChunkSize int64
+}
+
+// needsUpload returns true if the blob desc is missing from repo, and it could
+// not be mounted from the repository mountFrom, if set.
+func needsUpload(dest source.Destination, repo string, desc distribution.Descriptor, mountFrom string) (bool, error) {
+	exists, err := dest.BlobExists(repo, desc.Digest)
+	if err != nil {
+		return false, fmt.Errorf("checking blob %s: %w", desc.Digest, err)
+	}
+	if exists {
+		glog.V(2).Infof("%s: blob %s already exists", repo, desc.Digest)
+		return false, nil
+	}
+	if mountFrom == "" || mountFrom == repo {
+		return true, nil
+	}
+	mounted, err := dest.MountBlob(repo, mountFrom, desc.Digest)
+	if err != nil {
+		glog.Warningf("%s: mounting blob %s from %s: %v",
+			repo, desc.Digest, mountFrom, err)
+		return true, nil
+	}
+	if mounted {
+		glog.V(2).Infof("%s: mounted blob %s from %s",
+			repo, desc.Digest, mountFrom)
+	}
+	return !mounted, nil
+}
+
+// uploadBlob uploads the blob desc from the layer cache into repo.
+func (s *Store) uploadBlob(dest source.Destination, repo string, desc distribution.Descriptor, chunkSize int64) error {
+	path := filepath.Join(s.layerDir, desc.Digest.Encoded())
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	// Schema1 manifests do not have the size of layers.
+	if desc.Size > 0 && desc.Size != info.Size() {
+		return fmt.Errorf("blob %s has size %d, expected %d",
+			path, info.Size(), desc.Size)
+	}
+	desc.Size = info.Size()
+	glog.Infof("%s: uploading blob %s (%d bytes)", repo, desc.Digest, desc.Size)
+	return dest.PutBlob(repo, desc, f, chunkSize)
+}
+
+// forEachBlob calls fn for each blob, using at most s.parallelDownloads
+// goroutines.
+func (s *Store) forEachBlob(blobs []distribution.Descriptor, fn func(desc distribution.Descriptor) error) error {
+	parallelism := s.parallelDownloads
+	if parallelism <= 0 {
+		parallelism = len(blobs)
+	}
+	sem := make(chan struct{}, parallelism)
+	ch := make(chan error, len(blobs))
+	for _, blob := range blobs {
+		blob := blob
+		go func() {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			err := fn(blob)
+			if err != nil {
+				err = fmt.Errorf("blob %s: %w", blob.Digest, err)
+			}
+			ch <- err
+		}()
+	}
+	var result error
+	for range blobs {
+		if err := <-ch; err != nil {
+			glog.Warningf("%v", err)
+			result = multierror.Append(result, err)
+		}
+	}
+	return result
+}
+
+// destReference returns the repository and the reference to push the manifest
+// with the digest dgst to, for the destination image destRef. If destRef has
+// no tag, srcRef, the tag or digest of the source image, is used. Manifests
+// are pushed via their digest if neither has a tag.
+func destReference(destRef, srcRef string, dgst digest.Digest) (string, string, error) {
+	repo, tag, destDigest, err := util.ParseImageReference(destRef)
+	if err != nil {
+		return "", "", err
+	}
+	if destDigest != "" {
+		if destDigest != dgst {
+			return "", "", fmt.Errorf("%s: manifest digest is %s", destRef, dgst)
+		}
+		return repo, destDigest.String(), nil
+	}
+	if tag != "" {
+		return repo, tag, nil
+	}
+	if _, err := digest.Parse(srcRef); err == nil {
+		return repo, dgst.String(), nil
+	}
+	return repo, srcRef, nil
+}
+
+// Push uploads localImage from the store to remoteRef, e.g.
+// myteam/alpine:3.6, using the source of the store as the destination, which
+// needs to implement source.Destination. Blobs already present in the
+// destination repository are skipped, then the manifest is uploaded. If
+// remoteRef has no tag, the tag of localImage is used. It returns the digest of
+// the pushed manifest. For multi-platform images, only the manifest for the
+// current platform is pushed.
+func (s *Store) Push(localImage, remoteRef string, opts PushOptions) (digest.Digest, error) {
+	dest, ok := s.src.(source.Destination)
+	if !ok {
+		return "", fmt.Errorf("pushing %s: destination does not support pushing",
+			remoteRef)
+	}
+	repo, ref, err := util.ParseImageSpec(localImage)
+	if err != nil {
+		return "", err
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return "", err
+	}
+	mediaType, payload, err := mfest.Payload()
+	if err != nil {
+		return "", err
+	}
+	if manifest.PayloadDigest(payload) != mfest.Digest {
+		glog.Warningf("%s is a multi-platform image, pushing only the manifest %s for the current platform",
+			localImage, manifest.PayloadDigest(payload))
+	}
+	remoteRepo, reference, err := destReference(
+		remoteRef, ref, manifest.PayloadDigest(payload))
+	if err != nil {
+		return "", err
+	}
+	blobs := mfest.References()
+	if config, ok := mfest.ConfigDescriptor(); ok {
+		path := filepath.Join(s.layerDir, config.Digest.Encoded())
+		if !util.PathExists(path) {
+			return "", fmt.Errorf("config blob %s of %s not found, pull the image again",
+				config.Digest, localImage)
+		}
+	}
+	err = s.forEachBlob(blobs, func(desc distribution.Descriptor) error {
+		missing, err := needsUpload(dest, remoteRepo, desc, opts.MountFrom)
+		if err != nil || !missing {
+			return err
+		}
+		return s.uploadBlob(dest, remoteRepo, desc, opts.ChunkSize)
+	})
+	if err != nil {
+		return "", fmt.Errorf("pushing blobs for %s: %w", remoteRef, err)
+	}
+	glog.V(2).Infof("uploading manifest for %s:%s", remoteRepo, reference)
+	dgst, err := dest.PutManifest(remoteRepo, reference, mediaType, payload)
+	if err != nil {
+		return "", fmt.Errorf("pushing manifest for %s: %w", remoteRef, err)
+	}
+	return dgst, nil
+}
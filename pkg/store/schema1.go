@@ -0,0 +1,60 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/elotl/tosi/pkg/manifest"
+	"github.com/elotl/tosi/pkg/util"
+	"github.com/opencontainers/go-digest"
+)
+
+// layerDiffID returns the diff ID of the layer desc in the layer cache, which
+// is the digest of the uncompressed layer tarball.
+func (s *Store) layerDiffID(desc distribution.Descriptor) (digest.Digest, error) {
+	f, err := os.Open(filepath.Join(s.layerDir, desc.Digest.Encoded()))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	reader, err := archive.DecompressStream(f)
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+	digester := digest.Canonical.Digester()
+	_, err = io.Copy(digester.Hash(), reader)
+	if err != nil {
+		return "", err
+	}
+	return digester.Digest(), nil
+}
+
+// convertSchema1 converts the schema1 manifest mfest, which needs to have its
+// layers in the layer cache, into an OCI image manifest, and saves the config
+// synthesized from its history along with the layers, like config blobs of
+// other images.
+func (s *Store) convertSchema1(mfest *manifest.Manifest) error {
+	err := mfest.ConvertSchema1(s.layerDiffID)
+	if err != nil {
+		return err
+	}
+	config, err := mfest.Config()
+	if err != nil {
+		return err
+	}
+	desc, _ := mfest.ConfigDescriptor()
+	path := filepath.Join(s.layerDir, desc.Digest.Encoded())
+	if util.PathExists(path) {
+		return nil
+	}
+	err = util.AtomicWriteFile(path, config, 0644)
+	if err != nil && !util.PathExists(path) {
+		return fmt.Errorf("saving converted config for %s: %v", mfest.Image, err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -19,45 +20,87 @@ import (
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/elotl/tosi/pkg/manifest"
-	"github.com/elotl/tosi/pkg/registryclient"
+	"github.com/elotl/tosi/pkg/metrics"
+	"github.com/elotl/tosi/pkg/source"
+	"github.com/elotl/tosi/pkg/tracing"
 	"github.com/elotl/tosi/pkg/util"
 	"github.com/golang/glog"
 	"github.com/hashicorp/go-multierror"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
 	maxRetries = 10
 )
 
+// Verifier verifies images before they are pulled into the store, e.g. via
+// their signatures.
+type Verifier interface {
+	// Verify returns an error if the image repo, pulled via reference, which
+	// is a tag or a digest, with the manifest dgst must not be used. The
+	// manifest is a manifest list or an image index for multi-platform
+	// images.
+	Verify(src source.Source, repo, reference string, dgst digest.Digest) error
+}
+
+// VerificationError is returned when a verifier rejects an image.
+type VerificationError struct {
+	Repo string
+	Err  error
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("verifying %s: %v", e.Repo, e.Err)
+}
+
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
 type Store struct {
 	BaseDir           string
 	layerDir          string
 	configDir         string
 	manifestDir       string
 	overlayDir        string
+	diskImageDir      string
 	parallelDownloads int
-	reg               *registryclient.RegistryClient
+	src               source.Source
+	verifiers         []Verifier
+	allowUnsigned     bool
+	// layerPulls is shared by the stores created via WithSource, so layers
+	// are only pulled once when several images are pulled concurrently.
+	layerPulls *inflight
+	// ctx is the parent of the tracing spans of operations, see
+	// WithContext.
+	ctx context.Context
 }
 
 // NewStore creates a new image store, with basedir as the base directory for
 // storing layers and metadata, and overlaydir as the directory layers will be
 // unpacked into. The filesystem backing overlaydir needs to support special
 // files like device files and sockets. The parameter parallelism can be used
-// to parallelize layer downloads and unpacking. The parameter reg is a
-// RegistryClient.
-func NewStore(basedir string, overlaydir string, parallelism int, reg *registryclient.RegistryClient) (*Store, error) {
+// to parallelize layer downloads and unpacking. The parameter src is the
+// source images are pulled from, e.g. a RegistryClient.
+func NewStore(basedir string, overlaydir string, parallelism int, src source.Source) (*Store, error) {
 	layerdir := filepath.Join(basedir, "layers")
 	configdir := filepath.Join(basedir, "configs")
 	manifestdir := filepath.Join(basedir, "manifests")
+	diskimagedir := filepath.Join(basedir, "diskimages")
 	if overlaydir == "" {
 		overlaydir = filepath.Join(basedir, "overlays")
 	}
-	for _, dir := range []string{layerdir, configdir, manifestdir, overlaydir} {
+	for _, dir := range []string{layerdir, configdir, manifestdir, overlaydir, diskimagedir} {
 		err := os.MkdirAll(dir, 0755)
 		if err != nil {
 			return nil, fmt.Errorf("creating %s: %v", dir, err)
 		}
 	}
+	err := manifest.Migrate(manifestdir)
+	if err != nil {
+		return nil, fmt.Errorf("migrating manifests in %s: %v", manifestdir, err)
+	}
 	if parallelism < 0 {
 		parallelism = 1
 	}
@@ -67,39 +110,130 @@ func NewStore(basedir string, overlaydir string, parallelism int, reg *registryc
 		configDir:         configdir,
 		manifestDir:       manifestdir,
 		overlayDir:        overlaydir,
+		diskImageDir:      diskimagedir,
 		parallelDownloads: parallelism,
-		reg:               reg,
+		src:               src,
+		layerPulls:        newInflight(),
+		ctx:               context.Background(),
 	}, nil
 }
 
-func (s *Store) doPull(repo string, wg *sync.WaitGroup, layers chan distribution.Descriptor, results chan error) {
+// WithSource returns a store using the same directories and settings as s,
+// pulling images from src. Concurrent pulls of the same layer via s and the
+// stores created from it are deduplicated.
+func (s *Store) WithSource(src source.Source) *Store {
+	store := *s
+	store.src = src
+	store.verifiers = append([]Verifier{}, s.verifiers...)
+	return &store
+}
+
+// WithContext returns a copy of s creating the tracing spans of its operations
+// as children of the span in ctx, e.g. the one of an API request.
+func (s *Store) WithContext(ctx context.Context) *Store {
+	store := *s
+	store.ctx = ctx
+	return &store
+}
+
+// AddVerifier adds a verifier images are checked with when pulling them,
+// before any of their layers are downloaded. Images already in the store are
+// verified too when they are pulled again. Images need to pass all verifiers.
+func (s *Store) AddVerifier(verifier Verifier) {
+	s.verifiers = append(s.verifiers, verifier)
+}
+
+// AllowUnsignedSchema1 allows pulling and copying images with schema1
+// manifests without signatures. By default, schema1 manifests need to have
+// valid signatures.
+func (s *Store) AllowUnsignedSchema1() {
+	s.allowUnsigned = true
+}
+
+// verify verifies the image repo pulled via reference, with the manifest dgst.
+func (s *Store) verify(repo, reference string, dgst digest.Digest) error {
+	for _, verifier := range s.verifiers {
+		err := verifier.Verify(s.src, repo, reference, dgst)
+		if err != nil {
+			return &VerificationError{Repo: repo, Err: err}
+		}
+	}
+	return nil
+}
+
+// hasBlob returns true if the blob dgst is in the layer directory.
+func (s *Store) hasBlob(dgst digest.Digest) bool {
+	return util.PathExists(filepath.Join(s.layerDir, dgst.Encoded()))
+}
+
+// saveBlob saves the blob desc of repo into the layer directory, tracing it
+// as a child of the span in ctx.
+func (s *Store) saveBlob(ctx context.Context, repo string, desc distribution.Descriptor) error {
+	hit := s.hasBlob(desc.Digest)
+	_, span := tracing.Start(ctx, "SaveBlob", tracing.Image(repo),
+		tracing.Digest(desc.Digest), tracing.Size(desc.Size),
+		tracing.CacheHit(hit))
+	_, err := s.src.SaveBlob(repo, s.layerDir, desc)
+	tracing.End(span, err)
+	return err
+}
+
+// pullLayer downloads layer, and unpacks it into the overlay directory.
+func (s *Store) pullLayer(ctx context.Context, repo string, layer distribution.Descriptor) error {
+	glog.V(2).Infof("pulling %s layer %+v", repo, layer.Digest.String())
+	if s.hasBlob(layer.Digest) {
+		metrics.LayerCache.WithLabelValues(metrics.ResultHit).Inc()
+	} else {
+		metrics.LayerCache.WithLabelValues(metrics.ResultMiss).Inc()
+	}
+	err := s.saveBlob(ctx, repo, layer)
+	if err != nil {
+		return fmt.Errorf("downloading layer %v: %w", layer, err)
+	}
+	glog.V(2).Infof("unpacking %s layer %+v", repo, layer.Digest.String())
+	dgest := layer.Digest.Encoded()
+	into := filepath.Join(s.overlayDir, dgest)
+	if _, err = os.Stat(into); err != nil {
+		err = s.unpackLayer(ctx, dgest, into, true)
+	}
+	if err == nil {
+		err = s.createShortLink(into)
+	}
+	if err != nil {
+		return fmt.Errorf("unpacking layer %v: %w", layer, err)
+	}
+	return nil
+}
+
+func (s *Store) doPull(ctx context.Context, repo string, wg *sync.WaitGroup, layers chan distribution.Descriptor, results chan error, progress ProgressFunc) {
 	wg.Add(1)
 	defer wg.Done()
 	for layer := range layers {
-		glog.V(2).Infof("pulling %s layer %+v", repo, layer.Digest.String())
-		_, err := s.reg.SaveBlob(repo, s.layerDir, layer)
-		if err != nil {
-			results <- fmt.Errorf("downloading layer %v: %v", layer, err)
-			continue
+		layer := layer
+		event := ProgressEvent{
+			Layer: layer.Digest,
 		}
-		glog.V(2).Infof("unpacking %s layer %+v", repo, layer.Digest.String())
-		dgest := layer.Digest.Encoded()
-		into := filepath.Join(s.overlayDir, dgest)
-		if _, err = os.Stat(into); err != nil {
-			err = s.unpackLayer(dgest, into, true)
+		waiting := func() {
+			glog.V(2).Infof("%s layer %s is being pulled, waiting",
+				repo, layer.Digest)
+			event.Status = StatusWaiting
+			progress(event)
 		}
+		err := s.layerPulls.do(layer.Digest.String(), waiting, func() error {
+			event.Status = StatusDownloading
+			event.Cached = s.hasBlob(layer.Digest)
+			progress(event)
+			return s.pullLayer(ctx, repo, layer)
+		})
 		if err == nil {
-			err = s.createShortLink(into)
-		}
-		if err != nil {
-			results <- fmt.Errorf("unpacking layer %v: %v", layer, err)
-			continue
+			event.Status = StatusDownloaded
+			progress(event)
 		}
-		results <- nil
+		results <- err
 	}
 }
 
-func (s *Store) pullLayers(repo string, mfest *manifest.Manifest) error {
+func (s *Store) pullLayers(ctx context.Context, repo string, mfest *manifest.Manifest, progress ProgressFunc) error {
 	wg := &sync.WaitGroup{}
 	layers := mfest.Layers()
 	layerCh := make(chan distribution.Descriptor, len(layers))
@@ -110,7 +244,7 @@ func (s *Store) pullLayers(repo string, mfest *manifest.Manifest) error {
 	}
 	glog.V(2).Infof("starting %d workers for pulling %s", parallelism, repo)
 	for i := 0; i < parallelism; i++ {
-		go s.doPull(repo, wg, layerCh, resultCh)
+		go s.doPull(ctx, repo, wg, layerCh, resultCh, progress)
 	}
 	for _, layer := range layers {
 		layerCh <- layer
@@ -130,47 +264,222 @@ func (s *Store) pullLayers(repo string, mfest *manifest.Manifest) error {
 	return result
 }
 
+// cached returns the manifest for the image pinned to dgst if it has already
+// been pulled, along with all of its layers and its config.
+func (s *Store) cached(repo string, dgst digest.Digest) *manifest.Manifest {
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, dgst.String())
+	if err != nil {
+		glog.V(2).Infof("%s@%s not found in cache: %v", repo, dgst, err)
+		return nil
+	}
+	for _, layer := range mfest.Layers() {
+		path := filepath.Join(s.layerDir, layer.Digest.Encoded())
+		if _, err := os.Stat(path); err != nil {
+			glog.V(2).Infof("%s@%s: missing layer %s", repo, dgst, path)
+			return nil
+		}
+	}
+	if _, ok := mfest.ConfigDescriptor(); !ok {
+		glog.V(2).Infof("%s@%s: schema1 manifest not converted", repo, dgst)
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(s.configDir, mfest.ID())); err != nil {
+		glog.V(2).Infof("%s@%s: missing config", repo, dgst)
+		return nil
+	}
+	return mfest
+}
+
+// Pull pulls image into the store, and returns the image ID. Images pinned to
+// a digest, e.g. library/alpine@sha256:..., are not pulled again if they are
+// already in the store, even if they were pulled via a tag. If the image has
+// both a tag and a digest, the digest is used for pulling.
 func (s *Store) Pull(image string) (string, error) {
-	repo, ref, err := util.ParseImageSpec(image)
+	id, _, err := s.PullWithDigest(image)
+	return id, err
+}
+
+// PullWithDigest pulls image into the store like Pull. It also returns the
+// digest of the manifest the image reference points to.
+func (s *Store) PullWithDigest(image string) (string, digest.Digest, error) {
+	return s.PullWithProgress(image, nil)
+}
+
+// pullFailed counts a failed pull with reason, and returns err.
+func pullFailed(reason string, err error) (string, digest.Digest, error) {
+	metrics.Pulls.WithLabelValues(metrics.ResultFailed).Inc()
+	metrics.Failures.WithLabelValues(metrics.OperationPull, reason).Inc()
+	return "", "", err
+}
+
+// PullWithProgress pulls image into the store like PullWithDigest, calling
+// progress, if it is not nil, with the progress of the pull.
+func (s *Store) PullWithProgress(image string, progress ProgressFunc) (string, digest.Digest, error) {
+	ctx, span := tracing.Start(s.ctx, "Pull", tracing.Image(image))
+	id, dgst, err := s.pull(ctx, image, progress)
+	if err == nil {
+		span.SetAttributes(tracing.Digest(dgst))
+	}
+	tracing.End(span, err)
+	return id, dgst, err
+}
+
+func (s *Store) pull(ctx context.Context, image string, progress ProgressFunc) (string, digest.Digest, error) {
+	start := time.Now()
+	report := func(event ProgressEvent) {
+		if progress != nil {
+			event.Image = image
+			progress(event)
+		}
+	}
+	repo, tag, dgst, err := util.ParseImageReference(image)
 	if err != nil {
-		return "", err
+		return pullFailed("invalid_reference", err)
+	}
+	ref := tag
+	if dgst != "" {
+		if mfest := s.cached(repo, dgst); mfest != nil {
+			glog.V(2).Infof("%s found in cache", image)
+			if err := s.verify(repo, dgst.String(), mfest.Digest); err != nil {
+				return pullFailed("verification", err)
+			}
+			report(ProgressEvent{
+				Status: StatusCached,
+				Digest: mfest.Digest,
+				ID:     mfest.ID(),
+			})
+			metrics.Pulls.WithLabelValues(metrics.ResultCached).Inc()
+			trace.SpanFromContext(ctx).SetAttributes(tracing.CacheHit(true))
+			return mfest.ID(), mfest.Digest, nil
+		}
+		ref = dgst.String()
+	} else if ref == "" {
+		ref = "latest"
 	}
-	mfest, err := manifest.Fetch(s.reg, repo, ref)
+	_, span := tracing.Start(ctx, "manifest.Fetch", tracing.Image(repo+":"+ref))
+	mfest, err := manifest.Fetch(s.src, repo, ref, s.allowUnsigned)
+	if err == nil {
+		span.SetAttributes(tracing.Digest(mfest.Digest))
+	}
+	tracing.End(span, err)
 	if err != nil {
-		return "", fmt.Errorf("retrieving manifest for %s: %v", image, err)
+		return pullFailed(metrics.Reason(err),
+			fmt.Errorf("retrieving manifest for %s: %w", image, err))
+	}
+	if err := s.verify(repo, ref, mfest.Digest); err != nil {
+		return pullFailed("verification", err)
 	}
-	err = s.pullLayers(repo, mfest)
+	report(ProgressEvent{
+		Status: StatusResolved,
+		Digest: mfest.Digest,
+	})
+	err = s.pullLayers(ctx, repo, mfest, report)
 	if err != nil {
-		return "", fmt.Errorf("pulling layers for %s: %v", image, err)
+		// The reasons are counted for each layer.
+		return pullFailed("layers",
+			fmt.Errorf("pulling layers for %s: %w", image, err))
+	}
+	if mfest.ManifestV1 != nil {
+		err = s.convertSchema1(mfest)
+		if err != nil {
+			return pullFailed(metrics.Reason(err), err)
+		}
+	} else if config, ok := mfest.ConfigDescriptor(); ok {
+		// Keep the config blob along with the layers, so the image can be
+		// pushed.
+		err = s.saveBlob(ctx, repo, config)
+		if err != nil {
+			return pullFailed(metrics.Reason(err),
+				fmt.Errorf("saving config blob for %s: %w", image, err))
+		}
 	}
 	err = mfest.Save(s.manifestDir)
 	if err != nil {
-		return "", fmt.Errorf("saving manifest for %s: %v", image, err)
+		return pullFailed(metrics.Reason(err),
+			fmt.Errorf("saving manifest for %s: %w", image, err))
 	}
 	imageID := mfest.ID()
 	configPath := filepath.Join(s.configDir, imageID)
 	if _, err = os.Stat(configPath); err != nil {
 		err = s.saveConfig(mfest, configPath)
 		if err != nil {
-			return "", fmt.Errorf("saving config for %s: %v", image, err)
+			return pullFailed(metrics.Reason(err),
+				fmt.Errorf("saving config for %s: %w", image, err))
 		}
 	}
-	return imageID, nil
+	report(ProgressEvent{
+		Status: StatusPulled,
+		Digest: mfest.Digest,
+		ID:     imageID,
+	})
+	metrics.Pulls.WithLabelValues(metrics.ResultPulled).Inc()
+	metrics.PullDuration.Observe(time.Since(start).Seconds())
+	return imageID, mfest.Digest, nil
 }
 
+// Has returns true if image and all of its layers are in the store.
+func (s *Store) Has(image string) bool {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return false
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return false
+	}
+	for _, layer := range mfest.Layers() {
+		path := filepath.Join(s.layerDir, layer.Digest.Encoded())
+		if !util.PathExists(path) {
+			return false
+		}
+	}
+	return true
+}
+
+// Layers returns the layers of image, which needs to be in the store.
+func (s *Store) Layers(image string) ([]distribution.Descriptor, error) {
+	repo, ref, err := util.ParseImageSpec(image)
+	if err != nil {
+		return nil, err
+	}
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
+	if err != nil {
+		return nil, err
+	}
+	return mfest.Layers(), nil
+}
+
+// Unpack extracts image into dest, layer by layer.
 func (s *Store) Unpack(image, dest string) error {
+	return s.UnpackFiltered(image, dest, nil)
+}
+
+// UnpackFiltered extracts image into dest like Unpack. If filter is not nil,
+// only the files selected by it are extracted, along with their parent
+// directories, from the merged tree of the layers.
+func (s *Store) UnpackFiltered(image, dest string, filter *PathFilter) error {
+	ctx, span := tracing.Start(s.ctx, "Unpack", tracing.Image(image))
+	err := s.unpack(ctx, image, dest, filter)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *Store) unpack(ctx context.Context, image, dest string, filter *PathFilter) error {
+	if filter != nil {
+		return s.unpackFiltered(image, dest, filter)
+	}
 	repo, ref, err := util.ParseImageSpec(image)
 	if err != nil {
 		return err
 	}
 	glog.V(2).Infof("image %s is %s:%s", image, repo, ref)
-	mfest, err := manifest.Load(s.reg, s.manifestDir, repo, ref)
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
 	if err != nil {
 		return err
 	}
 	for _, layer := range mfest.Layers() {
 		dgest := layer.Digest.Encoded()
-		err = s.unpackLayer(dgest, dest, false)
+		err = s.unpackLayer(ctx, dgest, dest, false)
 		if err != nil {
 			return err
 		}
@@ -178,7 +487,22 @@ func (s *Store) Unpack(image, dest string) error {
 	return nil
 }
 
-func (s *Store) unpackLayer(dgest, into string, atomic bool) error {
+func (s *Store) unpackLayer(ctx context.Context, dgest, into string, atomic bool) error {
+	start := time.Now()
+	_, span := tracing.Start(ctx, "unpackLayer",
+		tracing.Digest(digest.NewDigestFromEncoded(digest.SHA256, dgest)))
+	err := s.doUnpackLayer(dgest, into, atomic)
+	tracing.End(span, err)
+	if err != nil {
+		metrics.Failures.WithLabelValues(metrics.OperationUnpack,
+			metrics.Reason(err)).Inc()
+		return err
+	}
+	metrics.UnpackDuration.Observe(time.Since(start).Seconds())
+	return nil
+}
+
+func (s *Store) doUnpackLayer(dgest, into string, atomic bool) error {
 	glog.V(1).Infof("unpacking layer %s into %s", dgest, into)
 	path := filepath.Join(s.layerDir, dgest)
 	reader, err := os.Open(path)
@@ -263,12 +587,19 @@ func (s *Store) createShortLink(path string) error {
 }
 
 func (s *Store) Mount(image, dest string) error {
+	ctx, span := tracing.Start(s.ctx, "Mount", tracing.Image(image))
+	err := s.mount(ctx, image, dest)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *Store) mount(ctx context.Context, image, dest string) error {
 	repo, ref, err := util.ParseImageSpec(image)
 	if err != nil {
 		return err
 	}
 	glog.V(2).Infof("image %s is %s:%s", image, repo, ref)
-	mfest, err := manifest.Load(s.reg, s.manifestDir, repo, ref)
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
 	if err != nil {
 		return err
 	}
@@ -301,7 +632,7 @@ func (s *Store) Mount(image, dest string) error {
 		go func() {
 			_, err := os.Stat(into)
 			if err != nil {
-				err = s.unpackLayer(dgst, into, true)
+				err = s.unpackLayer(ctx, dgst, into, true)
 			}
 			if err == nil {
 				err = s.createShortLink(into)
@@ -344,7 +675,9 @@ func (s *Store) Mount(image, dest string) error {
 	if err != nil {
 		return fmt.Errorf("mounting to %s: %v; output: %s", dest, err, output)
 	}
-	return nil
+	// Keep track of the image, so changes can be committed later.
+	base := repo + "@" + mfest.Digest.String()
+	return util.AtomicWriteFile(dest+".image", []byte(base), 0644)
 }
 
 type Config struct {
@@ -356,20 +689,26 @@ func (s *Store) saveConfig(mfest *manifest.Manifest, path string) error {
 	if err != nil {
 		return err
 	}
+	return saveContainerConfig(mfest.ID(), data, path)
+}
+
+// saveContainerConfig saves the container config from the image config data
+// of the image imageID into path.
+func saveContainerConfig(imageID string, data []byte, path string) error {
 	cfg := Config{}
-	glog.V(5).Infof("%s full config: %s", mfest.ID(), string(data))
-	err = json.Unmarshal(data, &cfg)
+	glog.V(5).Infof("%s full config: %s", imageID, string(data))
+	err := json.Unmarshal(data, &cfg)
 	if err != nil {
 		return err
 	}
 	if cfg.Config == nil {
-		return fmt.Errorf("%s: missing config in manifest", mfest.ID())
+		return fmt.Errorf("%s: missing config in manifest", imageID)
 	}
 	buf, err := json.Marshal(cfg.Config)
 	if err != nil {
 		return err
 	}
-	glog.V(5).Infof("%s saving container config: %s", mfest.ID(), string(buf))
+	glog.V(5).Infof("%s saving container config: %s", imageID, string(buf))
 	return util.AtomicWriteFile(path, buf, 0644)
 }
 
@@ -378,7 +717,7 @@ func (s *Store) SaveConfig(image, dest string) error {
 	if err != nil {
 		return err
 	}
-	mfest, err := manifest.Load(s.reg, s.manifestDir, repo, ref)
+	mfest, err := manifest.Load(s.src, s.manifestDir, repo, ref)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,151 @@
+package store
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/opencontainers/go-digest"
+)
+
+// writeLegacyStore writes an image with layer into basedir, laid out the way
+// previous versions did: the manifest is saved under the image ID in the
+// manifest directory, and the image names are symlinks pointing to it. It
+// returns the digest of the manifest.
+func writeLegacyStore(t *testing.T, basedir string, layer []byte, names ...string) digest.Digest {
+	layerDigest := digest.FromBytes(layer)
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config":       map[string]interface{}{},
+		"rootfs": map[string]interface{}{
+			"type":     "layers",
+			"diff_ids": []digest.Digest{layerDigest},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: schema2.MediaTypeImageConfig,
+			Size:      int64(len(config)),
+			Digest:    digest.FromBytes(config),
+		},
+		Layers: []distribution.Descriptor{{
+			MediaType: schema2.MediaTypeUncompressedLayer,
+			Size:      int64(len(layer)),
+			Digest:    layerDigest,
+		}},
+	}
+	buf, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := "v2:" + m.Config.Digest.String()
+	files := map[string][]byte{
+		filepath.Join("layers", layerDigest.Encoded()): layer,
+		filepath.Join("configs", id):                   config,
+		filepath.Join("manifests", id):                 buf,
+	}
+	for name, content := range files {
+		path := filepath.Join(basedir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range names {
+		link := filepath.Join(basedir, "manifests", name)
+		if err := os.MkdirAll(filepath.Dir(link), 0755); err != nil {
+			t.Fatal(err)
+		}
+		target := strings.Repeat("../", strings.Count(name, "/")) + id
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return digest.FromBytes(buf)
+}
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tosi-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layer := testLayer(t, testDir("etc/"), testFile("etc/hostname", "tosi"))
+	dgst := writeLegacyStore(t, dir, layer, "library/alpine:3.6", "app:1")
+
+	st, err := NewStore(dir, "", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images, err := st.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 {
+		t.Fatalf("expected one image, got %+v", images)
+	}
+	expected := []string{"app:1", "library/alpine:3.6"}
+	if images[0].Digest != dgst || !reflect.DeepEqual(images[0].Names, expected) {
+		t.Errorf("expected %s with names %v, got %+v", dgst, expected, images[0])
+	}
+	for _, name := range expected {
+		actual := flattened(t, st, name)
+		files := map[string]string{"etc/": "dir", "etc/hostname": "tosi"}
+		if !reflect.DeepEqual(actual, files) {
+			t.Errorf("%s: expected %v, got %v", name, files, actual)
+		}
+	}
+	legacy, err := filepath.Glob(filepath.Join(dir, "manifests", "v2:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 0 {
+		t.Errorf("expected legacy manifests to be removed, got %v", legacy)
+	}
+
+	// The layout version is saved, so the manifest directory is not
+	// migrated again.
+	other := writeLegacyStore(t, dir, testLayer(t, testFile("other", "")), "other:1")
+	if _, err := NewStore(dir, "", 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	legacy, err = filepath.Glob(filepath.Join(dir, "manifests", "v2:*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(legacy) != 1 {
+		t.Errorf("expected the new legacy manifest to be kept, got %v", legacy)
+	}
+	images, err = st.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, image := range images {
+		if image.Digest == other {
+			t.Errorf("unexpected migrated image %+v", image)
+		}
+	}
+
+	// Newer layouts are not supported.
+	path := filepath.Join(dir, "manifests", ".layout")
+	if err := ioutil.WriteFile(path, []byte("2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStore(dir, "", 1, nil); err == nil ||
+		!strings.Contains(err.Error(), "unsupported manifest layout version") {
+		t.Errorf("expected error for layout version 2, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+)
+
+// fsEntry is a file in the filesystem of an image.
+type fsEntry struct {
+	hdr *tar.Header
+	// digest is the digest of the content of regular files, if it was
+	// calculated. For hard links, it is the digest of the link target.
+	digest digest.Digest
+	// size is the size of regular files, or the size of the target for hard
+	// links.
+	size int64
+	// layer is the index of the layer the entry comes from, and index is
+	// the position of the entry in the layer tarball.
+	layer int
+	index int
+}
+
+// fsTree is the filesystem of an image, built by applying its layers in order,
+// without extracting them. Whiteouts in a layer remove entries from previous
+// layers.
+type fsTree struct {
+	entries map[string]*fsEntry
+	layer   int
+}
+
+func newFSTree() *fsTree {
+	return &fsTree{
+		entries: make(map[string]*fsEntry),
+	}
+}
+
+// cleanPath returns the path of a tar entry relative to the root, without a
+// leading or trailing slash, e.g. "etc/os-release". The root is ".".
+func cleanPath(name string) string {
+	p := path.Clean("/" + name)
+	if p == "/" {
+		return "."
+	}
+	return p[1:]
+}
+
+// absPath returns the absolute path of an entry in the tree.
+func absPath(p string) string {
+	if p == "." {
+		return "/"
+	}
+	return "/" + p
+}
+
+// isUnder returns true if p is dir or is inside dir.
+func isUnder(p, dir string) bool {
+	return dir == "." || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// remove removes p and everything under it from layers before the current
+// one.
+func (t *fsTree) remove(p string, keepSelf bool) {
+	for name, e := range t.entries {
+		if e.layer == t.layer || !isUnder(name, p) {
+			continue
+		}
+		if keepSelf && name == p {
+			continue
+		}
+		delete(t.entries, name)
+	}
+}
+
+// apply adds the tar entry hdr from the current layer to the tree, and
+// returns the new entry. It returns nil for whiteouts, which remove entries
+// added by previous layers.
+func (t *fsTree) apply(hdr *tar.Header) *fsEntry {
+	p := cleanPath(hdr.Name)
+	dir, base := path.Split(p)
+	dir = cleanPath(dir)
+	switch {
+	case base == archive.WhiteoutOpaqueDir:
+		// Opaque directory, hide everything in it from previous layers.
+		t.remove(dir, true)
+		return nil
+	case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+		// AUFS metadata, e.g. hard link directories.
+		return nil
+	case strings.HasPrefix(base, archive.WhiteoutPrefix):
+		t.remove(path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)), false)
+		return nil
+	}
+	if old, ok := t.entries[p]; ok && old.hdr.Typeflag == tar.TypeDir &&
+		hdr.Typeflag != tar.TypeDir {
+		// A directory replaced by a file.
+		t.remove(p, false)
+	}
+	e := &fsEntry{
+		hdr:   hdr,
+		size:  hdr.Size,
+		layer: t.layer,
+	}
+	if hdr.Typeflag == tar.TypeLink {
+		if target, ok := t.entries[cleanPath(hdr.Linkname)]; ok {
+			e.digest = target.digest
+			e.size = target.size
+		}
+	}
+	t.entries[p] = e
+	return e
+}
+
+// isRegular returns true if hdr is a regular file.
+func isRegular(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+}
+
+// paths returns the paths in the tree, sorted.
+func (t *fsTree) paths() []string {
+	paths := make([]string, 0, len(t.entries))
+	for p := range t.entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// walkLayer calls fn for each entry in the layer blob desc in the layer cache.
+// The reader passed to fn returns the content of the entry.
+func (s *Store) walkLayer(desc distribution.Descriptor, fn func(hdr *tar.Header, r io.Reader) error) error {
+	f, err := os.Open(filepath.Join(s.layerDir, desc.Digest.Encoded()))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := archive.DecompressStream(f)
+	if err != nil {
+		return fmt.Errorf("layer %s: %v", desc.Digest, err)
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("layer %s: %v", desc.Digest, err)
+		}
+		err = fn(hdr, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// buildTree builds the filesystem tree of the image from its layers. If
+// hashContent is set, the digest of regular files is calculated.
+func (s *Store) buildTree(layers []distribution.Descriptor, hashContent bool) (*fsTree, error) {
+	t := newFSTree()
+	for i, layer := range layers {
+		glog.V(2).Infof("reading layer %s", layer.Digest)
+		t.layer = i
+		index := 0
+		err := s.walkLayer(layer, func(hdr *tar.Header, r io.Reader) error {
+			e := t.apply(hdr)
+			index++
+			if e == nil {
+				return nil
+			}
+			e.index = index - 1
+			if !hashContent || !isRegular(hdr) {
+				return nil
+			}
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), r); err != nil {
+				return fmt.Errorf("layer %s: %s: %v", layer.Digest, hdr.Name, err)
+			}
+			e.digest = digester.Digest()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
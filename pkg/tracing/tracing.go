@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/opencontainers/go-digest"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters spans can be exported via.
+const (
+	// ExporterNone disables tracing.
+	ExporterNone = ""
+	// ExporterStdout prints spans as JSON. They are printed to stderr, so
+	// they are not mixed up with the output of commands.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OTLP collector via gRPC.
+	ExporterOTLP = "otlp"
+)
+
+// tracerName is the name of the tracer creating the spans of tosi.
+const tracerName = "github.com/elotl/tosi"
+
+// shutdownTimeout is how long Init waits for exporting the remaining spans
+// when shutting down.
+const shutdownTimeout = 5 * time.Second
+
+// Init sets up exporting spans via exporter, for the service version. The
+// OTLP exporter sends spans to endpoint, e.g. localhost:4317, without TLS, as
+// the collector is expected to run locally. If endpoint is empty, the
+// OTEL_EXPORTER_OTLP_ENDPOINT environment variable or localhost:4317 is used.
+// It returns the function to call before exiting, which exports the remaining
+// spans. Without calling Init, spans are not recorded.
+func Init(exporter, endpoint, version string) (func(), error) {
+	var exp sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case ExporterNone:
+		return func() {}, nil
+	case ExporterStdout:
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stderr))
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithInsecure()}
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		exp, err = otlptracegrpc.New(context.Background(), opts...)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %v", exporter, err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "tosi"),
+			attribute.String("service.version", version),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			glog.Warningf("exporting spans: %v", err)
+		}
+	}, nil
+}
+
+// Start starts a span called name, as a child of the span in ctx, if there is
+// one. The returned context has the new span.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// StartLinked starts a span called name, as a child of the span in ctx, like
+// Start, with links to other spans, e.g. the one of the request that started
+// an operation shared with other requests. Invalid links are left out.
+func StartLinked(ctx context.Context, name string, links []trace.Link, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	valid := make([]trace.Link, 0, len(links))
+	for _, link := range links {
+		if link.SpanContext.IsValid() {
+			valid = append(valid, link)
+		}
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...),
+		trace.WithLinks(valid...))
+}
+
+// End ends span, marking it as failed if err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Attributes of spans.
+
+// Image is the image the operation is for, e.g. library/alpine:3.6.
+func Image(image string) attribute.KeyValue {
+	return attribute.String("image", image)
+}
+
+// Digest is the digest of a manifest or a blob.
+func Digest(dgst digest.Digest) attribute.KeyValue {
+	return attribute.String("digest", dgst.String())
+}
+
+// Size is the size of a blob in bytes.
+func Size(size int64) attribute.KeyValue {
+	return attribute.Int64("size", size)
+}
+
+// CacheHit is true if the image or blob was already in the cache.
+func CacheHit(hit bool) attribute.KeyValue {
+	return attribute.Bool("cache.hit", hit)
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/distribution"
+	"github.com/golang/glog"
+)
+
+// WriteBlob saves the content read from reader into the file name, verifying
+// its size and digest against desc. The blob is written into a temporary file
+// first, and only renamed to name if the verification succeeds.
+func WriteBlob(name string, desc distribution.Descriptor, reader io.Reader) error {
+	dir := filepath.Dir(name)
+	tmpname := filepath.Join(dir, "."+filepath.Base(name))
+	f, err := os.OpenFile(tmpname, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+	defer f.Close()
+	verifier := desc.Digest.Verifier()
+	writer := io.MultiWriter(f, verifier)
+	n, err := io.Copy(writer, reader)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if n < desc.Size {
+		return fmt.Errorf(
+			"saving %s: wrote only %d/%d bytes", name, n, desc.Size)
+	}
+	glog.V(5).Infof("%s size: %d bytes", name, n)
+	if !verifier.Verified() {
+		return fmt.Errorf("%s: verifier failed", name)
+	}
+	return RenameFile(tmpname, name)
+}
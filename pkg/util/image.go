@@ -2,70 +2,154 @@ package util
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"strings"
 
+	"github.com/elotl/tosi/pkg/registries"
 	"github.com/opencontainers/go-digest"
 )
 
-// This parses a full image name with the registry name as the first part.
-func ParseFullImage(fullImage string) (string, string) {
-	registry := ""
-	repo := ""
-	parts := strings.Split(fullImage, "/")
-	if len(parts) == 1 {
-		// Old docker-style image name, e.g. "alpine".
-		registry = "https://registry-1.docker.io/"
-		repo = "library/" + parts[0]
-		return registry, repo
-	}
-	if parts[0] == "k8s.gcr.io" {
-		// k8s.gcr.io is an alias used by GCR.
-		registry = "https://gcr.io/"
-		repo = "google_containers/" + strings.Join(parts[1:], "/")
-		return registry, repo
+const (
+	// TransportOCI is the prefix for images in an OCI image layout directory,
+	// e.g. oci:/srv/images:myapp:1.2.
+	TransportOCI = "oci"
+	// TransportDockerArchive is the prefix for images in a tarball created
+	// via "docker save", e.g. docker-archive:/tmp/app.tar:myapp:1.2.
+	TransportDockerArchive = "docker-archive"
+)
+
+var transports = []string{
+	TransportOCI,
+	TransportDockerArchive,
+}
+
+// SplitTransport splits a location returned by ParseFullImage into the
+// transport and the path of the image source. For registries, the transport
+// is empty and the path is the registry URL.
+func SplitTransport(location string) (string, string) {
+	for _, transport := range transports {
+		prefix := transport + ":"
+		if strings.HasPrefix(location, prefix) {
+			return transport, strings.TrimPrefix(location, prefix)
+		}
 	}
-	if strings.Contains(parts[0], ".") {
-		registry = strings.ToLower(parts[0])
-		if !strings.HasPrefix(registry, "http://") &&
-			!strings.HasPrefix(registry, "https://") {
-			registry = "https://" + registry + "/"
+	return "", location
+}
+
+// localPrefix returns the prefix of the names images from transport are
+// stored under, e.g. _oci/. Repository names in registries can't start with
+// an underscore, so these never collide with images pulled from registries.
+func localPrefix(transport string) string {
+	return "_" + transport + "/"
+}
+
+// SourceName returns the name of an image in its source. For images with a
+// transport prefix, this strips the namespace added by ParseFullImage, e.g.
+// _oci/myapp:1.2 becomes myapp:1.2; other names are returned as is.
+func SourceName(image string) string {
+	for _, transport := range transports {
+		prefix := localPrefix(transport)
+		if strings.HasPrefix(image, prefix) {
+			return strings.TrimPrefix(image, prefix)
 		}
-		repo = strings.Join(parts[1:], "/")
-		return registry, repo
 	}
-	registry = "https://registry-1.docker.io/"
-	repo = strings.Join(parts, "/")
-	return registry, repo
+	return image
 }
 
-// This parses an image name with an optional tag, without the registry name.
-func ParseImageSpec(image string) (string, string, error) {
+// parseTransportImage parses an image name with a transport prefix, e.g.
+// oci:/srv/images:myapp:1.2. If the image name is omitted after the path, the
+// base name of the path is used, which works for sources that contain only
+// one image. The name returned is namespaced by the transport, e.g.
+// _oci/myapp:1.2, so images from local sources are stored apart from the ones
+// pulled from registries.
+func parseTransportImage(transport, image string) (string, string) {
+	path := image
+	name := ""
+	if i := strings.Index(image, ":"); i >= 0 {
+		path = image[:i]
+		name = image[i+1:]
+	}
+	if name == "" {
+		base := filepath.Base(path)
+		name = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	return transport + ":" + path, localPrefix(transport) + name
+}
+
+// This parses a full image name with the registry name as the first part. The
+// image name might also start with a transport prefix, e.g. oci:, in which
+// case the first value returned is the transport and path of the image source
+// instead of a registry URL; see SplitTransport(), and the second value is
+// the name the image is stored under; see SourceName(). Registry names are resolved
+// via the built-in registries configuration; use registries.Config.Lookup()
+// for custom configurations. An error is returned if the name can't be
+// resolved, e.g. a *registries.BlockedError.
+func ParseFullImage(fullImage string) (string, string, error) {
+	if transport, image := SplitTransport(fullImage); transport != "" {
+		location, name := parseTransportImage(transport, image)
+		return location, name, nil
+	}
+	refs, err := registries.DefaultConfig().Lookup(fullImage)
+	if err != nil {
+		return "", "", err
+	}
+	return refs[0].Registry, refs[0].Repo, nil
+}
+
+var tagRegexp = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// ParseImageReference parses an image name without the registry name, with
+// an optional tag and an optional digest, e.g. library/alpine:3.6@sha256:...
+// The tag is empty if it is not specified; the digest is empty unless the
+// image is pinned to a digest.
+func ParseImageReference(image string) (string, string, digest.Digest, error) {
 	repo := image
-	dgest := ""
-	reference := "latest"
+	tag := ""
+	dgst := digest.Digest("")
 	if strings.Contains(repo, "@") { // Exact hash for the image.
 		parts := strings.Split(repo, "@")
 		if len(parts) != 2 {
-			return "", "", fmt.Errorf("invalid image spec %q", image)
+			return "", "", "", fmt.Errorf("invalid image spec %q", image)
 		}
 		repo = parts[0]
-		dgest = parts[1]
-		d, err := digest.Parse(dgest)
+		d, err := digest.Parse(parts[1])
 		if err != nil {
-			return "", "", fmt.Errorf("invalid image hash in %q", image)
+			return "", "", "", fmt.Errorf("invalid image hash in %q", image)
 		}
-		reference = d.String()
+		dgst = d
 	}
 	if strings.Contains(repo, ":") {
 		parts := strings.Split(repo, ":")
 		if len(parts) != 2 {
-			return "", "", fmt.Errorf("invalid image spec %q", image)
+			return "", "", "", fmt.Errorf("invalid image spec %q", image)
 		}
 		repo = parts[0]
-		if dgest == "" {
-			// Only use the tag if no digest is specified.
-			reference = parts[1]
+		tag = parts[1]
+		if !tagRegexp.MatchString(tag) {
+			return "", "", "", fmt.Errorf("invalid tag %q in %q", tag, image)
 		}
 	}
-	return repo, reference, nil
+	if repo == "" {
+		return "", "", "", fmt.Errorf("invalid image spec %q", image)
+	}
+	return repo, tag, dgst, nil
+}
+
+// This parses an image name with an optional tag, without the registry name.
+// The reference returned is the digest if the image is pinned to one,
+// otherwise the tag, which defaults to "latest".
+func ParseImageSpec(image string) (string, string, error) {
+	repo, tag, dgst, err := ParseImageReference(image)
+	if err != nil {
+		return "", "", err
+	}
+	if dgst != "" {
+		// Only use the tag if no digest is specified.
+		return repo, dgst.String(), nil
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	return repo, tag, nil
 }
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestParseFullImage(t *testing.T) {
+	testCases := []struct {
+		image    string
+		location string
+		name     string
+		source   string
+	}{
+		{"oci:/srv/images:myapp:1.2", "oci:/srv/images", "_oci/myapp:1.2", "myapp:1.2"},
+		{"oci:/srv/images", "oci:/srv/images", "_oci/images", "images"},
+		{"docker-archive:/tmp/app.tar:myapp:1.2", "docker-archive:/tmp/app.tar", "_docker-archive/myapp:1.2", "myapp:1.2"},
+		{"docker-archive:/tmp/app.tar", "docker-archive:/tmp/app.tar", "_docker-archive/app", "app"},
+		{"docker.io/library/alpine:3.12", "https://registry-1.docker.io/", "library/alpine:3.12", "library/alpine:3.12"},
+	}
+	for _, tc := range testCases {
+		location, name, err := ParseFullImage(tc.image)
+		if err != nil {
+			t.Errorf("%s: %v", tc.image, err)
+			continue
+		}
+		if location != tc.location || name != tc.name {
+			t.Errorf("%s: expected %s %s, got %s %s", tc.image, tc.location,
+				tc.name, location, name)
+		}
+		if source := SourceName(name); source != tc.source {
+			t.Errorf("%s: expected source name %s, got %s", tc.image,
+				tc.source, source)
+		}
+	}
+}
@@ -55,3 +55,10 @@ rootfs="$(tmpd)"
 [ "$(ls -l $rootfs | wc -l)" -gt 5 ]
 # Use cached layers.
 ./tosi -image library/ubuntu
+# Resolve a tag to a digest, and pull via the digest.
+pinned="$(./tosi resolve library/alpine:3.6)"
+[[ "$pinned" == docker.io/library/alpine@sha256:* ]]
+./tosi -image "$pinned" -extractto "$(tmpd)"
+# List tags.
+./tosi tags library/alpine | grep -q '^3.6$'
+[ "$(./tosi tags -semver-range '~3.6' library/alpine | head -n1)" = "3.6" ]